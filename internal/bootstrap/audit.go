@@ -0,0 +1,275 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
+	"github.com/infrakit-io/talos-docker-bootstrap/pkg/model"
+)
+
+// HardeningAudit checks, without changing the VM, each baseline control
+// os_hardening applies and reports whether it still holds. The audit runs
+// regardless of hardening.enabled, against the baseline the config
+// describes.
+func HardeningAudit(ctx context.Context, logger *slog.Logger, cfg config.Config) ([]model.AuditControl, error) {
+	h := cfg.Hardening
+	enableUFW, allowRules := hardeningUFW(cfg)
+	chrony, timesyncd := ntpConfs(cfg)
+	script := fmt.Sprintf(`#!/usr/bin/env bash
+set -uo pipefail
+
+fact() { printf 'fact: %%s=%%s\n' "$1" "$2"; }
+
+file_state() {
+  local tmp
+  tmp="$(mktemp)"
+  printf '%%s\n' "$2" > "${tmp}"
+  if [ ! -f "$1" ]; then
+    echo missing
+  elif cmp -s "${tmp}" "$1"; then
+    echo match
+  else
+    echo differs
+  fi
+  rm -f "${tmp}"
+}
+
+for PKG in %s; do
+  if dpkg -s "${PKG}" >/dev/null 2>&1; then
+    fact "package:${PKG}" installed
+  else
+    fact "package:${PKG}" missing
+  fi
+done
+
+fact sshd_dropin "$(file_state %q %s)"
+SSHD_T="$(sshd -T 2>/dev/null || true)"
+for KEY in %s; do
+  fact "sshd:${KEY}" "$(printf '%%s\n' "${SSHD_T}" | awk -v k="${KEY}" '$1 == k {v = v (v == "" ? "" : " ") $2} END {print v}')"
+done
+
+fact sysctl_conf "$(file_state %q %s)"
+for KEY in %s; do
+  fact "sysctl:${KEY}" "$(sysctl -n "${KEY}" 2>/dev/null | tr -s '[:space:]' ' ')"
+done
+%s
+fact unattended_upgrades "$(systemctl is-enabled unattended-upgrades 2>/dev/null || true)/$(systemctl is-active unattended-upgrades 2>/dev/null || true)"
+
+if [ "%t" = "true" ]; then
+  fact fail2ban_jail "$(file_state %q %s)"
+  fact fail2ban "$(systemctl is-active fail2ban 2>/dev/null || true)"
+fi
+if [ "%t" = "true" ]; then
+  fact auditd_rules "$(file_state %q %s)"
+  fact auditd "$(systemctl is-active auditd 2>/dev/null || true)"
+fi
+if [ "%t" = "true" ]; then
+  fact apparmor "$(cat /sys/module/apparmor/parameters/enabled 2>/dev/null || true)"
+  ENFORCED="$(aa-status --enforced 2>/dev/null || true)"
+  fact apparmor_enforced "${ENFORCED:-0}"
+fi
+if [ "%t" = "true" ]; then
+  if dpkg -s chrony >/dev/null 2>&1; then
+    fact ntp "$(file_state %q %s)"
+  else
+    fact ntp "$(file_state %q %s)"
+  fi
+fi
+
+if [ "%s" = "true" ]; then
+  if command -v ufw >/dev/null 2>&1; then
+    STATUS="$(ufw status verbose 2>/dev/null || true)"
+    fact ufw_status "$(printf '%%s\n' "${STATUS}" | awk '/^Status:/ {print $2; exit}')"
+    fact ufw_incoming "$(printf '%%s\n' "${STATUS}" | sed -n 's/^Default: \([a-z]*\) (incoming).*/\1/p')"
+    fact ufw_outgoing "$(printf '%%s\n' "${STATUS}" | sed -n 's/.* \([a-z]*\) (outgoing).*/\1/p')"
+    UFW_RULES=%s
+%s
+    ADDED="$(ufw_added)"
+    while IFS= read -r RULE; do
+      [ -n "${RULE}" ] || continue
+      if printf '%%s\n' "${ADDED}" | grep -Fxq -- "${RULE}"; then
+        fact "ufw_rule:${RULE#ufw }" present
+      else
+        fact "ufw_rule:${RULE#ufw }" missing
+      fi
+    done <<< "${UFW_RULES}"
+    while IFS= read -r RULE; do
+      [ -n "${RULE}" ] || continue
+      if ! printf '%%s\n' "${UFW_RULES}" | grep -Fxq -- "${RULE}"; then
+        fact "ufw_extra:${RULE#ufw }" present
+      fi
+    done <<< "$(ufw_tagged)"
+  else
+    fact ufw_status "not installed"
+  fi
+fi
+
+if [ "%t" = "true" ]; then
+  if systemctl is-active --quiet docker 2>/dev/null; then
+    fact docker_user "$(systemctl is-active %s 2>/dev/null || true)"
+  else
+    fact docker_user "docker inactive"
+  fi
+fi
+`, hardeningPackageList(cfg),
+		sshDropInPath, heredocValue("SSHCFG", sshdDropIn(cfg)), strings.Join(auditSSHDKeys(cfg), " "),
+		sysctlConfPath, heredocValue("SYSCTL", sysctlConf(cfg)), strings.Join(sysctlKeys(cfg), " "),
+		auditBannerScript(cfg),
+		h.Fail2banEnabled(), fail2banJailPath, heredocValue("FAIL2BAN", fail2banJail(cfg)),
+		h.AuditdEnabled(), auditdRulesPath, heredocValue("AUDITRULES", auditdRules),
+		h.AppArmorEnabled(),
+		len(h.NTPServers) > 0, chronySourcesPath, heredocValue("CHRONY", chrony), timesyncdConfPath, heredocValue("TIMESYNCD", timesyncd),
+		enableUFW, heredocValue("UFWRULES", allowRules), ufwRuleFuncs,
+		cfg.Hardening.FilterDockerPorts, dockerUserUnitName)
+
+	stdout, stderr, err := sshRunScriptFn(ctx, execConfig(cfg), script)
+	if stderr != "" {
+		logger.Debug("hardening_audit stderr", "output", strings.TrimSpace(stderr))
+	}
+	if err != nil {
+		return nil, err
+	}
+	controls := evaluateAudit(cfg, parsePreflightFacts(stdout))
+	for _, c := range controls {
+		logger.Debug("hardening control", "name", c.Name, "expected", c.Expected, "actual", c.Actual, "passed", c.Passed)
+	}
+	return controls, nil
+}
+
+// evaluateAudit turns raw audit facts into controls, in a fixed order. A
+// fact that is missing fails its control.
+func evaluateAudit(cfg config.Config, raw map[string]string) []model.AuditControl {
+	var controls []model.AuditControl
+	add := func(name, expected, actual string, passed bool) {
+		if actual == "" {
+			actual = "unknown"
+		}
+		controls = append(controls, model.AuditControl{Name: name, Expected: expected, Actual: actual, Passed: passed})
+	}
+	expect := func(name, key, expected string) {
+		add(name, expected, raw[key], raw[key] == expected)
+	}
+
+	h := cfg.Hardening
+	for _, pkg := range strings.Fields(hardeningPackageList(cfg)) {
+		expect("package "+pkg, "package:"+pkg, "installed")
+	}
+	expect("sshd drop-in "+sshDropInPath, "sshd_dropin", "match")
+	sshd := sshdSettings(cfg)
+	for _, key := range auditSSHDKeys(cfg) {
+		expect("sshd -T "+key, "sshd:"+key, sshd[key])
+	}
+	expect("sysctl config "+sysctlConfPath, "sysctl_conf", "match")
+	for _, kv := range sysctlSettings(cfg) {
+		expect("sysctl "+kv[0], "sysctl:"+kv[0], strings.Join(strings.Fields(kv[1]), " "))
+	}
+	if h.LoginBanner != "" {
+		expect("login banner "+loginBannerSSHPath, "banner_ssh", "match")
+		expect("login banner "+loginBannerConsolePath, "banner_console", "match")
+	}
+	expect("unattended-upgrades", "unattended_upgrades", "enabled/active")
+	if h.Fail2banEnabled() {
+		expect("fail2ban sshd jail", "fail2ban_jail", "match")
+		expect("fail2ban", "fail2ban", "active")
+	}
+	if h.AuditdEnabled() {
+		expect("auditd rules", "auditd_rules", "match")
+		expect("auditd", "auditd", "active")
+	}
+	if h.AppArmorEnabled() {
+		expect("AppArmor enabled", "apparmor", "Y")
+		n, err := strconv.Atoi(raw["apparmor_enforced"])
+		add("AppArmor profiles enforced", "at least 1", raw["apparmor_enforced"], err == nil && n > 0)
+	}
+	if len(h.NTPServers) > 0 {
+		expect("NTP servers", "ntp", "match")
+	}
+
+	if h.EnableUFW {
+		expect("ufw status", "ufw_status", "active")
+		expect("ufw default incoming", "ufw_incoming", "deny")
+		expect("ufw default outgoing", "ufw_outgoing", "allow")
+		for _, rule := range ufwRuleCommands(cfg) {
+			rule = strings.TrimPrefix(rule, "ufw ")
+			expect("ufw rule "+rule, "ufw_rule:"+rule, "present")
+		}
+		var extra []string
+		for name := range raw {
+			if rule, ok := strings.CutPrefix(name, "ufw_extra:"); ok {
+				extra = append(extra, rule)
+			}
+		}
+		slices.Sort(extra)
+		for _, rule := range extra {
+			add("ufw rule "+rule, "absent", "present", false)
+		}
+	}
+
+	if h.FilterDockerPorts {
+		v := raw["docker_user"]
+		add("DOCKER-USER rules", "active", v, v == "active" || v == "docker inactive")
+	}
+	return controls
+}
+
+// sshdSettings maps the lowercased keys of the sshd drop-in to their
+// values, as sshd -T prints them.
+func sshdSettings(cfg config.Config) map[string]string {
+	out := map[string]string{}
+	for _, line := range strings.Split(sshdDropIn(cfg), "\n") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(line), " "); ok {
+			out[strings.ToLower(k)] = strings.TrimSpace(v)
+		}
+	}
+	return out
+}
+
+// auditSSHDKeys lists the drop-in keys checked with sshd -T.
+// ChallengeResponseAuthentication is an alias of KbdInteractiveAuthentication
+// that current OpenSSH no longer prints, so it is covered by the latter.
+func auditSSHDKeys(cfg config.Config) []string {
+	var keys []string
+	for _, line := range strings.Split(sshdDropIn(cfg), "\n") {
+		k, _, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if ok && !strings.EqualFold(k, "ChallengeResponseAuthentication") {
+			keys = append(keys, strings.ToLower(k))
+		}
+	}
+	return keys
+}
+
+// auditBannerScript reports whether the login banner files hold the
+// configured banner. It expects file_state.
+func auditBannerScript(cfg config.Config) string {
+	if cfg.Hardening.LoginBanner == "" {
+		return ""
+	}
+	banner := heredocValue("BANNER", strings.TrimRight(cfg.Hardening.LoginBanner, "\n"))
+	return fmt.Sprintf(`fact banner_ssh "$(file_state %q %s)"
+fact banner_console "$(file_state %q %s)"
+`, loginBannerSSHPath, banner, loginBannerConsolePath, banner)
+}
+
+// sysctlSettings returns the key/value pairs of the managed sysctl config.
+func sysctlSettings(cfg config.Config) [][2]string {
+	var out [][2]string
+	for _, line := range strings.Split(sysctlConf(cfg), "\n") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(line), "="); ok {
+			out = append(out, [2]string{strings.TrimSpace(k), strings.TrimSpace(v)})
+		}
+	}
+	return out
+}
+
+func sysctlKeys(cfg config.Config) []string {
+	var keys []string
+	for _, kv := range sysctlSettings(cfg) {
+		keys = append(keys, kv[0])
+	}
+	return keys
+}
@@ -0,0 +1,304 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
+)
+
+// Check scripts inspect the VM without changing it and print one
+// "change: <what>" line per difference from the target state.
+const checkChangePrefix = "change: "
+
+// checkFileFunc defines check_file PATH CONTENT WHAT, which prints a change
+// line when PATH does not hold CONTENT (or exists while CONTENT is empty).
+const checkFileFunc = `
+check_file() {
+  local path="$1" content="$2" what="$3" tmp
+  if [ -z "${content}" ]; then
+    if [ -e "${path}" ]; then
+      echo "change: remove ${what} ${path}"
+    fi
+    return
+  fi
+  tmp="$(mktemp)"
+  printf '%s\n' "${content}" > "${tmp}"
+  if [ ! -f "${path}" ]; then
+    echo "change: create ${what} ${path}"
+  elif ! cmp -s "${tmp}" "${path}"; then
+    echo "change: update ${what} ${path} (content differs)"
+  fi
+  rm -f "${tmp}"
+}
+`
+
+var (
+	checkOSHardeningFn     = checkOSHardening
+	checkDockerInstallFn   = checkDockerInstall
+	checkTalosctlInstallFn = checkTalosctlInstall
+	checkClusterCreateFn   = checkClusterCreate
+)
+
+func checkOSHardening(ctx context.Context, logger *slog.Logger, cfg config.Config) ([]string, error) {
+	if !cfg.Hardening.Enabled {
+		return nil, nil
+	}
+	enableUFW, allowRules := hardeningUFW(cfg)
+	dockerUser, dockerUserUnitContent := "", ""
+	if cfg.Hardening.FilterDockerPorts {
+		dockerUser, dockerUserUnitContent = dockerUserRules(cfg), dockerUserUnit
+	}
+	script := fmt.Sprintf(`#!/usr/bin/env bash
+set -euo pipefail
+%s
+for PKG in %s; do
+  if ! dpkg -s "$PKG" >/dev/null 2>&1; then
+    echo "change: install package $PKG"
+  fi
+done
+
+TMP_SSH="$(mktemp)"
+TMP_SYSCTL="$(mktemp)"
+trap 'rm -f "$TMP_SSH" "$TMP_SYSCTL"' EXIT
+
+SSH_DROPIN=%s
+cat > "$TMP_SSH" <<'SSHCFG'
+%s
+SSHCFG
+if [ ! -f "$SSH_DROPIN" ]; then
+  echo "change: create sshd drop-in $SSH_DROPIN"
+elif ! cmp -s "$TMP_SSH" "$SSH_DROPIN"; then
+  echo "change: update sshd drop-in $SSH_DROPIN (content differs)"
+fi
+
+SYSCTL_FILE=%s
+cat > "$TMP_SYSCTL" <<'SYSCTL'
+%s
+SYSCTL
+if [ ! -f "$SYSCTL_FILE" ]; then
+  echo "change: create sysctl config $SYSCTL_FILE"
+elif ! cmp -s "$TMP_SYSCTL" "$SYSCTL_FILE"; then
+  echo "change: update sysctl config $SYSCTL_FILE (content differs)"
+fi
+
+if ! systemctl is-enabled --quiet unattended-upgrades 2>/dev/null || ! systemctl is-active --quiet unattended-upgrades 2>/dev/null; then
+  echo "change: enable and start unattended-upgrades"
+fi
+%s
+if [ "%s" = "true" ]; then
+  if ! command -v ufw >/dev/null 2>&1; then
+    echo "change: install and enable UFW"
+  else
+    STATUS="$(ufw status verbose 2>/dev/null || true)"
+    if ! printf '%%s\n' "$STATUS" | grep -q '^Status: active'; then
+      echo "change: enable UFW"
+    fi
+    if ! printf '%%s\n' "$STATUS" | grep -q 'deny (incoming)'; then
+      echo "change: set UFW default deny incoming"
+    fi
+    if ! printf '%%s\n' "$STATUS" | grep -q 'allow (outgoing)'; then
+      echo "change: set UFW default allow outgoing"
+    fi
+    UFW_RULES=%s
+%s
+    ADDED="$(ufw_added)"
+    while IFS= read -r RULE; do
+      [ -n "${RULE}" ] || continue
+      if ! printf '%%s\n' "${ADDED}" | grep -Fxq -- "${RULE}"; then
+        echo "change: add UFW rule ${RULE#ufw }"
+      fi
+    done <<< "${UFW_RULES}"
+    while IFS= read -r RULE; do
+      [ -n "${RULE}" ] || continue
+      if ! printf '%%s\n' "${UFW_RULES}" | grep -Fxq -- "${RULE}"; then
+        echo "change: remove UFW rule ${RULE#ufw }"
+      fi
+    done <<< "$(ufw_tagged)"
+  fi
+fi
+
+check_file %q %s "DOCKER-USER rules script"
+check_file %q %s "DOCKER-USER rules unit"
+if [ "%t" = "true" ] && systemctl is-active --quiet docker 2>/dev/null && ! systemctl is-active --quiet %s 2>/dev/null; then
+  echo "change: apply DOCKER-USER rules (%s not active)"
+fi
+`, checkFileFunc, hardeningPackageList(cfg), sshDropInPath, sshdDropIn(cfg), sysctlConfPath, sysctlConf(cfg), hardeningControlsCheckScript(cfg), enableUFW, heredocValue("UFWRULES", allowRules), ufwRuleFuncs,
+		dockerUserScriptPath, heredocValue("DOCKERUSER", dockerUser),
+		dockerUserUnitPath, heredocValue("DOCKERUSERUNIT", dockerUserUnitContent),
+		cfg.Hardening.FilterDockerPorts, dockerUserUnitName, dockerUserUnitName)
+
+	return runRemoteCheck(ctx, logger, cfg, "os_hardening", script)
+}
+
+func checkDockerInstall(ctx context.Context, logger *slog.Logger, cfg config.Config) ([]string, error) {
+	proxyCheck, err := proxyCheckScript(cfg)
+	if err != nil {
+		return nil, err
+	}
+	daemon, err := renderDaemonJSON(cfg.Docker.Daemon)
+	if err != nil {
+		return nil, err
+	}
+	script := fmt.Sprintf(`#!/usr/bin/env bash
+set -euo pipefail
+
+TARGET_DOCKER_VERSION=%q
+TARGET_USER=%q
+%s%s
+check_file %q %s "Docker daemon config"
+
+if ! command -v docker >/dev/null 2>&1; then
+  echo "change: install Docker ${TARGET_DOCKER_VERSION} (not installed)"
+  exit 0
+fi
+CURRENT="$(docker --version | sed -n 's/^Docker version \([^,]*\),.*/\1/p')"
+if [ "${CURRENT}" != "${TARGET_DOCKER_VERSION}" ]; then
+  echo "change: install Docker ${TARGET_DOCKER_VERSION} (installed: ${CURRENT:-unknown})"
+fi
+if ! systemctl is-enabled --quiet docker 2>/dev/null || ! systemctl is-active --quiet docker 2>/dev/null; then
+  echo "change: enable and start docker service"
+fi
+if ! id -nG "${TARGET_USER}" | tr ' ' '\n' | grep -qx docker; then
+  echo "change: add ${TARGET_USER} to docker group"
+fi
+`, cfg.Docker.Version, cfg.VM.User, checkFileFunc, proxyCheck, dockerDaemonConfigPath, heredocValue("DAEMONJSON", daemon))
+
+	return runRemoteCheck(ctx, logger, cfg, "docker_install", script)
+}
+
+func checkTalosctlInstall(ctx context.Context, logger *slog.Logger, cfg config.Config) ([]string, error) {
+	script := fmt.Sprintf(`#!/usr/bin/env bash
+set -euo pipefail
+
+TARGET_TALOS_VERSION=%q
+
+if ! command -v talosctl >/dev/null 2>&1; then
+  echo "change: install talosctl ${TARGET_TALOS_VERSION} (not installed)"
+  exit 0
+fi
+CURRENT="$(talosctl version --client 2>/dev/null | grep -Eo 'v[0-9]+\.[0-9]+\.[0-9]+([.-][0-9A-Za-z]+)?' | head -n1 | sed 's/^v//' || true)"
+if [ "${CURRENT}" != "${TARGET_TALOS_VERSION}" ]; then
+  echo "change: install talosctl ${TARGET_TALOS_VERSION} (installed: ${CURRENT:-unknown})"
+fi
+`, cfg.Talos.Version)
+
+	return runRemoteCheck(ctx, logger, cfg, "talosctl_install", script)
+}
+
+func checkClusterCreate(ctx context.Context, logger *slog.Logger, cfg config.Config) ([]string, error) {
+	patches, err := clusterPatches(cfg)
+	if err != nil {
+		return nil, err
+	}
+	script := fmt.Sprintf(`#!/usr/bin/env bash
+set -euo pipefail
+
+TARGET_USER=%q
+CLUSTER_NAME=%q
+STATE_DIR=%q
+MOUNT_SRCS=%s
+CONTROLPLANES=%d
+WORKERS=%d
+%s%s%sTALOSCONFIG="${STATE_DIR}/talosconfig"
+KUBECONFIG="${STATE_DIR}/kubeconfig"
+PATCH_HASH=%q
+PATCH_HASH_FILE="${STATE_DIR}/%s"
+%s
+%s
+%s
+check_node_capacity
+while IFS= read -r MOUNT_SRC; do
+  if [ -n "${MOUNT_SRC}" ] && [ ! -d "${MOUNT_SRC}" ]; then
+    echo "change: create mount source ${MOUNT_SRC}"
+  fi
+done <<< "${MOUNT_SRCS}"
+if ! command -v talosctl >/dev/null 2>&1; then
+  echo "change: create cluster ${CLUSTER_NAME} (missing; talosctl not installed yet)"
+  exit 0
+fi
+
+show="$(sudo -n -u "${TARGET_USER}" -H env CLUSTER_NAME="${CLUSTER_NAME}" STATE_DIR="${STATE_DIR}" bash -lc 'talosctl cluster --name "${CLUSTER_NAME}" --state "${STATE_DIR}" show --provisioner docker 2>/dev/null || true')"
+if ! printf "%%s\n" "${show}" | grep -Eiq 'controlplane|worker'; then
+  echo "change: create cluster ${CLUSTER_NAME} (missing)"
+  exit 0
+fi
+cp_count="$(printf "%%s\n" "${show}" | awk 'tolower($2) == "controlplane" {c++} END {print c+0}')"
+worker_count="$(printf "%%s\n" "${show}" | awk 'tolower($2) == "worker" {c++} END {print c+0}')"
+if [ "${cp_count}" -ne "${CONTROLPLANES}" ]; then
+  echo "change: recreate cluster ${CLUSTER_NAME} with ${CONTROLPLANES} controlplane nodes (has ${cp_count})"
+  exit 0
+fi
+if [ ! -s "${TALOSCONFIG}" ] || [ ! -s "${KUBECONFIG}" ]; then
+  echo "change: recreate cluster ${CLUSTER_NAME} (degraded: talosconfig or kubeconfig missing in ${STATE_DIR})"
+  exit 0
+fi
+node_name="$(printf "%%s\n" "${show}" | awk 'tolower($2) ~ /controlplane/ {print $1; exit}')"
+if command -v docker >/dev/null 2>&1 && [ -n "${node_name}" ]; then
+  running="$(docker inspect -f '{{.State.Running}}' "${node_name}" 2>/dev/null || echo false)"
+  if [ "${running}" != "true" ]; then
+    echo "change: recreate cluster ${CLUSTER_NAME} (degraded: node container ${node_name} is not running)"
+    exit 0
+  fi
+fi
+if [ "${worker_count}" -gt "${WORKERS}" ]; then
+  echo "change: remove $((worker_count - WORKERS)) worker nodes (has ${worker_count}, want ${WORKERS})"
+elif [ "${worker_count}" -eq 0 ] && [ "${WORKERS}" -gt 0 ]; then
+  echo "change: recreate cluster ${CLUSTER_NAME} with ${WORKERS} workers (no worker node to copy)"
+  exit 0
+elif [ "${worker_count}" -lt "${WORKERS}" ]; then
+  echo "change: add $((WORKERS - worker_count)) worker nodes (has ${worker_count}, want ${WORKERS})"
+fi
+if command -v docker >/dev/null 2>&1; then
+  image_drift="$(node_image_drift "${show}")"
+  if [ -n "${image_drift}" ]; then
+    echo "change: recreate cluster ${CLUSTER_NAME} (node ${image_drift%%%% *} runs ${image_drift#* }, want ${TALOS_IMAGE})"
+    exit 0
+  fi
+  if [ "$(cat "${PATCH_HASH_FILE}" 2>/dev/null || true)" != "${PATCH_HASH}" ]; then
+    echo "change: recreate cluster ${CLUSTER_NAME} (config patches changed since it was created)"
+    exit 0
+  fi
+  network_drift="$(registry_network_drift)"
+  if [ -n "${network_drift}" ]; then
+    echo "change: recreate cluster ${CLUSTER_NAME} (cluster network is ${network_drift}, the offline registry needs ${REGISTRY_CIDR})"
+    exit 0
+  fi
+  while read -r name flags; do
+    [ -n "${name}" ] || continue
+    echo "change: resize node ${name} (${flags})"
+  done < <(node_resource_changes "${show}")
+fi
+if [ -n "${KUBERNETES_VERSION}" ]; then
+  kubelet="$(kubelet_versions "${show}")"
+  if [ -n "${kubelet}" ] && [ "${kubelet}" != "${KUBERNETES_VERSION}" ]; then
+    echo "change: upgrade Kubernetes from ${kubelet} to ${KUBERNETES_VERSION}"
+  fi
+fi
+`, cfg.VM.User, cfg.Cluster.Name, cfg.Cluster.StateDir, heredocValue("MOUNTSRCS", mountSources(cfg)), cfg.Cluster.ControlplaneCount(), cfg.Cluster.Workers,
+		clusterResourceVars(cfg), clusterVersionVars(cfg), offlineRegistryVars(cfg), clusterPatchHash(patches), configPatchHashFile,
+		clusterResourceFuncs, clusterVersionFuncs, offlineRegistryFuncs)
+
+	return runRemoteCheck(ctx, logger, cfg, "cluster_create", script)
+}
+
+// runRemoteCheck runs a read-only check script and returns the changes it
+// reports.
+func runRemoteCheck(ctx context.Context, logger *slog.Logger, cfg config.Config, stepName, script string) ([]string, error) {
+	stdout, stderr, err := sshRunScriptFn(ctx, execConfig(cfg), script)
+	if stderr != "" {
+		logger.Debug(stepName+" check stderr", "output", strings.TrimSpace(stderr))
+	}
+	if err != nil {
+		return nil, err
+	}
+	var changes []string
+	for _, line := range strings.Split(stdout, "\n") {
+		if rest, ok := strings.CutPrefix(strings.TrimSpace(line), checkChangePrefix); ok && rest != "" {
+			changes = append(changes, rest)
+		}
+	}
+	return changes, nil
+}
@@ -11,39 +11,297 @@ import (
 	"github.com/infrakit-io/talos-docker-bootstrap/internal/ssh"
 )
 
+// clusterTopologyFuncs reconciles the worker count of a running cluster.
+// talosctl cannot scale an existing cluster, so workers are added by
+// starting copies of an existing worker container (same image, machine
+// config, mounts and limits, next free name and an unused IP of the cluster
+// network) and removed by cordoning and draining their Kubernetes node, then
+// deleting the node and its container. A changed controlplane count needs a
+// new cluster.
+const clusterTopologyFuncs = `
+cluster_show() {
+  sudo -n -u "${TARGET_USER}" -H env CLUSTER_NAME="${CLUSTER_NAME}" STATE_DIR="${STATE_DIR}" bash -lc 'talosctl cluster --name "${CLUSTER_NAME}" --state "${STATE_DIR}" show --provisioner docker 2>/dev/null || true'
+}
+
+# kube_api METHOD PATH [BODY [CONTENT_TYPE]] calls the cluster's Kubernetes
+# API with the credentials of the generated kubeconfig and prints the response.
+kube_api() {
+  local dir server rc=0
+  local -a data=()
+  if [ "$#" -ge 3 ]; then
+    data=(-H "Content-Type: ${4:-application/json}" --data-binary "$3")
+  fi
+  dir="$(mktemp -d)"
+  server="$(awk '$1 == "server:" {print $2; exit}' "${KUBECONFIG}")"
+  awk '$1 == "certificate-authority-data:" {print $2; exit}' "${KUBECONFIG}" | base64 -d > "${dir}/ca.crt"
+  awk '$1 == "client-certificate-data:" {print $2; exit}' "${KUBECONFIG}" | base64 -d > "${dir}/client.crt"
+  awk '$1 == "client-key-data:" {print $2; exit}' "${KUBECONFIG}" | base64 -d > "${dir}/client.key"
+  curl -fsS --max-time 30 --cacert "${dir}/ca.crt" --cert "${dir}/client.crt" --key "${dir}/client.key" -X "$1" "${data[@]}" "${server}$2" || rc=$?
+  rm -rf "${dir}"
+  return "${rc}"
+}
+
+# drain_node NAME cordons the node, evicts its pods through the eviction API
+# (so PodDisruptionBudgets apply) and waits up to two minutes for them to
+# leave the node. Pods are listed as namespace/name from the metadata that
+# the API server serializes first for each item.
+drain_node() {
+  local pods pod out deadline
+  kube_api PATCH "/api/v1/nodes/$1" '{"spec":{"unschedulable":true}}' application/merge-patch+json >/dev/null || return 1
+  pods="$(kube_api GET "/api/v1/pods?fieldSelector=spec.nodeName%3D$1")" || return 1
+  pods="$(printf '%s' "${pods}" | grep -o '"metadata":{"name":"[^"]*",\("generateName":"[^"]*",\)\?"namespace":"[^"]*"' | sed 's|.*"name":"\([^"]*\)".*"namespace":"\([^"]*\)"|\2/\1|' || true)"
+  for pod in ${pods}; do
+    if ! kube_api POST "/api/v1/namespaces/${pod%%/*}/pods/${pod#*/}/eviction" "{\"apiVersion\":\"policy/v1\",\"kind\":\"Eviction\",\"metadata\":{\"name\":\"${pod#*/}\",\"namespace\":\"${pod%%/*}\"}}" >/dev/null; then
+      echo "Could not evict pod ${pod} from $1." >&2
+    fi
+  done
+  deadline=$((SECONDS + 120))
+  for pod in ${pods}; do
+    while true; do
+      out="$(kube_api GET "/api/v1/namespaces/${pod%%/*}/pods/${pod#*/}" 2>/dev/null || true)"
+      case "${out}" in
+        *"\"nodeName\":\"$1\""*) ;;
+        *) break ;;
+      esac
+      if [ "${SECONDS}" -ge "${deadline}" ]; then
+        echo "Pods on $1 did not leave within 2 minutes." >&2
+        return 1
+      fi
+      sleep 2
+    done
+  done
+}
+
+# remove_workers SHOW COUNT drains and removes the COUNT highest-numbered
+# workers. talosctl prints container names with a leading slash.
+remove_workers() {
+  local name
+  for name in $(printf '%s\n' "$1" | awk 'tolower($2) == "worker" {sub(/^\//, "", $1); print $1}' | sort -V -r | head -n "$2"); do
+    if ! drain_node "${name}"; then
+      echo "Could not drain Kubernetes node ${name}; its remaining pods are rescheduled after the node is deleted." >&2
+    fi
+    if ! kube_api DELETE "/api/v1/nodes/${name}" >/dev/null; then
+      echo "Could not delete Kubernetes node ${name}; it stays listed as NotReady." >&2
+    fi
+    docker rm -f -v "${name}" >/dev/null
+    echo "Removed worker ${name}."
+  done
+}
+
+ip_to_int() {
+  local IFS=.
+  set -- $1
+  echo $(( ($1 << 24) + ($2 << 16) + ($3 << 8) + $4 ))
+}
+
+int_to_ip() {
+  echo "$(( ($1 >> 24) & 255 )).$(( ($1 >> 16) & 255 )).$(( ($1 >> 8) & 255 )).$(( $1 & 255 ))"
+}
+
+# next_free_ip NETWORK AFTER prints the first host address of NETWORK's IPv4
+# subnet above the address AFTER that neither the gateway nor a container
+# uses. It fails when the subnet has no such address left.
+next_free_ip() {
+  local subnet bits base last used n ip
+  subnet="$(docker network inspect -f '{{range .IPAM.Config}}{{.Subnet}} {{end}}' "$1" | tr ' ' '\n' | grep -m 1 -E '^[0-9]+(\.[0-9]+){3}/[0-9]+$' || true)"
+  if [ -z "${subnet}" ]; then
+    echo "Docker network $1 has no IPv4 subnet." >&2
+    return 1
+  fi
+  bits="${subnet#*/}"
+  base=$(( $(ip_to_int "${subnet%/*}") & ~((1 << (32 - bits)) - 1) & 0xffffffff ))
+  last=$(( base + (1 << (32 - bits)) - 2 ))
+  used=" $(docker network inspect -f '{{range .IPAM.Config}}{{.Gateway}} {{end}}{{range .Containers}}{{.IPv4Address}} {{end}}' "$1" | sed 's|/[0-9]*||g') "
+  n=$(( $2 + 1 ))
+  if [ "${n}" -le "${base}" ]; then
+    n=$(( base + 1 ))
+  fi
+  for (( ; n <= last; n++ )); do
+    ip="$(int_to_ip "${n}")"
+    case "${used}" in
+      *" ${ip} "*) ;;
+      *) echo "${ip}"; return 0 ;;
+    esac
+  done
+  echo "Docker network $1 (${subnet}) has no free address for another worker." >&2
+  return 1
+}
+
+# add_workers SHOW COUNT starts COUNT more workers, copied from the first.
+# Only the container name and hostname differ from the template; labels
+# whose value is the template's name are re-derived for the new worker.
+add_workers() {
+  local template network image nano cpus after max_index name ip i j
+  local -a args
+  template="$(printf '%s\n' "$1" | awk 'tolower($2) == "worker" {sub(/^\//, "", $1); print $1}' | sort -V | head -n 1)"
+  network="$(docker inspect -f '{{range $k, $v := .NetworkSettings.Networks}}{{$k}}{{end}}' "${template}")"
+  image="$(docker inspect -f '{{.Config.Image}}' "${template}")"
+  nano="$(docker inspect -f '{{.HostConfig.NanoCpus}}' "${template}")"
+  cpus=""
+  if [ "${nano:-0}" -gt 0 ]; then
+    cpus="$(awk -v n="${nano}" 'BEGIN {print n / 1000000000}')"
+  fi
+  after=0
+  for ip in $(printf '%s\n' "$1" | awk 'tolower($2) ~ /controlplane|worker/ {sub(/\/.*/, "", $3); print $3}'); do
+    if [ "$(ip_to_int "${ip}")" -gt "${after}" ]; then
+      after="$(ip_to_int "${ip}")"
+    fi
+  done
+  max_index="$(printf '%s\n' "$1" | awk 'tolower($2) == "worker" {n = $1; sub(/.*-/, "", n); if (n + 0 > m) m = n + 0} END {print m + 0}')"
+  for (( i = 1; i <= $2; i++ )); do
+    name="${CLUSTER_NAME}-worker-$((max_index + i))"
+    ip="$(next_free_ip "${network}" "${after}")" || return 1
+    after="$(ip_to_int "${ip}")"
+    mapfile -t args < <(docker inspect -f "${WORKER_CLONE_FORMAT}" "${template}")
+    for (( j = 1; j < ${#args[@]}; j++ )); do
+      if [ "${args[j-1]}" = "--label" ] && [ "${args[j]#*=}" = "${template}" ]; then
+        args[j]="${args[j]%%=*}=${name}"
+      fi
+    done
+    docker run -d --name "${name}" --hostname "${name}" --network "${network}" --ip "${ip}" \
+      "${args[@]}" ${cpus:+--cpus "${cpus}"} "${image}" >/dev/null
+    echo "Added worker ${name} (${ip})."
+  done
+}
+
+wait_cluster_healthy() {
+  local show cps workers
+  show="$(cluster_show)"
+  cps="$(printf '%s\n' "${show}" | awk 'tolower($2) == "controlplane" {printf "%s%s", s, $3; s = ","}')"
+  workers="$(printf '%s\n' "${show}" | awk 'tolower($2) == "worker" {printf "%s%s", s, $3; s = ","}')"
+  if ! sudo -n -u "${TARGET_USER}" -H env TALOSCONFIG="${TALOSCONFIG}" CPS="${cps}" WORKER_IPS="${workers}" bash -lc 'timeout 330s talosctl --talosconfig "${TALOSCONFIG}" --nodes "${CPS%%,*}" --endpoints "${CPS%%,*}" health --wait-timeout 5m --server=false --control-plane-nodes "${CPS}" ${WORKER_IPS:+--worker-nodes "${WORKER_IPS}"}'; then
+    echo "Cluster ${CLUSTER_NAME} is not healthy after changing workers." >&2
+    exit 1
+  fi
+}
+
+WORKER_CLONE_FORMAT="$(cat <<'FORMAT'
+{{range .Config.Env}}--env
+{{.}}
+{{end}}{{range $k, $v := .Config.Labels}}--label
+{{$k}}={{$v}}
+{{end}}{{range $p, $o := .HostConfig.Tmpfs}}--tmpfs
+{{$p}}{{if $o}}:{{$o}}{{end}}
+{{end}}{{range .HostConfig.SecurityOpt}}--security-opt
+{{.}}
+{{end}}{{range .Mounts}}{{if eq .Type "bind"}}--mount
+type=bind,src={{.Source}},dst={{.Destination}}{{if not .RW}},readonly{{end}}
+{{else if eq .Type "volume"}}--mount
+type=volume,dst={{.Destination}}
+{{end}}{{end}}{{if .HostConfig.Privileged}}--privileged
+{{end}}{{if .HostConfig.ReadonlyRootfs}}--read-only
+{{end}}{{with .HostConfig.CgroupnsMode}}--cgroupns
+{{.}}
+{{end}}{{with .HostConfig.Memory}}--memory
+{{.}}
+{{end}}
+FORMAT
+)"
+`
+
 func runClusterCreate(ctx context.Context, logger *slog.Logger, cfg config.Config) error {
+	var offlineNodeImages []string
+	if cfg.Offline.Enabled {
+		images, err := loadOfflineImages(ctx, logger, cfg)
+		if err != nil {
+			return err
+		}
+		offlineNodeImages = images
+	}
+	proxyPatch, err := talosProxyPatch(cfg)
+	if err != nil {
+		return err
+	}
+	patches, err := clusterPatches(cfg)
+	if err != nil {
+		return err
+	}
+	if err := uploadClusterPatches(ctx, cfg, patches); err != nil {
+		return err
+	}
 	script := fmt.Sprintf(`#!/usr/bin/env bash
 set -euo pipefail
 
 TARGET_USER=%q
 CLUSTER_NAME=%q
 STATE_DIR=%q
-MOUNT_SRC=%q
-MOUNT_DST=%q
-TALOS_HOME="/home/${TARGET_USER}/.talos"
+MOUNT_SRCS=%s
+MOUNT_SPECS=%s
+CONTROLPLANES=%d
+WORKERS=%d
+%s%s%sTALOS_HOME="/home/${TARGET_USER}/.talos"
 TALOSCONFIG="${STATE_DIR}/talosconfig"
 KUBECONFIG="${STATE_DIR}/kubeconfig"
+PROXY_PATCH=%s
+REGISTRY_PATCH=%s
+PATCH_HASH=%q
+PATCH_HASH_FILE="${STATE_DIR}/%s"
 
-if [ ! -d "${MOUNT_SRC}" ]; then
-  if ! sudo -n -u "${TARGET_USER}" -H env MOUNT_SRC="${MOUNT_SRC}" bash -lc 'set -euo pipefail; install -d -m 0755 "${MOUNT_SRC}"'; then
+while IFS= read -r MOUNT_SRC; do
+  if [ -z "${MOUNT_SRC}" ] || [ -d "${MOUNT_SRC}" ]; then
+    continue
+  fi
+  if ! sudo -n -u "${TARGET_USER}" -H env MOUNT_SRC="${MOUNT_SRC}" bash -lc 'set -euo pipefail; install -d -m 0755 "${MOUNT_SRC}"' </dev/null; then
     echo "Mount source not found and could not be created: ${MOUNT_SRC}" >&2
     exit 1
   fi
   echo "Mount source created: ${MOUNT_SRC}"
-fi
+done <<< "${MOUNT_SRCS}"
 
-show="$(sudo -n -u "${TARGET_USER}" -H env CLUSTER_NAME="${CLUSTER_NAME}" STATE_DIR="${STATE_DIR}" bash -lc 'set -euo pipefail; talosctl cluster --name "${CLUSTER_NAME}" --state "${STATE_DIR}" show --provisioner docker 2>/dev/null || true')"
+%s
+%s
+%s
+%s
+check_node_capacity
+show="$(cluster_show)"
 if printf "%%s\n" "${show}" | grep -Eiq 'controlplane|worker'; then
+  cp_count="$(printf "%%s\n" "${show}" | awk 'tolower($2) == "controlplane" {c++} END {print c+0}')"
   worker_count="$(printf "%%s\n" "${show}" | awk 'tolower($2) == "worker" {c++} END {print c+0}')"
-  if [ "${worker_count}" -gt 0 ]; then
-    echo "Cluster has worker nodes (${worker_count}); recreating as single-node controlplane: ${CLUSTER_NAME}"
+  image_drift="$(node_image_drift "${show}")"
+  network_drift="$(registry_network_drift)"
+  node_name="$(printf "%%s\n" "${show}" | awk 'tolower($2) ~ /controlplane/ {print $1; exit}')"
+  recreate=""
+  if [ "${cp_count}" -ne "${CONTROLPLANES}" ]; then
+    recreate="cluster has ${cp_count} controlplane nodes, want ${CONTROLPLANES}"
+  elif [ ! -s "${TALOSCONFIG}" ] || [ ! -s "${KUBECONFIG}" ]; then
+    recreate="Talos artifacts missing, self-healing state"
+  elif [ -n "${node_name}" ] && [ "$(docker inspect -f '{{.State.Running}}' "${node_name}" 2>/dev/null || echo false)" != "true" ]; then
+    recreate="node container ${node_name} is not running"
+  elif [ -n "${image_drift}" ]; then
+    recreate="node ${image_drift%%%% *} runs ${image_drift#* }, want ${TALOS_IMAGE}"
+  elif [ "$(cat "${PATCH_HASH_FILE}" 2>/dev/null || true)" != "${PATCH_HASH}" ]; then
+    recreate="config patches changed since the cluster was created"
+  elif [ -n "${network_drift}" ]; then
+    recreate="cluster network is ${network_drift}, the offline registry needs ${REGISTRY_CIDR}"
+  elif [ "${worker_count}" -eq 0 ] && [ "${WORKERS}" -gt 0 ]; then
+    recreate="no worker node to copy for ${WORKERS} workers"
+  fi
+  if [ -n "${recreate}" ]; then
+    echo "Recreating cluster ${CLUSTER_NAME}: ${recreate}"
+    disconnect_registry
     sudo -n -u "${TARGET_USER}" -H env CLUSTER_NAME="${CLUSTER_NAME}" STATE_DIR="${STATE_DIR}" bash -lc 'set -euo pipefail; timeout 60s talosctl cluster --name "${CLUSTER_NAME}" --state "${STATE_DIR}" destroy --force || true'
-  elif [ -s "${TALOSCONFIG}" ] && [ -s "${KUBECONFIG}" ]; then
-    echo "Cluster already running: ${CLUSTER_NAME} (single-node, artifacts present, skipping create)"
-    exit 0
   else
-    echo "Cluster running but Talos artifacts missing; recreating to self-heal state: ${CLUSTER_NAME}"
-    sudo -n -u "${TARGET_USER}" -H env CLUSTER_NAME="${CLUSTER_NAME}" STATE_DIR="${STATE_DIR}" bash -lc 'set -euo pipefail; timeout 60s talosctl cluster --name "${CLUSTER_NAME}" --state "${STATE_DIR}" destroy --force || true'
+    connect_registry
+    if [ "${worker_count}" -gt "${WORKERS}" ]; then
+      remove_workers "${show}" $((worker_count - WORKERS))
+    elif [ "${worker_count}" -lt "${WORKERS}" ]; then
+      add_workers "${show}" $((WORKERS - worker_count))
+    fi
+    update_node_resources "$(cluster_show)"
+    if [ "${worker_count}" -lt "${WORKERS}" ]; then
+      wait_cluster_healthy
+    fi
+    if [ -n "${KUBERNETES_VERSION}" ]; then
+      kubelet="$(kubelet_versions "$(cluster_show)")"
+      if [ -z "${kubelet}" ]; then
+        echo "Could not read the nodes' Kubernetes version; skipping the upgrade check." >&2
+      elif [ "${kubelet}" != "${KUBERNETES_VERSION}" ]; then
+        echo "Upgrading Kubernetes from ${kubelet} to ${KUBERNETES_VERSION}."
+        upgrade_kubernetes "$(cluster_show)"
+      fi
+    fi
+    echo "Cluster already running: ${CLUSTER_NAME} (${CONTROLPLANES} controlplane, ${WORKERS} workers, artifacts present)"
+    exit 0
   fi
 fi
 
@@ -57,14 +315,51 @@ if ! sudo -n -u "${TARGET_USER}" -H env STATE_DIR="${STATE_DIR}" bash -lc 'set -
   exit 1
 fi
 
+# The proxy reaches the nodes through a machine config patch.
+CONFIG_PATCH=""
+if [ -n "${PROXY_PATCH}" ]; then
+  CONFIG_PATCH="${TALOS_HOME}/${CLUSTER_NAME}-proxy-patch.yaml"
+  printf '%%s\n' "${PROXY_PATCH}" > "${CONFIG_PATCH}"
+  chown "${TARGET_USER}:${TARGET_USER}" "${CONFIG_PATCH}"
+  chmod 0600 "${CONFIG_PATCH}"
+fi
+# Offline, the nodes pull through the registry on the VM.
+REGISTRY_PATCH_FILE=""
+if [ -n "${REGISTRY_PATCH}" ]; then
+  REGISTRY_PATCH_FILE="${TALOS_HOME}/${CLUSTER_NAME}-registry-patch.yaml"
+  printf '%%s\n' "${REGISTRY_PATCH}" > "${REGISTRY_PATCH_FILE}"
+  chown "${TARGET_USER}:${TARGET_USER}" "${REGISTRY_PATCH_FILE}"
+  chmod 0600 "${REGISTRY_PATCH_FILE}"
+fi
+%s
+RESOURCE_FLAGS="$(resource_flags)"
+IMAGE_FLAGS="$(image_flags)"
+REGISTRY_CONNECT_PID=""
+if [ -n "${REGISTRY_IP}" ]; then
+  connect_registry &
+  REGISTRY_CONNECT_PID=$!
+fi
+
 sudo -n -u "${TARGET_USER}" -H env \
   CLUSTER_NAME="${CLUSTER_NAME}" \
   STATE_DIR="${STATE_DIR}" \
-  MOUNT_SRC="${MOUNT_SRC}" \
-  MOUNT_DST="${MOUNT_DST}" \
+  MOUNT_SPECS="${MOUNT_SPECS}" \
   TALOSCONFIG="${TALOSCONFIG}" \
+  CONFIG_PATCH="${CONFIG_PATCH}" \
+  REGISTRY_PATCH_FILE="${REGISTRY_PATCH_FILE}" \
+  CONTROLPLANES="${CONTROLPLANES}" \
+  WORKERS="${WORKERS}" \
+  RESOURCE_FLAGS="${RESOURCE_FLAGS}" \
+  IMAGE_FLAGS="${IMAGE_FLAGS}" \
+  PATCH_FLAGS="${PATCH_FLAGS}" \
   bash -lc 'set -euo pipefail
-    if ! timeout 600s talosctl cluster --name "${CLUSTER_NAME}" --state "${STATE_DIR}" create docker --workers 0 --talosconfig-destination "${TALOSCONFIG}" --mount "type=bind,src=${MOUNT_SRC},dst=${MOUNT_DST}"; then
+    MOUNT_ARGS=()
+    while IFS= read -r spec; do
+      if [ -n "${spec}" ]; then
+        MOUNT_ARGS+=(--mount "${spec}")
+      fi
+    done <<< "${MOUNT_SPECS}"
+    if ! timeout 600s talosctl cluster --name "${CLUSTER_NAME}" --state "${STATE_DIR}" create docker --controlplanes "${CONTROLPLANES}" --workers "${WORKERS}" --talosconfig-destination "${TALOSCONFIG}" "${MOUNT_ARGS[@]}" ${RESOURCE_FLAGS} ${IMAGE_FLAGS} ${CONFIG_PATCH:+--config-patch "@${CONFIG_PATCH}"} ${REGISTRY_PATCH_FILE:+--config-patch "@${REGISTRY_PATCH_FILE}"} ${PATCH_FLAGS}; then
       rc=$?
       show_after="$(talosctl cluster --name "${CLUSTER_NAME}" --state "${STATE_DIR}" show --provisioner docker 2>/dev/null || true)"
       if printf "%%s\n" "${show_after}" | grep -Eiq "controlplane|worker"; then
@@ -74,13 +369,22 @@ sudo -n -u "${TARGET_USER}" -H env \
       fi
     fi
   '
+if [ -n "${REGISTRY_CONNECT_PID}" ]; then
+  wait "${REGISTRY_CONNECT_PID}"
+fi
 
 if [ ! -s "${TALOSCONFIG}" ]; then
   echo "Missing talosconfig after cluster create: ${TALOSCONFIG}" >&2
   exit 1
 fi
+if [ -n "${PATCH_HASH}" ]; then
+  printf '%%s\n' "${PATCH_HASH}" > "${PATCH_HASH_FILE}"
+  chown "${TARGET_USER}:${TARGET_USER}" "${PATCH_HASH_FILE}"
+else
+  rm -f "${PATCH_HASH_FILE}"
+fi
 
-node_ip="$(sudo -n -u "${TARGET_USER}" -H env CLUSTER_NAME="${CLUSTER_NAME}" STATE_DIR="${STATE_DIR}" bash -lc 'set -euo pipefail; talosctl cluster --name "${CLUSTER_NAME}" --state "${STATE_DIR}" show --provisioner docker | awk '"'"'tolower($2) ~ /controlplane|worker/ {print $3; exit}'"'"'')"
+node_ip="$(cluster_show | awk 'tolower($2) == "controlplane" {print $3; exit}')"
 if [ -z "${node_ip}" ]; then
   echo "Failed to detect Talos node IP from cluster state." >&2
   exit 1
@@ -96,22 +400,89 @@ if [ ! -s "${KUBECONFIG}" ]; then
   echo "Failed to generate kubeconfig at ${KUBECONFIG}." >&2
   exit 1
 fi
-`, cfg.VM.User, cfg.Cluster.Name, cfg.Cluster.StateDir, cfg.Cluster.MountSrc, cfg.Cluster.MountDst)
+`, cfg.VM.User, cfg.Cluster.Name, cfg.Cluster.StateDir,
+		heredocValue("MOUNTSRCS", mountSources(cfg)), heredocValue("MOUNTSPECS", mountSpecs(cfg)),
+		cfg.Cluster.ControlplaneCount(), cfg.Cluster.Workers, clusterResourceVars(cfg), clusterVersionVars(cfg), offlineRegistryVars(cfg),
+		heredocValue("PROXYPATCH", proxyPatch), heredocValue("REGISTRYPATCH", offlineRegistryPatch(offlineNodeImages)), clusterPatchHash(patches), configPatchHashFile,
+		clusterTopologyFuncs, clusterResourceFuncs, clusterVersionFuncs, offlineRegistryFuncs, clusterPatchScript(cfg, patches))
 
 	return runRemoteScript(ctx, logger, cfg, "cluster_create", script)
 }
 
 func ClusterStatus(ctx context.Context, logger *slog.Logger, cfg config.Config) (string, error) {
 	sshCfg := execConfig(cfg)
-	cmd := fmt.Sprintf("sudo -n -u %q -H env STATE_DIR=%q CLUSTER_NAME=%q bash -lc 'set -euo pipefail; out=\"$(talosctl cluster --name \"${CLUSTER_NAME}\" --state \"${STATE_DIR}\" show --provisioner docker 2>/dev/null || true)\"; if [ -z \"$(printf \"%%s\" \"$out\" | tr -d \"[:space:]\")\" ]; then echo \"No Talos-in-Docker cluster found on remote VM.\" >&2; exit 2; fi; printf \"%%s\\n\" \"$out\"'", cfg.VM.User, cfg.Cluster.StateDir, cfg.Cluster.Name)
+	cmd := fmt.Sprintf(`sudo -n -u %q -H env STATE_DIR=%q CLUSTER_NAME=%q TALOSCONFIG=%q bash -lc '
+set -euo pipefail
+out="$(talosctl cluster --name "${CLUSTER_NAME}" --state "${STATE_DIR}" show --provisioner docker 2>/dev/null || true)"
+if [ -z "$(printf "%%s" "$out" | tr -d "[:space:]")" ]; then
+  echo "No Talos-in-Docker cluster found on remote VM." >&2
+  exit 2
+fi
+printf "%%s\n" "$out"
+nodes="$(printf "%%s\n" "$out" | awk '"'"'tolower($2) ~ /^(controlplane|worker)$/ {sub(/^\//, "", $1); print $1}'"'"')"
+if [ -n "${nodes}" ] && command -v docker >/dev/null 2>&1; then
+  printf "fact: config_patches=%%s\n" "$(cat "${STATE_DIR}/%s" 2>/dev/null || true)"
+  printf "fact: node_images=%%s\n" "$(docker inspect -f "{{.Config.Image}}" ${nodes} 2>/dev/null | sort -u | paste -sd, -)"
+  cp="$(printf "%%s\n" "$out" | awk '"'"'tolower($2) == "controlplane" {print $3; exit}'"'"')"
+  ips="$(printf "%%s\n" "$out" | awk '"'"'tolower($2) ~ /^(controlplane|worker)$/ {printf "%%s%%s", s, $3; s = ","}'"'"')"
+  printf "fact: kubelet=%%s\n" "$(timeout 30s talosctl --talosconfig "${TALOSCONFIG}" --nodes "${ips}" --endpoints "${cp}" get kubeletspec -o yaml 2>/dev/null | awk '"'"'$1 == "image:" {n = split($2, p, ":"); v = p[n]; sub(/^v/, "", v); print v}'"'"' | sort -u | paste -sd, -)"
+fi
+'`, cfg.VM.User, cfg.Cluster.StateDir, cfg.Cluster.Name, filepath.Join(cfg.Cluster.StateDir, "talosconfig"), configPatchHashFile)
 	stdout, stderr, err := sshRunCommandFn(ctx, sshCfg, cmd)
 	if stderr != "" {
 		logger.Debug("cluster_status stderr", "output", strings.TrimSpace(stderr))
 	}
+	// Version facts are split off the talosctl output.
+	var lines []string
+	for _, line := range strings.Split(stdout, "\n") {
+		if !strings.HasPrefix(line, "fact: ") {
+			lines = append(lines, line)
+		}
+	}
+	out := strings.TrimSpace(strings.Join(lines, "\n"))
 	if err != nil {
-		return strings.TrimSpace(stdout), err
+		return out, err
+	}
+	if topology := clusterTopology(cfg, out); topology != "" {
+		out += "\n\n" + topology
+	}
+	facts := parsePreflightFacts(stdout)
+	if versions := clusterVersions(cfg, facts); versions != "" {
+		out += "\n" + versions
+	}
+	if recorded, ok := facts["config_patches"]; ok {
+		if drift := clusterPatchDrift(cfg, recorded); drift != "" {
+			out += "\n" + drift
+		}
+	}
+	return out, nil
+}
+
+// clusterTopology summarizes the node counts in talosctl cluster show
+// output and how they differ from the config. It is empty when the output
+// lists no nodes.
+func clusterTopology(cfg config.Config, show string) string {
+	var controlplanes, workers int
+	for _, line := range strings.Split(show, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch strings.ToLower(fields[1]) {
+		case "controlplane":
+			controlplanes++
+		case "worker":
+			workers++
+		}
 	}
-	return strings.TrimSpace(stdout), nil
+	if controlplanes+workers == 0 {
+		return ""
+	}
+	topology := fmt.Sprintf("Topology: %d controlplane, %d workers", controlplanes, workers)
+	if controlplanes != cfg.Cluster.ControlplaneCount() || workers != cfg.Cluster.Workers {
+		topology += fmt.Sprintf(" (config: %d controlplane, %d workers; run bootstrap to reconcile)", cfg.Cluster.ControlplaneCount(), cfg.Cluster.Workers)
+	}
+	return topology
 }
 
 func KubeconfigExport(ctx context.Context, logger *slog.Logger, cfg config.Config) (string, error) {
@@ -125,7 +496,7 @@ if [ ! -s "${REMOTE_KUBECONFIG}" ]; then
     echo "Remote Talos config missing: ${TALOSCONFIG} (run make talos-bootstrap to self-heal)." >&2
     exit 2
   fi
-  node_ip="$(talosctl cluster --name "${CLUSTER_NAME}" --state "${STATE_DIR}" show --provisioner docker | awk '"'"'tolower($2) ~ /controlplane|worker/ {print $3; exit}'"'"')"
+  node_ip="$(talosctl cluster --name "${CLUSTER_NAME}" --state "${STATE_DIR}" show --provisioner docker | awk '"'"'tolower($2) == "controlplane" {print $3; exit}'"'"')"
   if [ -z "${node_ip}" ]; then
     echo "No remote Talos cluster found on VM." >&2
     exit 2
@@ -144,45 +515,97 @@ cat "${REMOTE_KUBECONFIG}"
 	return stdout, nil
 }
 
+// MountCheck verifies every cluster mount on every node: that it is
+// mapped, from the configured source, with the configured access. Each
+// result is printed; the check fails after all of them if any failed.
 func MountCheck(ctx context.Context, logger *slog.Logger, cfg config.Config) error {
 	script := fmt.Sprintf(`#!/usr/bin/env bash
 set -euo pipefail
 
 TARGET_USER=%q
-MOUNT_DST=%q
+MOUNTS=%s
 STATE_DIR=%q
 CLUSTER_NAME=%q
 
-sudo -n -u "${TARGET_USER}" -H env MOUNT_DST="${MOUNT_DST}" STATE_DIR="${STATE_DIR}" CLUSTER_NAME="${CLUSTER_NAME}" bash -lc '
+sudo -n -u "${TARGET_USER}" -H env MOUNTS="${MOUNTS}" STATE_DIR="${STATE_DIR}" CLUSTER_NAME="${CLUSTER_NAME}" bash -lc '
   set -euo pipefail
   show="$(talosctl cluster --name "${CLUSTER_NAME}" --state "${STATE_DIR}" show --provisioner docker 2>/dev/null || true)"
-  node_name="$(printf "%%s\n" "${show}" | awk "tolower(\$2) ~ /controlplane|worker/ {print \$1; exit}")"
-  if [ -z "${node_name}" ]; then
+  node_names="$(printf "%%s\n" "${show}" | awk "tolower(\$2) ~ /controlplane|worker/ {print \$1}")"
+  if [ -z "${node_names}" ]; then
     echo "No Talos-in-Docker cluster found on remote VM." >&2
     exit 2
   fi
-  mount_src="$(docker inspect "${node_name}" --format "{{range .Mounts}}{{if eq .Destination \"${MOUNT_DST}\"}}{{.Source}}{{end}}{{end}}")"
-  if [ -z "${mount_src}" ]; then
-    echo "Mount path not configured on node ${node_name}: ${MOUNT_DST}" >&2
+  total=0
+  failed=0
+  for node_name in ${node_names}; do
+    while read -r dst mode src; do
+      if [ -z "${dst}" ]; then
+        continue
+      fi
+      total=$((total + 1))
+      want_rw=true
+      access=read-write
+      if [ "${mode}" = "ro" ]; then
+        want_rw=false
+        access=read-only
+      fi
+      got="$(docker inspect "${node_name}" --format "{{range .Mounts}}{{if eq .Destination \"${dst}\"}}{{.RW}} {{.Source}}{{end}}{{end}}")"
+      if [ -z "${got}" ]; then
+        echo "Mount path not configured on node ${node_name}: ${dst}" >&2
+        failed=$((failed + 1))
+      elif [ "${got#* }" != "${src}" ]; then
+        echo "Mount path on node ${node_name}: ${dst} <- ${got#* }, want ${src}" >&2
+        failed=$((failed + 1))
+      elif [ "${got%%%% *}" != "${want_rw}" ]; then
+        echo "Mount path on node ${node_name}: ${dst} is not ${access}" >&2
+        failed=$((failed + 1))
+      else
+        echo "Mount path mapped on node ${node_name}: ${dst} <- ${src} (${access})"
+      fi
+    done <<< "${MOUNTS}"
+  done
+  if [ "${failed}" -gt 0 ]; then
+    echo "${failed} of ${total} mount checks failed." >&2
     exit 1
   fi
-  echo "Mount path mapped on node: ${MOUNT_DST} <- ${mount_src}"
 '
-`, cfg.VM.User, cfg.Cluster.MountDst, cfg.Cluster.StateDir, cfg.Cluster.Name)
+`, cfg.VM.User, heredocValue("MOUNTS", mountChecks(cfg)), cfg.Cluster.StateDir, cfg.Cluster.Name)
 
 	return runRemoteScript(ctx, logger, cfg, "mount_check", script)
 }
 
+// SSHExecConfig maps the VM section of cfg to ssh connection settings.
+func SSHExecConfig(cfg config.Config) ssh.ExecConfig {
+	return execConfig(cfg)
+}
+
 func execConfig(cfg config.Config) ssh.ExecConfig {
+	jumps := make([]ssh.JumpHost, 0, len(cfg.VM.JumpHosts))
+	for _, j := range cfg.VM.JumpHosts {
+		jumps = append(jumps, ssh.JumpHost{
+			Host:             j.Host,
+			Port:             j.Port,
+			User:             j.User,
+			PrivateKeyPath:   j.SSHPrivateKey,
+			ExpectedHostKeys: j.SSHHostFingerprint,
+		})
+	}
 	return ssh.ExecConfig{
-		Host:                  cfg.VM.Host,
-		Port:                  cfg.VM.Port,
-		User:                  cfg.VM.User,
-		PrivateKeyPath:        cfg.VM.SSHPrivateKey,
-		KnownHostsFile:        cfg.VM.KnownHostsFile,
-		KnownHostsMode:        cfg.VM.KnownHostsMode,
-		ExpectedHostKeySHA256: cfg.VM.SSHHostFingerprint,
-		Prompt:                knownHostsPromptFn,
-		ConnectTimeout:        cfg.Timeouts.SSHConnectDuration(),
+		Host:              cfg.VM.Host,
+		Port:              cfg.VM.Port,
+		User:              cfg.VM.User,
+		PrivateKeyPath:    cfg.VM.SSHPrivateKey,
+		KnownHostsFile:    cfg.VM.KnownHostsFile,
+		KnownHostsMode:    cfg.VM.KnownHostsMode,
+		ExpectedHostKeys:  cfg.VM.SSHHostFingerprint,
+		HostKeyAlgorithms: cfg.VM.SSHHostKeyAlgorithms,
+		Prompt:            knownHostsPromptFn,
+		ConnectTimeout:    cfg.Timeouts.SSHConnectDuration(),
+		Transport:         cfg.VM.SSHTransport,
+		UseAgent:          cfg.VM.UsesAgent(),
+		AgentIdentity:     cfg.VM.SSHAgentIdentity,
+		CertificateFile:   cfg.VM.SSHCertificate,
+		HostCAFile:        cfg.VM.SSHHostCA,
+		JumpHosts:         jumps,
 	}
 }
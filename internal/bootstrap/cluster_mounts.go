@@ -0,0 +1,45 @@
+package bootstrap
+
+import (
+	"path"
+	"strings"
+
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
+)
+
+// mountSources lists the host directories of cluster mounts, one per line.
+func mountSources(cfg config.Config) string {
+	var lines []string
+	for _, m := range cfg.Cluster.MountList() {
+		lines = append(lines, m.Src)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// mountSpecs renders the cluster mounts as docker --mount values, one per
+// line.
+func mountSpecs(cfg config.Config) string {
+	var lines []string
+	for _, m := range cfg.Cluster.MountList() {
+		spec := "type=bind,src=" + m.Src + ",dst=" + m.Dst
+		if m.ReadOnly {
+			spec += ",readonly"
+		}
+		lines = append(lines, spec)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// mountChecks lists the mounts for MountCheck as "DST MODE SRC" lines, MODE
+// being ro or rw. Only the source may contain spaces, so it comes last.
+func mountChecks(cfg config.Config) string {
+	var lines []string
+	for _, m := range cfg.Cluster.MountList() {
+		mode := "rw"
+		if m.ReadOnly {
+			mode = "ro"
+		}
+		lines = append(lines, path.Clean(m.Dst)+" "+mode+" "+path.Clean(m.Src))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,178 @@
+package bootstrap
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
+)
+
+// configPatchHashFile records, in the cluster state dir, the hash of the
+// config patches the cluster was created with.
+const configPatchHashFile = "config-patches.sha256"
+
+// clusterPatch is a cluster.config_patches file read for talosctl.
+type clusterPatch struct {
+	flag    string
+	name    string
+	path    string
+	content string
+}
+
+// clusterPatches reads and validates cluster.config_patches, global patches
+// first, then controlplane and worker ones, each in config order.
+func clusterPatches(cfg config.Config) ([]clusterPatch, error) {
+	var patches []clusterPatch
+	for _, list := range []struct {
+		role, flag string
+		paths      []string
+	}{
+		{"global", "--config-patch", cfg.Cluster.ConfigPatches.Global},
+		{"controlplane", "--config-patch-control-plane", cfg.Cluster.ConfigPatches.Controlplane},
+		{"worker", "--config-patch-worker", cfg.Cluster.ConfigPatches.Worker},
+	} {
+		for i, file := range list.paths {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("read cluster.config_patches.%s: %w", list.role, err)
+			}
+			if err := validateConfigPatch(data); err != nil {
+				return nil, fmt.Errorf("cluster.config_patches.%s %s: %w", list.role, file, err)
+			}
+			patches = append(patches, clusterPatch{
+				flag:    list.flag,
+				name:    fmt.Sprintf("%s-%d", list.role, i+1),
+				path:    file,
+				content: strings.TrimRight(string(data), "\n"),
+			})
+		}
+	}
+	return patches, nil
+}
+
+var jsonPatchOps = []string{"add", "remove", "replace", "move", "copy", "test"}
+
+// validateConfigPatch checks that data holds strategic merge patch documents
+// (YAML mappings) or one list of RFC 6902 JSON patch operations, as talosctl
+// accepts them.
+func validateConfigPatch(data []byte) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	docs := 0
+	for {
+		var doc any
+		err := dec.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("parse: %w", err)
+		}
+		switch v := doc.(type) {
+		case nil:
+			continue
+		case map[string]any:
+		case []any:
+			if docs > 0 || len(v) == 0 {
+				return fmt.Errorf("a JSON patch must be the only document and list at least one operation")
+			}
+			for i, op := range v {
+				m, ok := op.(map[string]any)
+				name, _ := m["op"].(string)
+				path, _ := m["path"].(string)
+				if !ok || !slices.Contains(jsonPatchOps, name) || !strings.HasPrefix(path, "/") {
+					return fmt.Errorf("JSON patch operation %d needs op (%s) and a path starting with /", i+1, strings.Join(jsonPatchOps, ", "))
+				}
+			}
+		default:
+			return fmt.Errorf("document %d is neither a mapping nor a JSON patch list", docs+1)
+		}
+		docs++
+	}
+	if docs == 0 {
+		return fmt.Errorf("patch is empty")
+	}
+	return nil
+}
+
+// clusterPatchHash fingerprints the patches, including their order and the
+// nodes they apply to. It is empty without patches, as for clusters created
+// before any were configured.
+func clusterPatchHash(patches []clusterPatch) string {
+	if len(patches) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	for _, p := range patches {
+		fmt.Fprintf(h, "%s %s\n%s\n", p.flag, p.name, p.content)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// configPatchInput is the patch hash as a journal input, so --resume sees
+// an edited patch file. A patch that cannot be read is left to the step to
+// report.
+func configPatchInput(cfg config.Config) string {
+	patches, err := clusterPatches(cfg)
+	if err != nil {
+		return ""
+	}
+	return clusterPatchHash(patches)
+}
+
+// clusterPatchFile is where patch p is uploaded on the VM: the login user's
+// talosctl home, TALOS_HOME in the cluster script.
+func clusterPatchFile(cfg config.Config, p clusterPatch) string {
+	return path.Join("/home", cfg.VM.User, ".talos", cfg.Cluster.Name+"-patch-"+p.name+".yaml")
+}
+
+// uploadClusterPatches copies the patch files to the VM as they are, so
+// their content never passes through the cluster script.
+func uploadClusterPatches(ctx context.Context, cfg config.Config, patches []clusterPatch) error {
+	for _, p := range patches {
+		if err := sshUploadFn(ctx, execConfig(cfg), p.path, clusterPatchFile(cfg, p), 0o600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clusterPatchScript hands the uploaded patches to the login user and
+// collects their talosctl flags in PATCH_FLAGS.
+func clusterPatchScript(cfg config.Config, patches []clusterPatch) string {
+	var b strings.Builder
+	b.WriteString("PATCH_FLAGS=\"\"\n")
+	for _, p := range patches {
+		fmt.Fprintf(&b, `PATCH_FILE=%q
+if [ ! -s "${PATCH_FILE}" ]; then
+  echo "Config patch ${PATCH_FILE} was not uploaded." >&2
+  exit 1
+fi
+chown "${TARGET_USER}:${TARGET_USER}" "${PATCH_FILE}"
+chmod 0600 "${PATCH_FILE}"
+PATCH_FLAGS+=" %s @${PATCH_FILE}"
+`, clusterPatchFile(cfg, p), p.flag)
+	}
+	return b.String()
+}
+
+// clusterPatchDrift reports whether the recorded patch hash of a running
+// cluster differs from the config. It is empty when they match or the
+// patches cannot be read.
+func clusterPatchDrift(cfg config.Config, recorded string) string {
+	patches, err := clusterPatches(cfg)
+	if err != nil || recorded == clusterPatchHash(patches) {
+		return ""
+	}
+	return "Config patches: changed since the cluster was created (run bootstrap to recreate)"
+}
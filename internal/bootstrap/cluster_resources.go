@@ -0,0 +1,157 @@
+package bootstrap
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
+)
+
+// clusterResourceVars sets the node limits of cluster.controlplane and
+// cluster.worker for clusterResourceFuncs. An unset limit is empty and left
+// to talosctl.
+func clusterResourceVars(cfg config.Config) string {
+	cpus := func(v float64) string {
+		if v <= 0 {
+			return ""
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	memory := func(v int) string {
+		if v <= 0 {
+			return ""
+		}
+		return strconv.Itoa(v)
+	}
+	cp, w := cfg.Cluster.Controlplane, cfg.Cluster.Worker
+	need, _ := nodeCapacityNeeds(cfg)
+	return fmt.Sprintf(`CP_CPUS=%q
+CP_MEMORY_MB=%q
+WORKER_CPUS=%q
+WORKER_MEMORY_MB=%q
+NODE_COUNT=%d
+NEED_CPUS=%q
+NEED_MEMORY_MB=%q
+NEED_DISK_GB=%q
+`, cpus(cp.CPUs), memory(cp.MemoryMB), cpus(w.CPUs), memory(w.MemoryMB),
+		need.nodes, cpus(need.cpus), memory(need.memoryMB), memory(need.diskGB))
+}
+
+// nodeCapacity is what the cluster's nodes need of the VM: the largest
+// per-node CPU limit, and the memory and reserved disk of all nodes together.
+type nodeCapacity struct {
+	nodes    int
+	cpus     float64
+	memoryMB int
+	diskGB   int
+}
+
+// nodeCapacityNeeds returns what the nodes need of the VM. It is false for a
+// single default-sized node, which is left to the preflight minimums.
+func nodeCapacityNeeds(cfg config.Config) (nodeCapacity, bool) {
+	c := cfg.Cluster
+	cps, workers := c.ControlplaneCount(), c.Workers
+	if cps+workers <= 1 && c.Controlplane == (config.NodeResources{}) && c.Worker == (config.NodeResources{}) {
+		return nodeCapacity{}, false
+	}
+	need := nodeCapacity{
+		nodes:    cps + workers,
+		cpus:     c.Controlplane.EffectiveCPUs(),
+		memoryMB: cps*c.Controlplane.EffectiveMemoryMB() + workers*c.Worker.EffectiveMemoryMB(),
+		diskGB:   cps*c.Controlplane.ReservedDiskGB + workers*c.Worker.ReservedDiskGB,
+	}
+	if workers > 0 {
+		need.cpus = max(need.cpus, c.Worker.EffectiveCPUs())
+	}
+	return need, true
+}
+
+// clusterResourceFuncs sizes the node containers. New clusters get the
+// limits as talosctl create flags, whose names changed when the docker
+// provisioner became a subcommand; running nodes are resized in place with
+// docker update. Memory swap is kept at twice the memory, as Docker sets it
+// by default. check_node_capacity repeats the node_* preflight checks, so
+// they hold when preflight is disabled.
+const clusterResourceFuncs = `
+# check_node_capacity fails when the nodes do not fit the VM. NEED_CPUS is
+# empty when there is nothing to check.
+check_node_capacity() {
+  local have root
+  [ -n "${NEED_CPUS}" ] || return 0
+  have="$(nproc)"
+  if awk -v need="${NEED_CPUS}" -v have="${have}" 'BEGIN {exit !(need > have)}'; then
+    echo "A node needs ${NEED_CPUS} CPUs, but the VM has ${have}; Docker refuses the limit." >&2
+    return 1
+  fi
+  have="$(awk '/^MemTotal:/ {print int($2 / 1024)}' /proc/meminfo)"
+  if [ "${have}" -lt "${NEED_MEMORY_MB}" ]; then
+    echo "The ${NODE_COUNT} nodes need ${NEED_MEMORY_MB} MB of memory, but the VM has ${have} MB." >&2
+    return 1
+  fi
+  if [ -n "${NEED_DISK_GB}" ]; then
+    root="$(docker info -f '{{.DockerRootDir}}' 2>/dev/null || true)"
+    root="${root:-/var/lib/docker}"
+    while [ ! -e "${root}" ]; do root="$(dirname "${root}")"; done
+    have="$(df -Pk "${root}" | awk 'NR == 2 {print int($2 / 1048576)}')"
+    if [ "${have}" -lt "${NEED_DISK_GB}" ]; then
+      echo "The ${NODE_COUNT} nodes reserve ${NEED_DISK_GB} GB of disk, but the Docker filesystem at ${root} has ${have} GB." >&2
+      return 1
+    fi
+  fi
+}
+
+resource_flags() {
+  local help
+  help="$(talosctl cluster create docker --help 2>/dev/null || true)"
+  case "${help}" in
+    *--cpus-controlplanes*)
+      printf '%s' "${CP_CPUS:+ --cpus-controlplanes ${CP_CPUS}}${CP_MEMORY_MB:+ --memory-controlplanes ${CP_MEMORY_MB}MiB}"
+      printf '%s' "${WORKER_CPUS:+ --cpus-workers ${WORKER_CPUS}}${WORKER_MEMORY_MB:+ --memory-workers ${WORKER_MEMORY_MB}MiB}"
+      ;;
+    *)
+      printf '%s' "${CP_CPUS:+ --cpus ${CP_CPUS}}${CP_MEMORY_MB:+ --memory ${CP_MEMORY_MB}}"
+      printf '%s' "${WORKER_CPUS:+ --cpus-workers ${WORKER_CPUS}}${WORKER_MEMORY_MB:+ --memory-workers ${WORKER_MEMORY_MB}}"
+      ;;
+  esac
+}
+
+# node_resource_changes SHOW prints "NAME FLAGS" for every node whose
+# container limits differ from the config.
+node_resource_changes() {
+  local name role cpus memory_mb flags want
+  while read -r name role; do
+    if [ "${role}" = "controlplane" ]; then
+      cpus="${CP_CPUS}" memory_mb="${CP_MEMORY_MB}"
+    else
+      cpus="${WORKER_CPUS}" memory_mb="${WORKER_MEMORY_MB}"
+    fi
+    flags=""
+    if [ -n "${cpus}" ]; then
+      want="$(awk -v c="${cpus}" 'BEGIN {printf "%.0f", c * 1000000000}')"
+      if [ "$(docker inspect -f '{{.HostConfig.NanoCpus}}' "${name}" 2>/dev/null)" != "${want}" ]; then
+        flags+=" --cpus ${cpus}"
+      fi
+    fi
+    if [ -n "${memory_mb}" ]; then
+      want=$((memory_mb * 1048576))
+      if [ "$(docker inspect -f '{{.HostConfig.Memory}}' "${name}" 2>/dev/null)" != "${want}" ]; then
+        flags+=" --memory ${want} --memory-swap $((want * 2))"
+      fi
+    fi
+    if [ -n "${flags}" ]; then
+      printf '%s%s\n' "${name}" "${flags}"
+    fi
+  done < <(printf '%s\n' "$1" | awk 'tolower($2) ~ /^(controlplane|worker)$/ {sub(/^\//, "", $1); print $1, tolower($2)}')
+}
+
+# update_node_resources SHOW resizes the running nodes to the config.
+update_node_resources() {
+  local name flags
+  while read -r name flags; do
+    [ -n "${name}" ] || continue
+    # shellcheck disable=SC2086
+    docker update ${flags} "${name}" >/dev/null
+    echo "Resized node ${name} (${flags})."
+  done < <(node_resource_changes "$1")
+}
+`
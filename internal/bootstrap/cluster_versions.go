@@ -0,0 +1,97 @@
+package bootstrap
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
+)
+
+// clusterVersionVars sets the node image, installer image and Kubernetes
+// version of the config for clusterVersionFuncs.
+func clusterVersionVars(cfg config.Config) string {
+	return fmt.Sprintf(`TALOS_IMAGE=%q
+INSTALL_IMAGE=%q
+KUBERNETES_VERSION=%q
+`, cfg.TalosNodeImage(), cfg.TalosInstallImage(), cfg.Cluster.KubernetesVersionNumber())
+}
+
+// clusterVersionFuncs detects and resolves version drift of a running
+// cluster. The node image is the container image, so a node on another
+// image means a new cluster; the Kubernetes version is moved in place with
+// talosctl upgrade-k8s, node by node. Kubelet versions are read per node,
+// which also catches workers copied from a node's original machine config.
+const clusterVersionFuncs = `
+# image_flags prints the talosctl create flags for the node image, the
+# Kubernetes version and, when this talosctl takes it, the installer image.
+image_flags() {
+  local help
+  printf '%s' " --image ${TALOS_IMAGE}${KUBERNETES_VERSION:+ --kubernetes-version ${KUBERNETES_VERSION}}"
+  if [ -n "${INSTALL_IMAGE}" ]; then
+    help="$(talosctl cluster create docker --help 2>/dev/null || true)"
+    case "${help}" in
+      *--install-image*) printf '%s' " --install-image ${INSTALL_IMAGE}" ;;
+    esac
+  fi
+}
+
+# node_image_drift SHOW prints "NAME IMAGE" for the first node that does not
+# run TALOS_IMAGE.
+node_image_drift() {
+  local name image
+  for name in $(printf '%s\n' "$1" | awk 'tolower($2) ~ /^(controlplane|worker)$/ {sub(/^\//, "", $1); print $1}'); do
+    image="$(docker inspect -f '{{.Config.Image}}' "${name}" 2>/dev/null || true)"
+    if [ "${image}" != "${TALOS_IMAGE}" ]; then
+      printf '%s %s\n' "${name}" "${image:-unknown}"
+      return
+    fi
+  done
+}
+
+# kubelet_versions SHOW prints the distinct kubelet versions of the nodes,
+# comma-separated.
+kubelet_versions() {
+  local cp ips
+  cp="$(printf '%s\n' "$1" | awk 'tolower($2) == "controlplane" {print $3; exit}')"
+  ips="$(printf '%s\n' "$1" | awk 'tolower($2) ~ /^(controlplane|worker)$/ {printf "%s%s", s, $3; s = ","}')"
+  sudo -n -u "${TARGET_USER}" -H env TALOSCONFIG="${TALOSCONFIG}" CP="${cp}" IPS="${ips}" bash -lc 'timeout 30s talosctl --talosconfig "${TALOSCONFIG}" --nodes "${IPS}" --endpoints "${CP}" get kubeletspec -o yaml 2>/dev/null || true' |
+    awk '$1 == "image:" {n = split($2, p, ":"); v = p[n]; sub(/^v/, "", v); print v}' | sort -u | paste -sd, -
+}
+
+# upgrade_kubernetes SHOW upgrades the control plane and every kubelet to
+# KUBERNETES_VERSION. talosctl upgrade-k8s skips what is already there, so a
+# failed run is resumed by the next one.
+upgrade_kubernetes() {
+  local cp
+  cp="$(printf '%s\n' "$1" | awk 'tolower($2) == "controlplane" {print $3; exit}')"
+  if ! sudo -n -u "${TARGET_USER}" -H env TALOSCONFIG="${TALOSCONFIG}" CP="${cp}" KUBERNETES_VERSION="${KUBERNETES_VERSION}" bash -lc 'timeout 1800s talosctl --talosconfig "${TALOSCONFIG}" --nodes "${CP}" --endpoints "${CP}" upgrade-k8s --to "${KUBERNETES_VERSION}"'; then
+    echo "Kubernetes upgrade to ${KUBERNETES_VERSION} failed; run bootstrap again to resume it." >&2
+    exit 1
+  fi
+}
+`
+
+// clusterVersions summarises the node image and kubelet versions reported
+// by ClusterStatus, noting any difference from the config. It is empty
+// without facts.
+func clusterVersions(cfg config.Config, facts map[string]string) string {
+	images, kubelet := facts["node_images"], facts["kubelet"]
+	if images == "" {
+		return ""
+	}
+	out := "Versions: image " + images
+	if kubelet != "" {
+		out += ", Kubernetes " + kubelet
+	}
+	var drift []string
+	if images != cfg.TalosNodeImage() {
+		drift = append(drift, "image "+cfg.TalosNodeImage())
+	}
+	if want := cfg.Cluster.KubernetesVersionNumber(); want != "" && kubelet != want {
+		drift = append(drift, "Kubernetes "+want)
+	}
+	if len(drift) > 0 {
+		out += " (config: " + strings.Join(drift, ", ") + "; run bootstrap to reconcile)"
+	}
+	return out
+}
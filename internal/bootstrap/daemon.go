@@ -0,0 +1,118 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
+)
+
+const (
+	dockerDaemonConfigPath = "/etc/docker/daemon.json"
+	dockerDefaultDataRoot  = "/var/lib/docker"
+)
+
+type daemonAddressPool struct {
+	Base string `json:"base"`
+	Size int    `json:"size"`
+}
+
+// daemonJSON mirrors the daemon.json keys docker.daemon manages. Fields are
+// in key order so the rendered file is stable.
+type daemonJSON struct {
+	DataRoot            string              `json:"data-root,omitempty"`
+	DefaultAddressPools []daemonAddressPool `json:"default-address-pools,omitempty"`
+	InsecureRegistries  []string            `json:"insecure-registries,omitempty"`
+	LiveRestore         bool                `json:"live-restore,omitempty"`
+	LogDriver           string              `json:"log-driver,omitempty"`
+	LogOpts             map[string]string   `json:"log-opts,omitempty"`
+	RegistryMirrors     []string            `json:"registry-mirrors,omitempty"`
+}
+
+// renderDaemonJSON renders docker.daemon as the content of daemon.json.
+func renderDaemonJSON(d config.DockerDaemonConfig) (string, error) {
+	out := daemonJSON{
+		DataRoot:           d.DataRoot,
+		InsecureRegistries: d.InsecureRegistries,
+		LiveRestore:        d.LiveRestore,
+		LogDriver:          d.LogDriver,
+		RegistryMirrors:    d.RegistryMirrors,
+	}
+	for _, p := range d.DefaultAddressPools {
+		out.DefaultAddressPools = append(out.DefaultAddressPools, daemonAddressPool(p))
+	}
+	// Rotation options are only understood by the file-based drivers.
+	if d.LogDriver == "" || d.LogDriver == "json-file" || d.LogDriver == "local" {
+		opts := map[string]string{}
+		if d.LogMaxSize != "" {
+			opts["max-size"] = d.LogMaxSize
+		}
+		if d.LogMaxFile > 0 {
+			opts["max-file"] = strconv.Itoa(d.LogMaxFile)
+		}
+		if len(opts) > 0 {
+			out.LogOpts = opts
+		}
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("render daemon.json: %w", err)
+	}
+	return string(data), nil
+}
+
+// dockerConfigScript converges the Docker daemon proxy drop-in and
+// daemon.json, then restarts a running Docker once if either changed, with
+// the cluster containers stopped around the restart. Before Docker is
+// installed the files are only written, and the daemon picks them up on
+// first start. A data root change is refused while Talos containers exist,
+// as Docker would come back without them. It expects proxySetupScript and
+// dockerUpgradeFuncs to have run first.
+func dockerConfigScript(cfg config.Config) (string, error) {
+	daemon, err := renderDaemonJSON(cfg.Docker.Daemon)
+	if err != nil {
+		return "", err
+	}
+	dataRoot := cfg.Docker.Daemon.DataRoot
+	if dataRoot == "" {
+		dataRoot = dockerDefaultDataRoot
+	}
+	return dockerProxyScript(cfg) + fmt.Sprintf(`
+DAEMON_JSON_PATH=%q
+WANT_DATA_ROOT=%q
+TMP_DAEMON="$(mktemp)"
+printf '%%s\n' %s > "${TMP_DAEMON}"
+if [ ! -f "${DAEMON_JSON_PATH}" ] || ! cmp -s "${TMP_DAEMON}" "${DAEMON_JSON_PATH}"; then
+  CURRENT_DATA_ROOT="$(docker info -f '{{.DockerRootDir}}' 2>/dev/null || true)"
+  if [ -n "${CURRENT_DATA_ROOT}" ] && [ "${CURRENT_DATA_ROOT%%/}" != "${WANT_DATA_ROOT%%/}" ] &&
+    [ -n "$(docker ps -aq --filter label=talos.cluster.name 2>/dev/null || true)" ]; then
+    echo "docker.daemon.data_root moves Docker from ${CURRENT_DATA_ROOT} to ${WANT_DATA_ROOT}, which would orphan the Talos cluster containers; destroy the cluster first or keep the data root." >&2
+    rm -f "${TMP_DAEMON}"
+    exit 1
+  fi
+  if command -v dockerd >/dev/null 2>&1 && dockerd --help 2>/dev/null | grep -q -- '--validate'; then
+    if ! dockerd --validate --config-file "${TMP_DAEMON}" >/dev/null; then
+      echo "Rendered daemon.json is rejected by dockerd; check the docker.daemon section." >&2
+      rm -f "${TMP_DAEMON}"
+      exit 1
+    fi
+  fi
+  if [ -f "${DAEMON_JSON_PATH}" ]; then
+    diff -u "${DAEMON_JSON_PATH}" "${TMP_DAEMON}" || true
+  fi
+  install -d -m 0755 "$(dirname "${DAEMON_JSON_PATH}")"
+  install -m 0644 "${TMP_DAEMON}" "${DAEMON_JSON_PATH}"
+  DOCKER_RESTART=1
+  echo "Updated ${DAEMON_JSON_PATH}."
+fi
+rm -f "${TMP_DAEMON}"
+
+if [ "${DOCKER_RESTART:-0}" = "1" ] && systemctl is-active --quiet docker 2>/dev/null; then
+  stop_cluster_containers
+  systemctl restart docker
+  echo "Restarted Docker to apply daemon configuration."
+  restore_cluster_containers
+fi
+`, dockerDaemonConfigPath, dataRoot, heredocValue("DAEMONJSON", daemon)), nil
+}
@@ -4,38 +4,291 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"slices"
 	"strings"
 
 	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
 )
 
-func runOSHardening(ctx context.Context, logger *slog.Logger, cfg config.Config) error {
-	if !cfg.Hardening.Enabled {
-		logger.Info("os_hardening disabled by config")
-		return nil
+// hardeningPackages are installed by os_hardening when missing.
+const hardeningPackages = "openssh-server unattended-upgrades ufw ca-certificates curl"
+
+const (
+	sshDropInPath  = "/etc/ssh/sshd_config.d/99-talos-docker-bootstrap.conf"
+	sysctlConfPath = "/etc/sysctl.d/99-talos-docker-bootstrap.conf"
+)
+
+const baselineSysctls = `net.ipv4.conf.all.rp_filter=1
+net.ipv4.conf.default.rp_filter=1
+net.ipv4.tcp_syncookies=1
+kernel.kptr_restrict=2
+fs.protected_hardlinks=1
+fs.protected_symlinks=1`
+
+// strictSysctls are added by the strict profile. IP forwarding is left
+// alone because Docker needs it.
+const strictSysctls = `kernel.dmesg_restrict=1
+net.ipv4.conf.all.accept_redirects=0
+net.ipv4.conf.default.accept_redirects=0
+net.ipv4.conf.all.send_redirects=0
+net.ipv4.conf.all.accept_source_route=0
+net.ipv4.conf.all.log_martians=1
+net.ipv4.icmp_echo_ignore_broadcasts=1`
+
+// hardeningPackageList adds the packages of the enabled optional controls
+// to hardeningPackages.
+func hardeningPackageList(cfg config.Config) string {
+	pkgs := hardeningPackages
+	if cfg.Hardening.Fail2banEnabled() {
+		pkgs += " fail2ban python3-systemd"
+	}
+	if cfg.Hardening.AuditdEnabled() {
+		pkgs += " auditd"
 	}
+	if cfg.Hardening.AppArmorEnabled() {
+		pkgs += " apparmor"
+	}
+	return pkgs
+}
 
+// sshdDropIn renders the sshd_config drop-in written by os_hardening.
+func sshdDropIn(cfg config.Config) string {
+	h := cfg.Hardening
 	passwordAuth := "no"
-	if cfg.Hardening.AllowPasswordSSH {
+	if h.AllowPasswordSSH {
 		passwordAuth = "yes"
 	}
+	lines := []string{
+		"PermitRootLogin no",
+		"PasswordAuthentication " + passwordAuth,
+		"KbdInteractiveAuthentication no",
+		"ChallengeResponseAuthentication no",
+		"PubkeyAuthentication yes",
+	}
+	if h.Strict() {
+		lines = append(lines,
+			"X11Forwarding no",
+			"MaxAuthTries 3",
+			"LoginGraceTime 30",
+			"ClientAliveInterval 300",
+			"ClientAliveCountMax 2",
+		)
+	}
+	if len(h.SSHAllowUsers) > 0 {
+		lines = append(lines, "AllowUsers "+strings.Join(h.SSHAllowUsers, " "))
+	}
+	if len(h.SSHAllowGroups) > 0 {
+		lines = append(lines, "AllowGroups "+strings.Join(h.SSHAllowGroups, " "))
+	}
+	if h.LoginBanner != "" {
+		lines = append(lines, "Banner "+loginBannerSSHPath)
+	}
+	return strings.Join(lines, "\n")
+}
 
-	ports := make([]string, 0, len(cfg.Hardening.AllowTCPPorts))
-	for _, p := range cfg.Hardening.AllowTCPPorts {
-		ports = append(ports, fmt.Sprintf("%d", p))
+// sysctlConf renders the sysctl config written by os_hardening: the
+// profile's parameters, with hardening.sysctls overriding them in place and
+// the rest appended in key order.
+func sysctlConf(cfg config.Config) string {
+	lines := strings.Split(baselineSysctls, "\n")
+	if cfg.Hardening.Strict() {
+		lines = append(lines, strings.Split(strictSysctls, "\n")...)
+	}
+	extra := cfg.Hardening.Sysctls
+	seen := map[string]bool{}
+	for i, line := range lines {
+		k, _, _ := strings.Cut(line, "=")
+		seen[k] = true
+		if v, ok := extra[k]; ok {
+			lines[i] = k + "=" + strings.TrimSpace(v)
+		}
 	}
-	allowedPorts := strings.Join(ports, " ")
+	keys := make([]string, 0, len(extra))
+	for k := range extra {
+		if !seen[k] {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		lines = append(lines, k+"="+strings.TrimSpace(extra[k]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// hardeningUFW returns the "true"/"false" UFW switch and the UFW rules the
+// config asks for, one per line in the form ufw show added prints them.
+func hardeningUFW(cfg config.Config) (string, string) {
 	enableUFW := "false"
 	if cfg.Hardening.EnableUFW {
 		enableUFW = "true"
 	}
+	return enableUFW, strings.Join(ufwRuleCommands(cfg), "\n")
+}
+
+// ufwRuleCommands renders the configured firewall rules as ufw commands.
+// A port, protocol and source listed twice yields one rule, rate limited if
+// any of the entries asks for it.
+func ufwRuleCommands(cfg config.Config) []string {
+	type key struct{ port, proto, src string }
+	var (
+		order []key
+		limit = map[key]bool{}
+	)
+	for _, r := range cfg.Hardening.Rules() {
+		sources := r.Sources
+		if len(sources) == 0 {
+			sources = []string{""}
+		}
+		for _, src := range sources {
+			k := key{r.Port, r.Proto, src}
+			if _, seen := limit[k]; !seen {
+				order = append(order, k)
+			}
+			limit[k] = limit[k] || r.Limit
+		}
+	}
+	cmds := make([]string, 0, len(order))
+	for _, k := range order {
+		action := "allow"
+		if limit[k] {
+			action = "limit"
+		}
+		if k.src == "" {
+			cmds = append(cmds, fmt.Sprintf("ufw %s %s/%s", action, k.port, k.proto))
+		} else {
+			cmds = append(cmds, fmt.Sprintf("ufw %s from %s to any port %s proto %s", action, k.src, k.port, k.proto))
+		}
+	}
+	return cmds
+}
+
+// ufwRuleTag is the UFW comment on the rules this tool adds. Only tagged
+// rules are ever deleted, so rules added by hand stay in place.
+const ufwRuleTag = "talos-docker-bootstrap"
+
+// ufwRuleFuncs list the added UFW rules without their comments: ufw_added
+// every rule, ufw_tagged the ones this tool added.
+const ufwRuleFuncs = `
+UFW_TAG="` + ufwRuleTag + `"
+ufw_added() {
+  { ufw show added 2>/dev/null || true; } | grep '^ufw ' | sed "s/ comment '[^']*'\$//" || true
+}
+ufw_tagged() {
+  { ufw show added 2>/dev/null || true; } | grep "^ufw .* comment '${UFW_TAG}'\$" | sed "s/ comment '[^']*'\$//" || true
+}
+`
+
+// ufwConvergeScript adds the UFW rules in UFW_RULES that are missing, tagged
+// with UFW_TAG, and then deletes the tagged rules not in it, so the ruleset
+// follows the config and access is never narrower than both in between.
+const ufwConvergeScript = ufwRuleFuncs + `
+ADDED="$(ufw_added)"
+while IFS= read -r RULE; do
+  [ -n "${RULE}" ] || continue
+  if ! printf '%s\n' "${ADDED}" | grep -Fxq -- "${RULE}"; then
+    read -r -a ARGS <<< "${RULE#ufw }"
+    ufw "${ARGS[@]}" comment "${UFW_TAG}" >/dev/null
+    echo "Added UFW rule: ${RULE#ufw }"
+  fi
+done <<< "${UFW_RULES}"
+while IFS= read -r RULE; do
+  [ -n "${RULE}" ] || continue
+  if ! printf '%s\n' "${UFW_RULES}" | grep -Fxq -- "${RULE}"; then
+    read -r -a ARGS <<< "${RULE#ufw }"
+    ufw delete "${ARGS[@]}" >/dev/null
+    echo "Removed UFW rule: ${RULE#ufw }"
+  fi
+done <<< "$(ufw_tagged)"
+`
+
+const (
+	dockerUserScriptPath = "/usr/local/sbin/talos-docker-bootstrap-docker-user"
+	dockerUserUnitName   = "talos-docker-bootstrap-docker-user.service"
+	dockerUserUnitPath   = "/etc/systemd/system/" + dockerUserUnitName
+)
+
+// dockerUserUnit reapplies the DOCKER-USER rules whenever Docker starts, so
+// they survive reboots and daemon restarts.
+const dockerUserUnit = `[Unit]
+Description=Filter traffic to Docker-published ports (talos-docker-bootstrap)
+After=docker.service
+PartOf=docker.service
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=/bin/sh ` + dockerUserScriptPath + `
+ExecStop=-/usr/sbin/iptables -F DOCKER-USER
+ExecStop=-/usr/sbin/ip6tables -F DOCKER-USER
+
+[Install]
+WantedBy=docker.service`
+
+// dockerUserRules renders the script that rebuilds the DOCKER-USER chains of
+// iptables and ip6tables. Docker publishes ports with DNAT, so forwarded
+// traffic never reaches the UFW input rules; the chains filter it by the
+// original destination port. Container-originated and reply traffic passes,
+// new connections from outside are accepted only for the configured rules,
+// each source in the chain of its address family. Rate limits are not
+// carried over.
+func dockerUserRules(cfg config.Config) string {
+	var b strings.Builder
+	b.WriteString(`#!/bin/sh
+# Managed by talos-docker-bootstrap (hardening.filter_docker_ports).
+set -e
+`)
+	writeDockerUserChain(&b, cfg, "iptables", false)
+	b.WriteString("if command -v ip6tables >/dev/null 2>&1; then\n")
+	writeDockerUserChain(&b, cfg, "ip6tables", true)
+	b.WriteString("fi")
+	return b.String()
+}
+
+// writeDockerUserChain renders the DOCKER-USER chain of one address family.
+// A rule whose sources are all of the other family opens nothing here.
+func writeDockerUserChain(b *strings.Builder, cfg config.Config, cmd string, ipv6 bool) {
+	fmt.Fprintf(b, `%[1]s -N DOCKER-USER 2>/dev/null || true
+%[1]s -F DOCKER-USER
+%[1]s -A DOCKER-USER -m conntrack --ctstate RELATED,ESTABLISHED -j RETURN
+%[1]s -A DOCKER-USER -i docker0 -j RETURN
+%[1]s -A DOCKER-USER -i br-+ -j RETURN
+`, cmd)
+	for _, r := range cfg.Hardening.Rules() {
+		sources := []string{""}
+		if len(r.Sources) > 0 {
+			sources = nil
+			for _, src := range r.Sources {
+				if strings.Contains(src, ":") == ipv6 {
+					sources = append(sources, " -s "+src)
+				}
+			}
+		}
+		for _, src := range sources {
+			fmt.Fprintf(b, "%s -A DOCKER-USER -p %s%s -m conntrack --ctorigdstport %s -j RETURN\n", cmd, r.Proto, src, r.Port)
+		}
+	}
+	fmt.Fprintf(b, "%[1]s -A DOCKER-USER -o docker0 -j DROP\n%[1]s -A DOCKER-USER -o br-+ -j DROP\n", cmd)
+}
+
+func runOSHardening(ctx context.Context, logger *slog.Logger, cfg config.Config) error {
+	if !cfg.Hardening.Enabled {
+		logger.Info("os_hardening disabled by config")
+		return nil
+	}
+
+	enableUFW, allowRules := hardeningUFW(cfg)
+	proxySetup, err := proxySetupScript(cfg)
+	if err != nil {
+		return err
+	}
 
 	script := fmt.Sprintf(`#!/usr/bin/env bash
 set -euo pipefail
 export DEBIAN_FRONTEND=noninteractive
-
+%s
 MISSING=()
-for PKG in openssh-server unattended-upgrades ufw ca-certificates curl; do
+for PKG in %s; do
   if ! dpkg -s "$PKG" >/dev/null 2>&1; then
     MISSING+=("$PKG")
   fi
@@ -45,16 +298,12 @@ if [ "${#MISSING[@]}" -gt 0 ]; then
   apt-get update -y
   apt-get install -y --no-install-recommends "${MISSING[@]}"
 fi
-
+%s
 install -d -m 0755 /etc/ssh/sshd_config.d
-SSH_DROPIN=/etc/ssh/sshd_config.d/99-talos-docker-bootstrap.conf
+SSH_DROPIN=%s
 TMP_SSH="$(mktemp)"
 cat > "$TMP_SSH" <<'SSHCFG'
-PermitRootLogin no
-PasswordAuthentication %s
-KbdInteractiveAuthentication no
-ChallengeResponseAuthentication no
-PubkeyAuthentication yes
+%s
 SSHCFG
 if [ ! -f "$SSH_DROPIN" ] || ! cmp -s "$TMP_SSH" "$SSH_DROPIN"; then
   install -m 0644 "$TMP_SSH" "$SSH_DROPIN"
@@ -62,15 +311,10 @@ if [ ! -f "$SSH_DROPIN" ] || ! cmp -s "$TMP_SSH" "$SSH_DROPIN"; then
 fi
 rm -f "$TMP_SSH"
 
-SYSCTL_FILE=/etc/sysctl.d/99-talos-docker-bootstrap.conf
+SYSCTL_FILE=%s
 TMP_SYSCTL="$(mktemp)"
 cat > "$TMP_SYSCTL" <<'SYSCTL'
-net.ipv4.conf.all.rp_filter=1
-net.ipv4.conf.default.rp_filter=1
-net.ipv4.tcp_syncookies=1
-kernel.kptr_restrict=2
-fs.protected_hardlinks=1
-fs.protected_symlinks=1
+%s
 SYSCTL
 if [ ! -f "$SYSCTL_FILE" ] || ! cmp -s "$TMP_SYSCTL" "$SYSCTL_FILE"; then
   install -m 0644 "$TMP_SYSCTL" "$SYSCTL_FILE"
@@ -79,18 +323,41 @@ fi
 rm -f "$TMP_SYSCTL"
 
 systemctl enable --now unattended-upgrades
-
+%s
 if [ "%s" = "true" ]; then
   ufw --force default deny incoming >/dev/null
   ufw --force default allow outgoing >/dev/null
-  for PORT in %s; do
-    if ! ufw status | grep -Eq "^${PORT}/tcp[[:space:]]+ALLOW"; then
-      ufw allow "${PORT}/tcp" >/dev/null
-    fi
-  done
+  UFW_RULES=%s
+%s
   ufw --force enable >/dev/null
 fi
-`, passwordAuth, enableUFW, allowedPorts)
+
+if [ "%t" = "true" ]; then
+  FIREWALL_CHANGED=0
+  if converge_file %q %s; then FIREWALL_CHANGED=1; fi
+  if converge_file %q %s; then FIREWALL_CHANGED=1; fi
+  if [ "${FIREWALL_CHANGED}" = "1" ]; then
+    systemctl daemon-reload
+  fi
+  systemctl enable %s >/dev/null 2>&1
+  if systemctl is-active --quiet docker 2>/dev/null; then
+    if [ "${FIREWALL_CHANGED}" = "1" ] || ! systemctl is-active --quiet %s; then
+      systemctl restart %s
+      echo "Applied DOCKER-USER rules for published container ports."
+    fi
+  fi
+elif [ -e %q ]; then
+  systemctl disable --now %s >/dev/null 2>&1 || true
+  rm -f %q %q
+  systemctl daemon-reload
+  echo "Removed DOCKER-USER filtering."
+fi
+`, proxySetup, hardeningPackageList(cfg), loginBannerScript(cfg), sshDropInPath, sshdDropIn(cfg), sysctlConfPath, sysctlConf(cfg), hardeningControlsScript(cfg), enableUFW, heredocValue("UFWRULES", allowRules), ufwConvergeScript,
+		cfg.Hardening.FilterDockerPorts,
+		dockerUserScriptPath, heredocValue("DOCKERUSER", dockerUserRules(cfg)),
+		dockerUserUnitPath, heredocValue("DOCKERUSERUNIT", dockerUserUnit),
+		dockerUserUnitName, dockerUserUnitName, dockerUserUnitName,
+		dockerUserUnitPath, dockerUserUnitName, dockerUserUnitPath, dockerUserScriptPath)
 
 	return runRemoteScript(ctx, logger, cfg, "os_hardening", script)
 }
@@ -0,0 +1,198 @@
+package bootstrap
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
+)
+
+const (
+	loginBannerSSHPath     = "/etc/issue.net"
+	loginBannerConsolePath = "/etc/issue"
+	fail2banJailPath       = "/etc/fail2ban/jail.d/talos-docker-bootstrap.local"
+	auditdRulesPath        = "/etc/audit/rules.d/talos-docker-bootstrap.rules"
+	chronySourcesPath      = "/etc/chrony/sources.d/talos-docker-bootstrap.sources"
+	timesyncdConfPath      = "/etc/systemd/timesyncd.conf.d/talos-docker-bootstrap.conf"
+)
+
+// auditdRules watches the identity, privilege, SSH and Docker configuration
+// files for changes.
+const auditdRules = `-w /etc/passwd -p wa -k identity
+-w /etc/group -p wa -k identity
+-w /etc/shadow -p wa -k identity
+-w /etc/gshadow -p wa -k identity
+-w /etc/sudoers -p wa -k privilege
+-w /etc/sudoers.d/ -p wa -k privilege
+-w /etc/ssh/sshd_config -p wa -k sshd
+-w /etc/ssh/sshd_config.d/ -p wa -k sshd
+-w /etc/docker/ -p wa -k docker`
+
+// fail2banJail enables the sshd jail, reading the journal so it works
+// without rsyslog.
+func fail2banJail(cfg config.Config) string {
+	port := "ssh"
+	if cfg.VM.Port != 0 && cfg.VM.Port != 22 {
+		port = strconv.Itoa(cfg.VM.Port)
+	}
+	return `[sshd]
+enabled = true
+backend = systemd
+port = ` + port + `
+maxretry = 5
+findtime = 10m
+bantime = 1h`
+}
+
+// ntpConfs renders the chrony sources file and the timesyncd drop-in for
+// hardening.ntp_servers; both are empty when no servers are configured.
+func ntpConfs(cfg config.Config) (string, string) {
+	servers := cfg.Hardening.NTPServers
+	if len(servers) == 0 {
+		return "", ""
+	}
+	lines := make([]string, 0, len(servers))
+	for _, s := range servers {
+		lines = append(lines, "server "+s+" iburst")
+	}
+	return strings.Join(lines, "\n"), "[Time]\nNTP=" + strings.Join(servers, " ")
+}
+
+// optionalContent returns content when enabled, or "" so converge_file and
+// check_file remove the file.
+func optionalContent(enabled bool, content string) string {
+	if enabled {
+		return content
+	}
+	return ""
+}
+
+// loginBannerScript converges the login banner files. Without a banner they
+// are left as the distribution ships them. It runs before the sshd drop-in,
+// which points Banner at the file. It expects converge_file.
+func loginBannerScript(cfg config.Config) string {
+	if cfg.Hardening.LoginBanner == "" {
+		return ""
+	}
+	banner := heredocValue("BANNER", strings.TrimRight(cfg.Hardening.LoginBanner, "\n"))
+	return fmt.Sprintf(`
+if converge_file %q %s; then
+  echo "Updated login banner %s."
+fi
+if converge_file %q %s; then
+  echo "Updated login banner %s."
+fi
+`, loginBannerSSHPath, banner, loginBannerSSHPath, loginBannerConsolePath, banner, loginBannerConsolePath)
+}
+
+// hardeningControlsScript converges fail2ban, auditd, AppArmor and NTP. A
+// control that is turned off has its managed file removed; packages and
+// services are left installed. It expects converge_file.
+func hardeningControlsScript(cfg config.Config) string {
+	h := cfg.Hardening
+	chrony, timesyncd := ntpConfs(cfg)
+	return fmt.Sprintf(`
+FAIL2BAN_CHANGED=0
+if converge_file %q %s; then
+  FAIL2BAN_CHANGED=1
+  echo "Updated fail2ban sshd jail."
+fi
+# unit_failed reports a service that did not start with its recent journal,
+# as systemctl's own output says little about why.
+unit_failed() {
+  echo "$1 failed to start." >&2
+  journalctl -u "$1" -n 20 --no-pager >&2 || true
+  exit 1
+}
+if [ "%t" = "true" ]; then
+  systemctl enable --now fail2ban >/dev/null 2>&1 || unit_failed fail2ban
+  if [ "${FAIL2BAN_CHANGED}" = "1" ]; then
+    systemctl restart fail2ban || unit_failed fail2ban
+  fi
+elif [ "${FAIL2BAN_CHANGED}" = "1" ] && systemctl is-active --quiet fail2ban 2>/dev/null; then
+  systemctl restart fail2ban || unit_failed fail2ban
+fi
+
+if [ "%t" = "true" ]; then
+  systemctl enable --now auditd >/dev/null 2>&1 || unit_failed auditd
+fi
+if converge_file %q %s; then
+  if command -v augenrules >/dev/null 2>&1; then
+    augenrules --load >/dev/null
+  fi
+  echo "Updated auditd rules."
+fi
+
+if [ "%t" = "true" ]; then
+  systemctl enable --now apparmor >/dev/null 2>&1 || true
+  if [ "$(cat /sys/module/apparmor/parameters/enabled 2>/dev/null)" != "Y" ]; then
+    echo "AppArmor is not enabled in the kernel; boot with apparmor=1 security=apparmor or set hardening.apparmor: false." >&2
+    exit 1
+  fi
+  ENFORCED="$(aa-status --enforced 2>/dev/null || true)"
+  if [ "${ENFORCED:-0}" = "0" ]; then
+    echo "AppArmor has no profiles in enforce mode." >&2
+    exit 1
+  fi
+fi
+
+if dpkg -s chrony >/dev/null 2>&1; then
+  if converge_file %q %s; then
+    chronyc reload sources >/dev/null 2>&1 || systemctl restart chrony
+    echo "Updated chrony NTP servers."
+  fi
+elif converge_file %q %s; then
+  systemctl restart systemd-timesyncd
+  echo "Updated systemd-timesyncd NTP servers."
+fi
+if [ "%t" = "true" ]; then
+  timedatectl set-ntp true
+fi
+`, fail2banJailPath, heredocValue("FAIL2BAN", optionalContent(h.Fail2banEnabled(), fail2banJail(cfg))), h.Fail2banEnabled(),
+		h.AuditdEnabled(), auditdRulesPath, heredocValue("AUDITRULES", optionalContent(h.AuditdEnabled(), auditdRules)),
+		h.AppArmorEnabled(),
+		chronySourcesPath, heredocValue("CHRONY", chrony), timesyncdConfPath, heredocValue("TIMESYNCD", timesyncd),
+		len(h.NTPServers) > 0)
+}
+
+// hardeningControlsCheckScript prints a change line for every optional
+// control that differs from the config. It expects checkFileFunc.
+func hardeningControlsCheckScript(cfg config.Config) string {
+	h := cfg.Hardening
+	chrony, timesyncd := ntpConfs(cfg)
+	banner := ""
+	if h.LoginBanner != "" {
+		banner = fmt.Sprintf(`
+check_file %q %s "login banner"
+check_file %q %s "login banner"
+`, loginBannerSSHPath, heredocValue("BANNER", strings.TrimRight(h.LoginBanner, "\n")),
+			loginBannerConsolePath, heredocValue("BANNER", strings.TrimRight(h.LoginBanner, "\n")))
+	}
+	return banner + fmt.Sprintf(`
+check_file %q %s "fail2ban sshd jail"
+if [ "%t" = "true" ] && ! systemctl is-active --quiet fail2ban 2>/dev/null; then
+  echo "change: enable and start fail2ban"
+fi
+check_file %q %s "auditd rules"
+if [ "%t" = "true" ] && ! systemctl is-active --quiet auditd 2>/dev/null; then
+  echo "change: enable and start auditd"
+fi
+if [ "%t" = "true" ]; then
+  ENFORCED="$(aa-status --enforced 2>/dev/null || true)"
+  if [ "$(cat /sys/module/apparmor/parameters/enabled 2>/dev/null)" != "Y" ]; then
+    echo "change: enable AppArmor in the kernel (not enabled; needs a reboot)"
+  elif [ "${ENFORCED:-0}" = "0" ]; then
+    echo "change: load AppArmor profiles in enforce mode"
+  fi
+fi
+if dpkg -s chrony >/dev/null 2>&1; then
+  check_file %q %s "chrony NTP servers"
+else
+  check_file %q %s "systemd-timesyncd NTP servers"
+fi
+`, fail2banJailPath, heredocValue("FAIL2BAN", optionalContent(h.Fail2banEnabled(), fail2banJail(cfg))), h.Fail2banEnabled(),
+		auditdRulesPath, heredocValue("AUDITRULES", optionalContent(h.AuditdEnabled(), auditdRules)), h.AuditdEnabled(),
+		h.AppArmorEnabled(),
+		chronySourcesPath, heredocValue("CHRONY", chrony), timesyncdConfPath, heredocValue("TIMESYNCD", timesyncd))
+}
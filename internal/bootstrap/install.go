@@ -13,27 +13,118 @@ import (
 var sshRunScriptFn = ssh.RunScript
 var sshRunCommandFn = ssh.RunCommand
 
-func runDockerInstall(ctx context.Context, logger *slog.Logger, cfg config.Config) error {
-	script := fmt.Sprintf(`#!/usr/bin/env bash
-set -euo pipefail
-export DEBIAN_FRONTEND=noninteractive
+// dockerPackages are the packages docker_install installs and holds.
+const dockerPackages = "docker-ce docker-ce-cli containerd.io docker-buildx-plugin docker-compose-plugin"
+
+// dockerUpgradeFuncs defines the helpers that change an installed Docker,
+// its version or its daemon configuration, without leaving the cluster down:
+// the Talos node containers are stopped before the change and started again,
+// and checked, afterwards. The stopped container IDs are kept in a state
+// file so a run that failed in between starts them on the next attempt.
+// Expects TARGET_USER, CLUSTER_NAME and STATE_DIR.
+const dockerUpgradeFuncs = `
+DOCKER_PACKAGES="` + dockerPackages + `"
+STOPPED_CONTAINERS_FILE=/var/lib/talos-docker-bootstrap/docker-upgrade-stopped-containers
+
+prepare_docker_change() {
+  if ! command -v docker >/dev/null 2>&1; then
+    return 0
+  fi
+  echo "Docker ${CURRENT:-unknown} -> ${TARGET_DOCKER_VERSION}: unholding packages and stopping cluster containers."
+  apt-mark unhold ${DOCKER_PACKAGES} >/dev/null || true
+  stop_cluster_containers
+}
 
-TARGET_DOCKER_VERSION="%s"
-TARGET_USER="%s"
+stop_cluster_containers() {
+  local ids
+  ids="$(docker ps -q --filter "label=talos.cluster.name=${CLUSTER_NAME}" 2>/dev/null || true)"
+  if [ -n "${ids}" ]; then
+    install -d -m 0755 "$(dirname "${STOPPED_CONTAINERS_FILE}")"
+    printf '%s\n' ${ids} >> "${STOPPED_CONTAINERS_FILE}"
+    docker stop --time 60 ${ids} >/dev/null
+    echo "Stopped cluster containers: $(echo ${ids})"
+  fi
+}
+
+restore_cluster_containers() {
+  if [ ! -s "${STOPPED_CONTAINERS_FILE}" ]; then
+    return 0
+  fi
+  local ids node_ip
+  ids="$(sort -u "${STOPPED_CONTAINERS_FILE}")"
+  docker start ${ids} >/dev/null
+  echo "Started cluster containers: $(echo ${ids})"
+  node_ip="$(sudo -n -u "${TARGET_USER}" -H env CLUSTER_NAME="${CLUSTER_NAME}" STATE_DIR="${STATE_DIR}" bash -lc 'talosctl cluster --name "${CLUSTER_NAME}" --state "${STATE_DIR}" show --provisioner docker 2>/dev/null' | awk 'tolower($2) ~ /controlplane/ {print $3; exit}' || true)"
+  if [ -n "${node_ip}" ] && [ -s "${STATE_DIR}/talosconfig" ]; then
+    if ! sudo -n -u "${TARGET_USER}" -H env TALOSCONFIG="${STATE_DIR}/talosconfig" NODE_IP="${node_ip}" bash -lc 'timeout 330s talosctl --talosconfig "${TALOSCONFIG}" --nodes "${NODE_IP}" --endpoints "${NODE_IP}" health --wait-timeout 5m --server=false'; then
+      echo "Cluster ${CLUSTER_NAME} is not healthy after the Docker change." >&2
+      exit 1
+    fi
+    echo "Cluster ${CLUSTER_NAME} is healthy."
+  fi
+  rm -f "${STOPPED_CONTAINERS_FILE}"
+}
+`
 
+// dockerAtTargetScript exits early when Docker is already at
+// TARGET_DOCKER_VERSION, after making sure the service and group are set up
+// and restoring cluster containers a failed earlier change left stopped.
+const dockerAtTargetScript = `
 if command -v docker >/dev/null 2>&1; then
   CURRENT="$(docker --version | sed -n 's/^Docker version \([^,]*\),.*/\1/p')"
   if [ "${CURRENT}" = "${TARGET_DOCKER_VERSION}" ]; then
+    apt-mark hold ${DOCKER_PACKAGES} >/dev/null || true
     systemctl enable --now docker >/dev/null
     if ! id -nG "${TARGET_USER}" | tr ' ' '\n' | grep -qx docker; then
       usermod -aG docker "${TARGET_USER}"
       echo "Added ${TARGET_USER} to docker group."
     fi
+    restore_cluster_containers
     echo "Docker already at target version: ${CURRENT}"
     exit 0
   fi
 fi
+`
+
+// dockerFinishScript runs after the Docker packages are installed.
+const dockerFinishScript = `
+apt-mark hold ${DOCKER_PACKAGES} >/dev/null || true
+systemctl enable --now docker >/dev/null
+
+if ! id -nG "${TARGET_USER}" | tr ' ' '\n' | grep -qx docker; then
+  usermod -aG docker "${TARGET_USER}"
+  echo "Added ${TARGET_USER} to docker group."
+fi
+
+INSTALLED="$(docker --version | sed -n 's/^Docker version \([^,]*\),.*/\1/p')"
+if [ "${INSTALLED}" != "${TARGET_DOCKER_VERSION}" ]; then
+  echo "Docker version mismatch after install (got ${INSTALLED}, expected ${TARGET_DOCKER_VERSION})" >&2
+  exit 1
+fi
+restore_cluster_containers
+`
 
+func runDockerInstall(ctx context.Context, logger *slog.Logger, cfg config.Config) error {
+	if cfg.Offline.Enabled {
+		return runDockerInstallOffline(ctx, logger, cfg)
+	}
+	proxySetup, err := proxySetupScript(cfg)
+	if err != nil {
+		return err
+	}
+	dockerConfig, err := dockerConfigScript(cfg)
+	if err != nil {
+		return err
+	}
+	script := fmt.Sprintf(`#!/usr/bin/env bash
+set -euo pipefail
+export DEBIAN_FRONTEND=noninteractive
+
+TARGET_DOCKER_VERSION="%s"
+TARGET_USER="%s"
+CLUSTER_NAME=%q
+STATE_DIR=%q
+%s%s%s%s
 apt-get update -y
 apt-get install -y --no-install-recommends ca-certificates curl gnupg lsb-release
 
@@ -57,46 +148,44 @@ if [ -z "${DOCKER_PKG_VER}" ]; then
   exit 1
 fi
 
-apt-get install -y --no-install-recommends \
+prepare_docker_change
+apt-get install -y --no-install-recommends --allow-downgrades --allow-change-held-packages \
   docker-ce="${DOCKER_PKG_VER}" \
   docker-ce-cli="${DOCKER_PKG_VER}" \
   containerd.io \
   docker-buildx-plugin \
   docker-compose-plugin
 
-apt-mark hold docker-ce docker-ce-cli containerd.io docker-buildx-plugin docker-compose-plugin >/dev/null || true
-systemctl enable --now docker >/dev/null
-
-if ! id -nG "${TARGET_USER}" | tr ' ' '\n' | grep -qx docker; then
-  usermod -aG docker "${TARGET_USER}"
-  echo "Added ${TARGET_USER} to docker group."
-fi
-
-INSTALLED="$(docker --version | sed -n 's/^Docker version \([^,]*\),.*/\1/p')"
-if [ "${INSTALLED}" != "${TARGET_DOCKER_VERSION}" ]; then
-  echo "Docker version mismatch after install (got ${INSTALLED}, expected ${TARGET_DOCKER_VERSION})" >&2
-  exit 1
-fi
-`, cfg.Docker.Version, cfg.VM.User)
+%s`, cfg.Docker.Version, cfg.VM.User, cfg.Cluster.Name, cfg.Cluster.StateDir, proxySetup, dockerUpgradeFuncs, dockerConfig, dockerAtTargetScript, dockerFinishScript)
 
 	return runRemoteScript(ctx, logger, cfg, "docker_install", script)
 }
 
 func runTalosctlInstall(ctx context.Context, logger *slog.Logger, cfg config.Config) error {
+	if cfg.Offline.Enabled {
+		return runTalosctlInstallOffline(ctx, logger, cfg)
+	}
+	proxySetup, err := proxySetupScript(cfg)
+	if err != nil {
+		return err
+	}
 	script := fmt.Sprintf(`#!/usr/bin/env bash
 set -euo pipefail
-
+%s
 TARGET_TALOS_VERSION="%s"
-TARGET_SHA256="%s"
 ARCH="$(dpkg --print-architecture)"
 case "${ARCH}" in
-  amd64) BIN="talosctl-linux-amd64" ;;
-  arm64) BIN="talosctl-linux-arm64" ;;
+  amd64) BIN="talosctl-linux-amd64"; TARGET_SHA256="%s" ;;
+  arm64) BIN="talosctl-linux-arm64"; TARGET_SHA256="%s" ;;
   *)
     echo "Unsupported architecture for talosctl: ${ARCH}" >&2
     exit 1
     ;;
 esac
+if [ -z "${TARGET_SHA256}" ]; then
+  echo "No talosctl checksum configured for ${ARCH}; set talos.sha256_checksums.${ARCH}" >&2
+  exit 1
+fi
 URL="https://github.com/siderolabs/talos/releases/download/v${TARGET_TALOS_VERSION}/${BIN}"
 
 current_talos_version() {
@@ -131,25 +220,13 @@ if [ "${INSTALLED}" != "${TARGET_TALOS_VERSION}" ]; then
   echo "talosctl version mismatch after install (got ${INSTALLED}, expected ${TARGET_TALOS_VERSION})" >&2
   exit 1
 fi
-`, cfg.Talos.Version, strings.ToLower(cfg.Talos.SHA256Checksum))
+`, proxySetup, cfg.Talos.Version, cfg.Talos.ChecksumFor("amd64"), cfg.Talos.ChecksumFor("arm64"))
 
 	return runRemoteScript(ctx, logger, cfg, "talosctl_install", script)
 }
 
 func runRemoteScript(ctx context.Context, logger *slog.Logger, cfg config.Config, stepName, script string) error {
-	sshCfg := ssh.ExecConfig{
-		Host:                  cfg.VM.Host,
-		Port:                  cfg.VM.Port,
-		User:                  cfg.VM.User,
-		PrivateKeyPath:        cfg.VM.SSHPrivateKey,
-		KnownHostsFile:        cfg.VM.KnownHostsFile,
-		KnownHostsMode:        cfg.VM.KnownHostsMode,
-		ExpectedHostKeySHA256: cfg.VM.SSHHostFingerprint,
-		Prompt:                knownHostsPromptFn,
-		ConnectTimeout:        cfg.Timeouts.SSHConnectDuration(),
-	}
-
-	stdout, stderr, err := sshRunScriptFn(ctx, sshCfg, script)
+	stdout, stderr, err := sshRunScriptFn(ctx, execConfig(cfg), script)
 	if stdout != "" {
 		logger.Debug(stepName+" stdout", "output", strings.TrimSpace(stdout))
 	}
@@ -0,0 +1,126 @@
+package bootstrap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/infrakit-io/talos-docker-bootstrap/pkg/model"
+)
+
+// journalVersion is bumped when the journal format or the meaning of the
+// step input hashes changes, so older journals are ignored on --resume.
+const journalVersion = 1
+
+// Journal records the outcome of each bootstrap step for one VM and cluster,
+// so a later run with Options.Resume can skip steps that already succeeded
+// with the same inputs.
+type Journal struct {
+	Version   int                     `json:"version"`
+	VMHost    string                  `json:"vm_host"`
+	Cluster   string                  `json:"cluster"`
+	UpdatedAt time.Time               `json:"updated_at"`
+	Steps     map[string]JournalEntry `json:"steps"`
+}
+
+// JournalEntry is the last recorded outcome of one step.
+type JournalEntry struct {
+	Status     model.StepStatus `json:"status"`
+	InputsHash string           `json:"inputs_hash"`
+	FinishedAt time.Time        `json:"finished_at"`
+}
+
+var journalNameRE = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// DefaultJournalDir returns the local directory holding run journals:
+// $XDG_STATE_HOME/talos-docker-bootstrap/journal, falling back to
+// ~/.local/state.
+func DefaultJournalDir() string {
+	base := strings.TrimSpace(os.Getenv("XDG_STATE_HOME"))
+	if base == "" {
+		home, err := os.UserHomeDir()
+		if err != nil || home == "" {
+			return ""
+		}
+		base = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(base, "talos-docker-bootstrap", "journal")
+}
+
+// JournalPath returns the journal file for host and cluster inside dir.
+func JournalPath(dir, host, cluster string) string {
+	name := journalNameRE.ReplaceAllString(strings.TrimSpace(host), "_") + "_" +
+		journalNameRE.ReplaceAllString(strings.TrimSpace(cluster), "_") + ".json"
+	return filepath.Join(dir, name)
+}
+
+// loadJournal reads the journal at path. A missing file, or one written by
+// an incompatible version, yields an empty journal.
+func loadJournal(path, host, cluster string) (Journal, error) {
+	j := Journal{Version: journalVersion, VMHost: host, Cluster: cluster, Steps: map[string]JournalEntry{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return j, nil
+	}
+	if err != nil {
+		return j, fmt.Errorf("read run journal %s: %w", path, err)
+	}
+	var stored Journal
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return j, fmt.Errorf("parse run journal %s: %w", path, err)
+	}
+	if stored.Version != journalVersion || stored.Steps == nil {
+		return j, nil
+	}
+	return stored, nil
+}
+
+func (j *Journal) save(path string) error {
+	j.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode run journal: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("create run journal dir: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("write run journal %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("replace run journal %s: %w", path, err)
+	}
+	return nil
+}
+
+func (j *Journal) record(step string, status model.StepStatus, inputsHash string) {
+	j.Steps[step] = JournalEntry{Status: status, InputsHash: inputsHash, FinishedAt: time.Now().UTC()}
+}
+
+// succeededWith reports whether step last succeeded with the given inputs.
+func (j *Journal) succeededWith(step, inputsHash string) bool {
+	e, ok := j.Steps[step]
+	return ok && inputsHash != "" && e.Status == model.StepStatusSuccess && e.InputsHash == inputsHash
+}
+
+// hashStepInputs returns a stable digest of a step's inputs. Steps without
+// inputs return "" and are never skipped.
+func hashStepInputs(step string, inputs any) string {
+	if inputs == nil {
+		return ""
+	}
+	data, err := json.Marshal(inputs)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(append([]byte(step+"\x00"), data...))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,594 @@
+package bootstrap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/ssh"
+)
+
+// In offline mode the VM never downloads anything: artifacts are resolved
+// into cfg.Offline.CacheDir on this machine, verified there, uploaded under
+// remoteArtifactDir and installed from it.
+const remoteArtifactDir = "/var/cache/talos-docker-bootstrap"
+
+var (
+	dockerRepoURL      = "https://download.docker.com/linux/ubuntu"
+	talosReleaseURLFmt = "https://github.com/siderolabs/talos/releases/download/v%s/%s"
+	offlineHTTPClient  = &http.Client{Timeout: 15 * time.Minute}
+	sshUploadFn        = ssh.Upload
+	dockerImageSaveFn  = dockerImageSave
+)
+
+// dockerDebPackages are installed from .deb files in offline mode.
+// docker-ce and docker-ce-cli are pinned to docker.version; the others use
+// the newest version the repository index lists.
+var dockerDebPackages = []string{"docker-ce", "docker-ce-cli", "containerd.io", "docker-buildx-plugin", "docker-compose-plugin"}
+
+var imageFileNameRE = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// artifact is a verified file in the local cache.
+type artifact struct {
+	local  string
+	sha256 string
+}
+
+// vmPlatform selects which packages and binaries match the VM.
+type vmPlatform struct {
+	codename string
+	arch     string
+}
+
+func runDockerInstallOffline(ctx context.Context, logger *slog.Logger, cfg config.Config) error {
+	if current := remoteDockerVersion(ctx, cfg); current == cfg.Docker.Version {
+		// Nothing to upload; the script only checks service and group.
+		script, err := dockerOfflineScript(cfg, "", nil)
+		if err != nil {
+			return err
+		}
+		return runRemoteScript(ctx, logger, cfg, "docker_install", script)
+	}
+	platform, err := detectPlatform(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	debs, deps, err := resolveDockerDebs(ctx, logger, cfg, platform)
+	if err != nil {
+		return err
+	}
+	missing, err := missingDebs(ctx, cfg, deps)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the VM lacks packages the Docker packages depend on, which offline mode cannot download: %s; install them on the VM first", strings.Join(missing, ", "))
+	}
+	dir := path.Join(remoteArtifactDir, "docker")
+	if err := pushArtifacts(ctx, logger, cfg, dir, debs, 0o644); err != nil {
+		return err
+	}
+	script, err := dockerOfflineScript(cfg, dir, debs)
+	if err != nil {
+		return err
+	}
+	return runRemoteScript(ctx, logger, cfg, "docker_install", script)
+}
+
+func dockerOfflineScript(cfg config.Config, dir string, debs []artifact) (string, error) {
+	proxySetup, err := proxySetupScript(cfg)
+	if err != nil {
+		return "", err
+	}
+	dockerConfig, err := dockerConfigScript(cfg)
+	if err != nil {
+		return "", err
+	}
+	var files []string
+	for _, d := range debs {
+		files = append(files, "./"+filepath.Base(d.local))
+	}
+	return fmt.Sprintf(`#!/usr/bin/env bash
+set -euo pipefail
+export DEBIAN_FRONTEND=noninteractive
+
+TARGET_DOCKER_VERSION="%s"
+TARGET_USER="%s"
+CLUSTER_NAME=%q
+STATE_DIR=%q
+%s%s%s%s
+cd %q
+sha256sum -c --quiet <<'SUMS'
+%sSUMS
+prepare_docker_change
+apt-get install -y --no-install-recommends --no-download --allow-downgrades --allow-change-held-packages %s
+%s`, cfg.Docker.Version, cfg.VM.User, cfg.Cluster.Name, cfg.Cluster.StateDir, proxySetup, dockerUpgradeFuncs, dockerConfig, dockerAtTargetScript, dir, checksumList(debs), strings.Join(files, " "), dockerFinishScript), nil
+}
+
+func runTalosctlInstallOffline(ctx context.Context, logger *slog.Logger, cfg config.Config) error {
+	if current := remoteTalosctlVersion(ctx, cfg); current == cfg.Talos.Version {
+		stepNote(ctx, "talosctl already at target version: "+current)
+		return nil
+	}
+	platform, err := detectPlatform(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	bin, err := resolveTalosctl(ctx, logger, cfg, platform)
+	if err != nil {
+		return err
+	}
+	dir := path.Join(remoteArtifactDir, "talosctl", "v"+cfg.Talos.Version)
+	if err := pushArtifacts(ctx, logger, cfg, dir, []artifact{bin}, 0o755); err != nil {
+		return err
+	}
+	script := fmt.Sprintf(`#!/usr/bin/env bash
+set -euo pipefail
+
+TARGET_TALOS_VERSION=%q
+TARGET_SHA256=%q
+BIN_PATH=%q
+
+if ! echo "${TARGET_SHA256}  ${BIN_PATH}" | sha256sum -c - >/dev/null; then
+  echo "talosctl checksum verification failed on the VM for ${BIN_PATH}" >&2
+  exit 1
+fi
+install -m 0755 "${BIN_PATH}" /usr/local/bin/talosctl
+
+INSTALLED="$(talosctl version --client 2>/dev/null | grep -Eo 'v[0-9]+\.[0-9]+\.[0-9]+([.-][0-9A-Za-z]+)?' | head -n1 | sed 's/^v//' || true)"
+if [ "${INSTALLED}" != "${TARGET_TALOS_VERSION}" ]; then
+  echo "talosctl version mismatch after install (got ${INSTALLED}, expected ${TARGET_TALOS_VERSION})" >&2
+  exit 1
+fi
+`, cfg.Talos.Version, bin.sha256, path.Join(dir, filepath.Base(bin.local)))
+
+	return runRemoteScript(ctx, logger, cfg, "talosctl_install", script)
+}
+
+// loadOfflineImages makes the offline images available on the VM: the Talos
+// node image and the registry are loaded into Docker, and the images the
+// nodes pull are pushed into the offline registry. Images already there are
+// not uploaded again. It returns the node images, for offlineRegistryPatch.
+func loadOfflineImages(ctx context.Context, logger *slog.Logger, cfg config.Config) ([]string, error) {
+	nodes, err := remoteNodeImages(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		platform vmPlatform
+		tars     []artifact
+		pushes   []string
+	)
+	resolve := func(ref string) error {
+		if _, _, err := sshRunCommandFn(ctx, execConfig(cfg), fmt.Sprintf("sudo -n docker image inspect %q >/dev/null 2>&1", ref)); err == nil {
+			stepNote(ctx, "image already loaded: "+ref)
+			return nil
+		}
+		if platform.arch == "" {
+			p, err := detectPlatform(ctx, cfg)
+			if err != nil {
+				return err
+			}
+			platform = p
+		}
+		tar, err := resolveImage(ctx, logger, cfg, platform, ref)
+		if err != nil {
+			return err
+		}
+		tars = append(tars, tar)
+		return nil
+	}
+	for _, ref := range offlineImages(cfg) {
+		if err := resolve(ref); err != nil {
+			return nil, err
+		}
+	}
+	for _, ref := range nodes {
+		if offlineRegistryHas(ctx, cfg, ref) {
+			stepNote(ctx, "image already in the offline registry: "+ref)
+			continue
+		}
+		if err := resolve(ref); err != nil {
+			return nil, err
+		}
+		pushes = append(pushes, ref)
+	}
+	dir := path.Join(remoteArtifactDir, "images")
+	if err := pushArtifacts(ctx, logger, cfg, dir, tars, 0o644); err != nil {
+		return nil, err
+	}
+	load := ""
+	if len(tars) > 0 {
+		var loads []string
+		for _, t := range tars {
+			loads = append(loads, fmt.Sprintf("docker load -i %q", "./"+filepath.Base(t.local)))
+		}
+		load = fmt.Sprintf(`
+cd %q
+sha256sum -c --quiet <<'SUMS'
+%sSUMS
+%s
+`, dir, checksumList(tars), strings.Join(loads, "\n"))
+	}
+	script := "#!/usr/bin/env bash\nset -euo pipefail\n" + load + offlineRegistryScript(pushes)
+
+	if err := runRemoteScript(ctx, logger, cfg, "cluster_create", script); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// offlineImages lists the images loaded into the VM's Docker in offline
+// mode: the Talos node image and the offline registry.
+func offlineImages(cfg config.Config) []string {
+	return []string{cfg.TalosNodeImage(), offlineRegistryImage}
+}
+
+func detectPlatform(ctx context.Context, cfg config.Config) (vmPlatform, error) {
+	out, _, err := sshRunCommandFn(ctx, execConfig(cfg), `. /etc/os-release && printf '%s %s\n' "${VERSION_CODENAME}" "$(dpkg --print-architecture)"`)
+	if err != nil {
+		return vmPlatform{}, fmt.Errorf("detect VM platform: %w", err)
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return vmPlatform{}, fmt.Errorf("detect VM platform: unexpected output %q", strings.TrimSpace(out))
+	}
+	return vmPlatform{codename: fields[0], arch: fields[1]}, nil
+}
+
+func remoteDockerVersion(ctx context.Context, cfg config.Config) string {
+	out, _, err := sshRunCommandFn(ctx, execConfig(cfg), `docker --version 2>/dev/null | sed -n 's/^Docker version \([^,]*\),.*/\1/p'`)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(out)
+}
+
+func remoteTalosctlVersion(ctx context.Context, cfg config.Config) string {
+	out, _, err := sshRunCommandFn(ctx, execConfig(cfg), `talosctl version --client 2>/dev/null | grep -Eo 'v[0-9]+\.[0-9]+\.[0-9]+([.-][0-9A-Za-z]+)?' | head -n1 | sed 's/^v//'`)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(out)
+}
+
+// resolveDockerDebs returns the cached .deb files for the VM's release and
+// architecture, and the dependencies they need from the VM. Their checksums
+// come from the repository's Packages index, which is only used after
+// readDockerIndex checked it against the signed InRelease file. Both are
+// cached next to them so later runs can verify without network.
+func resolveDockerDebs(ctx context.Context, logger *slog.Logger, cfg config.Config, p vmPlatform) ([]artifact, [][]string, error) {
+	files := dockerRepoCache(cfg, p)
+	if cfg.Offline.Fetch {
+		warn := func(path string, err error) {
+			logger.Warn("using cached docker repository metadata", "path", path, "error", err)
+		}
+		if err := fetchDockerRepoFiles(ctx, warn, files, p); err != nil {
+			return nil, nil, err
+		}
+	}
+	index, err := readDockerIndex(files, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	selected, err := selectDockerDebs(cfg, parseDebIndex(index), p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var debs []artifact
+	for _, e := range selected {
+		local := filepath.Join(filepath.Dir(files.packages), path.Base(e.filename))
+		if err := ensureCachedFile(ctx, cfg, dockerRepoURL+"/"+e.filename, local, e.sha256); err != nil {
+			return nil, nil, err
+		}
+		debs = append(debs, artifact{local: local, sha256: e.sha256})
+	}
+	return debs, debDependencies(selected), nil
+}
+
+// selectDockerDebs picks the index entries of dockerDebPackages.
+func selectDockerDebs(cfg config.Config, entries []debEntry, p vmPlatform) ([]debEntry, error) {
+	var selected []debEntry
+	for _, pkg := range dockerDebPackages {
+		prefix := ""
+		if pkg == "docker-ce" || pkg == "docker-ce-cli" {
+			prefix = "5:" + cfg.Docker.Version + "-"
+		}
+		e, ok := pickDebEntry(entries, pkg, prefix)
+		if !ok {
+			return nil, fmt.Errorf("%s %s not found in the Docker repository index for %s/%s", pkg, cfg.Docker.Version, p.codename, p.arch)
+		}
+		selected = append(selected, e)
+	}
+	return selected, nil
+}
+
+func resolveTalosctl(ctx context.Context, _ *slog.Logger, cfg config.Config, p vmPlatform) (artifact, error) {
+	sum := cfg.Talos.ChecksumFor(p.arch)
+	if sum == "" {
+		return artifact{}, fmt.Errorf("no talosctl checksum configured for %s; set talos.sha256_checksums.%s", p.arch, p.arch)
+	}
+	bin := "talosctl-linux-" + p.arch
+	local := filepath.Join(cfg.Offline.CacheDir, "talosctl", "v"+cfg.Talos.Version, bin)
+	if err := ensureCachedFile(ctx, cfg, fmt.Sprintf(talosReleaseURLFmt, cfg.Talos.Version, bin), local, sum); err != nil {
+		return artifact{}, err
+	}
+	return artifact{local: local, sha256: sum}, nil
+}
+
+// resolveImage returns the cached tarball of ref for the VM architecture.
+// Saved images are not reproducible, so the checksum recorded when the
+// tarball was created (in a .sha256 file next to it) is what gets verified.
+func resolveImage(ctx context.Context, _ *slog.Logger, cfg config.Config, p vmPlatform, ref string) (artifact, error) {
+	local := filepath.Join(cfg.Offline.CacheDir, "images", p.arch, imageFileNameRE.ReplaceAllString(ref, "_")+".tar")
+	sumPath := local + ".sha256"
+	if recorded, err := os.ReadFile(sumPath); err == nil {
+		want := strings.TrimSpace(string(recorded))
+		got, err := fileSHA256(local)
+		if err != nil {
+			return artifact{}, fmt.Errorf("read cached image %s: %w", local, err)
+		}
+		if got != want {
+			return artifact{}, fmt.Errorf("cached image %s does not match its recorded checksum; delete it to fetch again", local)
+		}
+		return artifact{local: local, sha256: want}, nil
+	}
+	if !cfg.Offline.Fetch {
+		return artifact{}, fmt.Errorf("image %s not in offline cache (%s); enable offline.fetch or save it there with a .sha256 file", ref, local)
+	}
+	stepNote(ctx, "saving image "+ref+" for linux/"+p.arch)
+	if err := os.MkdirAll(filepath.Dir(local), 0o755); err != nil {
+		return artifact{}, fmt.Errorf("create offline cache dir: %w", err)
+	}
+	if err := dockerImageSaveFn(ctx, ref, "linux/"+p.arch, local); err != nil {
+		return artifact{}, err
+	}
+	sum, err := fileSHA256(local)
+	if err != nil {
+		return artifact{}, err
+	}
+	if err := os.WriteFile(sumPath, []byte(sum+"\n"), 0o644); err != nil {
+		return artifact{}, fmt.Errorf("record image checksum: %w", err)
+	}
+	return artifact{local: local, sha256: sum}, nil
+}
+
+// dockerImageSave pulls ref for platform with the local Docker and saves it
+// to dst.
+func dockerImageSave(ctx context.Context, ref, platform, dst string) error {
+	if out, err := exec.CommandContext(ctx, "docker", "pull", "--platform", platform, ref).CombinedOutput(); err != nil {
+		return fmt.Errorf("docker pull %s: %w: %s", ref, err, strings.TrimSpace(string(out)))
+	}
+	tmp := dst + ".part"
+	if out, err := exec.CommandContext(ctx, "docker", "save", "-o", tmp, ref).CombinedOutput(); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("docker save %s: %w: %s", ref, err, strings.TrimSpace(string(out)))
+	}
+	return os.Rename(tmp, dst)
+}
+
+// ensureCachedFile makes sure local exists with checksum sum, downloading it
+// from url when it is missing or stale and offline.fetch allows it.
+func ensureCachedFile(ctx context.Context, cfg config.Config, url, local, sum string) error {
+	sum = strings.ToLower(sum)
+	if got, err := fileSHA256(local); err == nil && got == sum {
+		return nil
+	}
+	if !cfg.Offline.Fetch {
+		return fmt.Errorf("%s missing from offline cache or checksum mismatch; enable offline.fetch or place a verified copy there", local)
+	}
+	stepNote(ctx, "fetching "+url)
+	if err := downloadFile(ctx, url, local); err != nil {
+		return err
+	}
+	got, err := fileSHA256(local)
+	if err != nil {
+		return err
+	}
+	if got != sum {
+		_ = os.Remove(local)
+		return fmt.Errorf("checksum mismatch for %s (got %s, expected %s)", url, got, sum)
+	}
+	return nil
+}
+
+func downloadFile(ctx context.Context, url, dst string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := offlineHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("download %s: %w", url, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download %s: %s", url, resp.Status)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return fmt.Errorf("create offline cache dir: %w", err)
+	}
+	tmp := dst + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", tmp, err)
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return fmt.Errorf("download %s: %w", url, err)
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("write %s: %w", tmp, err)
+	}
+	return os.Rename(tmp, dst)
+}
+
+// pushArtifacts uploads artifacts into dir on the VM, skipping files the VM
+// already has with the same checksum.
+func pushArtifacts(ctx context.Context, logger *slog.Logger, cfg config.Config, dir string, arts []artifact, mode os.FileMode) error {
+	for _, a := range arts {
+		remote := path.Join(dir, filepath.Base(a.local))
+		out, _, _ := sshRunCommandFn(ctx, execConfig(cfg), fmt.Sprintf("sudo -n sha256sum %q 2>/dev/null || true", remote))
+		if fields := strings.Fields(out); len(fields) > 0 && fields[0] == a.sha256 {
+			logger.Debug("artifact already on VM", "path", remote)
+			continue
+		}
+		stepNote(ctx, "uploading "+filepath.Base(a.local))
+		if err := sshUploadFn(ctx, execConfig(cfg), a.local, remote, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checksumList(arts []artifact) string {
+	var b strings.Builder
+	for _, a := range arts {
+		fmt.Fprintf(&b, "%s  %s\n", a.sha256, filepath.Base(a.local))
+	}
+	return b.String()
+}
+
+func fileSHA256(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// stepNote reports local progress through the step's output stream, so it
+// shows up alongside remote output.
+func stepNote(ctx context.Context, msg string) {
+	if fn := ssh.OutputFromContext(ctx); fn != nil {
+		fn(ssh.StreamStdout, msg)
+	}
+}
+
+type debEntry struct {
+	pkg      string
+	version  string
+	filename string
+	sha256   string
+	// depends holds the Depends and Pre-Depends fields, one entry per
+	// comma-separated dependency.
+	depends []string
+}
+
+// parseDebIndex reads an APT Packages index.
+func parseDebIndex(data []byte) []debEntry {
+	var (
+		entries []debEntry
+		cur     debEntry
+	)
+	flush := func() {
+		if cur.pkg != "" && cur.filename != "" && cur.sha256 != "" {
+			entries = append(entries, cur)
+		}
+		cur = debEntry{}
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || strings.HasPrefix(line, " ") {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Package":
+			cur.pkg = value
+		case "Version":
+			cur.version = value
+		case "Filename":
+			cur.filename = value
+		case "SHA256":
+			cur.sha256 = strings.ToLower(value)
+		case "Depends", "Pre-Depends":
+			for _, dep := range strings.Split(value, ",") {
+				if dep = strings.TrimSpace(dep); dep != "" {
+					cur.depends = append(cur.depends, dep)
+				}
+			}
+		}
+	}
+	flush()
+	return entries
+}
+
+// pickDebEntry returns the newest entry for pkg whose version starts with
+// prefix.
+func pickDebEntry(entries []debEntry, pkg, prefix string) (debEntry, bool) {
+	var (
+		best  debEntry
+		found bool
+	)
+	for _, e := range entries {
+		if e.pkg != pkg || !strings.HasPrefix(e.version, prefix) {
+			continue
+		}
+		if !found || naturalLess(best.version, e.version) {
+			best, found = e, true
+		}
+	}
+	return best, found
+}
+
+// naturalLess orders version strings comparing digit runs numerically.
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		da, db := isDigit(a[0]), isDigit(b[0])
+		var ra, rb string
+		ra, a = splitRun(a, da)
+		rb, b = splitRun(b, db)
+		if da && db {
+			ra, rb = strings.TrimLeft(ra, "0"), strings.TrimLeft(rb, "0")
+			if len(ra) != len(rb) {
+				return len(ra) < len(rb)
+			}
+		}
+		if ra != rb {
+			return ra < rb
+		}
+	}
+	return len(a) < len(b)
+}
+
+func splitRun(s string, digits bool) (string, string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) == digits {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
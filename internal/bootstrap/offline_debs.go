@@ -0,0 +1,235 @@
+package bootstrap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
+	"github.com/infrakit-io/talos-docker-bootstrap/pkg/model"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// dockerRepoKeyFingerprint is the fingerprint Docker publishes for the key
+// that signs its apt repository. The key file is fetched from the
+// repository, so this pin is what makes the signature check meaningful.
+var dockerRepoKeyFingerprint = "9DC858229FC7DD38854AE2D88D81803C0EBFCD88"
+
+// dockerRepoFiles are the cached repository metadata for one release and
+// architecture.
+type dockerRepoFiles struct {
+	key      string
+	release  string
+	packages string
+}
+
+func dockerRepoCache(cfg config.Config, p vmPlatform) dockerRepoFiles {
+	root := filepath.Join(cfg.Offline.CacheDir, "docker")
+	return dockerRepoFiles{
+		key:      filepath.Join(root, "gpg"),
+		release:  filepath.Join(root, p.codename, "InRelease"),
+		packages: filepath.Join(root, p.codename, p.arch, "Packages"),
+	}
+}
+
+// fetchDockerRepoFiles refreshes the cached repository metadata. A failed
+// download falls back to the cached copy, which is verified all the same.
+func fetchDockerRepoFiles(ctx context.Context, warn func(path string, err error), f dockerRepoFiles, p vmPlatform) error {
+	dist := fmt.Sprintf("%s/dists/%s", dockerRepoURL, p.codename)
+	for _, d := range []struct{ url, path string }{
+		{dockerRepoURL + "/gpg", f.key},
+		{dist + "/InRelease", f.release},
+		{fmt.Sprintf("%s/stable/binary-%s/Packages", dist, p.arch), f.packages},
+	} {
+		if err := downloadFile(ctx, d.url, d.path); err != nil {
+			if _, statErr := os.Stat(d.path); statErr != nil {
+				return err
+			}
+			warn(d.path, err)
+		}
+	}
+	return nil
+}
+
+// readDockerIndex returns the cached Packages index after checking that the
+// Docker repository signed it: InRelease must carry a valid signature by the
+// key pinned in dockerRepoKeyFingerprint and list the index's SHA256.
+func readDockerIndex(f dockerRepoFiles, p vmPlatform) ([]byte, error) {
+	for _, path := range []string{f.key, f.release, f.packages} {
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("docker repository metadata not in offline cache (%s); enable offline.fetch or copy it there: %w", path, err)
+		}
+	}
+	keyData, err := os.ReadFile(f.key)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(keyData))
+	if err != nil {
+		return nil, fmt.Errorf("read docker repository key %s: %w", f.key, err)
+	}
+	var trusted openpgp.EntityList
+	for _, k := range keys {
+		if strings.EqualFold(hex.EncodeToString(k.PrimaryKey.Fingerprint[:]), dockerRepoKeyFingerprint) {
+			trusted = append(trusted, k)
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, fmt.Errorf("docker repository key %s is not the key with fingerprint %s", f.key, dockerRepoKeyFingerprint)
+	}
+
+	release, err := os.ReadFile(f.release)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := clearsign.Decode(release)
+	if block == nil {
+		return nil, fmt.Errorf("docker repository release file %s is not signed", f.release)
+	}
+	if _, err := openpgp.CheckDetachedSignature(trusted, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body); err != nil {
+		return nil, fmt.Errorf("verify signature of %s: %w", f.release, err)
+	}
+
+	index, err := os.ReadFile(f.packages)
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("stable/binary-%s/Packages", p.arch)
+	want, ok := releaseSHA256(block.Plaintext, name)
+	if !ok {
+		return nil, fmt.Errorf("docker repository release file %s does not list %s", f.release, name)
+	}
+	sum := sha256.Sum256(index)
+	if got := hex.EncodeToString(sum[:]); got != want {
+		return nil, fmt.Errorf("docker package index %s does not match the signed release file (got %s, expected %s); fetch both again", f.packages, got, want)
+	}
+	return index, nil
+}
+
+// releaseSHA256 returns the SHA256 that a Release file's SHA256 section
+// lists for name.
+func releaseSHA256(release []byte, name string) (string, bool) {
+	inSection := false
+	sc := bufio.NewScanner(bytes.NewReader(release))
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, " ") {
+			inSection = strings.TrimSpace(line) == "SHA256:"
+			continue
+		}
+		if fields := strings.Fields(line); inSection && len(fields) == 3 && fields[2] == name {
+			return strings.ToLower(fields[0]), true
+		}
+	}
+	return "", false
+}
+
+// debDependencies lists the dependencies of the selected packages that are
+// not themselves selected. Each entry holds the alternatives of one
+// dependency; versions are not checked.
+func debDependencies(selected []debEntry) [][]string {
+	var (
+		names []string
+		deps  [][]string
+		seen  = map[string]bool{}
+	)
+	for _, e := range selected {
+		names = append(names, e.pkg)
+	}
+	for _, e := range selected {
+		for _, group := range e.depends {
+			var alts []string
+			for _, alt := range strings.Split(group, "|") {
+				alt, _, _ = strings.Cut(strings.TrimSpace(alt), " ")
+				alt, _, _ = strings.Cut(alt, ":")
+				if alt != "" {
+					alts = append(alts, alt)
+				}
+			}
+			key := strings.Join(alts, " | ")
+			if len(alts) == 0 || seen[key] || slices.ContainsFunc(alts, func(a string) bool { return slices.Contains(names, a) }) {
+				continue
+			}
+			seen[key] = true
+			deps = append(deps, alts)
+		}
+	}
+	return deps
+}
+
+// missingDebs returns the dependencies that no installed package on the VM
+// satisfies. apt-get --no-download cannot fetch them in offline mode.
+func missingDebs(ctx context.Context, cfg config.Config, deps [][]string) ([]string, error) {
+	var names []string
+	for _, alts := range deps {
+		names = append(names, alts...)
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	out, _, err := sshRunCommandFn(ctx, execConfig(cfg), fmt.Sprintf(`dpkg-query -W -f='${Package} ${db:Status-Abbrev}\n' %s 2>/dev/null || true`, strings.Join(names, " ")))
+	if err != nil {
+		return nil, fmt.Errorf("check installed packages: %w", err)
+	}
+	installed := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[1] == "ii" {
+			installed[fields[0]] = true
+		}
+	}
+	var missing []string
+	for _, alts := range deps {
+		if !slices.ContainsFunc(alts, func(a string) bool { return installed[a] }) {
+			missing = append(missing, strings.Join(alts, " | "))
+		}
+	}
+	return missing, nil
+}
+
+// offlineDependencyFact checks, in offline mode, that the VM already has the
+// packages the Docker packages depend on. It needs the verified package
+// index in the offline cache; without it the check is left to
+// docker_install.
+func offlineDependencyFact(ctx context.Context, cfg config.Config, raw map[string]string) model.PreflightFact {
+	const requirement = "Docker package dependencies installed"
+	fact := model.PreflightFact{Name: "docker_dependencies", Requirement: requirement}
+	p := vmPlatform{codename: raw["codename"], arch: raw["arch"]}
+	if p.codename == "" || p.arch == "" {
+		fact.Value = "unknown platform"
+		return fact
+	}
+	index, err := readDockerIndex(dockerRepoCache(cfg, p), p)
+	if errors.Is(err, fs.ErrNotExist) {
+		fact.Value, fact.OK = "not checked (package index not cached)", true
+		return fact
+	}
+	if err != nil {
+		fact.Value = err.Error()
+		return fact
+	}
+	selected, err := selectDockerDebs(cfg, parseDebIndex(index), p)
+	if err != nil {
+		fact.Value = err.Error()
+		return fact
+	}
+	missing, err := missingDebs(ctx, cfg, debDependencies(selected))
+	switch {
+	case err != nil:
+		fact.Value = err.Error()
+	case len(missing) > 0:
+		fact.Value = "missing " + strings.Join(missing, ", ")
+	default:
+		fact.Value, fact.OK = "installed", true
+	}
+	return fact
+}
@@ -0,0 +1,238 @@
+package bootstrap
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
+)
+
+// In offline mode the Talos nodes cannot pull the Kubernetes and system
+// images from their registries. The images are pushed into a registry
+// container on the VM instead, published on the VM's loopback only and
+// attached to the cluster network, where a registry mirror patch points the
+// nodes at it.
+const (
+	offlineRegistryName  = "talos-docker-bootstrap-registry"
+	offlineRegistryImage = "docker.io/library/registry:2"
+	offlineRegistryPort  = 5000
+	// talosClusterCIDR is the network talosctl creates for a Docker cluster
+	// without --cidr, which cluster_create never passes.
+	talosClusterCIDR = "10.5.0.0/24"
+)
+
+// offlineRegistryIP is the registry's address on the cluster network: the
+// last host address of talosClusterCIDR, above the node addresses. A running
+// cluster on another network is recreated in offline mode, since the nodes'
+// mirror patch points at this address.
+var offlineRegistryIP = lastHostAddr(netip.MustParsePrefix(talosClusterCIDR))
+
+// lastHostAddr returns the address below the broadcast address of an IPv4
+// prefix.
+func lastHostAddr(p netip.Prefix) string {
+	a := p.Masked().Addr().As4()
+	n := binary.BigEndian.Uint32(a[:]) | (1<<(32-p.Bits()) - 1)
+	binary.BigEndian.PutUint32(a[:], n-1)
+	return netip.AddrFrom4(a).String()
+}
+
+// kubernetesImages are the default images whose tag follows the Kubernetes
+// version.
+var kubernetesImages = []string{"kube-apiserver", "kube-controller-manager", "kube-scheduler", "kube-proxy", "kubelet"}
+
+// remoteNodeImages lists the images the Talos nodes pull, from the talosctl
+// installed on the VM.
+func remoteNodeImages(ctx context.Context, cfg config.Config) ([]string, error) {
+	out, _, err := sshRunCommandFn(ctx, execConfig(cfg), "talosctl image default 2>/dev/null || talosctl images 2>/dev/null")
+	if err != nil {
+		return nil, fmt.Errorf("list the default Talos images with talosctl on the VM: %w", err)
+	}
+	return nodeImages(cfg, out)
+}
+
+// nodeImages parses the talosctl default image list, applies
+// cluster.kubernetes_version and appends offline.images. The installer is
+// left out, as Docker nodes never install.
+func nodeImages(cfg config.Config, list string) ([]string, error) {
+	var images []string
+	add := func(ref string) {
+		if ref != "" && !slices.Contains(images, ref) {
+			images = append(images, ref)
+		}
+	}
+	version := cfg.Cluster.KubernetesVersionNumber()
+	for _, line := range strings.Split(list, "\n") {
+		ref := strings.TrimSpace(line)
+		if ref == "" || strings.ContainsAny(ref, " \t") || !strings.Contains(ref, "/") {
+			continue
+		}
+		host, repo, tag := splitImageRef(ref)
+		name := path.Base(repo)
+		if name == "installer" || name == "installer-base" {
+			continue
+		}
+		if version != "" && slices.Contains(kubernetesImages, name) {
+			tag = "v" + version
+		}
+		add(host + "/" + repo + ":" + tag)
+	}
+	if len(images) == 0 {
+		return nil, fmt.Errorf("talosctl on the VM listed no default Talos images")
+	}
+	for _, img := range cfg.Offline.Images {
+		host, repo, tag := splitImageRef(strings.TrimSpace(img))
+		add(host + "/" + repo + ":" + tag)
+	}
+	return images, nil
+}
+
+// splitImageRef splits a tagged image reference into registry host,
+// repository and tag, with the Docker Hub defaults for short names.
+func splitImageRef(ref string) (host, repo, tag string) {
+	name, tag := ref, "latest"
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		name, tag = ref[:i], ref[i+1:]
+	}
+	host, repo, ok := strings.Cut(name, "/")
+	if !ok || (!strings.ContainsAny(host, ".:") && host != "localhost") {
+		host, repo = "docker.io", name
+	}
+	if host == "docker.io" && !strings.Contains(repo, "/") {
+		repo = "library/" + repo
+	}
+	return host, repo, tag
+}
+
+// offlineMirrorPath is where ref is kept in the offline registry: under its
+// original registry host, so images of different registries do not clash.
+func offlineMirrorPath(ref string) (repo, tag string) {
+	host, repo, tag := splitImageRef(ref)
+	return host + "/" + repo, tag
+}
+
+// offlineRegistryPatch renders the machine config patch that sends the
+// nodes' pulls from every registry of images to the offline registry. It is
+// empty without images.
+func offlineRegistryPatch(images []string) string {
+	var hosts []string
+	for _, ref := range images {
+		if host, _, _ := splitImageRef(ref); !slices.Contains(hosts, host) {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		return ""
+	}
+	slices.Sort(hosts)
+	var b strings.Builder
+	b.WriteString("machine:\n  registries:\n    mirrors:")
+	for _, host := range hosts {
+		fmt.Fprintf(&b, "\n      %s:\n        endpoints:\n          - http://%s:%d/v2/%s\n        overridePath: true", host, offlineRegistryIP, offlineRegistryPort, host)
+	}
+	return b.String()
+}
+
+// offlineRegistryVars sets the registry the cluster script attaches to the
+// cluster network. REGISTRY_IP is empty outside offline mode.
+func offlineRegistryVars(cfg config.Config) string {
+	ip := ""
+	if cfg.Offline.Enabled {
+		ip = offlineRegistryIP
+	}
+	return fmt.Sprintf("REGISTRY_NAME=%q\nREGISTRY_IP=%q\nREGISTRY_CIDR=%q\n", offlineRegistryName, ip, talosClusterCIDR)
+}
+
+// offlineRegistryFuncs attach the offline registry to the cluster network
+// and detach it again before the cluster is destroyed, as Docker does not
+// remove a network with containers on it. registry_network_drift finds a
+// cluster network outside REGISTRY_CIDR. All do nothing without
+// REGISTRY_IP.
+const offlineRegistryFuncs = `
+# registry_network_drift prints the cluster network's subnet when it is not
+# REGISTRY_CIDR, the network the registry address and the nodes' mirror
+# patch assume.
+registry_network_drift() {
+  local subnet
+  [ -n "${REGISTRY_IP}" ] || return 0
+  subnet="$(docker network inspect -f '{{range .IPAM.Config}}{{.Subnet}} {{end}}' "${CLUSTER_NAME}" 2>/dev/null | tr ' ' '\n' | grep -m 1 -E '^[0-9]+(\.[0-9]+){3}/[0-9]+$' || true)"
+  if [ -n "${subnet}" ] && [ "${subnet}" != "${REGISTRY_CIDR}" ]; then
+    echo "${subnet}"
+  fi
+}
+
+# connect_registry waits for talosctl to create the cluster network and
+# attaches the registry to it. The nodes retry their image pulls until it
+# is there.
+connect_registry() {
+  local i
+  [ -n "${REGISTRY_IP}" ] || return 0
+  for i in $(seq 1 300); do
+    if docker network inspect "${CLUSTER_NAME}" >/dev/null 2>&1; then
+      if docker network inspect -f '{{range .Containers}}{{.Name}} {{end}}' "${CLUSTER_NAME}" | tr ' ' '\n' | grep -qx "${REGISTRY_NAME}" ||
+        docker network connect --ip "${REGISTRY_IP}" "${CLUSTER_NAME}" "${REGISTRY_NAME}" 2>/dev/null; then
+        return 0
+      fi
+    fi
+    sleep 1
+  done
+  echo "Could not attach the offline registry ${REGISTRY_NAME} to network ${CLUSTER_NAME}." >&2
+  return 1
+}
+
+disconnect_registry() {
+  [ -n "${REGISTRY_IP}" ] || return 0
+  docker network disconnect -f "${CLUSTER_NAME}" "${REGISTRY_NAME}" >/dev/null 2>&1 || true
+}
+`
+
+// offlineRegistryHas reports whether the offline registry on the VM serves
+// ref.
+func offlineRegistryHas(ctx context.Context, cfg config.Config, ref string) bool {
+	repo, tag := offlineMirrorPath(ref)
+	cmd := fmt.Sprintf("curl -fsS -o /dev/null -H %q http://127.0.0.1:%d/v2/%s/manifests/%s", "Accept: application/vnd.oci.image.index.v1+json, application/vnd.oci.image.manifest.v1+json, application/vnd.docker.distribution.manifest.list.v2+json, application/vnd.docker.distribution.manifest.v2+json", offlineRegistryPort, repo, tag)
+	_, _, err := sshRunCommandFn(ctx, execConfig(cfg), cmd)
+	return err == nil
+}
+
+// offlineRegistryScript starts the offline registry when it is not running
+// and pushes the images in PUSHES ("REF MIRROR" lines) into it.
+func offlineRegistryScript(images []string) string {
+	var pushes []string
+	for _, ref := range images {
+		repo, tag := offlineMirrorPath(ref)
+		pushes = append(pushes, fmt.Sprintf("%s 127.0.0.1:%d/%s:%s", ref, offlineRegistryPort, repo, tag))
+	}
+	return fmt.Sprintf(`
+REGISTRY_NAME=%q
+REGISTRY_URL="http://127.0.0.1:%d/v2/"
+PUSHES=%s
+if ! docker container inspect "${REGISTRY_NAME}" >/dev/null 2>&1; then
+  docker run -d --name "${REGISTRY_NAME}" --restart always -p 127.0.0.1:%d:5000 -v "${REGISTRY_NAME}:/var/lib/registry" %q >/dev/null
+  echo "Started offline registry ${REGISTRY_NAME}."
+elif [ "$(docker inspect -f '{{.State.Running}}' "${REGISTRY_NAME}")" != "true" ]; then
+  docker start "${REGISTRY_NAME}" >/dev/null
+fi
+for i in $(seq 1 30); do
+  if curl -fsS -o /dev/null "${REGISTRY_URL}"; then
+    break
+  fi
+  sleep 1
+done
+if ! curl -fsS -o /dev/null "${REGISTRY_URL}"; then
+  echo "Offline registry ${REGISTRY_NAME} is not answering on ${REGISTRY_URL}." >&2
+  exit 1
+fi
+while read -r REF MIRROR; do
+  [ -n "${REF}" ] || continue
+  docker tag "${REF}" "${MIRROR}"
+  docker push "${MIRROR}" >/dev/null
+  docker rmi "${MIRROR}" >/dev/null
+  echo "Pushed ${REF} to the offline registry."
+done <<< "${PUSHES}"
+`, offlineRegistryName, offlineRegistryPort, heredocValue("PUSHES", strings.Join(pushes, "\n")), offlineRegistryPort, offlineRegistryImage)
+}
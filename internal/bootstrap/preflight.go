@@ -0,0 +1,298 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/ssh"
+	"github.com/infrakit-io/talos-docker-bootstrap/pkg/model"
+)
+
+// The preflight script runs as the login user, without sudo, so that a
+// missing passwordless sudo shows up as a fact instead of a failed session.
+var sshRunUserScriptFn = func(ctx context.Context, cfg ssh.ExecConfig, script string) (string, string, error) {
+	return ssh.RunScriptWithCommand(ctx, cfg, "bash -s", script)
+}
+
+// Preflight scripts print one "fact: <name>=<value>" line per fact.
+const preflightFactPrefix = "fact: "
+
+var leadingVersionRE = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*`)
+
+// PreflightError reports the facts that did not meet the configured minimums.
+type PreflightError struct {
+	Failed []model.PreflightFact
+}
+
+func (e *PreflightError) Error() string {
+	parts := make([]string, 0, len(e.Failed))
+	for _, f := range e.Failed {
+		parts = append(parts, fmt.Sprintf("%s is %s (need %s)", f.Name, f.Value, f.Requirement))
+	}
+	return "preflight failed: " + strings.Join(parts, "; ")
+}
+
+// Preflight gathers facts from the VM without changing it and validates them
+// against cfg.Preflight. The facts are returned even when validation fails,
+// in which case the error is a *PreflightError.
+func Preflight(ctx context.Context, logger *slog.Logger, cfg config.Config) ([]model.PreflightFact, error) {
+	script := fmt.Sprintf(`#!/usr/bin/env bash
+set -uo pipefail
+
+%sTALOS_VERSION=%q
+ENDPOINTS=%q
+OFFLINE=%t
+
+fact() { printf 'fact: %%s=%%s\n' "$1" "$2"; }
+
+avail_gb() {
+  local p="$1"
+  while [ ! -e "$p" ]; do p="$(dirname "$p")"; done
+  df -Pk "$p" 2>/dev/null | awk 'NR == 2 {print int($4 / 1048576)}'
+}
+
+size_gb() {
+  local p="$1"
+  while [ ! -e "$p" ]; do p="$(dirname "$p")"; done
+  df -Pk "$p" 2>/dev/null | awk 'NR == 2 {print int($2 / 1048576)}'
+}
+
+. /etc/os-release 2>/dev/null || true
+fact os_id "${ID:-}"
+fact os_version "${VERSION_ID:-}"
+fact codename "${VERSION_CODENAME:-}"
+ARCH="$(dpkg --print-architecture 2>/dev/null || true)"
+fact arch "${ARCH}"
+fact kernel "$(uname -r)"
+if [ "$(stat -fc %%T /sys/fs/cgroup 2>/dev/null)" = "cgroup2fs" ]; then
+  fact cgroup 2
+else
+  fact cgroup 1
+fi
+fact disk_root_gb "$(avail_gb /)"
+fact disk_docker_gb "$(avail_gb /var/lib/docker)"
+fact disk_docker_total_gb "$(size_gb /var/lib/docker)"
+fact memory_mb "$(awk '/^MemTotal:/ {print int($2 / 1024)}' /proc/meminfo)"
+fact cpus "$(nproc 2>/dev/null || true)"
+if sudo -n true >/dev/null 2>&1; then
+  fact sudo yes
+else
+  fact sudo no
+fi
+
+if [ "${OFFLINE}" = "true" ]; then
+  :
+elif command -v curl >/dev/null 2>&1; then
+  for HOST in ${ENDPOINTS}; do
+    if curl -sS -o /dev/null --max-time 10 "https://${HOST}/" >/dev/null 2>&1; then
+      fact "reach:${HOST}" yes
+    else
+      fact "reach:${HOST}" no
+    fi
+  done
+  SUMS="$(curl -fsSL --max-time 15 "https://github.com/siderolabs/talos/releases/download/v${TALOS_VERSION}/sha256sum.txt" 2>/dev/null || true)"
+  fact talosctl_sha256 "$(printf '%%s\n' "${SUMS}" | awk -v bin="talosctl-linux-${ARCH}" '$2 == bin {print $1; exit}')"
+else
+  for HOST in ${ENDPOINTS}; do
+    fact "reach:${HOST}" "no curl"
+  done
+fi
+`, proxyExports(cfg), cfg.Talos.Version, strings.Join(preflightEndpoints(cfg), " "), cfg.Offline.Enabled)
+
+	stdout, stderr, err := sshRunUserScriptFn(ctx, execConfig(cfg), script)
+	if stderr != "" {
+		logger.Debug("preflight stderr", "output", strings.TrimSpace(stderr))
+	}
+	if err != nil {
+		return nil, err
+	}
+	raw := parsePreflightFacts(stdout)
+	facts := evaluatePreflight(cfg, raw)
+	if cfg.Offline.Enabled {
+		facts = append(facts, offlineDependencyFact(ctx, cfg, raw))
+	}
+	var failed []model.PreflightFact
+	for _, f := range facts {
+		logger.Debug("preflight fact", "name", f.Name, "value", f.Value, "ok", f.OK, "requirement", f.Requirement)
+		if !f.OK {
+			failed = append(failed, f)
+		}
+	}
+	if len(failed) > 0 {
+		return facts, &PreflightError{Failed: failed}
+	}
+	return facts, nil
+}
+
+func parsePreflightFacts(stdout string) map[string]string {
+	raw := map[string]string{}
+	for _, line := range strings.Split(stdout, "\n") {
+		rest, ok := strings.CutPrefix(strings.TrimSpace(line), preflightFactPrefix)
+		if !ok {
+			continue
+		}
+		if name, value, ok := strings.Cut(rest, "="); ok {
+			raw[name] = strings.TrimSpace(value)
+		}
+	}
+	return raw
+}
+
+// evaluatePreflight turns raw facts into validated ones, in a fixed order.
+// A fact whose value is missing or unparseable fails its check.
+func evaluatePreflight(cfg config.Config, raw map[string]string) []model.PreflightFact {
+	p := cfg.Preflight
+	var facts []model.PreflightFact
+	add := func(name, value string, ok bool, requirement string) {
+		if value == "" {
+			value = "unknown"
+		}
+		facts = append(facts, model.PreflightFact{Name: name, Value: value, OK: ok, Requirement: requirement})
+	}
+
+	osID, osVersion := raw["os_id"], raw["os_version"]
+	osOK := len(p.SupportedOS) == 0 || slices.Contains(p.SupportedOS, strings.ToLower(osID))
+	var osReq []string
+	if len(p.SupportedOS) > 0 {
+		osReq = append(osReq, strings.Join(p.SupportedOS, " or "))
+	}
+	if p.MinOSVersion != "" {
+		osOK = osOK && versionAtLeast(osVersion, p.MinOSVersion)
+		osReq = append(osReq, ">= "+p.MinOSVersion)
+	}
+	add("os", strings.TrimSpace(osID+" "+osVersion), osOK, strings.Join(osReq, " "))
+
+	arch := raw["arch"]
+	archOK := arch != "" && (len(p.Architectures) == 0 || slices.Contains(p.Architectures, arch))
+	add("arch", arch, archOK, "one of "+strings.Join(p.Architectures, ", "))
+
+	if p.MinKernel != "" {
+		add("kernel", raw["kernel"], versionAtLeast(raw["kernel"], p.MinKernel), ">= "+p.MinKernel)
+	} else {
+		add("kernel", raw["kernel"], true, "")
+	}
+
+	if p.CgroupVersion != 0 {
+		want := strconv.Itoa(p.CgroupVersion)
+		add("cgroup", "v"+raw["cgroup"], raw["cgroup"] == want, "v"+want)
+	} else {
+		add("cgroup", "v"+raw["cgroup"], true, "")
+	}
+
+	addMin := func(name, key, unit string, minimum int) {
+		v, err := strconv.Atoi(raw[key])
+		value := ""
+		if err == nil {
+			value = fmt.Sprintf("%d %s", v, unit)
+		}
+		if minimum <= 0 {
+			add(name, value, err == nil, "")
+			return
+		}
+		add(name, value, err == nil && v >= minimum, fmt.Sprintf(">= %d %s", minimum, unit))
+	}
+	addMin("disk_root", "disk_root_gb", "GB free", p.MinRootDiskGB)
+	addMin("disk_docker", "disk_docker_gb", "GB free", p.MinDockerDiskGB)
+	addMin("memory", "memory_mb", "MB", p.MinMemoryMB)
+	addMin("cpus", "cpus", "CPUs", p.MinCPUs)
+	facts = append(facts, evaluateNodeResources(cfg, raw)...)
+
+	if raw["sudo"] == "yes" {
+		add("sudo", "passwordless", true, "passwordless sudo")
+	} else {
+		add("sudo", "password required", false, "passwordless sudo")
+	}
+
+	for _, host := range preflightEndpoints(cfg) {
+		v := raw["reach:"+host]
+		switch v {
+		case "yes":
+			v = "reachable"
+		case "", "no":
+			v = "unreachable"
+		}
+		add("reach "+host, v, v == "reachable", "outbound HTTPS")
+	}
+
+	// The configured checksum must exist for this VM's architecture and,
+	// when the release checksum list could be fetched, match it.
+	if archOK {
+		bin := "talosctl-linux-" + arch
+		want := "talos.sha256_checksums." + arch + " for " + bin
+		switch sum := cfg.Talos.ChecksumFor(arch); {
+		case sum == "":
+			add("talos_checksum", "missing for "+arch, false, want)
+		case raw["talosctl_sha256"] == "":
+			add("talos_checksum", "configured for "+arch+" (release list unavailable)", true, want)
+		case strings.EqualFold(raw["talosctl_sha256"], sum):
+			add("talos_checksum", bin, true, want)
+		default:
+			add("talos_checksum", "not for "+bin+" v"+cfg.Talos.Version, false, want)
+		}
+	}
+	return facts
+}
+
+// evaluateNodeResources checks the cluster's node sizing against the VM, as
+// check_node_capacity does again in cluster_create. Docker refuses a CPU
+// limit above the VM's CPU count, the nodes together must fit in its memory,
+// and their reserved disk in the Docker filesystem (its size, since a running
+// cluster already uses part of it).
+func evaluateNodeResources(cfg config.Config, raw map[string]string) []model.PreflightFact {
+	need, ok := nodeCapacityNeeds(cfg)
+	if !ok {
+		return nil
+	}
+	var facts []model.PreflightFact
+	add := func(name, key, unit string, need float64, requirement string) {
+		value := "unknown"
+		have, err := strconv.ParseFloat(raw[key], 64)
+		if err == nil {
+			value = fmt.Sprintf("%s %s", strconv.FormatFloat(have, 'f', -1, 64), unit)
+		}
+		facts = append(facts, model.PreflightFact{Name: name, Value: value, OK: err == nil && need <= have, Requirement: requirement})
+	}
+
+	add("node_cpus", "cpus", "CPUs", need.cpus, fmt.Sprintf(">= %s CPUs per node", strconv.FormatFloat(need.cpus, 'f', -1, 64)))
+	add("node_memory", "memory_mb", "MB", float64(need.memoryMB), fmt.Sprintf(">= %d MB for %d nodes", need.memoryMB, need.nodes))
+	if need.diskGB > 0 {
+		add("node_disk", "disk_docker_total_gb", "GB", float64(need.diskGB), fmt.Sprintf(">= %d GB Docker filesystem for %d nodes", need.diskGB, need.nodes))
+	}
+	return facts
+}
+
+// preflightEndpoints lists the hosts the VM must reach. In offline mode
+// artifacts arrive over SSH, so there are none.
+func preflightEndpoints(cfg config.Config) []string {
+	if cfg.Offline.Enabled {
+		return nil
+	}
+	return cfg.Preflight.Endpoints
+}
+
+// versionAtLeast compares the leading dotted number of have (so kernel
+// releases like 6.8.0-45-generic work) against minimum.
+func versionAtLeast(have, minimum string) bool {
+	h := strings.Split(leadingVersionRE.FindString(strings.TrimSpace(have)), ".")
+	m := strings.Split(leadingVersionRE.FindString(strings.TrimSpace(minimum)), ".")
+	if h[0] == "" {
+		return false
+	}
+	for i := 0; i < len(m); i++ {
+		var hv, mv int
+		if i < len(h) {
+			hv, _ = strconv.Atoi(h[i])
+		}
+		mv, _ = strconv.Atoi(m[i])
+		if hv != mv {
+			return hv > mv
+		}
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package bootstrap
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/ssh"
+)
+
+const (
+	// stepTailLines is how many recent output lines human mode keeps visible.
+	stepTailLines = 6
+	// stepTailWidth truncates tail lines so they never wrap, which would
+	// break redrawing in place.
+	stepTailWidth = 110
+)
+
+// stepOutput receives a step's remote output as it streams in. It keeps the
+// full output for the result and forwards each line to the human tail or,
+// without one, to the logger.
+type stepOutput struct {
+	mu     sync.Mutex
+	step   string
+	logger *slog.Logger
+	tail   *stepTail
+	lines  []string
+}
+
+func (o *stepOutput) line(stream, text string) {
+	o.mu.Lock()
+	o.lines = append(o.lines, text)
+	o.mu.Unlock()
+	if o.tail != nil {
+		o.tail.add(stream, text)
+		return
+	}
+	o.logger.Info("remote output", "step", o.step, "stream", stream, "line", text)
+}
+
+func (o *stepOutput) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return strings.Join(o.lines, "\n")
+}
+
+// stepTail renders a status line and the last few output lines under the
+// step header, redrawing them in place as output arrives.
+type stepTail struct {
+	mu      sync.Mutex
+	w       io.Writer
+	step    string
+	started time.Time
+	lines   []string
+	drawn   int
+}
+
+func newStepTail(w io.Writer, step string) *stepTail {
+	return &stepTail{w: w, step: step, started: time.Now()}
+}
+
+func (t *stepTail) add(stream, text string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	text = truncateRunes(strings.ReplaceAll(text, "\t", "  "), stepTailWidth)
+	if stream == ssh.StreamStderr {
+		text = "\033[33m" + text + "\033[0m"
+	} else {
+		text = "\033[90m" + text + "\033[0m"
+	}
+	t.lines = append(t.lines, text)
+	if len(t.lines) > stepTailLines {
+		t.lines = t.lines[len(t.lines)-stepTailLines:]
+	}
+	t.redraw()
+}
+
+// tick refreshes the elapsed time in the status line.
+func (t *stepTail) tick() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.redraw()
+}
+
+// finish stops drawing. On success the tail is erased so only the step
+// summary remains; on failure it is left on screen for context.
+func (t *stepTail) finish(keep bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !keep && t.drawn > 0 {
+		fmt.Fprintf(t.w, "\033[%dF\033[J", t.drawn)
+	}
+	t.drawn = 0
+}
+
+func (t *stepTail) redraw() {
+	if t.drawn > 0 {
+		// Move to the start of the first drawn line and clear to the end.
+		fmt.Fprintf(t.w, "\033[%dF\033[J", t.drawn)
+	}
+	fmt.Fprintf(t.w, "  \033[90m... %s running (%s)\033[0m\n", humanStepLabel(t.step), time.Since(t.started).Truncate(time.Second))
+	for _, l := range t.lines {
+		fmt.Fprintf(t.w, "  \033[90m│\033[0m %s\n", l)
+	}
+	t.drawn = 1 + len(t.lines)
+}
+
+func truncateRunes(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
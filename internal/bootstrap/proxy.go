@@ -0,0 +1,202 @@
+package bootstrap
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/ssh"
+)
+
+const (
+	aptProxyConfPath     = "/etc/apt/apt.conf.d/90talos-docker-bootstrap-proxy"
+	dockerProxyDropInDir = "/etc/systemd/system/docker.service.d"
+	dockerProxyDropIn    = dockerProxyDropInDir + "/http-proxy.conf"
+	proxyCAPath          = "/usr/local/share/ca-certificates/talos-docker-bootstrap-proxy.crt"
+)
+
+// proxyURLs returns the http and https proxy URLs, each falling back to the
+// other when only one is configured.
+func proxyURLs(p config.ProxyConfig) (string, string) {
+	httpURL, httpsURL := strings.TrimSpace(p.HTTP), strings.TrimSpace(p.HTTPS)
+	if httpURL == "" {
+		httpURL = httpsURL
+	}
+	if httpsURL == "" {
+		httpsURL = httpURL
+	}
+	return httpURL, httpsURL
+}
+
+// proxyExports sets the proxy environment for the rest of a remote script,
+// so apt-get and curl pick it up. The values are single-quoted, as proxy
+// credentials may hold characters the shell expands. It is empty without a
+// proxy.
+func proxyExports(cfg config.Config) string {
+	if !cfg.Proxy.Enabled() {
+		return ""
+	}
+	httpURL, httpsURL := proxyURLs(cfg.Proxy)
+	httpURL, httpsURL = ssh.ShellQuote(httpURL), ssh.ShellQuote(httpsURL)
+	noProxy := ssh.ShellQuote(cfg.Proxy.NoProxyList())
+	return fmt.Sprintf(`export http_proxy=%s HTTP_PROXY=%s
+export https_proxy=%s HTTPS_PROXY=%s
+export no_proxy=%s NO_PROXY=%s
+`, httpURL, httpURL, httpsURL, httpsURL, noProxy, noProxy)
+}
+
+// proxyCA reads the configured CA bundle, or returns "" when none is set.
+func proxyCA(cfg config.Config) (string, error) {
+	if strings.TrimSpace(cfg.Proxy.CABundle) == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(cfg.Proxy.CABundle)
+	if err != nil {
+		return "", fmt.Errorf("read proxy.ca_bundle: %w", err)
+	}
+	pem := strings.TrimSpace(string(data))
+	if !strings.Contains(pem, "-----BEGIN CERTIFICATE-----") {
+		return "", fmt.Errorf("proxy.ca_bundle %s contains no PEM certificate", cfg.Proxy.CABundle)
+	}
+	return pem, nil
+}
+
+// proxyInput is the proxy config with the CA content as a journal input, so
+// --resume sees a replaced CA file. A CA that cannot be read is left to the
+// step to report.
+func proxyInput(cfg config.Config) any {
+	ca, _ := proxyCA(cfg)
+	return []any{cfg.Proxy, ca}
+}
+
+// aptProxyConf renders the apt configuration written on the VM.
+func aptProxyConf(cfg config.Config) string {
+	httpURL, httpsURL := proxyURLs(cfg.Proxy)
+	return fmt.Sprintf("Acquire::http::Proxy \"%s\";\nAcquire::https::Proxy \"%s\";", httpURL, httpsURL)
+}
+
+// dockerProxyConf renders the systemd drop-in that passes the proxy to the
+// Docker daemon, which pulls the Talos node image. systemd expands %
+// specifiers in Environment=, so percent-encoded credentials are escaped.
+func dockerProxyConf(cfg config.Config) string {
+	httpURL, httpsURL := proxyURLs(cfg.Proxy)
+	escape := strings.NewReplacer("%", "%%").Replace
+	return fmt.Sprintf(`[Service]
+Environment="HTTP_PROXY=%s"
+Environment="HTTPS_PROXY=%s"
+Environment="NO_PROXY=%s"`, escape(httpURL), escape(httpsURL), escape(cfg.Proxy.NoProxyList()))
+}
+
+// proxySetupScript exports the proxy environment and converges the apt proxy
+// configuration and the proxy CA in the VM's trust store. Without a proxy it
+// removes what an earlier run installed. It runs as root.
+func proxySetupScript(cfg config.Config) (string, error) {
+	ca, err := proxyCA(cfg)
+	if err != nil {
+		return "", err
+	}
+	apt := ""
+	if cfg.Proxy.Enabled() {
+		apt = aptProxyConf(cfg)
+	}
+	return proxyExports(cfg) + fmt.Sprintf(`
+converge_file() {
+  # converge_file PATH CONTENT: write CONTENT to PATH (or remove PATH when
+  # CONTENT is empty); exit status 0 means the file changed.
+  local path="$1" content="$2" tmp
+  if [ -z "${content}" ]; then
+    [ -e "${path}" ] || return 1
+    rm -f "${path}"
+    return 0
+  fi
+  tmp="$(mktemp)"
+  printf '%%s\n' "${content}" > "${tmp}"
+  if [ -f "${path}" ] && cmp -s "${tmp}" "${path}"; then
+    rm -f "${tmp}"
+    return 1
+  fi
+  install -d -m 0755 "$(dirname "${path}")"
+  install -m 0644 "${tmp}" "${path}"
+  rm -f "${tmp}"
+}
+
+if converge_file %q %s; then
+  echo "Updated apt proxy configuration."
+fi
+if converge_file %q %s; then
+  update-ca-certificates >/dev/null
+  echo "Updated proxy CA in the system trust store."
+fi
+`, aptProxyConfPath, heredocValue("APTPROXY", apt), proxyCAPath, heredocValue("PROXYCA", ca)), nil
+}
+
+// dockerProxyScript converges the Docker daemon proxy drop-in and sets
+// DOCKER_RESTART when it changed; dockerConfigScript does the restart.
+func dockerProxyScript(cfg config.Config) string {
+	conf := ""
+	if cfg.Proxy.Enabled() {
+		conf = dockerProxyConf(cfg)
+	}
+	return fmt.Sprintf(`
+if converge_file %q %s; then
+  systemctl daemon-reload
+  DOCKER_RESTART=1
+  echo "Updated Docker daemon proxy configuration."
+fi
+`, dockerProxyDropIn, heredocValue("DOCKERPROXY", conf))
+}
+
+// proxyCheckScript prints a change line for every proxy file on the VM that
+// differs from the config. It expects checkFileFunc.
+func proxyCheckScript(cfg config.Config) (string, error) {
+	ca, err := proxyCA(cfg)
+	if err != nil {
+		return "", err
+	}
+	apt, docker := "", ""
+	if cfg.Proxy.Enabled() {
+		apt, docker = aptProxyConf(cfg), dockerProxyConf(cfg)
+	}
+	return fmt.Sprintf(`
+check_file %q %s "apt proxy configuration"
+check_file %q %s "proxy CA"
+check_file %q %s "Docker proxy drop-in"
+`, aptProxyConfPath, heredocValue("APTPROXY", apt), proxyCAPath, heredocValue("PROXYCA", ca), dockerProxyDropIn, heredocValue("DOCKERPROXY", docker)), nil
+}
+
+// talosProxyPatch renders the machine config patch that gives the Talos
+// nodes the proxy environment and trusts the proxy CA. It is empty without a
+// proxy.
+func talosProxyPatch(cfg config.Config) (string, error) {
+	if !cfg.Proxy.Enabled() {
+		return "", nil
+	}
+	ca, err := proxyCA(cfg)
+	if err != nil {
+		return "", err
+	}
+	httpURL, httpsURL := proxyURLs(cfg.Proxy)
+	patch := fmt.Sprintf(`machine:
+  env:
+    http_proxy: %q
+    https_proxy: %q
+    no_proxy: %q`, httpURL, httpsURL, cfg.Proxy.NoProxyList())
+	if ca != "" {
+		patch += "\n---\napiVersion: v1alpha1\nkind: TrustedRootsConfig\nname: talos-docker-bootstrap-proxy\ncertificates: |\n"
+		for _, line := range strings.Split(ca, "\n") {
+			patch += "  " + line + "\n"
+		}
+		patch = strings.TrimSuffix(patch, "\n")
+	}
+	return patch, nil
+}
+
+// heredocValue renders content as a bash command substitution reading a
+// quoted heredoc, so it is passed verbatim.
+func heredocValue(marker, content string) string {
+	if content == "" {
+		return `""`
+	}
+	return fmt.Sprintf("\"$(cat <<'%s'\n%s\n%s\n)\"", marker, content, marker)
+}
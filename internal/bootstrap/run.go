@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"os"
 	"path/filepath"
 	"strings"
 	"time"
@@ -15,8 +16,20 @@ import (
 )
 
 type Options struct {
-	DryRun        bool
+	DryRun bool
+	// Check connects read-only and reports, per step, what a real run would
+	// change. Nothing is modified on the VM and the journal is not updated.
+	Check         bool
 	HumanProgress bool
+	// JournalDir holds the run journals; empty disables the journal.
+	JournalDir string
+	// Resume skips steps the journal records as succeeded with the same
+	// inputs. It has no effect without JournalDir.
+	Resume bool
+	// Only and Skip select steps by name (see StepNames); at most one may be
+	// set. ssh_connectivity always runs.
+	Only []string
+	Skip []string
 }
 
 type Result = model.BootstrapResult
@@ -25,6 +38,9 @@ type Step = model.StepResult
 
 var (
 	waitForTCPPortWithStatsFn = ssh.WaitForTCPPortWithStats
+	waitForTCPPortViaJumpsFn  = ssh.WaitForTCPPortViaJumpsWithStats
+	sshDialFn                 = ssh.Dial
+	runPreflightFn            = Preflight
 	runOSHardeningFn          = runOSHardening
 	runDockerInstallFn        = runDockerInstall
 	runTalosctlInstallFn      = runTalosctlInstall
@@ -40,6 +56,17 @@ func SetKnownHostsPrompt(fn func(message string) (bool, error)) func() {
 	return func() { knownHostsPromptFn = prev }
 }
 
+// OpenSession dials the VM once, verifying its host key, and returns a context
+// that routes every remote call of this package over that connection.
+// The returned close func must be called when the caller is done.
+func OpenSession(ctx context.Context, cfg config.Config) (context.Context, func(), error) {
+	sess, err := sshDialFn(ctx, execConfig(cfg))
+	if err != nil {
+		return ctx, func() {}, err
+	}
+	return ssh.ContextWithSession(ctx, sess), func() { _ = sess.Close() }, nil
+}
+
 func Run(ctx context.Context, logger *slog.Logger, cfg config.Config, opts Options) (Result, error) {
 	res := Result{
 		Status:         "running",
@@ -49,34 +76,69 @@ func Run(ctx context.Context, logger *slog.Logger, cfg config.Config, opts Optio
 		Cluster:        cfg.Cluster.Name,
 		KubeconfigPath: filepath.Join(cfg.Cluster.StateDir, "kubeconfig"),
 		DryRun:         opts.DryRun,
+		Check:          opts.Check,
 	}
 
+	if err := ValidateStepSelection(opts.Only, opts.Skip); err != nil {
+		res.Status = "failed"
+		res.Error = err.Error()
+		res.EndedAt = time.Now().UTC()
+		return res, err
+	}
+	only, skip := NormalizeStepNames(opts.Only), NormalizeStepNames(opts.Skip)
+
 	if opts.DryRun {
 		res.Steps = []Step{
-			{Name: "ssh_connectivity", Status: model.StepStatusPlanned, Message: "Check SSH TCP reachability"},
+			{Name: "ssh_connectivity", Status: model.StepStatusPlanned, Message: "Check SSH reachability and open session"},
+			{Name: "preflight", Status: model.StepStatusPlanned, Message: "Gather remote facts and check minimums"},
 			{Name: "os_hardening", Status: model.StepStatusPlanned, Message: "Apply idempotent OS hardening baseline"},
 			{Name: "docker_install", Status: model.StepStatusPlanned, Message: "Install pinned Docker version"},
 			{Name: "talosctl_install", Status: model.StepStatusPlanned, Message: "Install pinned talosctl and verify checksum"},
 			{Name: "cluster_create", Status: model.StepStatusPlanned, Message: "Create Talos-in-Docker cluster if missing"},
 		}
+		for i := range res.Steps {
+			if reason := stepSelection(only, skip, res.Steps[i].Name); reason != "" {
+				res.Steps[i].Status = model.StepStatusSkipped
+				res.Steps[i].Message = reason
+			}
+		}
 		res.Status = "planned"
 		res.EndedAt = time.Now().UTC()
 		return res, nil
 	}
 
+	// Every step after ssh_connectivity runs over the session it opens.
+	sessionCtx := ctx
+	closeSession := func() {}
+	defer func() { closeSession() }()
+
+	var (
+		journal     *Journal
+		journalPath string
+	)
+	if !opts.Check {
+		journal, journalPath = openJournal(logger, cfg, opts)
+	}
+
+	// inputs are the config values and file contents a step's script reads;
+	// a step without inputs always runs. check inspects the VM for check
+	// mode; a step without it is read-only and runs as usual.
 	steps := []struct {
-		name string
-		desc string
-		run  func(context.Context) error
+		name   string
+		desc   string
+		inputs any
+		run    func(context.Context) error
+		check  func(context.Context) ([]string, error)
 	}{
 		{
 			name: "ssh_connectivity",
-			desc: "Check SSH TCP reachability",
+			desc: "Check SSH reachability and open session",
 			run: func(ctx context.Context) error {
 				if opts.HumanProgress {
 					logger.Debug("ssh connectivity probe",
 						"host", cfg.VM.Host,
 						"port", cfg.VM.Port,
+						"jump_hosts", len(cfg.VM.JumpHosts),
 						"connect_timeout", cfg.Timeouts.SSHConnectDuration().String(),
 						"retries", cfg.Timeouts.SSHRetries,
 						"retry_delay", cfg.Timeouts.SSHRetryDelayDuration().String(),
@@ -85,63 +147,114 @@ func Run(ctx context.Context, logger *slog.Logger, cfg config.Config, opts Optio
 					logger.Info("ssh connectivity probe",
 						"host", cfg.VM.Host,
 						"port", cfg.VM.Port,
+						"jump_hosts", len(cfg.VM.JumpHosts),
 						"connect_timeout", cfg.Timeouts.SSHConnectDuration().String(),
 						"retries", cfg.Timeouts.SSHRetries,
 						"retry_delay", cfg.Timeouts.SSHRetryDelayDuration().String(),
 					)
 				}
-				stats, err := waitForTCPPortWithStatsFn(
-					ctx,
-					cfg.VM.Host,
-					cfg.VM.Port,
-					cfg.Timeouts.SSHRetries,
-					cfg.Timeouts.SSHConnectDuration(),
-					cfg.Timeouts.SSHRetryDelayDuration(),
+				var (
+					stats ssh.TCPCheckStats
+					err   error
 				)
+				if len(cfg.VM.JumpHosts) > 0 {
+					stats, err = waitForTCPPortViaJumpsFn(
+						ctx,
+						execConfig(cfg),
+						cfg.Timeouts.SSHRetries,
+						cfg.Timeouts.SSHRetryDelayDuration(),
+					)
+				} else {
+					stats, err = waitForTCPPortWithStatsFn(
+						ctx,
+						cfg.VM.Host,
+						cfg.VM.Port,
+						cfg.Timeouts.SSHRetries,
+						cfg.Timeouts.SSHConnectDuration(),
+						cfg.Timeouts.SSHRetryDelayDuration(),
+					)
+				}
 				if err != nil {
 					return err
 				}
+				dialStarted := time.Now()
+				sctx, closeFn, err := OpenSession(ctx, cfg)
+				if err != nil {
+					return err
+				}
+				sessionCtx, closeSession = sctx, closeFn
 				if opts.HumanProgress {
 					logger.Debug("ssh connectivity ready",
 						"attempts_used", stats.Attempts,
 						"elapsed", stats.Elapsed.Truncate(time.Millisecond).String(),
+						"session_dial", time.Since(dialStarted).Truncate(time.Millisecond).String(),
 					)
 				} else {
 					logger.Info("ssh connectivity ready",
 						"attempts_used", stats.Attempts,
 						"elapsed", stats.Elapsed.Truncate(time.Millisecond).String(),
+						"session_dial", time.Since(dialStarted).Truncate(time.Millisecond).String(),
 					)
 				}
 				return nil
 			},
 		},
 		{
-			name: "os_hardening",
-			desc: "Apply idempotent OS hardening baseline",
+			name: "preflight",
+			desc: "Gather remote facts and check minimums",
+			run: func(ctx context.Context) error {
+				if !cfg.Preflight.Enabled {
+					logger.Debug("preflight disabled")
+					return nil
+				}
+				facts, err := runPreflightFn(ctx, logger, cfg)
+				res.Preflight = facts
+				return err
+			},
+		},
+		{
+			name:   "os_hardening",
+			desc:   "Apply idempotent OS hardening baseline",
+			inputs: []any{cfg.Hardening, cfg.VM.Port, proxyInput(cfg)},
 			run: func(ctx context.Context) error {
 				return runOSHardeningFn(ctx, logger, cfg)
 			},
+			check: func(ctx context.Context) ([]string, error) {
+				return checkOSHardeningFn(ctx, logger, cfg)
+			},
 		},
 		{
-			name: "docker_install",
-			desc: "Install pinned Docker version",
+			name:   "docker_install",
+			desc:   "Install pinned Docker version",
+			inputs: []any{cfg.Docker, cfg.VM.User, proxyInput(cfg), cfg.Offline, cfg.Cluster.Name, cfg.Cluster.StateDir},
 			run: func(ctx context.Context) error {
 				return runDockerInstallFn(ctx, logger, cfg)
 			},
+			check: func(ctx context.Context) ([]string, error) {
+				return checkDockerInstallFn(ctx, logger, cfg)
+			},
 		},
 		{
-			name: "talosctl_install",
-			desc: "Install pinned talosctl and verify checksum",
+			name:   "talosctl_install",
+			desc:   "Install pinned talosctl and verify checksum",
+			inputs: []any{cfg.Talos, proxyInput(cfg), cfg.Offline},
 			run: func(ctx context.Context) error {
 				return runTalosctlInstallFn(ctx, logger, cfg)
 			},
+			check: func(ctx context.Context) ([]string, error) {
+				return checkTalosctlInstallFn(ctx, logger, cfg)
+			},
 		},
 		{
-			name: "cluster_create",
-			desc: "Create Talos-in-Docker cluster if missing",
+			name:   "cluster_create",
+			desc:   "Create Talos-in-Docker cluster if missing",
+			inputs: []any{cfg.Cluster, cfg.Talos.Version, cfg.VM.User, proxyInput(cfg), configPatchInput(cfg), cfg.Offline},
 			run: func(ctx context.Context) error {
 				return runClusterCreateFn(ctx, logger, cfg)
 			},
+			check: func(ctx context.Context) ([]string, error) {
+				return checkClusterCreateFn(ctx, logger, cfg)
+			},
 		},
 	}
 
@@ -160,28 +273,62 @@ func Run(ctx context.Context, logger *slog.Logger, cfg config.Config, opts Optio
 				"description", s.desc,
 			)
 		}
+		inputsHash := hashStepInputs(s.name, s.inputs)
+		reason := stepSelection(only, skip, s.name)
+		if reason == "" && opts.Resume && !opts.Check && journal != nil && journal.succeededWith(s.name, inputsHash) {
+			reason = "already succeeded with unchanged inputs"
+		}
+		if reason != "" {
+			if opts.HumanProgress {
+				fmt.Printf("  \033[33m↷ skipped\033[0m %s\n", reason)
+			} else {
+				logger.Info("step skipped", "step", s.name, "reason", reason)
+			}
+			res.Steps = append(res.Steps, Step{Name: s.name, Status: model.StepStatusSkipped, Message: reason})
+			continue
+		}
 		started := time.Now()
 		stopHeartbeat := func() {}
+		output := &stepOutput{step: s.name, logger: logger}
 		if opts.HumanProgress {
-			stopHeartbeat = startStepHeartbeat(s.name)
+			output.tail = newStepTail(os.Stdout, s.name)
+			stopHeartbeat = startStepHeartbeat(output.tail)
 		}
 		if !opts.HumanProgress {
 			logger.Info("step start", "step", s.name, "description", s.desc)
 		}
-		err := s.run(ctx)
+		var (
+			err     error
+			changes []string
+		)
+		if opts.Check && s.check != nil {
+			changes, err = s.check(sessionCtx)
+		} else if err = checkStepRequirements(sessionCtx, cfg, only, skip, s.name); err == nil {
+			err = s.run(ssh.ContextWithOutput(sessionCtx, output.line))
+		}
 		stopHeartbeat()
+		if output.tail != nil {
+			output.tail.finish(err != nil)
+		}
 		d := time.Since(started)
 		if err != nil {
 			if opts.HumanProgress {
 				fmt.Printf("  \033[31m✗ failed\033[0m in %s\n", d.Truncate(time.Millisecond))
 			}
-			res.Steps = append(res.Steps, Step{Name: s.name, Status: model.StepStatusFailed, Duration: d, Message: err.Error()})
+			res.Steps = append(res.Steps, Step{Name: s.name, Status: model.StepStatusFailed, Duration: d, Message: err.Error(), Output: output.String()})
+			saveJournal(logger, journal, journalPath, s.name, model.StepStatusFailed, inputsHash)
 			res.Status = "failed"
 			res.Error = fmt.Sprintf("step %s failed: %v", s.name, err)
 			res.EndedAt = time.Now().UTC()
 			return res, errors.New(res.Error)
 		}
-		res.Steps = append(res.Steps, Step{Name: s.name, Status: model.StepStatusSuccess, Duration: d})
+		if opts.Check && s.check != nil {
+			res.Steps = append(res.Steps, checkedStep(s.name, d, changes))
+			reportCheckedStep(logger, opts.HumanProgress, s.name, changes)
+			continue
+		}
+		res.Steps = append(res.Steps, Step{Name: s.name, Status: model.StepStatusSuccess, Duration: d, Output: output.String()})
+		saveJournal(logger, journal, journalPath, s.name, model.StepStatusSuccess, inputsHash)
 		donePct := current * 100 / total
 		if opts.HumanProgress {
 			fmt.Printf("  \033[32m✓ done\033[0m in %s \033[90m[%d/%d %d%%]\033[0m\n", d.Truncate(time.Millisecond), current, total, donePct)
@@ -195,28 +342,87 @@ func Run(ctx context.Context, logger *slog.Logger, cfg config.Config, opts Optio
 	}
 
 	res.Status = "success"
+	if opts.Check {
+		res.Status = "checked"
+	}
 	res.EndedAt = time.Now().UTC()
 	return res, nil
 }
 
+func checkedStep(name string, d time.Duration, changes []string) Step {
+	if len(changes) == 0 {
+		return Step{Name: name, Status: model.StepStatusNoChange, Duration: d, Message: "already in target state"}
+	}
+	return Step{Name: name, Status: model.StepStatusWouldChange, Duration: d, Message: fmt.Sprintf("%d change(s)", len(changes)), WouldChange: changes}
+}
+
+func reportCheckedStep(logger *slog.Logger, human bool, name string, changes []string) {
+	if !human {
+		logger.Info("step check", "step", name, "would_change", len(changes) > 0, "changes", changes)
+		return
+	}
+	if len(changes) == 0 {
+		fmt.Printf("  \033[32m✓ no change\033[0m\n")
+		return
+	}
+	fmt.Printf("  \033[33m~ would change\033[0m\n")
+	for _, c := range changes {
+		fmt.Printf("    - %s\n", c)
+	}
+}
+
+// openJournal loads the run journal for cfg when opts.JournalDir is set. An
+// unreadable journal is replaced, so nothing is skipped.
+func openJournal(logger *slog.Logger, cfg config.Config, opts Options) (*Journal, string) {
+	dir := strings.TrimSpace(opts.JournalDir)
+	if dir == "" {
+		return nil, ""
+	}
+	path := JournalPath(dir, cfg.VM.Host, cfg.Cluster.Name)
+	journal, err := loadJournal(path, cfg.VM.Host, cfg.Cluster.Name)
+	if err != nil {
+		logger.Warn("ignoring run journal", "path", path, "error", err)
+	}
+	return &journal, path
+}
+
+// saveJournal records a step outcome. Failing to persist the journal only
+// costs a later --resume, so it is logged rather than failing the run.
+func saveJournal(logger *slog.Logger, journal *Journal, path, step string, status model.StepStatus, inputsHash string) {
+	if journal == nil {
+		return
+	}
+	journal.record(step, status, inputsHash)
+	if err := journal.save(path); err != nil {
+		logger.Warn("run journal not saved", "path", path, "error", err)
+	}
+}
+
 func humanStepLabel(step string) string {
 	return strings.ReplaceAll(step, "_", "-")
 }
 
-func startStepHeartbeat(step string) func() {
+// startStepHeartbeat refreshes the tail's elapsed time every few seconds so
+// quiet steps still show progress. The returned func stops it and waits for
+// the last refresh to finish.
+func startStepHeartbeat(tail *stepTail) func() {
 	done := make(chan struct{})
-	started := time.Now()
+	stopped := make(chan struct{})
 	go func() {
+		defer close(stopped)
 		ticker := time.NewTicker(5 * time.Second)
 		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
-				fmt.Printf("  \033[90m... %s running (%s)\033[0m\n", humanStepLabel(step), time.Since(started).Truncate(time.Second))
+				tail.tick()
 			case <-done:
 				return
 			}
 		}
 	}()
-	return func() { close(done) }
+	return func() {
+		close(done)
+		<-stopped
+	}
 }
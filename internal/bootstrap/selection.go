@@ -0,0 +1,114 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/ssh"
+)
+
+// stepNames lists the bootstrap steps in execution order. ssh_connectivity
+// opens the session every other step uses, so it always runs. preflight
+// guards whatever else runs, so --only keeps it; only --skip drops it.
+var stepNames = []string{"ssh_connectivity", "preflight", "os_hardening", "docker_install", "talosctl_install", "cluster_create"}
+
+const (
+	alwaysRunStep = "ssh_connectivity"
+	preflightStep = "preflight"
+)
+
+// StepNames returns the bootstrap step names in execution order.
+func StepNames() []string {
+	return append([]string(nil), stepNames...)
+}
+
+// stepRequirement is something a step needs from an earlier step. When that
+// step is not selected, probe must succeed on the VM instead.
+type stepRequirement struct {
+	step  string
+	what  string
+	probe string
+}
+
+var stepRequirements = map[string][]stepRequirement{
+	"cluster_create": {
+		{step: "docker_install", what: "docker", probe: "command -v docker >/dev/null 2>&1"},
+		{step: "talosctl_install", what: "talosctl", probe: "command -v talosctl >/dev/null 2>&1"},
+	},
+}
+
+// NormalizeStepNames trims names, accepts the hyphenated labels shown in
+// human progress output (cluster-create) and drops empty entries.
+func NormalizeStepNames(names []string) []string {
+	out := make([]string, 0, len(names))
+	for _, n := range names {
+		n = strings.ReplaceAll(strings.ToLower(strings.TrimSpace(n)), "-", "_")
+		if n != "" {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// ValidateStepSelection checks --only/--skip step names.
+func ValidateStepSelection(only, skip []string) error {
+	only, skip = NormalizeStepNames(only), NormalizeStepNames(skip)
+	if len(only) > 0 && len(skip) > 0 {
+		return fmt.Errorf("--only and --skip cannot be combined")
+	}
+	for _, n := range append(append([]string(nil), only...), skip...) {
+		if !containsStep(stepNames, n) {
+			return fmt.Errorf("unknown step %q (valid steps: %s)", n, strings.Join(stepNames, ", "))
+		}
+	}
+	if containsStep(skip, alwaysRunStep) {
+		return fmt.Errorf("step %s cannot be skipped: every other step runs over the session it opens", alwaysRunStep)
+	}
+	return nil
+}
+
+// stepSelection reports why a step is deselected, or "" when it runs.
+func stepSelection(only, skip []string, step string) string {
+	if step == alwaysRunStep {
+		return ""
+	}
+	if len(only) > 0 && !containsStep(only, step) && step != preflightStep {
+		return "not selected by --only"
+	}
+	if containsStep(skip, step) {
+		return "excluded by --skip"
+	}
+	return ""
+}
+
+// checkStepRequirements verifies, for every deselected step that step
+// depends on, that what it would have provided is already on the VM.
+func checkStepRequirements(ctx context.Context, cfg config.Config, only, skip []string, step string) error {
+	for _, req := range stepRequirements[step] {
+		if stepSelection(only, skip, req.step) == "" {
+			continue
+		}
+		_, _, err := sshRunCommandFn(ctx, execConfig(cfg), req.probe)
+		if err == nil {
+			continue
+		}
+		// command -v exits 1 for a missing command; anything else means
+		// the probe itself failed.
+		if status, ok := ssh.ExitStatus(err); ok && status == 1 {
+			return fmt.Errorf("%s requires %s, which is not selected, and %s is not installed on the VM; include %s in the run", step, req.step, req.what, req.step)
+		}
+		return fmt.Errorf("%s requires %s, which is not selected; check for %s on the VM: %w", step, req.step, req.what, err)
+	}
+	return nil
+}
+
+func containsStep(list []string, step string) bool {
+	for _, s := range list {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
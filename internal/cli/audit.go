@@ -0,0 +1,103 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/bootstrap"
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
+	"github.com/infrakit-io/talos-docker-bootstrap/pkg/model"
+	"github.com/spf13/cobra"
+)
+
+func newHardeningAuditCmd() *cobra.Command {
+	var (
+		configPath string
+		jsonOut    bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "hardening-audit",
+		Short: "Check the VM against the OS hardening baseline without changing it",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			logger, err := newLogger(logFormat, logLevel)
+			if err != nil {
+				return err
+			}
+			cfg, err := config.Load(configPath)
+			if err != nil {
+				return err
+			}
+			human := !jsonOut && strings.EqualFold(logFormat, "text")
+			restorePrompt := maybeSetKnownHostsPrompt(cfg, human)
+			defer restorePrompt()
+
+			ctx, cancel := context.WithTimeout(cmd.Context(), cfg.Timeouts.TotalDuration())
+			defer cancel()
+			ctx, closeSession, err := bootstrap.OpenSession(ctx, cfg)
+			if err != nil {
+				return explainClusterOpError(err, cfg)
+			}
+			defer closeSession()
+
+			controls, err := bootstrap.HardeningAudit(ctx, logger, cfg)
+			if err != nil {
+				return explainClusterOpError(err, cfg)
+			}
+			failed := 0
+			for _, c := range controls {
+				if !c.Passed {
+					failed++
+				}
+			}
+
+			switch {
+			case jsonOut:
+				if perr := printJSON(struct {
+					VMHost   string               `json:"vm_host"`
+					Passed   bool                 `json:"passed"`
+					Controls []model.AuditControl `json:"controls"`
+				}{cfg.VM.Host, failed == 0, controls}); perr != nil {
+					return perr
+				}
+			case human:
+				printAuditControls(cfg.VM.Host, controls)
+			default:
+				for _, c := range controls {
+					logger.Info("hardening control", "name", c.Name, "expected", c.Expected, "actual", c.Actual, "passed", c.Passed)
+				}
+			}
+			if failed > 0 {
+				return &userError{
+					msg:  fmt.Sprintf("hardening audit failed: %d of %d controls do not match the baseline", failed, len(controls)),
+					hint: "Run bootstrap with hardening.enabled: true to re-apply the baseline, or adjust the hardening section of the config",
+				}
+			}
+			return nil
+		},
+	}
+
+	defCfg := defaultConfigPath()
+	cmd.Flags().StringVar(&configPath, "config", defCfg, "Path to YAML config file")
+	cmd.Flags().BoolVar(&jsonOut, "json", false, "Print machine-readable controls JSON")
+	if defCfg == "" {
+		_ = cmd.MarkFlagRequired("config")
+	}
+	return cmd
+}
+
+func printAuditControls(host string, controls []model.AuditControl) {
+	fmt.Printf("\033[1mHardening audit\033[0m \033[36m%s\033[0m\n", host)
+	for _, c := range controls {
+		mark := "\033[32m✓\033[0m"
+		if !c.Passed {
+			mark = "\033[31m✗\033[0m"
+		}
+		line := fmt.Sprintf("  %s %-44s %s", mark, c.Name, c.Actual)
+		if !c.Passed {
+			line += fmt.Sprintf(" \033[90m(expected %s)\033[0m", c.Expected)
+		}
+		fmt.Println(line)
+	}
+}
@@ -4,12 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/infrakit-io/talos-docker-bootstrap/internal/bootstrap"
 	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
+	"github.com/infrakit-io/talos-docker-bootstrap/pkg/model"
 	"github.com/spf13/cobra"
 )
 
@@ -18,6 +20,10 @@ func newBootstrapCmd() *cobra.Command {
 		configPath string
 		dryRun     bool
 		jsonOut    bool
+		resume     bool
+		check      bool
+		only       []string
+		skip       []string
 	)
 
 	cmd := &cobra.Command{
@@ -29,6 +35,9 @@ func newBootstrapCmd() *cobra.Command {
 				return err
 			}
 			warnPinnedAssetDrift()
+			if err := validateStepFlags(only, skip); err != nil {
+				return err
+			}
 
 			cfg, err := config.Load(configPath)
 			if err != nil {
@@ -43,7 +52,12 @@ func newBootstrapCmd() *cobra.Command {
 			human := !jsonOut && strings.EqualFold(logFormat, "text")
 			res, err := bootstrap.Run(ctx, logger, cfg, bootstrap.Options{
 				DryRun:        dryRun,
+				Check:         check,
 				HumanProgress: human,
+				JournalDir:    bootstrap.DefaultJournalDir(),
+				Resume:        resume,
+				Only:          only,
+				Skip:          skip,
 			})
 			if err != nil {
 				if jsonOut {
@@ -55,6 +69,10 @@ func newBootstrapCmd() *cobra.Command {
 			if jsonOut {
 				return printJSON(res)
 			}
+			if check {
+				reportCheckResult(logger, human, res)
+				return nil
+			}
 
 			if human {
 				fmt.Printf("\n\033[32m✓ bootstrap completed\033[0m\n")
@@ -76,6 +94,11 @@ func newBootstrapCmd() *cobra.Command {
 	cmd.Flags().StringVar(&configPath, "config", defCfg, "Path to YAML config file")
 	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Validate and print planned operations without changes")
 	cmd.Flags().BoolVar(&jsonOut, "json", false, "Print machine-readable result JSON")
+	cmd.Flags().BoolVar(&resume, "resume", false, "Skip steps that already succeeded with unchanged inputs (from the run journal)")
+	addStepSelectionFlags(cmd, &only, &skip)
+	cmd.Flags().BoolVar(&check, "check", false, "Connect read-only and report per step what would change")
+	cmd.MarkFlagsMutuallyExclusive("check", "dry-run")
+	cmd.MarkFlagsMutuallyExclusive("check", "resume")
 	if defCfg == "" {
 		_ = cmd.MarkFlagRequired("config")
 	}
@@ -83,6 +106,45 @@ func newBootstrapCmd() *cobra.Command {
 	return cmd
 }
 
+// addStepSelectionFlags registers --only/--skip for commands that run the
+// bootstrap steps.
+func addStepSelectionFlags(cmd *cobra.Command, only, skip *[]string) {
+	steps := strings.Join(bootstrap.StepNames(), ", ")
+	cmd.Flags().StringSliceVar(only, "only", nil, "Run only these bootstrap steps (comma-separated: "+steps+")")
+	cmd.Flags().StringSliceVar(skip, "skip", nil, "Skip these bootstrap steps (comma-separated: "+steps+")")
+	cmd.MarkFlagsMutuallyExclusive("only", "skip")
+}
+
+func validateStepFlags(only, skip []string) error {
+	if err := bootstrap.ValidateStepSelection(only, skip); err != nil {
+		return &userError{
+			msg:  err.Error(),
+			hint: "Valid steps: " + strings.Join(bootstrap.StepNames(), ", ") + ". ssh_connectivity always runs.",
+		}
+	}
+	return nil
+}
+
+// reportCheckResult summarizes a --check run.
+func reportCheckResult(logger *slog.Logger, human bool, res bootstrap.Result) {
+	changing := make([]string, 0, len(res.Steps))
+	for _, st := range res.Steps {
+		if st.Status == model.StepStatusWouldChange {
+			changing = append(changing, st.Name)
+		}
+	}
+	if !human {
+		logger.Info("check completed", "vm", res.VMHost, "cluster", res.Cluster, "would_change", changing)
+		return
+	}
+	if len(changing) == 0 {
+		fmt.Printf("\n\033[32m✓ check completed: VM is in target state\033[0m\n")
+		return
+	}
+	fmt.Printf("\n\033[33m~ check completed: %d step(s) would change\033[0m\n", len(changing))
+	fmt.Printf("  Steps:   \033[36m%s\033[0m\n", strings.Join(changing, ", "))
+}
+
 func printJSON(v any) error {
 	enc := json.NewEncoder(os.Stdout)
 	enc.SetIndent("", "  ")
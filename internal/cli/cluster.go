@@ -2,6 +2,7 @@ package cli
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/infrakit-io/talos-docker-bootstrap/internal/bootstrap"
 	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
+	sshutil "github.com/infrakit-io/talos-docker-bootstrap/internal/ssh"
 	"github.com/spf13/cobra"
 )
 
@@ -33,6 +35,11 @@ func newClusterStatusCmd() *cobra.Command {
 			defer restorePrompt()
 			ctx, cancel := context.WithTimeout(cmd.Context(), cfg.Timeouts.TotalDuration())
 			defer cancel()
+			ctx, closeSession, err := bootstrap.OpenSession(ctx, cfg)
+			if err != nil {
+				return explainClusterOpError(err, cfg)
+			}
+			defer closeSession()
 
 			out, err := bootstrap.ClusterStatus(ctx, logger, cfg)
 			if err != nil {
@@ -80,6 +87,11 @@ func newKubeconfigExportCmd() *cobra.Command {
 
 			ctx, cancel := context.WithTimeout(cmd.Context(), cfg.Timeouts.TotalDuration())
 			defer cancel()
+			ctx, closeSession, err := bootstrap.OpenSession(ctx, cfg)
+			if err != nil {
+				return explainClusterOpError(err, cfg)
+			}
+			defer closeSession()
 			kubeconfig, err := bootstrap.KubeconfigExport(ctx, logger, cfg)
 			if err != nil {
 				return explainClusterOpError(err, cfg)
@@ -128,6 +140,11 @@ func newMountCheckCmd() *cobra.Command {
 
 			ctx, cancel := context.WithTimeout(cmd.Context(), cfg.Timeouts.TotalDuration())
 			defer cancel()
+			ctx, closeSession, err := bootstrap.OpenSession(ctx, cfg)
+			if err != nil {
+				return explainClusterOpError(err, cfg)
+			}
+			defer closeSession()
 			if err := bootstrap.MountCheck(ctx, logger, cfg); err != nil {
 				return explainClusterOpError(err, cfg)
 			}
@@ -151,7 +168,36 @@ func explainClusterOpError(err error, cfg config.Config) error {
 			hint: "Run: make talos-bootstrap",
 		}
 	}
-	if strings.Contains(msg, "exit status 255") {
+	var mismatch *sshutil.HostKeyMismatchError
+	if errors.As(err, &mismatch) {
+		return &userError{
+			msg:  mismatch.Error(),
+			hint: "Verify the VM identity, then update vm.ssh_host_fingerprint or use vm.known_hosts_mode: prompt",
+		}
+	}
+	var unknown *sshutil.HostKeyUnknownError
+	if errors.As(err, &unknown) {
+		return &userError{
+			msg:  unknown.Error(),
+			hint: "Pin vm.ssh_host_fingerprint or use vm.known_hosts_mode: accept-new for first contact",
+		}
+	}
+	var hostCertErr *sshutil.HostCertificateError
+	if errors.As(err, &hostCertErr) {
+		return &userError{
+			msg:  hostCertErr.Error(),
+			hint: "Re-issue the VM host certificate from the CA, or check vm.ssh_host_ca points to the right CA key",
+		}
+	}
+	var userCertErr *sshutil.UserCertificateError
+	if errors.As(err, &userCertErr) {
+		return &userError{
+			msg:  userCertErr.Error(),
+			hint: "Request a fresh user certificate for " + cfg.VM.User + " and update vm.ssh_certificate",
+		}
+	}
+	var connErr *sshutil.ConnectError
+	if errors.As(err, &connErr) || strings.Contains(msg, "exit status 255") {
 		return &userError{
 			msg:  fmt.Sprintf("ssh connection to %s@%s:%d failed", cfg.VM.User, cfg.VM.Host, cfg.VM.Port),
 			hint: "Verify VM reachability/credentials, then run: make vm-deploy (if VM missing) or make talos-bootstrap",
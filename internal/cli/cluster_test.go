@@ -2,9 +2,12 @@ package cli
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
+	sshutil "github.com/infrakit-io/talos-docker-bootstrap/internal/ssh"
 )
 
 func TestExplainClusterOpError(t *testing.T) {
@@ -23,4 +26,28 @@ func TestExplainClusterOpError(t *testing.T) {
 	if !ok || ue.Hint() == "" {
 		t.Fatalf("expected userError with hint for ssh failure")
 	}
+
+	err = explainClusterOpError(fmt.Errorf("cluster status: %w", &sshutil.HostKeyMismatchError{Host: "1.2.3.4", Expected: "SHA256:a", Got: "SHA256:b"}), cfg)
+	ue, ok = err.(*userError)
+	if !ok || ue.Hint() == "" || !strings.Contains(ue.Error(), "SHA256:b") {
+		t.Fatalf("expected userError with hint for host key mismatch, got %v", err)
+	}
+
+	err = explainClusterOpError(&sshutil.ConnectError{Addr: "1.2.3.4:22", Err: errors.New("connection refused")}, cfg)
+	ue, ok = err.(*userError)
+	if !ok || ue.Hint() == "" {
+		t.Fatalf("expected userError with hint for native connect failure")
+	}
+
+	err = explainClusterOpError(&sshutil.ConnectError{Addr: "1.2.3.4:22", Err: &sshutil.HostCertificateError{Host: "1.2.3.4", Reason: "expired"}}, cfg)
+	ue, ok = err.(*userError)
+	if !ok || !strings.Contains(ue.Error(), "host certificate") || !strings.Contains(ue.Hint(), "vm.ssh_host_ca") {
+		t.Fatalf("expected host certificate userError, got %v", err)
+	}
+
+	err = explainClusterOpError(&sshutil.UserCertificateError{File: "/keys/id-cert.pub", Reason: "expired"}, cfg)
+	ue, ok = err.(*userError)
+	if !ok || !strings.Contains(ue.Hint(), "vm.ssh_certificate") {
+		t.Fatalf("expected user certificate userError, got %v", err)
+	}
 }
@@ -20,6 +20,7 @@ import (
 
 	survey "github.com/AlecAivazis/survey/v2"
 	wizard "github.com/infrakit-io/cli-wizard-core"
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
 	sshutil "github.com/infrakit-io/talos-docker-bootstrap/internal/ssh"
 	vmtool "github.com/infrakit-io/talos-docker-bootstrap/internal/tooling/vmbootstrap"
 	vmconfig "github.com/infrakit-io/vmware-vm-bootstrap/pkg/config"
@@ -29,32 +30,61 @@ import (
 
 type stage2File struct {
 	VM struct {
-		Host               string `yaml:"host"`
-		Port               int    `yaml:"port"`
-		User               string `yaml:"user"`
-		SSHPrivateKey      string `yaml:"ssh_private_key"`
-		KnownHostsFile     string `yaml:"known_hosts_file"`
-		KnownHostsMode     string `yaml:"known_hosts_mode"`
-		SSHHostFingerprint string `yaml:"ssh_host_fingerprint"`
+		Host               string                  `yaml:"host"`
+		Port               int                     `yaml:"port"`
+		User               string                  `yaml:"user"`
+		SSHPrivateKey      string                  `yaml:"ssh_private_key"`
+		KnownHostsFile     string                  `yaml:"known_hosts_file"`
+		KnownHostsMode     string                  `yaml:"known_hosts_mode"`
+		SSHHostFingerprint config.Fingerprints     `yaml:"ssh_host_fingerprint"`
+		SSHHostKeyAlgos    []string                `yaml:"ssh_host_key_algorithms,omitempty"`
+		SSHTransport       string                  `yaml:"ssh_transport"`
+		SSHAuth            string                  `yaml:"ssh_auth"`
+		SSHAgentIdentity   string                  `yaml:"ssh_agent_identity"`
+		SSHCertificate     string                  `yaml:"ssh_certificate"`
+		SSHHostCA          string                  `yaml:"ssh_host_ca"`
+		JumpHosts          []config.JumpHostConfig `yaml:"jump_hosts"`
 	} `yaml:"vm"`
 	Hardening struct {
-		Enabled          bool  `yaml:"enabled"`
-		AllowPasswordSSH bool  `yaml:"allow_password_ssh"`
-		EnableUFW        bool  `yaml:"enable_ufw"`
-		AllowTCPPorts    []int `yaml:"allow_tcp_ports"`
+		Enabled           bool                  `yaml:"enabled"`
+		AllowPasswordSSH  bool                  `yaml:"allow_password_ssh"`
+		EnableUFW         bool                  `yaml:"enable_ufw"`
+		AllowTCPPorts     []int                 `yaml:"allow_tcp_ports"`
+		AllowSourceCIDRs  []string              `yaml:"allow_source_cidrs,omitempty"`
+		FirewallRules     []config.FirewallRule `yaml:"firewall_rules,omitempty"`
+		FilterDockerPorts *bool                 `yaml:"filter_docker_ports,omitempty"`
+		Profile           string                `yaml:"profile,omitempty"`
+		Fail2ban          *bool                 `yaml:"fail2ban,omitempty"`
+		Auditd            *bool                 `yaml:"auditd,omitempty"`
+		AppArmor          *bool                 `yaml:"apparmor,omitempty"`
+		NTPServers        []string              `yaml:"ntp_servers,omitempty"`
+		LoginBanner       string                `yaml:"login_banner,omitempty"`
+		SSHAllowUsers     []string              `yaml:"ssh_allow_users,omitempty"`
+		SSHAllowGroups    []string              `yaml:"ssh_allow_groups,omitempty"`
+		Sysctls           map[string]string     `yaml:"sysctls,omitempty"`
 	} `yaml:"hardening"`
 	Docker struct {
 		Version string `yaml:"version"`
 	} `yaml:"docker"`
 	Talos struct {
-		Version        string `yaml:"version"`
-		SHA256Checksum string `yaml:"sha256_checksum"`
+		Version         string            `yaml:"version"`
+		SHA256Checksums map[string]string `yaml:"sha256_checksums,omitempty"`
+		SHA256Checksum  string            `yaml:"sha256_checksum,omitempty"`
 	} `yaml:"talos"`
 	Cluster struct {
-		Name     string `yaml:"name"`
-		StateDir string `yaml:"state_dir"`
-		MountSrc string `yaml:"mount_src"`
-		MountDst string `yaml:"mount_dst"`
+		Name              string               `yaml:"name"`
+		StateDir          string               `yaml:"state_dir"`
+		MountSrc          string               `yaml:"mount_src,omitempty"`
+		MountDst          string               `yaml:"mount_dst,omitempty"`
+		Mounts            []config.Mount       `yaml:"mounts,omitempty"`
+		Controlplanes     int                  `yaml:"controlplanes,omitempty"`
+		Workers           int                  `yaml:"workers,omitempty"`
+		Controlplane      config.NodeResources `yaml:"controlplane,omitempty"`
+		Worker            config.NodeResources `yaml:"worker,omitempty"`
+		KubernetesVersion string               `yaml:"kubernetes_version,omitempty"`
+		TalosImage        string               `yaml:"talos_image,omitempty"`
+		ImageRegistry     string               `yaml:"image_registry,omitempty"`
+		ConfigPatches     config.ConfigPatches `yaml:"config_patches,omitempty"`
 	} `yaml:"cluster"`
 	Timeouts struct {
 		SSHConnectSeconds int `yaml:"ssh_connect_seconds"`
@@ -98,8 +128,12 @@ type toolVersionMetadata struct {
 		LatestReleaseDate string `yaml:"latest_release_date"`
 	} `yaml:"docker"`
 	Talosctl struct {
-		LatestVersion       string            `yaml:"latest_version"`
-		LatestReleaseDate   string            `yaml:"latest_release_date"`
+		LatestVersion     string `yaml:"latest_version"`
+		LatestReleaseDate string `yaml:"latest_release_date"`
+		// ChecksumsLinux maps a version to talosctl-linux-<arch> checksums
+		// keyed by arch.
+		ChecksumsLinux map[string]map[string]string `yaml:"checksums_linux"`
+		// ChecksumsLinuxAMD64 is the older amd64-only form.
 		ChecksumsLinuxAMD64 map[string]string `yaml:"checksums_linux_amd64"`
 	} `yaml:"talosctl"`
 }
@@ -280,15 +314,36 @@ func upsertStage2(path string, edit bool, draftPath string) error {
 	cfg.VM.Host = askString("VM host", cfg.VM.Host)
 	cfg.VM.Port = askInt("VM SSH port", cfg.VM.Port)
 	cfg.VM.User = askString("VM user", cfg.VM.User)
-	cfg.VM.SSHPrivateKey = askString("VM SSH private key path", cfg.VM.SSHPrivateKey)
+	cfg.VM.SSHAuth = askOption("SSH authentication", sshAuthOrDefault(cfg.VM.SSHAuth), []string{"key", "agent"})
+	if cfg.VM.SSHAuth == "agent" {
+		cfg.VM.SSHAgentIdentity = askString("Agent key (pub file, SHA256 fingerprint or comment; blank = any)", cfg.VM.SSHAgentIdentity)
+	} else {
+		cfg.VM.SSHAgentIdentity = ""
+		cfg.VM.SSHPrivateKey = askString("VM SSH private key path", cfg.VM.SSHPrivateKey)
+	}
 	cfg.VM.KnownHostsFile = askString("Known hosts file", cfg.VM.KnownHostsFile)
 	cfg.VM.KnownHostsMode = normalizeKnownHostsModeOrDefault(cfg.VM.KnownHostsMode)
-	if strings.TrimSpace(cfg.VM.SSHHostFingerprint) == "" {
+	if askBool("Connect through jump hosts (bastion)", len(cfg.VM.JumpHosts) > 0) {
+		cfg.VM.JumpHosts = askJumpHosts(cfg.VM.JumpHosts)
+	} else {
+		cfg.VM.JumpHosts = nil
+	}
+	if askBool("Use SSH certificates (CA-signed host/user keys)", cfg.VM.SSHHostCA != "" || cfg.VM.SSHCertificate != "") {
+		cfg.VM.SSHHostCA = askString("Host CA public key file (blank = none)", cfg.VM.SSHHostCA)
+		cfg.VM.SSHCertificate = askString("User certificate file (blank = none)", cfg.VM.SSHCertificate)
+	} else {
+		cfg.VM.SSHHostCA = ""
+		cfg.VM.SSHCertificate = ""
+	}
+	// A host CA replaces trust-on-first-use, so there is nothing to scan.
+	if len(cfg.VM.SSHHostFingerprint) == 0 && strings.TrimSpace(cfg.VM.SSHHostCA) == "" {
 		cfg.VM.SSHHostFingerprint = detectSSHHostFingerprint(cfg)
 	}
 	if askBool("Customize SSH trust settings (advanced)", false) {
 		cfg.VM.KnownHostsMode = askKnownHostsMode("Known hosts mode", cfg.VM.KnownHostsMode)
-		cfg.VM.SSHHostFingerprint = askString("SSH host fingerprint (SHA256:...)", cfg.VM.SSHHostFingerprint)
+		cfg.VM.SSHHostKeyAlgos = askStringList("SSH host key algorithms (blank = ssh-ed25519)", cfg.VM.SSHHostKeyAlgos)
+		cfg.VM.SSHHostFingerprint = config.Fingerprints(askStringList("SSH host fingerprints (SHA256:...)", cfg.VM.SSHHostFingerprint))
+		cfg.VM.SSHTransport = askOption("SSH transport", cfg.VM.SSHTransport, []string{"openssh", "native"})
 	}
 
 	cfg.Hardening.Enabled = askBool("Apply OS security hardening", cfg.Hardening.Enabled)
@@ -303,19 +358,41 @@ func upsertStage2(path string, edit bool, draftPath string) error {
 
 	cfg.Docker.Version = askString(versionPrompt("Docker version", toolVersions.Docker.LatestVersion, toolVersions.Docker.LatestReleaseDate), cfg.Docker.Version)
 	cfg.Talos.Version = askString(versionPrompt("Talosctl version", toolVersions.Talosctl.LatestVersion, toolVersions.Talosctl.LatestReleaseDate), cfg.Talos.Version)
-	checksum, err := resolveTalosChecksum(toolVersions, cfg.Talos.Version)
+	checksums, err := resolveTalosChecksums(toolVersions, cfg.Talos.Version)
 	if err != nil {
 		return fmt.Errorf("resolve talosctl checksum for version %q: %w", cfg.Talos.Version, err)
 	}
-	cfg.Talos.SHA256Checksum = checksum
+	if missing := missingTalosArchitectures(checksums); len(missing) > 0 {
+		fmt.Printf("  \033[33m⚠ No talosctl checksum found for %s; VMs with that architecture will fail preflight\033[0m\n", strings.Join(missing, ", "))
+	}
+	cfg.Talos.SHA256Checksums = checksums
+	cfg.Talos.SHA256Checksum = ""
 	applyClusterNameFallback(&cfg)
 
 	previousClusterName := cfg.Cluster.Name
 	cfg.Cluster.Name = askString("Cluster name", cfg.Cluster.Name)
 	cfg.Cluster.StateDir = adjustStateDirForClusterName(cfg.Cluster.StateDir, previousClusterName, cfg.Cluster.Name)
 	cfg.Cluster.StateDir = askString("Cluster state dir", cfg.Cluster.StateDir)
-	cfg.Cluster.MountSrc = askString("Talos host path (mount source)", cfg.Cluster.MountSrc)
-	cfg.Cluster.MountDst = askString("Talos node path (mount destination)", cfg.Cluster.MountDst)
+	cfg.Cluster.Mounts = askMounts(config.ClusterConfig{Mounts: cfg.Cluster.Mounts, MountSrc: cfg.Cluster.MountSrc, MountDst: cfg.Cluster.MountDst}.MountList())
+	cfg.Cluster.MountSrc, cfg.Cluster.MountDst = "", ""
+	if askBool("Customize cluster nodes and sizing (advanced)", false) {
+		cfg.Cluster.Controlplanes = askInt("Controlplane nodes (0 = 1)", cfg.Cluster.Controlplanes)
+		cfg.Cluster.Workers = askInt("Worker nodes", cfg.Cluster.Workers)
+		cfg.Cluster.Controlplane = askNodeResources("Controlplane", cfg.Cluster.Controlplane)
+		if cfg.Cluster.Workers > 0 {
+			cfg.Cluster.Worker = askNodeResources("Worker", cfg.Cluster.Worker)
+		}
+	}
+	if askBool("Customize Kubernetes version and images (advanced)", false) {
+		cfg.Cluster.KubernetesVersion = askString("Kubernetes version (blank = talosctl default)", cfg.Cluster.KubernetesVersion)
+		cfg.Cluster.TalosImage = askString("Talos node image (blank = image of the Talos version)", cfg.Cluster.TalosImage)
+		cfg.Cluster.ImageRegistry = askString("Image registry replacing ghcr.io (blank = ghcr.io)", cfg.Cluster.ImageRegistry)
+	}
+	if askBool("Customize machine config patches (advanced)", false) {
+		cfg.Cluster.ConfigPatches.Global = askStringList("Patch files for all nodes", cfg.Cluster.ConfigPatches.Global)
+		cfg.Cluster.ConfigPatches.Controlplane = askStringList("Patch files for controlplane nodes", cfg.Cluster.ConfigPatches.Controlplane)
+		cfg.Cluster.ConfigPatches.Worker = askStringList("Patch files for worker nodes", cfg.Cluster.ConfigPatches.Worker)
+	}
 
 	if askBool("Customize connectivity/timeouts (advanced)", false) {
 		cfg.Timeouts.SSHConnectSeconds = askInt("SSH connect seconds", cfg.Timeouts.SSHConnectSeconds)
@@ -347,16 +424,82 @@ func askString(msg, def string) string {
 	return s
 }
 
+// askJumpHosts edits the bastion chain in dial order. Blank user or key
+// inherit the VM values.
+func askJumpHosts(def []config.JumpHostConfig) []config.JumpHostConfig {
+	count := len(def)
+	if count == 0 {
+		count = 1
+	}
+	for {
+		count = askInt("Number of jump hosts", count)
+		if count > 0 {
+			break
+		}
+		fmt.Println("  At least one jump host is required.")
+	}
+	out := make([]config.JumpHostConfig, count)
+	for i := range out {
+		hop := config.JumpHostConfig{Port: 22}
+		if i < len(def) {
+			hop = def[i]
+		}
+		if hop.Port <= 0 {
+			hop.Port = 22
+		}
+		label := fmt.Sprintf("Jump host %d", i+1)
+		hop.Host = askString(label+" address", hop.Host)
+		hop.Port = askInt(label+" SSH port", hop.Port)
+		hop.User = askString(label+" user (blank = VM user)", hop.User)
+		hop.SSHPrivateKey = askString(label+" SSH private key path (blank = VM key)", hop.SSHPrivateKey)
+		hop.SSHHostFingerprint = config.ParseFingerprints(askString(label+" SSH host fingerprints (SHA256:..., optional)", hop.SSHHostFingerprint.String()))
+		out[i] = hop
+	}
+	return out
+}
+
+// askMounts edits the cluster's bind mounts in order.
+func askMounts(def []config.Mount) []config.Mount {
+	count := len(def)
+	if count == 0 {
+		count = 1
+	}
+	for {
+		count = askInt("Number of host paths mounted into the nodes", count)
+		if count > 0 {
+			break
+		}
+		fmt.Println("  At least one mount is required.")
+	}
+	out := make([]config.Mount, count)
+	for i := range out {
+		m := config.Mount{}
+		if i < len(def) {
+			m = def[i]
+		}
+		label := fmt.Sprintf("Mount %d", i+1)
+		m.Src = askString(label+" host path (source)", m.Src)
+		m.Dst = askString(label+" node path (destination)", m.Dst)
+		m.ReadOnly = askBool(label+" read-only", m.ReadOnly)
+		out[i] = m
+	}
+	return out
+}
+
 func askKnownHostsMode(msg, def string) string {
-	options := []string{
+	return askOption(msg, def, []string{
 		"strict",
 		"prompt",
 		"accept-new",
 		"auto-refresh",
-	}
+	})
+}
+
+// askOption asks for one of options; an empty default falls back to the first option.
+func askOption(msg, def string, options []string) string {
 	def = strings.ToLower(strings.TrimSpace(def))
-	if def == "" {
-		def = "strict"
+	if def == "" && len(options) > 0 {
+		def = options[0]
 	}
 	for {
 		fmt.Printf("  %s [\033[36m%s\033[0m]: ", msg, def)
@@ -370,10 +513,17 @@ func askKnownHostsMode(msg, def string) string {
 				return raw
 			}
 		}
-		fmt.Printf("  Invalid mode. Options: %s\n", strings.Join(options, ", "))
+		fmt.Printf("  Invalid option. Options: %s\n", strings.Join(options, ", "))
 	}
 }
 
+func sshAuthOrDefault(auth string) string {
+	if strings.EqualFold(strings.TrimSpace(auth), "agent") {
+		return "agent"
+	}
+	return "key"
+}
+
 func normalizeKnownHostsModeOrDefault(mode string) string {
 	switch strings.ToLower(strings.TrimSpace(mode)) {
 	case "", "strict":
@@ -404,69 +554,111 @@ func versionPrompt(base, latestVersion, latestReleaseDate string) string {
 	return fmt.Sprintf("%s (latest known: %s, released %s)", base, latestVersion, latestReleaseDate)
 }
 
-func talosChecksumForVersion(meta toolVersionMetadata, version string) string {
+// talosChecksumsForVersion returns the known talosctl checksums for version,
+// keyed by arch.
+func talosChecksumsForVersion(meta toolVersionMetadata, version string) map[string]string {
 	v := strings.TrimSpace(version)
 	v = strings.TrimPrefix(v, "v")
-	if v == "" || len(meta.Talosctl.ChecksumsLinuxAMD64) == 0 {
-		return ""
+	if v == "" {
+		return nil
 	}
-	if sum := strings.TrimSpace(meta.Talosctl.ChecksumsLinuxAMD64[v]); sum != "" {
-		return sum
+	sums := map[string]string{}
+	for _, key := range []string{v, "v" + v} {
+		for arch, sum := range meta.Talosctl.ChecksumsLinux[key] {
+			if sum = strings.TrimSpace(sum); sum != "" && sums[arch] == "" {
+				sums[arch] = sum
+			}
+		}
+		if sum := strings.TrimSpace(meta.Talosctl.ChecksumsLinuxAMD64[key]); sum != "" && sums["amd64"] == "" {
+			sums["amd64"] = sum
+		}
 	}
-	if sum := strings.TrimSpace(meta.Talosctl.ChecksumsLinuxAMD64["v"+v]); sum != "" {
-		return sum
+	if len(sums) == 0 {
+		return nil
 	}
-	return ""
+	return sums
 }
 
-func resolveTalosChecksum(meta toolVersionMetadata, version string) (string, error) {
+// resolveTalosChecksums returns talosctl checksums for every supported arch,
+// from configs/tool-versions.yaml first and the release sha256sum.txt for the
+// rest. Arches the release does not list are left out.
+func resolveTalosChecksums(meta toolVersionMetadata, version string) (map[string]string, error) {
 	v := strings.TrimSpace(strings.TrimPrefix(version, "v"))
 	if v == "" {
-		return "", errors.New("empty talos version")
+		return nil, errors.New("empty talos version")
 	}
 
-	if sum := talosChecksumForVersion(meta, v); sum != "" {
-		return sum, nil
+	sums := talosChecksumsForVersion(meta, v)
+	if len(missingTalosArchitectures(sums)) == 0 {
+		return sums, nil
 	}
 
-	sum, err := fetchTalosChecksumFromRelease(v)
+	fetched, err := fetchTalosChecksumsFromRelease(v)
 	if err != nil {
-		return "", fmt.Errorf("checksum missing in configs/tool-versions.yaml and auto-fetch failed: %w", err)
+		if len(sums) > 0 {
+			return sums, nil
+		}
+		return nil, fmt.Errorf("checksum missing in configs/tool-versions.yaml and auto-fetch failed: %w", err)
+	}
+	if sums == nil {
+		sums = map[string]string{}
 	}
-	return sum, nil
+	for arch, sum := range fetched {
+		if sums[arch] == "" {
+			sums[arch] = sum
+		}
+	}
+	return sums, nil
 }
 
-func fetchTalosChecksumFromRelease(version string) (string, error) {
+func missingTalosArchitectures(sums map[string]string) []string {
+	var missing []string
+	for _, arch := range config.TalosArchitectures {
+		if sums[arch] == "" {
+			missing = append(missing, arch)
+		}
+	}
+	return missing
+}
+
+// fetchTalosChecksumsFromRelease reads the talosctl-linux-<arch> entries of
+// the release sha256sum.txt for every supported arch.
+func fetchTalosChecksumsFromRelease(version string) (map[string]string, error) {
 	url := fmt.Sprintf(talosReleaseChecksumsURLFmt, version)
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	client := &http.Client{Timeout: 8 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer func() { _ = resp.Body.Close() }()
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("download %s: %s", url, resp.Status)
+		return nil, fmt.Errorf("download %s: %s", url, resp.Status)
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	sums := map[string]string{}
 	for _, line := range strings.Split(string(body), "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" || !strings.HasSuffix(line, "talosctl-linux-amd64") {
+		parts := strings.Fields(line)
+		if len(parts) < 2 || len(parts[0]) != 64 {
 			continue
 		}
-		parts := strings.Fields(line)
-		if len(parts) >= 1 && len(parts[0]) == 64 {
-			return strings.ToLower(parts[0]), nil
+		for _, arch := range config.TalosArchitectures {
+			if strings.TrimPrefix(parts[1], "*") == "talosctl-linux-"+arch {
+				sums[arch] = strings.ToLower(parts[0])
+			}
 		}
 	}
-	return "", errors.New("talosctl-linux-amd64 checksum not found in release checksums")
+	if len(sums) == 0 {
+		return nil, errors.New("no talosctl-linux checksums found in release checksums")
+	}
+	return sums, nil
 }
 
 func askInt(msg string, def int) int {
@@ -483,6 +675,29 @@ func askInt(msg string, def int) int {
 	}
 }
 
+func askFloat(msg string, def float64) float64 {
+	for {
+		raw := readLineClean(fmt.Sprintf("  %s [\033[36m%s\033[0m]: ", msg, strconv.FormatFloat(def, 'f', -1, 64)))
+		if raw == "" {
+			return def
+		}
+		v, err := strconv.ParseFloat(raw, 64)
+		if err == nil {
+			return v
+		}
+		fmt.Println("  Invalid number.")
+	}
+}
+
+// askNodeResources edits the sizing of one node role. Zero keeps the
+// talosctl default.
+func askNodeResources(role string, def config.NodeResources) config.NodeResources {
+	def.CPUs = askFloat(fmt.Sprintf("%s CPUs per node (0 = %g)", role, config.DefaultNodeCPUs), def.CPUs)
+	def.MemoryMB = askInt(fmt.Sprintf("%s memory MB per node (0 = %d)", role, config.DefaultNodeMemoryMB), def.MemoryMB)
+	def.ReservedDiskGB = askInt(role+" host disk GB to reserve per node (checked against the VM, not a node disk size; 0 = unchecked)", def.ReservedDiskGB)
+	return def
+}
+
 func askBool(msg string, def bool) bool {
 	hint := "[y/N]"
 	if def {
@@ -502,6 +717,25 @@ func askBool(msg string, def bool) bool {
 	}
 }
 
+func askStringList(msg string, def []string) []string {
+	defVal := strings.Join(def, ",")
+	prompt := fmt.Sprintf("  %s (comma-separated): ", msg)
+	if defVal != "" {
+		prompt = fmt.Sprintf("  %s (comma-separated) [\033[36m%s\033[0m]: ", msg, defVal)
+	}
+	raw := readLineClean(prompt)
+	if raw == "" {
+		raw = defVal
+	}
+	var out []string
+	for _, p := range strings.Split(raw, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
 func askIntList(msg string, def []int) []int {
 	vals := make([]string, 0, len(def))
 	for _, v := range def {
@@ -737,25 +971,63 @@ func loadVMBootstrapConfig(path string) (vmBootstrapFile, error) {
 	return vm, nil
 }
 
-func detectSSHHostFingerprint(cfg stage2File) string {
+// detectSSHHostFingerprint pins every host key the VM offers for the
+// configured algorithms, preferring the last bootstrap result.
+func detectSSHHostFingerprint(cfg stage2File) config.Fingerprints {
 	if fp := latestBootstrapResultFingerprint(); fp != "" {
-		return fp
+		return config.Fingerprints{fp}
 	}
 	host := strings.TrimSpace(cfg.VM.Host)
 	if host == "" {
-		return ""
+		return nil
 	}
 	port := cfg.VM.Port
 	if port <= 0 {
 		port = 22
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	timeout := 3 * time.Second
+	if len(cfg.VM.JumpHosts) > 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-	fp, err := sshutil.ScanHostKeyFingerprint(ctx, host, port)
+	fps, err := sshutil.ScanHostKeyFingerprintsWithConfig(ctx, stage2ScanConfig(cfg, host, port))
 	if err != nil {
-		return ""
+		return nil
+	}
+	out := make(config.Fingerprints, 0, len(fps))
+	for _, fp := range fps {
+		out = append(out, fp.SHA256)
 	}
-	return strings.TrimSpace(fp)
+	return out
+}
+
+func stage2ScanConfig(cfg stage2File, host string, port int) sshutil.ExecConfig {
+	scan := sshutil.ExecConfig{
+		Host:            host,
+		Port:            port,
+		User:            strings.TrimSpace(cfg.VM.User),
+		PrivateKeyPath:  config.ExpandHome(cfg.VM.SSHPrivateKey),
+		KnownHostsFile:  config.ExpandHome(cfg.VM.KnownHostsFile),
+		KnownHostsMode:  cfg.VM.KnownHostsMode,
+		Transport:       cfg.VM.SSHTransport,
+		UseAgent:        strings.EqualFold(strings.TrimSpace(cfg.VM.SSHAuth), "agent"),
+		AgentIdentity:   config.ExpandHome(cfg.VM.SSHAgentIdentity),
+		CertificateFile: config.ExpandHome(cfg.VM.SSHCertificate),
+		HostCAFile:      config.ExpandHome(cfg.VM.SSHHostCA),
+		// Pins are what is being discovered, so only the algorithms carry over.
+		HostKeyAlgorithms: cfg.VM.SSHHostKeyAlgos,
+	}
+	for _, j := range cfg.VM.JumpHosts {
+		scan.JumpHosts = append(scan.JumpHosts, sshutil.JumpHost{
+			Host:             j.Host,
+			Port:             j.Port,
+			User:             j.User,
+			PrivateKeyPath:   config.ExpandHome(j.SSHPrivateKey),
+			ExpectedHostKeys: j.SSHHostFingerprint,
+		})
+	}
+	return scan
 }
 
 func latestBootstrapResultFingerprint() string {
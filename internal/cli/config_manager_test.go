@@ -55,33 +55,65 @@ func TestVersionPrompt(t *testing.T) {
 	}
 }
 
-func TestTalosChecksumForVersion(t *testing.T) {
+func TestTalosChecksumsForVersion(t *testing.T) {
 	meta := toolVersionMetadata{}
+	meta.Talosctl.ChecksumsLinux = map[string]map[string]string{
+		"1.12.4": {"arm64": "def"},
+	}
 	meta.Talosctl.ChecksumsLinuxAMD64 = map[string]string{
 		"1.12.4": "abc",
 	}
-	if got := talosChecksumForVersion(meta, "v1.12.4"); got != "abc" {
-		t.Fatalf("unexpected checksum: %q", got)
+	got := talosChecksumsForVersion(meta, "v1.12.4")
+	if got["amd64"] != "abc" || got["arm64"] != "def" {
+		t.Fatalf("unexpected checksums: %v", got)
 	}
 }
 
-func TestResolveTalosChecksumFromMetadata(t *testing.T) {
+func TestResolveTalosChecksumsFromMetadata(t *testing.T) {
 	meta := toolVersionMetadata{}
-	meta.Talosctl.ChecksumsLinuxAMD64 = map[string]string{
-		"1.12.4": "abc",
+	meta.Talosctl.ChecksumsLinux = map[string]map[string]string{
+		"1.12.4": {"amd64": "abc", "arm64": "def"},
+	}
+	origFmt := talosReleaseChecksumsURLFmt
+	talosReleaseChecksumsURLFmt = "http://127.0.0.1:0/v%s/sha256sum.txt"
+	t.Cleanup(func() { talosReleaseChecksumsURLFmt = origFmt })
+
+	got, err := resolveTalosChecksums(meta, "1.12.4")
+	if err != nil {
+		t.Fatalf("resolveTalosChecksums failed: %v", err)
 	}
-	got, err := resolveTalosChecksum(meta, "1.12.4")
+	if got["amd64"] != "abc" || got["arm64"] != "def" {
+		t.Fatalf("unexpected checksums: %v", got)
+	}
+}
+
+func TestResolveTalosChecksumsFillsMissingArchFromRelease(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(strings.Repeat("a", 64) + "  talosctl-linux-amd64\n" + strings.Repeat("b", 64) + "  talosctl-linux-arm64\n"))
+	}))
+	defer srv.Close()
+	origFmt := talosReleaseChecksumsURLFmt
+	talosReleaseChecksumsURLFmt = srv.URL + "/v%s/sha256sum.txt"
+	t.Cleanup(func() { talosReleaseChecksumsURLFmt = origFmt })
+
+	meta := toolVersionMetadata{}
+	meta.Talosctl.ChecksumsLinuxAMD64 = map[string]string{"1.12.4": "abc"}
+	got, err := resolveTalosChecksums(meta, "1.12.4")
 	if err != nil {
-		t.Fatalf("resolveTalosChecksum failed: %v", err)
+		t.Fatalf("resolveTalosChecksums failed: %v", err)
 	}
-	if got != "abc" {
-		t.Fatalf("unexpected checksum: %q", got)
+	if got["amd64"] != "abc" || got["arm64"] != strings.Repeat("b", 64) {
+		t.Fatalf("unexpected checksums: %v", got)
 	}
 }
 
-func TestFetchTalosChecksumFromRelease(t *testing.T) {
+func TestFetchTalosChecksumsFromRelease(t *testing.T) {
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
-		_, _ = w.Write([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa  talosctl-linux-amd64\n"))
+		_, _ = w.Write([]byte(strings.Join([]string{
+			"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa  talosctl-linux-amd64",
+			"bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb  talosctl-linux-arm64",
+			"cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc  talosctl-darwin-arm64",
+		}, "\n")))
 	}))
 	defer srv.Close()
 
@@ -89,12 +121,12 @@ func TestFetchTalosChecksumFromRelease(t *testing.T) {
 	talosReleaseChecksumsURLFmt = srv.URL + "/v%s/sha256sum.txt"
 	t.Cleanup(func() { talosReleaseChecksumsURLFmt = origFmt })
 
-	got, err := fetchTalosChecksumFromRelease("1.12.4")
+	got, err := fetchTalosChecksumsFromRelease("1.12.4")
 	if err != nil {
-		t.Fatalf("fetchTalosChecksumFromRelease failed: %v", err)
+		t.Fatalf("fetchTalosChecksumsFromRelease failed: %v", err)
 	}
-	if got != "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa" {
-		t.Fatalf("unexpected checksum: %q", got)
+	if len(got) != 2 || got["amd64"] != strings.Repeat("a", 64) || got["arm64"] != strings.Repeat("b", 64) {
+		t.Fatalf("unexpected checksums: %v", got)
 	}
 }
 
@@ -261,7 +293,7 @@ func TestLoadYAMLAndSaveYAML(t *testing.T) {
 }
 
 func TestResolveTalosChecksumErrorsForEmptyVersion(t *testing.T) {
-	_, err := resolveTalosChecksum(toolVersionMetadata{}, "")
+	_, err := resolveTalosChecksums(toolVersionMetadata{}, "")
 	if err == nil || !strings.Contains(err.Error(), "empty talos version") {
 		t.Fatalf("expected empty version error, got %v", err)
 	}
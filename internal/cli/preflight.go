@@ -0,0 +1,99 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/bootstrap"
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
+	"github.com/infrakit-io/talos-docker-bootstrap/pkg/model"
+	"github.com/spf13/cobra"
+)
+
+func newPreflightCmd() *cobra.Command {
+	var (
+		configPath string
+		jsonOut    bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "preflight",
+		Short: "Gather remote facts and check them against the preflight minimums",
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			logger, err := newLogger(logFormat, logLevel)
+			if err != nil {
+				return err
+			}
+			cfg, err := config.Load(configPath)
+			if err != nil {
+				return err
+			}
+			human := !jsonOut && strings.EqualFold(logFormat, "text")
+			restorePrompt := maybeSetKnownHostsPrompt(cfg, human)
+			defer restorePrompt()
+
+			ctx, cancel := context.WithTimeout(cmd.Context(), cfg.Timeouts.TotalDuration())
+			defer cancel()
+			ctx, closeSession, err := bootstrap.OpenSession(ctx, cfg)
+			if err != nil {
+				return explainClusterOpError(err, cfg)
+			}
+			defer closeSession()
+
+			facts, err := bootstrap.Preflight(ctx, logger, cfg)
+			var failed *bootstrap.PreflightError
+			if err != nil && !errors.As(err, &failed) {
+				return explainClusterOpError(err, cfg)
+			}
+
+			switch {
+			case jsonOut:
+				if perr := printJSON(struct {
+					VMHost string                `json:"vm_host"`
+					OK     bool                  `json:"ok"`
+					Facts  []model.PreflightFact `json:"facts"`
+				}{cfg.VM.Host, failed == nil, facts}); perr != nil {
+					return perr
+				}
+			case human:
+				printPreflightFacts(cfg.VM.Host, facts)
+			default:
+				for _, f := range facts {
+					logger.Info("preflight fact", "name", f.Name, "value", f.Value, "ok", f.OK, "requirement", f.Requirement)
+				}
+			}
+			if failed != nil {
+				return &userError{
+					msg:  failed.Error(),
+					hint: "Fix the VM, or adjust the preflight section of the config (set preflight.enabled: false to skip the stage)",
+				}
+			}
+			return nil
+		},
+	}
+
+	defCfg := defaultConfigPath()
+	cmd.Flags().StringVar(&configPath, "config", defCfg, "Path to YAML config file")
+	cmd.Flags().BoolVar(&jsonOut, "json", false, "Print machine-readable facts JSON")
+	if defCfg == "" {
+		_ = cmd.MarkFlagRequired("config")
+	}
+	return cmd
+}
+
+func printPreflightFacts(host string, facts []model.PreflightFact) {
+	fmt.Printf("\033[1mPreflight\033[0m \033[36m%s\033[0m\n", host)
+	for _, f := range facts {
+		mark := "\033[32m✓\033[0m"
+		if !f.OK {
+			mark = "\033[31m✗\033[0m"
+		}
+		line := fmt.Sprintf("  %s %-26s %s", mark, f.Name, f.Value)
+		if !f.OK && f.Requirement != "" {
+			line += fmt.Sprintf(" \033[90m(need %s)\033[0m", f.Requirement)
+		}
+		fmt.Println(line)
+	}
+}
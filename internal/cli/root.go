@@ -34,6 +34,8 @@ func newRootCmd() *cobra.Command {
 	cmd.AddCommand(newVMDeployCmd())
 	cmd.AddCommand(newConfigCmd())
 	cmd.AddCommand(newProvisionAndBootstrapCmd())
+	cmd.AddCommand(newPreflightCmd())
+	cmd.AddCommand(newHardeningAuditCmd())
 	cmd.AddCommand(newClusterStatusCmd())
 	cmd.AddCommand(newKubeconfigExportCmd())
 	cmd.AddCommand(newMountCheckCmd())
@@ -13,6 +13,7 @@ import (
 	"time"
 
 	wizard "github.com/infrakit-io/cli-wizard-core"
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/bootstrap"
 	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
 	vmtool "github.com/infrakit-io/talos-docker-bootstrap/internal/tooling/vmbootstrap"
 	"github.com/infrakit-io/talos-docker-bootstrap/internal/workflow"
@@ -26,6 +27,10 @@ func newProvisionAndBootstrapCmd() *cobra.Command {
 		vmConfigPath      string
 		dryRun            bool
 		jsonOut           bool
+		resume            bool
+		check             bool
+		only              []string
+		skip              []string
 		vmbootstrapBin    string
 		vmbootstrapRepo   string
 		vmbootstrapBuild  bool
@@ -41,6 +46,15 @@ func newProvisionAndBootstrapCmd() *cobra.Command {
 				return err
 			}
 			warnPinnedAssetDrift()
+			if err := validateStepFlags(only, skip); err != nil {
+				return err
+			}
+			if check && strings.TrimSpace(bootstrapPath) == "" && strings.TrimSpace(vmConfigPath) == "" {
+				return &userError{
+					msg:  "--check needs an existing VM",
+					hint: "Pass --bootstrap-result or --vm-config; without them the workflow would deploy a new VM.",
+				}
+			}
 			human := !jsonOut && strings.EqualFold(logFormat, "text")
 			progress := newWorkflowProgress(3, human)
 			progress.start("bootstrap-input", "Acquire VM bootstrap result")
@@ -71,7 +85,7 @@ func newProvisionAndBootstrapCmd() *cobra.Command {
 
 			progress.start("ssh-identity", "Stabilize SSH host trust for fresh VM")
 			if bootstrapFromRun {
-				changed, err := workflow.RefreshBootstrapFingerprint(bootstrapPath, &bootstrapResult)
+				changed, err := workflow.RefreshBootstrapFingerprint(bootstrapPath, &bootstrapResult, stage2Cfg)
 				if err != nil {
 					return err
 				}
@@ -100,7 +114,12 @@ func newProvisionAndBootstrapCmd() *cobra.Command {
 			progress.start("talos-bootstrap", "Run Talos bootstrap on target VM")
 			res, err := workflow.ProvisionAndBootstrap(ctx, logger, stage2Cfg, bootstrapResult, workflow.ProvisionAndBootstrapOptions{
 				DryRun:        dryRun,
+				Check:         check,
 				HumanProgress: human,
+				JournalDir:    bootstrap.DefaultJournalDir(),
+				Resume:        resume,
+				Only:          only,
+				Skip:          skip,
 			})
 			if err != nil {
 				if jsonOut {
@@ -113,6 +132,10 @@ func newProvisionAndBootstrapCmd() *cobra.Command {
 			if jsonOut {
 				return printJSON(res)
 			}
+			if check {
+				reportCheckResult(logger, human, res)
+				return nil
+			}
 
 			if human {
 				fmt.Printf("\n\033[32m✓ workflow completed\033[0m\n")
@@ -136,6 +159,11 @@ func newProvisionAndBootstrapCmd() *cobra.Command {
 	cmd.Flags().StringVar(&vmConfigPath, "vm-config", "", "Path to vmware-vm-bootstrap VM config (SOPS/cleartext)")
 	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Validate and print planned operations without changes")
 	cmd.Flags().BoolVar(&jsonOut, "json", false, "Print machine-readable result JSON")
+	cmd.Flags().BoolVar(&resume, "resume", false, "Skip Talos bootstrap steps that already succeeded with unchanged inputs (from the run journal)")
+	addStepSelectionFlags(cmd, &only, &skip)
+	cmd.Flags().BoolVar(&check, "check", false, "Connect read-only and report per Talos bootstrap step what would change")
+	cmd.MarkFlagsMutuallyExclusive("check", "dry-run")
+	cmd.MarkFlagsMutuallyExclusive("check", "resume")
 	cmd.Flags().StringVar(&vmbootstrapBin, "vmbootstrap-bin", "bin/vmbootstrap", "vmware-vm-bootstrap CLI binary")
 	cmd.Flags().StringVar(&vmbootstrapRepo, "vmbootstrap-repo", "../vmware-vm-bootstrap", "Path to vmware-vm-bootstrap repository (used only with --vmbootstrap-auto-build)")
 	cmd.Flags().BoolVar(&vmbootstrapBuild, "vmbootstrap-auto-build", false, "Auto-build vmbootstrap from --vmbootstrap-repo when binary is missing")
@@ -2,11 +2,16 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"gopkg.in/yaml.v3"
 )
@@ -14,9 +19,12 @@ import (
 // Config holds Talos bootstrap settings.
 type Config struct {
 	VM        VMConfig        `yaml:"vm"`
+	Preflight PreflightConfig `yaml:"preflight"`
 	Hardening HardeningConfig `yaml:"hardening"`
 	Docker    DockerConfig    `yaml:"docker"`
 	Talos     TalosConfig     `yaml:"talos"`
+	Offline   OfflineConfig   `yaml:"offline"`
+	Proxy     ProxyConfig     `yaml:"proxy"`
 	Cluster   ClusterConfig   `yaml:"cluster"`
 	Timeouts  TimeoutsConfig  `yaml:"timeouts"`
 }
@@ -25,20 +33,110 @@ var (
 	safeVersionTokenRE = regexp.MustCompile(`^[A-Za-z0-9._+-]+$`)
 	sha256HexRE        = regexp.MustCompile(`^[a-fA-F0-9]{64}$`)
 	sshFingerprintRE   = regexp.MustCompile(`^SHA256:[A-Za-z0-9+/]+$`)
+	numericVersionRE   = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+	hostnameRE         = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]*[A-Za-z0-9])?$`)
+	sshPrincipalRE     = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.*?@-]*$`)
+	sysctlKeyRE        = regexp.MustCompile(`^[a-z0-9_]+([./][A-Za-z0-9_-]+)+$`)
+	imageRegistryRE    = regexp.MustCompile(`^[A-Za-z0-9.-]+(:[0-9]+)?(/[a-z0-9._-]+)*$`)
 )
 
 type VMConfig struct {
-	Host               string `yaml:"host"`
-	Port               int    `yaml:"port"`
-	User               string `yaml:"user"`
-	SSHPrivateKey      string `yaml:"ssh_private_key"`
-	KnownHostsFile     string `yaml:"known_hosts_file"`
-	KnownHostsMode     string `yaml:"known_hosts_mode"`
-	SSHHostFingerprint string `yaml:"ssh_host_fingerprint"`
+	Host               string       `yaml:"host"`
+	Port               int          `yaml:"port"`
+	User               string       `yaml:"user"`
+	SSHPrivateKey      string       `yaml:"ssh_private_key"`
+	KnownHostsFile     string       `yaml:"known_hosts_file"`
+	KnownHostsMode     string       `yaml:"known_hosts_mode"`
+	SSHHostFingerprint Fingerprints `yaml:"ssh_host_fingerprint"`
+	// SSHHostKeyAlgorithms lists accepted host key algorithms in preference
+	// order; empty means ssh-ed25519 only.
+	SSHHostKeyAlgorithms []string         `yaml:"ssh_host_key_algorithms"`
+	SSHTransport         string           `yaml:"ssh_transport"`
+	SSHAuth              string           `yaml:"ssh_auth"`
+	SSHAgentIdentity     string           `yaml:"ssh_agent_identity"`
+	SSHCertificate       string           `yaml:"ssh_certificate"`
+	SSHHostCA            string           `yaml:"ssh_host_ca"`
+	JumpHosts            []JumpHostConfig `yaml:"jump_hosts"`
+}
+
+// JumpHostConfig is one bastion hop, dialed in list order before the VM.
+// Empty user and ssh_private_key inherit the VM values.
+type JumpHostConfig struct {
+	Host               string       `yaml:"host"`
+	Port               int          `yaml:"port"`
+	User               string       `yaml:"user"`
+	SSHPrivateKey      string       `yaml:"ssh_private_key"`
+	SSHHostFingerprint Fingerprints `yaml:"ssh_host_fingerprint"`
 }
 
 type DockerConfig struct {
-	Version string `yaml:"version"`
+	Version string             `yaml:"version"`
+	Daemon  DockerDaemonConfig `yaml:"daemon"`
+}
+
+// DockerDaemonConfig is rendered to /etc/docker/daemon.json. Empty values
+// are left out, so dockerd uses its own defaults for them.
+type DockerDaemonConfig struct {
+	LogDriver string `yaml:"log_driver"`
+	// LogMaxSize and LogMaxFile rotate json-file and local logs.
+	LogMaxSize          string              `yaml:"log_max_size"`
+	LogMaxFile          int                 `yaml:"log_max_file"`
+	DataRoot            string              `yaml:"data_root"`
+	RegistryMirrors     []string            `yaml:"registry_mirrors"`
+	InsecureRegistries  []string            `yaml:"insecure_registries"`
+	DefaultAddressPools []DockerAddressPool `yaml:"default_address_pools"`
+	LiveRestore         bool                `yaml:"live_restore"`
+}
+
+// DockerAddressPool is a range Docker carves bridge networks of Size bits
+// from.
+type DockerAddressPool struct {
+	Base string `yaml:"base"`
+	Size int    `yaml:"size"`
+}
+
+var logSizeRE = regexp.MustCompile(`^[0-9]+[kmg]?$`)
+
+func (d DockerDaemonConfig) validate() error {
+	if v := d.LogDriver; v != "" && !safeVersionTokenRE.MatchString(v) {
+		return fmt.Errorf("log_driver has invalid characters")
+	}
+	if v := d.LogMaxSize; v != "" && !logSizeRE.MatchString(v) {
+		return fmt.Errorf("log_max_size must be a size such as 10m (got %q)", v)
+	}
+	if d.LogMaxFile < 0 {
+		return fmt.Errorf("log_max_file must be >= 0")
+	}
+	if v := d.DataRoot; v != "" && (!strings.HasPrefix(v, "/") || strings.ContainsAny(v, " \t'\"")) {
+		return fmt.Errorf("data_root must be an absolute path (got %q)", v)
+	}
+	for _, m := range d.RegistryMirrors {
+		u, err := url.Parse(m)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("registry_mirrors entries must be http:// or https:// URLs (got %q)", m)
+		}
+	}
+	for _, r := range d.InsecureRegistries {
+		if strings.TrimSpace(r) == "" || (strings.ContainsAny(r, " \t'\"/") && !isCIDR(r)) {
+			return fmt.Errorf("insecure_registries entries must be host[:port] or a CIDR (got %q)", r)
+		}
+	}
+	for i, p := range d.DefaultAddressPools {
+		_, n, err := net.ParseCIDR(p.Base)
+		if err != nil {
+			return fmt.Errorf("default_address_pools[%d].base must be a CIDR (got %q)", i, p.Base)
+		}
+		ones, bits := n.Mask.Size()
+		if p.Size < ones || p.Size > bits {
+			return fmt.Errorf("default_address_pools[%d].size must be between %d and %d", i, ones, bits)
+		}
+	}
+	return nil
+}
+
+func isCIDR(s string) bool {
+	_, _, err := net.ParseCIDR(s)
+	return err == nil
 }
 
 type HardeningConfig struct {
@@ -46,18 +144,489 @@ type HardeningConfig struct {
 	AllowPasswordSSH bool  `yaml:"allow_password_ssh"`
 	EnableUFW        bool  `yaml:"enable_ufw"`
 	AllowTCPPorts    []int `yaml:"allow_tcp_ports"`
+	// AllowSourceCIDRs limits AllowTCPPorts to these sources; empty allows
+	// any source.
+	AllowSourceCIDRs []string `yaml:"allow_source_cidrs"`
+	// FirewallRules are allow rules with protocol, port range and sources,
+	// applied on top of AllowTCPPorts.
+	FirewallRules []FirewallRule `yaml:"firewall_rules"`
+	// FilterDockerPorts applies the allowed ports and sources to traffic
+	// forwarded to Docker-published ports through the DOCKER-USER chain,
+	// which UFW does not see.
+	FilterDockerPorts bool `yaml:"filter_docker_ports"`
+	// Profile selects the default set of controls: "baseline" (the
+	// default) or "strict", which adds stricter sshd and kernel settings and
+	// turns on fail2ban, auditd and the AppArmor check.
+	Profile string `yaml:"profile"`
+	// Fail2ban, Auditd and AppArmor override the profile for one control;
+	// unset follows the profile.
+	Fail2ban *bool `yaml:"fail2ban"`
+	Auditd   *bool `yaml:"auditd"`
+	AppArmor *bool `yaml:"apparmor"`
+	// NTPServers configures chrony, when installed, or systemd-timesyncd.
+	// Empty keeps the distribution defaults.
+	NTPServers []string `yaml:"ntp_servers"`
+	// LoginBanner is shown before SSH login and on the console.
+	LoginBanner string `yaml:"login_banner"`
+	// SSHAllowUsers and SSHAllowGroups restrict SSH logins (sshd AllowUsers
+	// and AllowGroups).
+	SSHAllowUsers  []string `yaml:"ssh_allow_users"`
+	SSHAllowGroups []string `yaml:"ssh_allow_groups"`
+	// Sysctls are extra kernel parameters, applied on top of (and
+	// overriding) the profile's.
+	Sysctls map[string]string `yaml:"sysctls"`
+}
+
+const (
+	HardeningProfileBaseline = "baseline"
+	HardeningProfileStrict   = "strict"
+)
+
+// Strict reports whether the strict profile is selected.
+func (h HardeningConfig) Strict() bool {
+	return strings.EqualFold(strings.TrimSpace(h.Profile), HardeningProfileStrict)
+}
+
+// Fail2banEnabled reports whether fail2ban guards sshd.
+func (h HardeningConfig) Fail2banEnabled() bool { return h.control(h.Fail2ban) }
+
+// AuditdEnabled reports whether auditd runs with the managed ruleset.
+func (h HardeningConfig) AuditdEnabled() bool { return h.control(h.Auditd) }
+
+// AppArmorEnabled reports whether AppArmor enforcement is required.
+func (h HardeningConfig) AppArmorEnabled() bool { return h.control(h.AppArmor) }
+
+func (h HardeningConfig) control(toggle *bool) bool {
+	if toggle != nil {
+		return *toggle
+	}
+	return h.Strict()
+}
+
+func (h HardeningConfig) validate(vmUser string) error {
+	switch strings.ToLower(strings.TrimSpace(h.Profile)) {
+	case "", HardeningProfileBaseline, HardeningProfileStrict:
+	default:
+		return fmt.Errorf("profile must be %s or %s (got %q)", HardeningProfileBaseline, HardeningProfileStrict, h.Profile)
+	}
+	for _, s := range h.NTPServers {
+		if !hostnameRE.MatchString(s) && net.ParseIP(s) == nil {
+			return fmt.Errorf("ntp_servers entries must be hostnames or IP addresses (got %q)", s)
+		}
+	}
+	for _, name := range append(append([]string{}, h.SSHAllowUsers...), h.SSHAllowGroups...) {
+		if !sshPrincipalRE.MatchString(name) {
+			return fmt.Errorf("ssh_allow_users and ssh_allow_groups entries must be user or group names (got %q)", name)
+		}
+	}
+	if len(h.SSHAllowUsers) > 0 && vmUser != "" && !slices.Contains(h.SSHAllowUsers, vmUser) {
+		return fmt.Errorf("ssh_allow_users must include vm.user %q, or SSH is locked out", vmUser)
+	}
+	for k, v := range h.Sysctls {
+		if !sysctlKeyRE.MatchString(k) {
+			return fmt.Errorf("sysctls keys must be kernel parameters such as net.ipv4.tcp_syncookies (got %q)", k)
+		}
+		if strings.TrimSpace(v) == "" || strings.ContainsAny(v, "\n\r") {
+			return fmt.Errorf("sysctls.%s must be a single-line value", k)
+		}
+	}
+	return nil
+}
+
+// FirewallRule allows Port (a port or an inclusive "from:to" range) over
+// Proto from Sources, or from anywhere when Sources is empty. Limit uses
+// UFW rate limiting (for SSH) instead of a plain allow.
+type FirewallRule struct {
+	Port    string   `yaml:"port"`
+	Proto   string   `yaml:"proto"`
+	Sources []string `yaml:"sources"`
+	Limit   bool     `yaml:"limit"`
+}
+
+// Rules returns AllowTCPPorts (with AllowSourceCIDRs) followed by
+// FirewallRules, with Proto defaulted to tcp.
+func (h HardeningConfig) Rules() []FirewallRule {
+	rules := make([]FirewallRule, 0, len(h.AllowTCPPorts)+len(h.FirewallRules))
+	for _, p := range h.AllowTCPPorts {
+		rules = append(rules, FirewallRule{Port: strconv.Itoa(p), Proto: "tcp", Sources: h.AllowSourceCIDRs})
+	}
+	for _, r := range h.FirewallRules {
+		r.Port = strings.TrimSpace(r.Port)
+		r.Proto = strings.ToLower(strings.TrimSpace(r.Proto))
+		if r.Proto == "" {
+			r.Proto = "tcp"
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// AllowsTCP reports whether a rule opens the tcp port. With UFW enabled and
+// no rule for the SSH port, the next session cannot connect.
+func (h HardeningConfig) AllowsTCP(port int) bool {
+	for _, r := range h.Rules() {
+		if r.Proto != "tcp" {
+			continue
+		}
+		from, to, isRange := strings.Cut(r.Port, ":")
+		lo, err := strconv.Atoi(from)
+		if err != nil {
+			continue
+		}
+		hi := lo
+		if isRange {
+			if hi, err = strconv.Atoi(to); err != nil {
+				continue
+			}
+		}
+		if lo <= port && port <= hi {
+			return true
+		}
+	}
+	return false
+}
+
+func (r FirewallRule) validate() error {
+	from, to, isRange := strings.Cut(strings.TrimSpace(r.Port), ":")
+	lo, err := strconv.Atoi(from)
+	if err != nil || lo < 1 || lo > 65535 {
+		return fmt.Errorf("port must be a port or a from:to range in 1..65535 (got %q)", r.Port)
+	}
+	if isRange {
+		hi, err := strconv.Atoi(to)
+		if err != nil || hi <= lo || hi > 65535 {
+			return fmt.Errorf("port must be a port or a from:to range in 1..65535 (got %q)", r.Port)
+		}
+	}
+	if p := strings.ToLower(strings.TrimSpace(r.Proto)); p != "" && p != "tcp" && p != "udp" {
+		return fmt.Errorf("proto must be tcp or udp (got %q)", r.Proto)
+	}
+	for _, src := range r.Sources {
+		if !isCIDR(src) {
+			return fmt.Errorf("sources entries must be CIDRs such as 10.0.0.0/8 (got %q)", src)
+		}
+	}
+	return nil
+}
+
+// PreflightConfig holds the minimums the VM must meet before any step
+// changes it. Zero minimums and empty lists are not checked.
+type PreflightConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// SupportedOS lists accepted /etc/os-release IDs.
+	SupportedOS     []string `yaml:"supported_os"`
+	MinOSVersion    string   `yaml:"min_os_version"`
+	Architectures   []string `yaml:"architectures"`
+	MinKernel       string   `yaml:"min_kernel"`
+	CgroupVersion   int      `yaml:"cgroup_version"`
+	MinRootDiskGB   int      `yaml:"min_root_disk_gb"`
+	MinDockerDiskGB int      `yaml:"min_docker_disk_gb"`
+	MinMemoryMB     int      `yaml:"min_memory_mb"`
+	MinCPUs         int      `yaml:"min_cpus"`
+	// Endpoints are hosts the VM must reach over HTTPS.
+	Endpoints []string `yaml:"endpoints"`
 }
 
 type TalosConfig struct {
-	Version        string `yaml:"version"`
-	SHA256Checksum string `yaml:"sha256_checksum"`
+	Version string `yaml:"version"`
+	// SHA256Checksums maps a VM architecture (amd64, arm64) to the checksum
+	// of talosctl-linux-<arch>. SHA256Checksum is the older single value,
+	// which only ever covered talosctl-linux-amd64 and is used for amd64
+	// when the map has no entry for it.
+	SHA256Checksums map[string]string `yaml:"sha256_checksums"`
+	SHA256Checksum  string            `yaml:"sha256_checksum"`
+}
+
+// TalosArchitectures lists the VM architectures talosctl is installed for.
+var TalosArchitectures = []string{"amd64", "arm64"}
+
+// ChecksumFor returns the talosctl checksum for arch, or "" when none is
+// configured. The legacy single checksum applies to amd64 only, so an arm64
+// VM needs sha256_checksums.arm64.
+func (t TalosConfig) ChecksumFor(arch string) string {
+	if sum := strings.TrimSpace(t.SHA256Checksums[arch]); sum != "" {
+		return strings.ToLower(sum)
+	}
+	if arch != "amd64" {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(t.SHA256Checksum))
+}
+
+// OfflineConfig turns on air-gapped installs: Docker packages, talosctl and
+// container images come from CacheDir on this machine and are uploaded to
+// the VM over SSH, so the VM needs no outbound access. The Talos nodes pull
+// their images from a registry on the VM.
+type OfflineConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	CacheDir string `yaml:"cache_dir"`
+	// Fetch downloads artifacts missing from CacheDir on this machine.
+	Fetch bool `yaml:"fetch"`
+	// Images are extra container images the nodes can pull, on top of the
+	// Talos default images. They are referenced by tag: docker save does
+	// not keep registry digests.
+	Images []string `yaml:"images"`
+}
+
+// ProxyConfig routes the VM's outbound HTTP(S) through a proxy: apt, curl,
+// the Docker daemon and the Talos nodes all use it.
+type ProxyConfig struct {
+	HTTP  string `yaml:"http"`
+	HTTPS string `yaml:"https"`
+	// NoProxy lists hosts, domains and CIDRs reached directly.
+	NoProxy []string `yaml:"no_proxy"`
+	// CABundle is a local PEM file with the CA certificates of a
+	// TLS-intercepting proxy; it is installed into the VM's trust store.
+	CABundle string `yaml:"ca_bundle"`
+}
+
+// Enabled reports whether a proxy URL is set.
+func (p ProxyConfig) Enabled() bool {
+	return strings.TrimSpace(p.HTTP) != "" || strings.TrimSpace(p.HTTPS) != ""
+}
+
+// proxyBypassDefaults are always reached directly: loopback and the
+// Talos-in-Docker node network.
+var proxyBypassDefaults = []string{"localhost", "127.0.0.1", "::1", "10.5.0.0/24"}
+
+// NoProxyList returns no_proxy with the built-in bypass entries appended,
+// as a comma-separated list.
+func (p ProxyConfig) NoProxyList() string {
+	var list []string
+	for _, h := range append(append([]string(nil), p.NoProxy...), proxyBypassDefaults...) {
+		if h = strings.TrimSpace(h); h != "" && !slices.Contains(list, h) {
+			list = append(list, h)
+		}
+	}
+	return strings.Join(list, ",")
+}
+
+// shellMeta are the characters a proxy value must not carry into the
+// scripts and unit files it is written to.
+const shellMeta = " '\"$`\\;&|<>(){}"
+
+func hasShellMeta(s string) bool {
+	return strings.ContainsAny(s, shellMeta) || strings.IndexFunc(s, unicode.IsControl) >= 0
+}
+
+func (p ProxyConfig) validate() error {
+	for _, f := range []struct{ name, value string }{{"http", p.HTTP}, {"https", p.HTTPS}} {
+		v := strings.TrimSpace(f.value)
+		if v == "" {
+			continue
+		}
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s must be an http:// or https:// URL (got %q)", f.name, f.value)
+		}
+		if hasShellMeta(v) {
+			return fmt.Errorf("%s must not contain spaces, control characters or shell metacharacters; percent-encode them in credentials", f.name)
+		}
+	}
+	for _, h := range p.NoProxy {
+		if strings.TrimSpace(h) == "" || strings.Contains(h, ",") || hasShellMeta(h) {
+			return fmt.Errorf("no_proxy entries must be host names, domains or CIDRs (got %q)", h)
+		}
+	}
+	if strings.TrimSpace(p.CABundle) != "" && !p.Enabled() {
+		return fmt.Errorf("ca_bundle requires http or https to be set")
+	}
+	return nil
 }
 
 type ClusterConfig struct {
 	Name     string `yaml:"name"`
 	StateDir string `yaml:"state_dir"`
+	// MountSrc and MountDst are a single bind mount, used when Mounts is
+	// empty.
 	MountSrc string `yaml:"mount_src"`
 	MountDst string `yaml:"mount_dst"`
+	// Mounts are the host directories bind-mounted into every node.
+	Mounts []Mount `yaml:"mounts"`
+	// Controlplanes and Workers set the node counts; zero controlplanes
+	// means one. Workers are added and removed in place; changing the
+	// controlplane count recreates the cluster.
+	Controlplanes int `yaml:"controlplanes"`
+	Workers       int `yaml:"workers"`
+	// Controlplane and Worker size the nodes of each role.
+	Controlplane NodeResources `yaml:"controlplane"`
+	Worker       NodeResources `yaml:"worker"`
+	// KubernetesVersion pins the cluster's Kubernetes version; empty keeps
+	// the talosctl default. A running cluster is upgraded in place.
+	KubernetesVersion string `yaml:"kubernetes_version"`
+	// TalosImage replaces the Talos node image of talos.version. A running
+	// cluster on another image is recreated.
+	TalosImage string `yaml:"talos_image"`
+	// ImageRegistry replaces ghcr.io in the default Talos node and installer
+	// images, for a registry mirror.
+	ImageRegistry string `yaml:"image_registry"`
+	// ConfigPatches are local machine config patch files applied when the
+	// cluster is created.
+	ConfigPatches ConfigPatches `yaml:"config_patches"`
+}
+
+// ConfigPatches lists Talos machine config patch files (strategic merge
+// YAML or RFC 6902 JSON patches) by the nodes they apply to, in order.
+type ConfigPatches struct {
+	Global       []string `yaml:"global"`
+	Controlplane []string `yaml:"controlplane"`
+	Worker       []string `yaml:"worker"`
+}
+
+func (p ConfigPatches) validate() error {
+	for _, list := range []struct {
+		role  string
+		paths []string
+	}{{"global", p.Global}, {"controlplane", p.Controlplane}, {"worker", p.Worker}} {
+		for _, path := range list.paths {
+			if strings.TrimSpace(path) == "" || strings.ContainsAny(path, "\n\r") {
+				return fmt.Errorf("%s entries must be file paths (got %q)", list.role, path)
+			}
+		}
+	}
+	return nil
+}
+
+// KubernetesVersionNumber returns KubernetesVersion without a leading "v",
+// as talosctl takes it.
+func (c ClusterConfig) KubernetesVersionNumber() string {
+	return strings.TrimPrefix(strings.TrimSpace(c.KubernetesVersion), "v")
+}
+
+const defaultImageRegistry = "ghcr.io"
+
+// TalosNodeImage returns the image the cluster's nodes run: cluster.talos_image,
+// or the Talos image of talos.version from cluster.image_registry.
+func (c Config) TalosNodeImage() string {
+	if c.Cluster.TalosImage != "" {
+		return c.Cluster.TalosImage
+	}
+	return c.imageRegistry() + "/siderolabs/talos:v" + c.Talos.Version
+}
+
+// TalosInstallImage returns the installer image from cluster.image_registry,
+// or "" to keep the talosctl default.
+func (c Config) TalosInstallImage() string {
+	if c.Cluster.ImageRegistry == "" {
+		return ""
+	}
+	return c.imageRegistry() + "/siderolabs/installer:v" + c.Talos.Version
+}
+
+func (c Config) imageRegistry() string {
+	if c.Cluster.ImageRegistry == "" {
+		return defaultImageRegistry
+	}
+	return strings.TrimSuffix(c.Cluster.ImageRegistry, "/")
+}
+
+// Mount is a host directory bind-mounted into the Talos nodes.
+type Mount struct {
+	Src      string `yaml:"src"`
+	Dst      string `yaml:"dst"`
+	ReadOnly bool   `yaml:"read_only"`
+}
+
+// MountList returns Mounts, or the MountSrc/MountDst pair when Mounts is
+// empty.
+func (c ClusterConfig) MountList() []Mount {
+	if len(c.Mounts) > 0 {
+		return c.Mounts
+	}
+	if c.MountSrc == "" && c.MountDst == "" {
+		return nil
+	}
+	return []Mount{{Src: c.MountSrc, Dst: c.MountDst}}
+}
+
+func (c ClusterConfig) validateMounts() error {
+	if len(c.Mounts) > 0 && (c.MountSrc != "" || c.MountDst != "") {
+		return fmt.Errorf("cluster.mounts and cluster.mount_src/mount_dst are mutually exclusive")
+	}
+	if len(c.Mounts) == 0 {
+		if strings.TrimSpace(c.MountSrc) == "" {
+			return fmt.Errorf("cluster.mount_src is required")
+		}
+		if strings.TrimSpace(c.MountDst) == "" {
+			return fmt.Errorf("cluster.mount_dst is required")
+		}
+	}
+	seen := map[string]bool{}
+	for i, m := range c.MountList() {
+		field := fmt.Sprintf("cluster.mounts[%d].", i)
+		if len(c.Mounts) == 0 {
+			field = "cluster.mount_"
+		}
+		// Docker's --mount syntax separates options with commas.
+		if strings.TrimSpace(m.Src) == "" || strings.ContainsAny(m.Src, ",\n") {
+			return fmt.Errorf("%ssrc must be a path without commas (got %q)", field, m.Src)
+		}
+		if !strings.HasPrefix(m.Dst, "/") || strings.ContainsAny(m.Dst, ", \n") {
+			return fmt.Errorf("%sdst must be an absolute path without commas or spaces (got %q)", field, m.Dst)
+		}
+		dst := strings.TrimSuffix(m.Dst, "/")
+		if seen[dst] {
+			return fmt.Errorf("%sdst %s is mounted twice", field, m.Dst)
+		}
+		seen[dst] = true
+	}
+	return nil
+}
+
+// NodeResources sizes the node containers of one role.
+type NodeResources struct {
+	// CPUs and MemoryMB limit each node container; zero keeps the talosctl
+	// default (DefaultNodeCPUs, DefaultNodeMemoryMB).
+	CPUs     float64 `yaml:"cpus"`
+	MemoryMB int     `yaml:"memory_mb"`
+	// ReservedDiskGB is host disk reserved for each node under the Docker
+	// data root. It is not a node disk size: the Docker provisioner cannot
+	// cap a node's disk, so it is never passed to talosctl or Docker and
+	// only checked against the VM's disk, in preflight and cluster_create.
+	ReservedDiskGB int `yaml:"reserved_disk_gb"`
+}
+
+// Resource defaults of talosctl's Docker provisioner.
+const (
+	DefaultNodeCPUs     = 2.0
+	DefaultNodeMemoryMB = 2048
+)
+
+// EffectiveCPUs returns CPUs, or the talosctl default when unset.
+func (r NodeResources) EffectiveCPUs() float64 {
+	if r.CPUs <= 0 {
+		return DefaultNodeCPUs
+	}
+	return r.CPUs
+}
+
+// EffectiveMemoryMB returns MemoryMB, or the talosctl default when unset.
+func (r NodeResources) EffectiveMemoryMB() int {
+	if r.MemoryMB <= 0 {
+		return DefaultNodeMemoryMB
+	}
+	return r.MemoryMB
+}
+
+func (r NodeResources) validate() error {
+	if r.CPUs < 0 || (r.CPUs > 0 && r.CPUs < 0.5) {
+		return fmt.Errorf("cpus must be at least 0.5, or 0 for the default (got %g)", r.CPUs)
+	}
+	if r.MemoryMB < 0 || (r.MemoryMB > 0 && r.MemoryMB < 1024) {
+		return fmt.Errorf("memory_mb must be at least 1024, or 0 for the default (got %d)", r.MemoryMB)
+	}
+	if r.ReservedDiskGB < 0 {
+		return fmt.Errorf("reserved_disk_gb must not be negative (got %d)", r.ReservedDiskGB)
+	}
+	return nil
+}
+
+// ControlplaneCount returns Controlplanes, defaulting to one.
+func (c ClusterConfig) ControlplaneCount() int {
+	if c.Controlplanes < 1 {
+		return 1
+	}
+	return c.Controlplanes
 }
 
 type TimeoutsConfig struct {
@@ -82,11 +651,37 @@ func (t TimeoutsConfig) TotalDuration() time.Duration {
 func defaultConfig() Config {
 	return Config{
 		VM: VMConfig{Port: 22, KnownHostsMode: "strict"},
+		Preflight: PreflightConfig{
+			Enabled:         true,
+			SupportedOS:     []string{"ubuntu"},
+			MinOSVersion:    "22.04",
+			Architectures:   []string{"amd64", "arm64"},
+			MinKernel:       "5.15",
+			CgroupVersion:   2,
+			MinRootDiskGB:   10,
+			MinDockerDiskGB: 20,
+			MinMemoryMB:     2048,
+			MinCPUs:         2,
+			Endpoints:       []string{"download.docker.com", "github.com"},
+		},
 		Hardening: HardeningConfig{
-			Enabled:          true,
-			AllowPasswordSSH: false,
-			EnableUFW:        true,
-			AllowTCPPorts:    []int{22},
+			Enabled:           true,
+			AllowPasswordSSH:  false,
+			EnableUFW:         true,
+			AllowTCPPorts:     []int{22},
+			FilterDockerPorts: true,
+			Profile:           HardeningProfileBaseline,
+		},
+		Docker: DockerConfig{
+			Daemon: DockerDaemonConfig{
+				LogDriver:  "json-file",
+				LogMaxSize: "10m",
+				LogMaxFile: 3,
+			},
+		},
+		Offline: OfflineConfig{
+			CacheDir: "~/.cache/talos-docker-bootstrap/artifacts",
+			Fetch:    true,
 		},
 		Timeouts: TimeoutsConfig{
 			SSHConnectSeconds: 5,
@@ -136,13 +731,30 @@ func applyEnvOverrides(cfg *Config) {
 }
 
 func expandHomePaths(cfg *Config) {
-	cfg.VM.SSHPrivateKey = expandHome(cfg.VM.SSHPrivateKey)
-	cfg.VM.KnownHostsFile = expandHome(cfg.VM.KnownHostsFile)
-	cfg.Cluster.StateDir = expandHome(cfg.Cluster.StateDir)
-	cfg.Cluster.MountSrc = expandHome(cfg.Cluster.MountSrc)
+	cfg.VM.SSHPrivateKey = ExpandHome(cfg.VM.SSHPrivateKey)
+	cfg.VM.KnownHostsFile = ExpandHome(cfg.VM.KnownHostsFile)
+	cfg.VM.SSHAgentIdentity = ExpandHome(cfg.VM.SSHAgentIdentity)
+	cfg.VM.SSHCertificate = ExpandHome(cfg.VM.SSHCertificate)
+	cfg.VM.SSHHostCA = ExpandHome(cfg.VM.SSHHostCA)
+	for i := range cfg.VM.JumpHosts {
+		cfg.VM.JumpHosts[i].SSHPrivateKey = ExpandHome(cfg.VM.JumpHosts[i].SSHPrivateKey)
+	}
+	cfg.Cluster.StateDir = ExpandHome(cfg.Cluster.StateDir)
+	cfg.Offline.CacheDir = ExpandHome(cfg.Offline.CacheDir)
+	cfg.Proxy.CABundle = ExpandHome(cfg.Proxy.CABundle)
+	cfg.Cluster.MountSrc = ExpandHome(cfg.Cluster.MountSrc)
+	for i := range cfg.Cluster.Mounts {
+		cfg.Cluster.Mounts[i].Src = ExpandHome(cfg.Cluster.Mounts[i].Src)
+	}
+	for _, paths := range [][]string{cfg.Cluster.ConfigPatches.Global, cfg.Cluster.ConfigPatches.Controlplane, cfg.Cluster.ConfigPatches.Worker} {
+		for i := range paths {
+			paths[i] = ExpandHome(paths[i])
+		}
+	}
 }
 
-func expandHome(path string) string {
+// ExpandHome expands a leading ~ to the current user's home directory.
+func ExpandHome(path string) string {
 	p := strings.TrimSpace(path)
 	if p == "" || !strings.HasPrefix(p, "~") {
 		return path
@@ -170,55 +782,110 @@ func (c Config) Validate() error {
 	if strings.TrimSpace(c.VM.User) == "" {
 		return fmt.Errorf("vm.user is required")
 	}
-	if strings.TrimSpace(c.VM.SSHPrivateKey) == "" {
+	if normalizeSSHAuth(c.VM.SSHAuth) == "" {
+		return fmt.Errorf("vm.ssh_auth must be one of: key, agent")
+	}
+	if !c.VM.UsesAgent() && strings.TrimSpace(c.VM.SSHPrivateKey) == "" {
 		return fmt.Errorf("vm.ssh_private_key is required")
 	}
 	if strings.HasSuffix(strings.ToLower(strings.TrimSpace(c.VM.SSHPrivateKey)), ".pub") {
 		return fmt.Errorf("vm.ssh_private_key must point to a private key, not a .pub file")
 	}
+	if cert := strings.TrimSpace(c.VM.SSHCertificate); cert != "" && cert == strings.TrimSpace(c.VM.SSHPrivateKey) {
+		return fmt.Errorf("vm.ssh_certificate must point to the certificate (*-cert.pub), not the private key")
+	}
 	if mode := normalizeKnownHostsMode(c.VM.KnownHostsMode); mode == "" {
 		return fmt.Errorf("vm.known_hosts_mode must be one of: strict, prompt, accept-new, auto-refresh")
 	}
-	if fp := strings.TrimSpace(c.VM.SSHHostFingerprint); fp != "" {
-		if !sshFingerprintRE.MatchString(fp) {
+	if len(c.VM.SSHHostFingerprint) > 0 {
+		if !c.VM.SSHHostFingerprint.valid() {
 			return fmt.Errorf("vm.ssh_host_fingerprint must be in SHA256:... format")
 		}
 		if strings.TrimSpace(c.VM.KnownHostsFile) == "" {
 			return fmt.Errorf("vm.known_hosts_file is required when vm.ssh_host_fingerprint is set")
 		}
 	}
+	for _, a := range c.VM.SSHHostKeyAlgorithms {
+		if !isSupportedHostKeyAlgorithm(a) {
+			return fmt.Errorf("vm.ssh_host_key_algorithms entries must be one of: %s (got %q)", strings.Join(supportedHostKeyAlgorithms, ", "), a)
+		}
+	}
+	if normalizeSSHTransport(c.VM.SSHTransport) == "" {
+		return fmt.Errorf("vm.ssh_transport must be one of: openssh, native")
+	}
 	if mode := normalizeKnownHostsMode(c.VM.KnownHostsMode); (mode == "prompt" || mode == "auto-refresh") && strings.TrimSpace(c.VM.KnownHostsFile) == "" {
 		return fmt.Errorf("vm.known_hosts_file is required when vm.known_hosts_mode is %s", mode)
 	}
+	for i, j := range c.VM.JumpHosts {
+		if err := j.validate(c.VM); err != nil {
+			return fmt.Errorf("vm.jump_hosts[%d].%w", i, err)
+		}
+	}
 	if strings.TrimSpace(c.Docker.Version) == "" {
 		return fmt.Errorf("docker.version is required")
 	}
 	if !isSafeVersionToken(c.Docker.Version) {
 		return fmt.Errorf("docker.version has invalid characters")
 	}
+	if err := c.Docker.Daemon.validate(); err != nil {
+		return fmt.Errorf("docker.daemon.%w", err)
+	}
 	if strings.TrimSpace(c.Talos.Version) == "" {
 		return fmt.Errorf("talos.version is required")
 	}
 	if !isSafeVersionToken(c.Talos.Version) {
 		return fmt.Errorf("talos.version has invalid characters")
 	}
-	if strings.TrimSpace(c.Talos.SHA256Checksum) == "" {
-		return fmt.Errorf("talos.sha256_checksum is required")
+	if strings.TrimSpace(c.Talos.SHA256Checksum) == "" && len(c.Talos.SHA256Checksums) == 0 {
+		return fmt.Errorf("talos.sha256_checksums is required")
 	}
-	if !sha256HexRE.MatchString(c.Talos.SHA256Checksum) {
+	if strings.TrimSpace(c.Talos.SHA256Checksum) != "" && !sha256HexRE.MatchString(c.Talos.SHA256Checksum) {
 		return fmt.Errorf("talos.sha256_checksum must be a valid SHA256 hex digest")
 	}
+	for arch, sum := range c.Talos.SHA256Checksums {
+		if !slices.Contains(TalosArchitectures, arch) {
+			return fmt.Errorf("talos.sha256_checksums keys must be one of: %s (got %q)", strings.Join(TalosArchitectures, ", "), arch)
+		}
+		if !sha256HexRE.MatchString(sum) {
+			return fmt.Errorf("talos.sha256_checksums.%s must be a valid SHA256 hex digest", arch)
+		}
+	}
 	if strings.TrimSpace(c.Cluster.Name) == "" {
 		return fmt.Errorf("cluster.name is required")
 	}
 	if strings.TrimSpace(c.Cluster.StateDir) == "" {
 		return fmt.Errorf("cluster.state_dir is required")
 	}
-	if strings.TrimSpace(c.Cluster.MountSrc) == "" {
-		return fmt.Errorf("cluster.mount_src is required")
+	if err := c.Cluster.validateMounts(); err != nil {
+		return err
+	}
+	if c.Cluster.Controlplanes < 0 {
+		return fmt.Errorf("cluster.controlplanes must not be negative (got %d)", c.Cluster.Controlplanes)
+	}
+	if c.Cluster.Workers < 0 {
+		return fmt.Errorf("cluster.workers must not be negative (got %d)", c.Cluster.Workers)
+	}
+	if v := c.Cluster.KubernetesVersionNumber(); c.Cluster.KubernetesVersion != "" && (!numericVersionRE.MatchString(v) || strings.Count(v, ".") != 2) {
+		return fmt.Errorf("cluster.kubernetes_version must be a version like 1.32.3 (got %q)", c.Cluster.KubernetesVersion)
+	}
+	if c.Cluster.TalosImage != "" && strings.ContainsAny(c.Cluster.TalosImage, " \t'\"") {
+		return fmt.Errorf("cluster.talos_image must be an image reference (got %q)", c.Cluster.TalosImage)
+	}
+	if c.Cluster.ImageRegistry != "" && !imageRegistryRE.MatchString(strings.TrimSuffix(c.Cluster.ImageRegistry, "/")) {
+		return fmt.Errorf("cluster.image_registry must be a registry host with an optional port and path (got %q)", c.Cluster.ImageRegistry)
+	}
+	if err := c.Cluster.ConfigPatches.validate(); err != nil {
+		return fmt.Errorf("cluster.config_patches.%w", err)
+	}
+	if err := c.Cluster.Controlplane.validate(); err != nil {
+		return fmt.Errorf("cluster.controlplane.%w", err)
+	}
+	if err := c.Cluster.Worker.validate(); err != nil {
+		return fmt.Errorf("cluster.worker.%w", err)
 	}
-	if strings.TrimSpace(c.Cluster.MountDst) == "" {
-		return fmt.Errorf("cluster.mount_dst is required")
+	// Nodes get consecutive addresses in the cluster's /24 network.
+	if n := c.Cluster.ControlplaneCount() + c.Cluster.Workers; n > 200 {
+		return fmt.Errorf("cluster.controlplanes plus cluster.workers must be at most 200 (got %d)", n)
 	}
 	if c.Timeouts.SSHConnectSeconds <= 0 {
 		return fmt.Errorf("timeouts.ssh_connect_seconds must be > 0")
@@ -232,11 +899,86 @@ func (c Config) Validate() error {
 	if c.Timeouts.TotalMinutes <= 0 {
 		return fmt.Errorf("timeouts.total_minutes must be > 0")
 	}
+	if c.Offline.Enabled && strings.TrimSpace(c.Offline.CacheDir) == "" {
+		return fmt.Errorf("offline.cache_dir is required when offline.enabled is true")
+	}
+	for _, img := range c.Offline.Images {
+		if strings.TrimSpace(img) == "" || strings.ContainsAny(img, " \t'\"") {
+			return fmt.Errorf("offline.images entries must be image references (got %q)", img)
+		}
+		if strings.Contains(img, "@") {
+			return fmt.Errorf("offline.images entries must be tagged, not pinned by digest (got %q)", img)
+		}
+	}
+	if err := c.Proxy.validate(); err != nil {
+		return fmt.Errorf("proxy.%w", err)
+	}
+	if err := c.Preflight.validate(); err != nil {
+		return fmt.Errorf("preflight.%w", err)
+	}
 	for _, p := range c.Hardening.AllowTCPPorts {
 		if p <= 0 || p > 65535 {
 			return fmt.Errorf("hardening.allow_tcp_ports entries must be in range 1..65535 (got %d)", p)
 		}
 	}
+	if c.Hardening.Enabled && c.Hardening.EnableUFW && !c.Hardening.AllowsTCP(c.VM.Port) {
+		return fmt.Errorf("hardening.enable_ufw needs a tcp rule for vm.port %d (allow_tcp_ports or firewall_rules), or SSH is locked out", c.VM.Port)
+	}
+	for i, r := range c.Hardening.FirewallRules {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("hardening.firewall_rules[%d].%w", i, err)
+		}
+	}
+	for _, cidr := range c.Hardening.AllowSourceCIDRs {
+		if !isCIDR(cidr) {
+			return fmt.Errorf("hardening.allow_source_cidrs entries must be CIDRs such as 10.0.0.0/8 (got %q)", cidr)
+		}
+	}
+	if err := c.Hardening.validate(c.VM.User); err != nil {
+		return fmt.Errorf("hardening.%w", err)
+	}
+	return nil
+}
+
+func (p PreflightConfig) validate() error {
+	if v := strings.TrimSpace(p.MinOSVersion); v != "" && !numericVersionRE.MatchString(v) {
+		return fmt.Errorf("min_os_version must be a dotted number such as 22.04 (got %q)", p.MinOSVersion)
+	}
+	if v := strings.TrimSpace(p.MinKernel); v != "" && !numericVersionRE.MatchString(v) {
+		return fmt.Errorf("min_kernel must be a dotted number such as 5.15 (got %q)", p.MinKernel)
+	}
+	if p.CgroupVersion != 0 && p.CgroupVersion != 1 && p.CgroupVersion != 2 {
+		return fmt.Errorf("cgroup_version must be 1 or 2, or 0 to accept either")
+	}
+	if p.MinRootDiskGB < 0 || p.MinDockerDiskGB < 0 || p.MinMemoryMB < 0 || p.MinCPUs < 0 {
+		return fmt.Errorf("minimums must be >= 0")
+	}
+	for _, e := range p.Endpoints {
+		if !hostnameRE.MatchString(e) {
+			return fmt.Errorf("endpoints entries must be host names (got %q)", e)
+		}
+	}
+	return nil
+}
+
+func (j JumpHostConfig) validate(vm VMConfig) error {
+	if strings.TrimSpace(j.Host) == "" {
+		return fmt.Errorf("host is required")
+	}
+	if j.Port < 0 || j.Port > 65535 {
+		return fmt.Errorf("port must be in range 1..65535")
+	}
+	if strings.HasSuffix(strings.ToLower(strings.TrimSpace(j.SSHPrivateKey)), ".pub") {
+		return fmt.Errorf("ssh_private_key must point to a private key, not a .pub file")
+	}
+	if len(j.SSHHostFingerprint) > 0 {
+		if !j.SSHHostFingerprint.valid() {
+			return fmt.Errorf("ssh_host_fingerprint must be in SHA256:... format")
+		}
+		if strings.TrimSpace(vm.KnownHostsFile) == "" {
+			return fmt.Errorf("ssh_host_fingerprint requires vm.known_hosts_file")
+		}
+	}
 	return nil
 }
 
@@ -244,6 +986,34 @@ func isSafeVersionToken(v string) bool {
 	return safeVersionTokenRE.MatchString(v)
 }
 
+func normalizeSSHTransport(transport string) string {
+	switch strings.ToLower(strings.TrimSpace(transport)) {
+	case "", "openssh":
+		return "openssh"
+	case "native":
+		return "native"
+	default:
+		return ""
+	}
+}
+
+func normalizeSSHAuth(auth string) string {
+	switch strings.ToLower(strings.TrimSpace(auth)) {
+	case "", "key":
+		return "key"
+	case "agent":
+		return "agent"
+	default:
+		return ""
+	}
+}
+
+// UsesAgent reports whether the VM (and hops without their own key)
+// authenticate through the running ssh-agent.
+func (v VMConfig) UsesAgent() bool {
+	return normalizeSSHAuth(v.SSHAuth) == "agent"
+}
+
 func normalizeKnownHostsMode(mode string) string {
 	switch strings.ToLower(strings.TrimSpace(mode)) {
 	case "", "strict":
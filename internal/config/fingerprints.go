@@ -0,0 +1,81 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// supportedHostKeyAlgorithms mirrors the algorithms the ssh package can verify.
+var supportedHostKeyAlgorithms = []string{
+	"ssh-ed25519",
+	"ecdsa-sha2-nistp256",
+	"ecdsa-sha2-nistp384",
+	"ecdsa-sha2-nistp521",
+	"rsa-sha2-512",
+	"rsa-sha2-256",
+}
+
+func isSupportedHostKeyAlgorithm(algo string) bool {
+	for _, a := range supportedHostKeyAlgorithms {
+		if a == strings.TrimSpace(algo) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fingerprints is a set of pinned SHA256 host key fingerprints, typically one
+// per host key type. In YAML it is either a single string or a list.
+type Fingerprints []string
+
+// ParseFingerprints splits a comma or whitespace separated fingerprint list.
+func ParseFingerprints(s string) Fingerprints {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+	if len(fields) == 0 {
+		return nil
+	}
+	return Fingerprints(fields)
+}
+
+// String renders the fingerprints as a comma separated list.
+func (f Fingerprints) String() string {
+	return strings.Join(f, ", ")
+}
+
+func (f Fingerprints) valid() bool {
+	for _, fp := range f {
+		if !sshFingerprintRE.MatchString(fp) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *Fingerprints) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		*f = ParseFingerprints(value.Value)
+		return nil
+	case yaml.SequenceNode:
+		var list []string
+		if err := value.Decode(&list); err != nil {
+			return err
+		}
+		*f = ParseFingerprints(strings.Join(list, ","))
+		return nil
+	default:
+		return fmt.Errorf("line %d: ssh_host_fingerprint must be a string or a list of strings", value.Line)
+	}
+}
+
+// MarshalYAML keeps the single-string form for zero or one fingerprint.
+func (f Fingerprints) MarshalYAML() (interface{}, error) {
+	if len(f) <= 1 {
+		return strings.Join(f, ""), nil
+	}
+	return []string(f), nil
+}
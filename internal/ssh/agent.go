@@ -0,0 +1,161 @@
+package ssh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// agentSocketEnv names the environment variable holding the agent socket path.
+const agentSocketEnv = "SSH_AUTH_SOCK"
+
+func agentSocket() (string, error) {
+	sock := strings.TrimSpace(os.Getenv(agentSocketEnv))
+	if sock == "" {
+		return "", fmt.Errorf("%s is not set; start ssh-agent (or your hardware key agent) or use key authentication", agentSocketEnv)
+	}
+	return sock, nil
+}
+
+// dialAgent connects to the running ssh-agent.
+func dialAgent() (agent.ExtendedAgent, func(), error) {
+	sock, err := agentSocket()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connect to ssh-agent at %s: %w", sock, err)
+	}
+	return agent.NewClient(conn), func() { _ = conn.Close() }, nil
+}
+
+// agentSigners returns the agent signers allowed by cfg.AgentIdentity.
+// The returned close func must be called once authentication is done.
+func agentSigners(cfg ExecConfig) ([]ssh.Signer, func(), error) {
+	client, closeAgent, err := dialAgent()
+	if err != nil {
+		return nil, nil, err
+	}
+	keys, err := client.List()
+	if err != nil {
+		closeAgent()
+		return nil, nil, fmt.Errorf("list ssh-agent keys: %w", err)
+	}
+	matched, err := matchAgentKeys(keys, cfg.AgentIdentity)
+	if err != nil {
+		closeAgent()
+		return nil, nil, err
+	}
+	signers, err := client.Signers()
+	if err != nil {
+		closeAgent()
+		return nil, nil, fmt.Errorf("load ssh-agent signers: %w", err)
+	}
+	allowed := make(map[string]bool, len(matched))
+	for _, k := range matched {
+		allowed[string(k.Marshal())] = true
+	}
+	out := make([]ssh.Signer, 0, len(matched))
+	for _, s := range signers {
+		if allowed[string(s.PublicKey().Marshal())] {
+			out = append(out, s)
+		}
+	}
+	return out, closeAgent, nil
+}
+
+// matchAgentKeys filters agent keys by identity: a public key file, an
+// authorized_keys line, a SHA256 fingerprint or an exact key comment. An
+// empty identity allows every key.
+func matchAgentKeys(keys []*agent.Key, identity string) ([]*agent.Key, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("ssh-agent has no keys loaded (ssh-add, or insert the hardware key)")
+	}
+	identity = strings.TrimSpace(identity)
+	if identity == "" {
+		return keys, nil
+	}
+
+	var want ssh.PublicKey
+	if data, err := os.ReadFile(identity); err == nil {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("parse agent identity %s: %w", identity, err)
+		}
+		want = pub
+	} else if pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(identity)); err == nil {
+		want = pub
+	}
+
+	out := make([]*agent.Key, 0, 1)
+	for _, k := range keys {
+		switch {
+		case want != nil:
+			if string(k.Marshal()) == string(want.Marshal()) {
+				out = append(out, k)
+			}
+		case strings.HasPrefix(identity, "SHA256:"):
+			if ssh.FingerprintSHA256(k) == identity {
+				out = append(out, k)
+			}
+		default:
+			if k.Comment == identity {
+				out = append(out, k)
+			}
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no ssh-agent key matches identity %q", identity)
+	}
+	return out, nil
+}
+
+// prepareAgentIdentity makes cfg usable by the OpenSSH client, which can only
+// restrict agent keys through a public key file: a fingerprint, comment or
+// inline key is resolved against the agent and written to a temporary .pub
+// file that replaces cfg.AgentIdentity.
+func prepareAgentIdentity(cfg ExecConfig) (ExecConfig, error) {
+	if !cfg.UseAgent {
+		return cfg, nil
+	}
+	if _, err := agentSocket(); err != nil {
+		return cfg, err
+	}
+	identity := strings.TrimSpace(cfg.AgentIdentity)
+	if identity == "" {
+		return cfg, nil
+	}
+	if st, err := os.Stat(identity); err == nil && !st.IsDir() {
+		return cfg, nil
+	}
+	client, closeAgent, err := dialAgent()
+	if err != nil {
+		return cfg, err
+	}
+	defer closeAgent()
+	keys, err := client.List()
+	if err != nil {
+		return cfg, fmt.Errorf("list ssh-agent keys: %w", err)
+	}
+	matched, err := matchAgentKeys(keys, identity)
+	if err != nil {
+		return cfg, err
+	}
+	line := ssh.MarshalAuthorizedKey(matched[0])
+	sum := sha256.Sum256(line)
+	path := filepath.Join(os.TempDir(), "tdb-agent-"+hex.EncodeToString(sum[:8])+".pub")
+	if err := writeFileAtomic(path, line, 0o600); err != nil {
+		return cfg, fmt.Errorf("write agent identity: %w", err)
+	}
+	cfg.AgentIdentity = path
+	return cfg, nil
+}
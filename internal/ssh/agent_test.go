@@ -0,0 +1,158 @@
+package ssh
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// startTestAgent serves keyring on a unix socket and points SSH_AUTH_SOCK at it.
+func startTestAgent(t *testing.T, keyring agent.Agent) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "tdb-agent")
+	if err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	sock := filepath.Join(dir, "agent.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("listen agent: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _ = agent.ServeAgent(keyring, conn) }()
+		}
+	}()
+	t.Setenv(agentSocketEnv, sock)
+}
+
+func addKeyFromFile(t *testing.T, keyring agent.Agent, path, comment string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read key: %v", err)
+	}
+	raw, err := ssh.ParseRawPrivateKey(data)
+	if err != nil {
+		t.Fatalf("parse key: %v", err)
+	}
+	if err := keyring.Add(agent.AddedKey{PrivateKey: raw, Comment: comment}); err != nil {
+		t.Fatalf("add key: %v", err)
+	}
+}
+
+func TestNativeRunCommandWithAgentIdentity(t *testing.T) {
+	srv := startTestSSHServer(t, echoStdinHandler)
+	keyring := agent.NewKeyring()
+	_, otherKey := newTestClientKey(t)
+	addKeyFromFile(t, keyring, otherKey, "laptop")
+	addKeyFromFile(t, keyring, srv.clientKeyPath, "yubikey-5c")
+	startTestAgent(t, keyring)
+
+	cfg := srv.execConfig(filepath.Join(t.TempDir(), "known_hosts"), "accept-new")
+	cfg.PrivateKeyPath = ""
+	cfg.UseAgent = true
+	cfg.AgentIdentity = "yubikey-5c"
+
+	out, _, err := RunCommand(context.Background(), cfg, "whoami")
+	if err != nil {
+		t.Fatalf("RunCommand with agent failed: %v", err)
+	}
+	if out != "whoami" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+}
+
+func TestAgentAuthWithoutSocketFails(t *testing.T) {
+	t.Setenv(agentSocketEnv, "")
+	cfg := ExecConfig{Host: "10.0.0.1", Port: 22, User: "dev", UseAgent: true}
+	_, _, err := RunCommand(context.Background(), cfg, "true")
+	if err == nil || !strings.Contains(err.Error(), agentSocketEnv) {
+		t.Fatalf("expected missing SSH_AUTH_SOCK error, got %v", err)
+	}
+}
+
+func TestMatchAgentKeys(t *testing.T) {
+	first := newTestSigner(t).PublicKey()
+	second := newTestSigner(t).PublicKey()
+	keys := []*agent.Key{
+		{Format: first.Type(), Blob: first.Marshal(), Comment: "laptop"},
+		{Format: second.Type(), Blob: second.Marshal(), Comment: "yubikey"},
+	}
+
+	pubFile := filepath.Join(t.TempDir(), "id.pub")
+	if err := os.WriteFile(pubFile, ssh.MarshalAuthorizedKey(second), 0o600); err != nil {
+		t.Fatalf("write pub: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		identity string
+		want     *agent.Key
+	}{
+		{name: "comment", identity: "yubikey", want: keys[1]},
+		{name: "fingerprint", identity: ssh.FingerprintSHA256(first), want: keys[0]},
+		{name: "inline key", identity: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(first))), want: keys[0]},
+		{name: "public key file", identity: pubFile, want: keys[1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := matchAgentKeys(keys, tt.identity)
+			if err != nil {
+				t.Fatalf("matchAgentKeys: %v", err)
+			}
+			if len(got) != 1 || got[0] != tt.want {
+				t.Fatalf("expected %s, got %v", tt.want.Comment, got)
+			}
+		})
+	}
+
+	if got, err := matchAgentKeys(keys, ""); err != nil || len(got) != 2 {
+		t.Fatalf("expected empty identity to allow all keys, got %v (%v)", got, err)
+	}
+	if _, err := matchAgentKeys(keys, "missing"); err == nil {
+		t.Fatalf("expected error for unmatched identity")
+	}
+	if _, err := matchAgentKeys(nil, ""); err == nil {
+		t.Fatalf("expected error for empty agent")
+	}
+}
+
+func TestPrepareAgentIdentityWritesPublicKeyForOpenSSH(t *testing.T) {
+	keyring := agent.NewKeyring()
+	_, keyPath := newTestClientKey(t)
+	addKeyFromFile(t, keyring, keyPath, "yubikey-5c")
+	startTestAgent(t, keyring)
+
+	cfg, err := prepareAgentIdentity(ExecConfig{Host: "10.0.0.1", User: "dev", UseAgent: true, AgentIdentity: "yubikey-5c"})
+	if err != nil {
+		t.Fatalf("prepareAgentIdentity: %v", err)
+	}
+	t.Cleanup(func() { _ = os.Remove(cfg.AgentIdentity) })
+	if !strings.HasSuffix(cfg.AgentIdentity, ".pub") {
+		t.Fatalf("expected identity to be resolved to a .pub file, got %q", cfg.AgentIdentity)
+	}
+	args := strings.Join(buildSSHArgs(cfg, "true"), " ")
+	if !strings.Contains(args, "-i "+cfg.AgentIdentity) || !strings.Contains(args, "IdentitiesOnly=yes") {
+		t.Fatalf("expected ssh to be restricted to the agent key, got %q", args)
+	}
+}
+
+func TestBuildSSHArgsAgentWithoutIdentityOffersAllKeys(t *testing.T) {
+	args := strings.Join(buildSSHArgs(ExecConfig{Host: "10.0.0.1", Port: 22, User: "dev", UseAgent: true, PrivateKeyPath: "/tmp/key"}, "true"), " ")
+	if strings.Contains(args, "-i ") || strings.Contains(args, "IdentitiesOnly") {
+		t.Fatalf("expected no identity restriction in agent mode, got %q", args)
+	}
+}
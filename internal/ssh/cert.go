@@ -0,0 +1,230 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// loadCAKeys reads the CA public keys from path. Lines may be plain
+// authorized_keys entries or known_hosts "@cert-authority <hosts> <key>" lines.
+func loadCAKeys(path string) ([]ssh.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read host CA %s: %w", path, err)
+	}
+	var keys []ssh.PublicKey
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "@cert-authority") {
+			fields := strings.Fields(line)
+			if len(fields) < 4 {
+				return nil, fmt.Errorf("host CA %s line %d: malformed @cert-authority entry", path, n+1)
+			}
+			line = strings.Join(fields[2:], " ")
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("host CA %s line %d: %w", path, n+1, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("host CA %s contains no public keys", path)
+	}
+	return keys, nil
+}
+
+// verifyHostCertificate checks that cert is a host certificate for cfg.Host,
+// signed by one of cas and valid now. A pinned fingerprint, when set, must
+// still match the certified key.
+func verifyHostCertificate(cfg ExecConfig, cert *ssh.Certificate) error {
+	target, _ := knownHostsTarget(cfg)
+	fail := func(format string, args ...any) error {
+		return &HostCertificateError{Host: target, Reason: fmt.Sprintf(format, args...)}
+	}
+	caFile := strings.TrimSpace(cfg.HostCAFile)
+	if caFile == "" {
+		return fail("server presented a certificate but no host CA is configured")
+	}
+	cas, err := loadCAKeys(caFile)
+	if err != nil {
+		return err
+	}
+	if cert.CertType != ssh.HostCert {
+		return fail("certificate %q is a user certificate", cert.KeyId)
+	}
+	if !containsKey(cas, cert.SignatureKey) {
+		return fail("certificate %q is signed by untrusted CA %s", cert.KeyId, ssh.FingerprintSHA256(cert.SignatureKey))
+	}
+	host := strings.TrimSpace(cfg.Host)
+	if len(cert.ValidPrincipals) > 0 && !containsString(cert.ValidPrincipals, host) {
+		return fail("certificate %q is not valid for %s (principals: %s)", cert.KeyId, host, strings.Join(cert.ValidPrincipals, ", "))
+	}
+	if reason := certValidityProblem(cert, time.Now()); reason != "" {
+		return fail("certificate %q %s", cert.KeyId, reason)
+	}
+	checker := &ssh.CertChecker{}
+	if err := checker.CheckCert(host, cert); err != nil {
+		return fail("certificate %q: %v", cert.KeyId, err)
+	}
+	if pins := expectedHostKeys(cfg); len(pins) > 0 {
+		if got := ssh.FingerprintSHA256(cert.Key); !containsString(pins, got) {
+			return &HostKeyMismatchError{Host: target, Expected: strings.Join(pins, ","), Got: got}
+		}
+	}
+	return nil
+}
+
+// loadUserCertificate reads cfg.CertificateFile and checks that it is a user
+// certificate valid now for cfg.User. It returns nil when no certificate is
+// configured.
+func loadUserCertificate(cfg ExecConfig) (*ssh.Certificate, error) {
+	path := strings.TrimSpace(cfg.CertificateFile)
+	if path == "" {
+		return nil, nil
+	}
+	fail := func(format string, args ...any) error {
+		return &UserCertificateError{File: path, Reason: fmt.Sprintf(format, args...)}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fail("%v", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fail("parse: %v", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fail("not an SSH certificate")
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fail("certificate %q is a host certificate", cert.KeyId)
+	}
+	if len(cert.ValidPrincipals) > 0 && !containsString(cert.ValidPrincipals, cfg.User) {
+		return nil, fail("certificate %q is not valid for user %q (principals: %s)", cert.KeyId, cfg.User, strings.Join(cert.ValidPrincipals, ", "))
+	}
+	if reason := certValidityProblem(cert, time.Now()); reason != "" {
+		return nil, fail("certificate %q %s", cert.KeyId, reason)
+	}
+	return cert, nil
+}
+
+// withUserCertificate replaces the signer matching the configured user
+// certificate with a certificate signer. Without a certificate signers are
+// returned unchanged.
+func withUserCertificate(cfg ExecConfig, signers []ssh.Signer) ([]ssh.Signer, error) {
+	cert, err := loadUserCertificate(cfg)
+	if err != nil || cert == nil {
+		return signers, err
+	}
+	want := cert.Key.Marshal()
+	for _, s := range signers {
+		if !bytes.Equal(s.PublicKey().Marshal(), want) {
+			continue
+		}
+		certSigner, err := ssh.NewCertSigner(cert, s)
+		if err != nil {
+			return nil, &UserCertificateError{File: cfg.CertificateFile, Reason: err.Error()}
+		}
+		return []ssh.Signer{certSigner}, nil
+	}
+	source := "private key " + cfg.PrivateKeyPath
+	if cfg.UseAgent {
+		source = "any ssh-agent key"
+	}
+	return nil, &UserCertificateError{File: cfg.CertificateFile, Reason: fmt.Sprintf("certificate %q does not match %s", cert.KeyId, source)}
+}
+
+func certValidityProblem(cert *ssh.Certificate, now time.Time) string {
+	unix := now.Unix()
+	if unix < 0 {
+		return ""
+	}
+	if uint64(unix) < cert.ValidAfter {
+		return "is not valid until " + certTime(cert.ValidAfter)
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity && uint64(unix) >= cert.ValidBefore {
+		return "expired at " + certTime(cert.ValidBefore)
+	}
+	return ""
+}
+
+func certTime(t uint64) string {
+	return time.Unix(int64(t), 0).UTC().Format(time.RFC3339)
+}
+
+func containsKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	want := key.Marshal()
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), want) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareHostCA makes cfg.HostCAFile usable by the OpenSSH client, which only
+// reads CA trust from known_hosts: the CA keys are written as @cert-authority
+// entries for the target and every jump host to a temporary file that is
+// consulted alongside cfg.KnownHostsFile.
+func prepareHostCA(cfg ExecConfig) (ExecConfig, error) {
+	caFile := strings.TrimSpace(cfg.HostCAFile)
+	if caFile == "" {
+		return cfg, nil
+	}
+	cas, err := loadCAKeys(caFile)
+	if err != nil {
+		return cfg, err
+	}
+	targets := make([]string, 0, len(cfg.JumpHosts)+1)
+	for i := range cfg.JumpHosts {
+		t, _ := knownHostsTarget(hopExecConfig(cfg, i))
+		targets = append(targets, t)
+	}
+	t, _ := knownHostsTarget(cfg)
+	targets = append(targets, t)
+	patterns := strings.Join(targets, ",")
+
+	var buf bytes.Buffer
+	for _, ca := range cas {
+		fmt.Fprintf(&buf, "@cert-authority %s %s", patterns, ssh.MarshalAuthorizedKey(ca))
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	path := filepath.Join(os.TempDir(), "tdb-ca-"+hex.EncodeToString(sum[:8])+".known_hosts")
+	if err := writeFileAtomic(path, buf.Bytes(), 0o600); err != nil {
+		return cfg, fmt.Errorf("write host CA known_hosts: %w", err)
+	}
+	cfg.hostCAKnownHosts = path
+	return cfg, nil
+}
+
+// prepareOpenSSH resolves the agent identity and host CA settings into files
+// the ssh binary can consume.
+func prepareOpenSSH(cfg ExecConfig) (ExecConfig, error) {
+	cfg, err := prepareAgentIdentity(cfg)
+	if err != nil {
+		return cfg, err
+	}
+	return prepareHostCA(cfg)
+}
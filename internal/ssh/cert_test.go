@@ -0,0 +1,236 @@
+package ssh
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type testCertOptions struct {
+	principals []string
+	validAfter time.Time
+	validUntil time.Time
+}
+
+func signTestCert(t *testing.T, ca ssh.Signer, key ssh.PublicKey, certType uint32, opts testCertOptions) *ssh.Certificate {
+	t.Helper()
+	after, before := uint64(0), uint64(ssh.CertTimeInfinity)
+	if !opts.validAfter.IsZero() {
+		after = uint64(opts.validAfter.Unix())
+	}
+	if !opts.validUntil.IsZero() {
+		before = uint64(opts.validUntil.Unix())
+	}
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        certType,
+		KeyId:           "test-cert",
+		ValidPrincipals: opts.principals,
+		ValidAfter:      after,
+		ValidBefore:     before,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatalf("sign cert: %v", err)
+	}
+	return cert
+}
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+	return path
+}
+
+// startCertTestServer serves a host certificate signed by hostCA. When userCA
+// is set, clients must present a user certificate signed by it.
+func startCertTestServer(t *testing.T, hostCA ssh.Signer, opts testCertOptions, userCA ssh.PublicKey) *testSSHServer {
+	t.Helper()
+	hostKey := newTestSigner(t)
+	clientSigner, clientKeyPath := newTestClientKey(t)
+	hostSigner, err := ssh.NewCertSigner(signTestCert(t, hostCA, hostKey.PublicKey(), ssh.HostCert, opts), hostKey)
+	if err != nil {
+		t.Fatalf("host cert signer: %v", err)
+	}
+
+	serverCfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(clientSigner.PublicKey().Marshal()) {
+				return &ssh.Permissions{}, nil
+			}
+			return nil, errors.New("unknown client key")
+		},
+	}
+	if userCA != nil {
+		checker := &ssh.CertChecker{
+			IsUserAuthority: func(auth ssh.PublicKey) bool { return string(auth.Marshal()) == string(userCA.Marshal()) },
+		}
+		serverCfg.PublicKeyCallback = checker.Authenticate
+	}
+	serverCfg.AddHostKey(hostSigner)
+	return serveTestSSH(t, serverCfg, hostKey, clientKeyPath, echoStdinHandler)
+}
+
+func TestNativeHostCertificateTrustedWithoutKnownHosts(t *testing.T) {
+	ca := newTestSigner(t)
+	srv := startCertTestServer(t, ca, testCertOptions{principals: []string{"127.0.0.1"}}, nil)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+
+	cfg := srv.execConfig(knownHosts, "strict")
+	cfg.HostCAFile = writeTestFile(t, "ca.pub", ssh.MarshalAuthorizedKey(ca.PublicKey()))
+
+	out, _, err := RunCommand(context.Background(), cfg, "hostname")
+	if err != nil {
+		t.Fatalf("RunCommand with host CA failed: %v", err)
+	}
+	if out != "hostname" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	if _, err := os.Stat(knownHosts); !os.IsNotExist(err) {
+		t.Fatalf("expected CA-trusted host not to be written to known_hosts, got %v", err)
+	}
+}
+
+func TestNativeHostCertificateRejected(t *testing.T) {
+	ca := newTestSigner(t)
+	now := time.Now()
+	tests := []struct {
+		name   string
+		trust  ssh.PublicKey
+		opts   testCertOptions
+		reason string
+	}{
+		{name: "untrusted CA", trust: newTestSigner(t).PublicKey(), opts: testCertOptions{principals: []string{"127.0.0.1"}}, reason: "untrusted CA"},
+		{name: "expired", trust: ca.PublicKey(), opts: testCertOptions{principals: []string{"127.0.0.1"}, validUntil: now.Add(-time.Hour)}, reason: "expired at"},
+		{name: "not yet valid", trust: ca.PublicKey(), opts: testCertOptions{principals: []string{"127.0.0.1"}, validAfter: now.Add(time.Hour)}, reason: "not valid until"},
+		{name: "wrong principal", trust: ca.PublicKey(), opts: testCertOptions{principals: []string{"vm.example.com"}}, reason: "not valid for 127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := startCertTestServer(t, ca, tt.opts, nil)
+			cfg := srv.execConfig(filepath.Join(t.TempDir(), "known_hosts"), "strict")
+			cfg.HostCAFile = writeTestFile(t, "ca.pub", ssh.MarshalAuthorizedKey(tt.trust))
+
+			_, _, err := RunCommand(context.Background(), cfg, "true")
+			var certErr *HostCertificateError
+			if !errors.As(err, &certErr) {
+				t.Fatalf("expected HostCertificateError, got %v", err)
+			}
+			if !strings.Contains(certErr.Reason, tt.reason) {
+				t.Fatalf("expected reason to mention %q, got %q", tt.reason, certErr.Reason)
+			}
+		})
+	}
+}
+
+func TestNativeUserCertificateAuth(t *testing.T) {
+	hostCA := newTestSigner(t)
+	userCA := newTestSigner(t)
+	srv := startCertTestServer(t, hostCA, testCertOptions{}, userCA.PublicKey())
+	clientSigner, err := ssh.ParsePrivateKey(mustReadFile(t, srv.clientKeyPath))
+	if err != nil {
+		t.Fatalf("parse client key: %v", err)
+	}
+
+	cfg := srv.execConfig(filepath.Join(t.TempDir(), "known_hosts"), "strict")
+	cfg.HostCAFile = writeTestFile(t, "ca.pub", ssh.MarshalAuthorizedKey(hostCA.PublicKey()))
+
+	if _, _, err := RunCommand(context.Background(), cfg, "true"); err == nil {
+		t.Fatalf("expected plain key to be rejected by a certificate-only server")
+	}
+
+	cert := signTestCert(t, userCA, clientSigner.PublicKey(), ssh.UserCert, testCertOptions{principals: []string{"dev"}, validUntil: time.Now().Add(time.Hour)})
+	cfg.CertificateFile = writeTestFile(t, "id_ed25519-cert.pub", ssh.MarshalAuthorizedKey(cert))
+	if _, _, err := RunCommand(context.Background(), cfg, "true"); err != nil {
+		t.Fatalf("RunCommand with user certificate failed: %v", err)
+	}
+}
+
+func TestLoadUserCertificateErrors(t *testing.T) {
+	ca := newTestSigner(t)
+	key := newTestSigner(t).PublicKey()
+	now := time.Now()
+	tests := []struct {
+		name   string
+		data   []byte
+		reason string
+	}{
+		{name: "expired", data: ssh.MarshalAuthorizedKey(signTestCert(t, ca, key, ssh.UserCert, testCertOptions{validUntil: now.Add(-time.Minute)})), reason: "expired at"},
+		{name: "wrong principal", data: ssh.MarshalAuthorizedKey(signTestCert(t, ca, key, ssh.UserCert, testCertOptions{principals: []string{"root"}})), reason: `not valid for user "dev"`},
+		{name: "host certificate", data: ssh.MarshalAuthorizedKey(signTestCert(t, ca, key, ssh.HostCert, testCertOptions{})), reason: "host certificate"},
+		{name: "plain key", data: ssh.MarshalAuthorizedKey(key), reason: "not an SSH certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := ExecConfig{User: "dev", CertificateFile: writeTestFile(t, "cert.pub", tt.data)}
+			_, err := loadUserCertificate(cfg)
+			var certErr *UserCertificateError
+			if !errors.As(err, &certErr) || !strings.Contains(certErr.Reason, tt.reason) {
+				t.Fatalf("expected UserCertificateError mentioning %q, got %v", tt.reason, err)
+			}
+		})
+	}
+}
+
+func TestWithUserCertificateRequiresMatchingKey(t *testing.T) {
+	ca := newTestSigner(t)
+	cert := signTestCert(t, ca, newTestSigner(t).PublicKey(), ssh.UserCert, testCertOptions{})
+	cfg := ExecConfig{User: "dev", PrivateKeyPath: "/keys/other", CertificateFile: writeTestFile(t, "cert.pub", ssh.MarshalAuthorizedKey(cert))}
+	_, err := withUserCertificate(cfg, []ssh.Signer{newTestSigner(t)})
+	var certErr *UserCertificateError
+	if !errors.As(err, &certErr) || !strings.Contains(certErr.Reason, "does not match private key /keys/other") {
+		t.Fatalf("expected key mismatch error, got %v", err)
+	}
+}
+
+func TestBuildSSHArgsWithHostCAAndCertificate(t *testing.T) {
+	ca := newTestSigner(t)
+	line := "@cert-authority *.example.com " + string(ssh.MarshalAuthorizedKey(ca.PublicKey()))
+	cfg := ExecConfig{
+		Host:            "10.0.0.5",
+		Port:            2222,
+		User:            "dev",
+		PrivateKeyPath:  "/keys/id_ed25519",
+		CertificateFile: "/keys/id_ed25519-cert.pub",
+		KnownHostsFile:  "/tmp/known_hosts",
+		HostCAFile:      writeTestFile(t, "ca", []byte("# team CA\n"+line)),
+	}
+	prepared, err := prepareHostCA(cfg)
+	if err != nil {
+		t.Fatalf("prepareHostCA: %v", err)
+	}
+	t.Cleanup(func() { _ = os.Remove(prepared.hostCAKnownHosts) })
+
+	data := string(mustReadFile(t, prepared.hostCAKnownHosts))
+	if !strings.HasPrefix(data, "@cert-authority [10.0.0.5]:2222 ssh-ed25519 ") {
+		t.Fatalf("unexpected CA known_hosts content: %q", data)
+	}
+	args := strings.Join(buildSSHArgs(prepared, "true"), " ")
+	for _, want := range []string{
+		"UserKnownHostsFile=/tmp/known_hosts " + prepared.hostCAKnownHosts,
+		"HostKeyAlgorithms=" + ssh.CertAlgoED25519v01 + "," + ssh.KeyAlgoED25519,
+		"CertificateFile=/keys/id_ed25519-cert.pub",
+	} {
+		if !strings.Contains(args, want) {
+			t.Fatalf("expected %q in ssh args, got %q", want, args)
+		}
+	}
+}
+
+func mustReadFile(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	return data
+}
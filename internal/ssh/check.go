@@ -1,9 +1,12 @@
 package ssh
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"net"
+	"os/exec"
 	"time"
 )
 
@@ -18,17 +21,93 @@ func WaitForTCPPort(ctx context.Context, host string, port int, attempts int, co
 }
 
 func WaitForTCPPortWithStats(ctx context.Context, host string, port int, attempts int, connectTimeout time.Duration, retryDelay time.Duration) (TCPCheckStats, error) {
+	address := net.JoinHostPort(host, fmt.Sprintf("%d", port))
+	return waitForTCP(ctx, attempts, retryDelay, func(ctx context.Context) error {
+		d := net.Dialer{Timeout: connectTimeout}
+		conn, err := d.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+}
+
+// WaitForTCPPortViaJumpsWithStats probes cfg.Host:cfg.Port from the last of
+// cfg.JumpHosts, so targets that are only reachable through a bastion can be
+// checked. Each attempt re-dials the jump chain with the configured
+// transport.
+func WaitForTCPPortViaJumpsWithStats(ctx context.Context, cfg ExecConfig, attempts int, retryDelay time.Duration) (TCPCheckStats, error) {
+	if !useNativeTransport(cfg) {
+		return waitForTCP(ctx, attempts, retryDelay, func(ctx context.Context) error {
+			return probeViaOpenSSH(ctx, cfg)
+		})
+	}
+	return waitForTCP(ctx, attempts, retryDelay, func(ctx context.Context) error {
+		conn, release, err := nativeDialConn(ctx, cfg, nativeAddr(cfg))
+		if err != nil {
+			return err
+		}
+		_ = conn.Close()
+		release()
+		return nil
+	})
+}
+
+// probeViaOpenSSH has the last jump host open cfg.Host:cfg.Port with ssh -W,
+// reached through the same ProxyCommand chain as the OpenSSH sessions, and
+// waits for the target's first bytes (its SSH banner).
+func probeViaOpenSSH(ctx context.Context, cfg ExecConfig) error {
+	cfg, err := prepareOpenSSH(cfg)
+	if err != nil {
+		return err
+	}
+	hop, err := ensureExpectedHostKey(ctx, lastHopExecConfig(cfg))
+	if err != nil {
+		return fmt.Errorf("jump host %s: %w", nativeAddr(hop), err)
+	}
+	// One connect timeout for the jump chain, one for the forwarded dial.
+	ctx, cancel := context.WithTimeout(ctx, 2*nativeConnectTimeout(cfg))
+	defer cancel()
+
+	args := append(buildSSHOptions(hop), "-W", nativeAddr(cfg), hop.User+"@"+hop.Host)
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	// An open stdin keeps ssh from closing the forwarded stream early.
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = time.Second
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("ssh probe failed: %w", err)
+	}
+	_, readErr := io.ReadFull(stdout, make([]byte, 1))
+	_ = stdin.Close()
+	cancel()
+	waitErr := cmd.Wait()
+	if readErr != nil {
+		if waitErr == nil {
+			waitErr = readErr
+		}
+		return formatSSHRunError(fmt.Sprintf("ssh probe of %s via %s failed", nativeAddr(cfg), nativeAddr(hop)), waitErr, stderr.String())
+	}
+	return nil
+}
+
+func waitForTCP(ctx context.Context, attempts int, retryDelay time.Duration, probe func(context.Context) error) (TCPCheckStats, error) {
 	started := time.Now()
 	stats := TCPCheckStats{}
-	address := net.JoinHostPort(host, fmt.Sprintf("%d", port))
 	var lastErr error
 
 	for i := 0; i < attempts; i++ {
 		stats.Attempts = i + 1
-		d := net.Dialer{Timeout: connectTimeout}
-		conn, err := d.DialContext(ctx, "tcp", address)
+		err := probe(ctx)
 		if err == nil {
-			_ = conn.Close()
 			stats.Elapsed = time.Since(started)
 			return stats, nil
 		}
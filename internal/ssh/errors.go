@@ -0,0 +1,89 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeyMismatchError reports a host key that differs from the pinned
+// fingerprint or, when KnownHostsFile is set, from the key recorded in known_hosts.
+type HostKeyMismatchError struct {
+	Host           string
+	Expected       string
+	Got            string
+	KnownHostsFile string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	if strings.TrimSpace(e.KnownHostsFile) != "" {
+		return fmt.Sprintf("ssh host key for %s does not match %s (expected %s, got %s)", e.Host, e.KnownHostsFile, e.Expected, e.Got)
+	}
+	return fmt.Sprintf("ssh host fingerprint mismatch (expected %s, got %s)", e.Expected, e.Got)
+}
+
+// HostKeyUnknownError reports a host that has no entry in known_hosts while
+// the known_hosts mode does not allow trusting new hosts.
+type HostKeyUnknownError struct {
+	Host           string
+	Got            string
+	KnownHostsFile string
+}
+
+func (e *HostKeyUnknownError) Error() string {
+	return fmt.Sprintf("ssh host key for %s (%s) not found in %s", e.Host, e.Got, e.KnownHostsFile)
+}
+
+// ConnectError reports a failure to establish the SSH connection itself
+// (TCP dial, handshake or authentication), as opposed to a remote command failure.
+type ConnectError struct {
+	Addr string
+	Err  error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("ssh connect %s: %v", e.Addr, e.Err)
+}
+
+func (e *ConnectError) Unwrap() error { return e.Err }
+
+// HostCertificateError reports a host certificate that is not trusted: wrong
+// type, unknown CA, principal mismatch or outside its validity window.
+type HostCertificateError struct {
+	Host   string
+	Reason string
+}
+
+func (e *HostCertificateError) Error() string {
+	return fmt.Sprintf("ssh host certificate for %s rejected: %s", e.Host, e.Reason)
+}
+
+// UserCertificateError reports a user certificate that cannot be presented:
+// unreadable, expired, not yet valid, wrong principals or not matching the key.
+type UserCertificateError struct {
+	File   string
+	Reason string
+}
+
+func (e *UserCertificateError) Error() string {
+	return fmt.Sprintf("ssh user certificate %s unusable: %s", e.File, e.Reason)
+}
+
+// ExitStatus returns the exit status of the remote command that err reports,
+// with either transport. It is false when the command did not run to an exit
+// status, for example because the connection failed; OpenSSH reports that
+// as 255.
+func ExitStatus(err error) (int, bool) {
+	var native *ssh.ExitError
+	if errors.As(err, &native) {
+		return native.ExitStatus(), true
+	}
+	var proc *exec.ExitError
+	if errors.As(err, &proc) && proc.ExitCode() >= 0 && proc.ExitCode() != 255 {
+		return proc.ExitCode(), true
+	}
+	return 0, false
+}
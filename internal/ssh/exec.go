@@ -4,48 +4,103 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
-
-	"golang.org/x/crypto/ssh"
 )
 
-const hostKeyAlgorithm = "ssh-ed25519"
-
 type ExecConfig struct {
-	Host                  string
-	Port                  int
-	User                  string
-	PrivateKeyPath        string
-	KnownHostsFile        string
-	KnownHostsMode        string
-	ExpectedHostKeySHA256 string
-	Prompt                func(message string) (bool, error)
-	ConnectTimeout        time.Duration
+	Host           string
+	Port           int
+	User           string
+	PrivateKeyPath string
+	KnownHostsFile string
+	KnownHostsMode string
+	// ExpectedHostKeys pins the host: the key presented must have one of
+	// these SHA256 fingerprints. Pins may cover several key types.
+	ExpectedHostKeys []string
+	// HostKeyAlgorithms lists the accepted host key algorithms in preference
+	// order; empty means ssh-ed25519 only.
+	HostKeyAlgorithms []string
+	Prompt            func(message string) (bool, error)
+	ConnectTimeout    time.Duration
+	// Transport selects TransportOpenSSH (default) or TransportNative.
+	Transport string
+	// JumpHosts are dialed in order before Host.
+	JumpHosts []JumpHost
+	// UseAgent authenticates with keys from the agent at SSH_AUTH_SOCK
+	// instead of PrivateKeyPath.
+	UseAgent bool
+	// AgentIdentity optionally restricts the agent to one key: a public key
+	// file, an authorized_keys line, a SHA256 fingerprint or a key comment.
+	AgentIdentity string
+	// HostCAFile holds CA public keys whose host certificates are trusted
+	// without a known_hosts entry.
+	HostCAFile string
+	// CertificateFile is a user certificate presented with the private key
+	// (or the matching agent key).
+	CertificateFile string
+
+	// hostCAKnownHosts is the generated @cert-authority file for OpenSSH.
+	hostCAKnownHosts string
 }
 
 func RunScript(ctx context.Context, cfg ExecConfig, script string) (string, string, error) {
 	return RunScriptWithCommand(ctx, cfg, "sudo -n bash -s", script)
 }
 
+// RunScriptWithCommand runs remoteCommand with script on stdin. When ctx carries
+// a Session for the same target (see ContextWithSession) it is reused.
 func RunScriptWithCommand(ctx context.Context, cfg ExecConfig, remoteCommand string, script string) (string, string, error) {
-	args := buildSSHArgs(cfg, remoteCommand)
-	return runSSHCommand(ctx, cfg, args, script, "ssh run script failed")
+	if s := sessionFor(ctx, cfg); s != nil {
+		return s.RunScriptWithCommand(ctx, remoteCommand, script)
+	}
+	if useNativeTransport(cfg) {
+		return runNativeCommand(ctx, cfg, remoteCommand, script, "ssh run script failed")
+	}
+	cfg, err := prepareOpenSSH(cfg)
+	if err != nil {
+		return "", "", err
+	}
+	return runSSHCommand(ctx, cfg, sshArgsFor(remoteCommand), script, "ssh run script failed")
 }
 
 func RunCommand(ctx context.Context, cfg ExecConfig, remoteCommand string) (string, string, error) {
-	args := buildSSHArgs(cfg, remoteCommand)
-	return runSSHCommand(ctx, cfg, args, "", "ssh run command failed")
+	if s := sessionFor(ctx, cfg); s != nil {
+		return s.RunCommand(ctx, remoteCommand)
+	}
+	if useNativeTransport(cfg) {
+		return runNativeCommand(ctx, cfg, remoteCommand, "", "ssh run command failed")
+	}
+	cfg, err := prepareOpenSSH(cfg)
+	if err != nil {
+		return "", "", err
+	}
+	return runSSHCommand(ctx, cfg, sshArgsFor(remoteCommand), "", "ssh run command failed")
 }
 
-func runSSHCommand(ctx context.Context, cfg ExecConfig, args []string, stdinScript string, prefix string) (string, string, error) {
-	if err := ensureExpectedHostKey(ctx, cfg); err != nil {
+func sshArgsFor(remoteCommand string) func(ExecConfig) []string {
+	return func(cfg ExecConfig) []string { return buildSSHArgs(cfg, remoteCommand) }
+}
+
+// runSSHCommand verifies pins, then runs ssh with the arguments buildArgs
+// renders for the verified config (its host key algorithms narrowed to the
+// pinned key types).
+func runSSHCommand(ctx context.Context, cfg ExecConfig, buildArgs func(ExecConfig) []string, stdinScript string, prefix string) (string, string, error) {
+	// Check the certificate up front: ssh only reports a rejected certificate
+	// as a generic authentication failure.
+	if _, err := loadUserCertificate(cfg); err != nil {
 		return "", "", err
 	}
+	cfg, err := ensureExpectedHostKey(ctx, cfg)
+	if err != nil {
+		return "", "", err
+	}
+	args := buildArgs(cfg)
 
 	cmd := exec.CommandContext(ctx, "ssh", args...)
 	if stdinScript != "" {
@@ -54,10 +109,12 @@ func runSSHCommand(ctx context.Context, cfg ExecConfig, args []string, stdinScri
 
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	var flush func()
+	cmd.Stdout, cmd.Stderr, flush = outputWriters(ctx, &stdout, &stderr)
 
-	if err := cmd.Run(); err != nil {
+	err = cmd.Run()
+	flush()
+	if err != nil {
 		if shouldAutoRefreshKnownHost(cfg, stderr.String()) {
 			allow := true
 			if normalizeKnownHostsMode(cfg.KnownHostsMode) == "prompt" {
@@ -72,19 +129,7 @@ func runSSHCommand(ctx context.Context, cfg ExecConfig, args []string, stdinScri
 			}
 			if allow {
 				if recErr := autoRefreshKnownHost(ctx, cfg); recErr == nil {
-					retry := exec.CommandContext(ctx, "ssh", args...)
-					if stdinScript != "" {
-						retry.Stdin = strings.NewReader(stdinScript)
-					}
-					stdout.Reset()
-					stderr.Reset()
-					retry.Stdout = &stdout
-					retry.Stderr = &stderr
-					if retryErr := retry.Run(); retryErr == nil {
-						return stdout.String(), stderr.String(), nil
-					} else {
-						return stdout.String(), stderr.String(), formatSSHRunError(prefix, retryErr, stderr.String())
-					}
+					return runSSHProcess(ctx, args, scriptReader(stdinScript), prefix)
 				}
 			}
 		}
@@ -94,6 +139,29 @@ func runSSHCommand(ctx context.Context, cfg ExecConfig, args []string, stdinScri
 	return stdout.String(), stderr.String(), nil
 }
 
+// scriptReader returns stdin for a script, or nil when there is none.
+func scriptReader(script string) io.Reader {
+	if script == "" {
+		return nil
+	}
+	return strings.NewReader(script)
+}
+
+func runSSHProcess(ctx context.Context, args []string, stdin io.Reader, prefix string) (string, string, error) {
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	cmd.Stdin = stdin
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	var flush func()
+	cmd.Stdout, cmd.Stderr, flush = outputWriters(ctx, &stdout, &stderr)
+	err := cmd.Run()
+	flush()
+	if err != nil {
+		return stdout.String(), stderr.String(), formatSSHRunError(prefix, err, stderr.String())
+	}
+	return stdout.String(), stderr.String(), nil
+}
+
 func shouldAutoRefreshKnownHost(cfg ExecConfig, stderr string) bool {
 	if strings.TrimSpace(cfg.KnownHostsFile) == "" {
 		return false
@@ -119,13 +187,24 @@ func autoRefreshKnownHost(ctx context.Context, cfg ExecConfig) error {
 	}
 
 	hostTarget, scanArgs := knownHostsTarget(cfg)
-	remove := exec.CommandContext(ctx, "ssh-keygen", "-f", knownHosts, "-R", hostTarget)
-	_ = remove.Run() // best-effort: entry may not exist
+	_ = removeKnownHostsEntries(knownHosts, hostTarget) // best-effort: entry may not exist
 
-	scan := exec.CommandContext(ctx, "ssh-keyscan", append([]string{"-H", "-t", "ed25519"}, scanArgs...)...)
-	out, err := scan.Output()
-	if err != nil {
-		return fmt.Errorf("ssh-keyscan %s: %w", hostTarget, err)
+	var out []byte
+	if len(cfg.JumpHosts) > 0 {
+		keys, err := scanHostKeysNative(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			out = append(out, k.entry...)
+		}
+	} else {
+		args := append([]string{"-H", "-t", strings.Join(hostKeyScanTypes(cfg), ",")}, scanArgs...)
+		scanned, err := exec.CommandContext(ctx, "ssh-keyscan", args...).Output()
+		if err != nil {
+			return fmt.Errorf("ssh-keyscan %s: %w", hostTarget, err)
+		}
+		out = scanned
 	}
 	f, err := os.OpenFile(knownHosts, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
 	if err != nil {
@@ -138,131 +217,132 @@ func autoRefreshKnownHost(ctx context.Context, cfg ExecConfig) error {
 	return nil
 }
 
-func ensureExpectedHostKey(ctx context.Context, cfg ExecConfig) error {
-	expected := strings.TrimSpace(cfg.ExpectedHostKeySHA256)
-	if expected == "" {
-		return nil
+// ensureExpectedHostKey checks the pinned fingerprints of every jump host, in
+// order, and then of the target itself. The returned config has its host key
+// algorithms narrowed to the verified key types, so ssh negotiates a key that
+// is in known_hosts.
+func ensureExpectedHostKey(ctx context.Context, cfg ExecConfig) (ExecConfig, error) {
+	if len(cfg.JumpHosts) > 0 {
+		cfg.JumpHosts = append([]JumpHost(nil), cfg.JumpHosts...)
+	}
+	for i := range cfg.JumpHosts {
+		hop, err := ensurePinnedHostKey(ctx, hopExecConfig(cfg, i))
+		if err != nil {
+			return cfg, fmt.Errorf("jump host %s: %w", nativeAddr(hop), err)
+		}
+		cfg.JumpHosts[i].HostKeyAlgorithms = hop.HostKeyAlgorithms
+	}
+	return ensurePinnedHostKey(ctx, cfg)
+}
+
+func ensurePinnedHostKey(ctx context.Context, cfg ExecConfig) (ExecConfig, error) {
+	pins := expectedHostKeys(cfg)
+	if len(pins) == 0 {
+		return cfg, nil
 	}
 	if strings.TrimSpace(cfg.KnownHostsFile) == "" {
-		return fmt.Errorf("known_hosts_file is required when expected host fingerprint is set")
+		return cfg, fmt.Errorf("known_hosts_file is required when expected host fingerprint is set")
 	}
 
-	fp, entry, allFPs, err := scanHostKeyFingerprintSet(ctx, cfg)
+	keys, err := scanHostKeys(ctx, cfg)
 	if err != nil {
-		return err
+		return cfg, err
 	}
-	if _, ok := allFPs[expected]; !ok {
+	var matched []scannedHostKey
+	for _, k := range keys {
+		if containsString(pins, k.SHA256) {
+			matched = append(matched, k)
+		}
+	}
+	if len(matched) == 0 {
+		got := keys[0]
+		hostTarget, _ := knownHostsTarget(cfg)
+		expected := strings.Join(pins, ",")
+		mismatch := &HostKeyMismatchError{Host: hostTarget, Expected: expected, Got: got.SHA256}
 		mode := normalizeKnownHostsMode(cfg.KnownHostsMode)
-		if mode == "auto-refresh" || mode == "prompt" {
-			allow := mode == "auto-refresh"
-			if mode == "prompt" {
-				if cfg.Prompt == nil {
-					return fmt.Errorf("ssh host fingerprint mismatch (expected %s, got %s)", expected, fp)
-				}
-				ok, pErr := cfg.Prompt(fmt.Sprintf("SSH host key changed (expected %s, got %s). Accept new host key?", expected, fp))
-				if pErr != nil {
-					return fmt.Errorf("known_hosts prompt failed: %w", pErr)
-				}
-				allow = ok
-			}
-			if allow {
-				stableFP, stableEntry, err := ensureStableScannedHostKey(ctx, cfg, fp, entry)
-				if err != nil {
-					return err
-				}
-				_ = stableFP // explicit for readability: stability is validated before trust update
-				if err := writeKnownHostsEntry(cfg, stableEntry); err != nil {
-					return err
-				}
-				return nil
-			}
+		allow, err := acceptHostKeyChange(cfg, mode, fmt.Sprintf("SSH host key changed (expected %s, got %s). Accept new host key?", expected, got.SHA256))
+		if err != nil {
+			return cfg, err
 		}
-		return fmt.Errorf("ssh host fingerprint mismatch (expected %s, got %s)", expected, fp)
+		if !allow {
+			return cfg, mismatch
+		}
+		// Stability is validated before the trust update.
+		stable, err := ensureStableScannedHostKey(ctx, cfg, got)
+		if err != nil {
+			return cfg, err
+		}
+		matched = []scannedHostKey{stable}
 	}
-	if err := writeKnownHostsEntry(cfg, entry); err != nil {
-		return err
+	entries := make([]string, 0, len(matched))
+	types := make([]string, 0, len(matched))
+	for _, k := range matched {
+		entries = append(entries, k.entry)
+		types = append(types, k.Type)
 	}
-	return nil
+	if err := writeKnownHostsEntry(cfg, strings.Join(entries, "")); err != nil {
+		return cfg, err
+	}
+	if algos := algorithmsForKeyTypes(cfg, types); len(algos) > 0 {
+		cfg.HostKeyAlgorithms = algos
+	}
+	return cfg, nil
 }
 
-func ensureStableScannedHostKey(ctx context.Context, cfg ExecConfig, firstFP, firstEntry string) (string, string, error) {
-	// Avoid trusting a host key that is still rotating during early boot.
+// ensureStableScannedHostKey rescans after a short delay and requires the
+// same key for first's type, to avoid trusting a host key that is still
+// rotating during early boot.
+func ensureStableScannedHostKey(ctx context.Context, cfg ExecConfig, first scannedHostKey) (scannedHostKey, error) {
 	timer := time.NewTimer(800 * time.Millisecond)
 	defer timer.Stop()
 	select {
 	case <-ctx.Done():
-		return "", "", ctx.Err()
+		return scannedHostKey{}, ctx.Err()
 	case <-timer.C:
 	}
 
-	secondFP, secondEntry, _, err := scanHostKeyFingerprintSet(ctx, cfg)
+	keys, err := scanHostKeys(ctx, cfg)
 	if err != nil {
-		return "", "", err
+		return scannedHostKey{}, err
 	}
-	if strings.TrimSpace(firstFP) == "" || strings.TrimSpace(secondFP) == "" {
-		return "", "", fmt.Errorf("ssh host fingerprint scan returned empty value")
+	if strings.TrimSpace(first.SHA256) == "" {
+		return scannedHostKey{}, fmt.Errorf("ssh host fingerprint scan returned empty value")
 	}
-	if firstFP != secondFP {
-		return "", "", fmt.Errorf("ssh host fingerprint changed during verification (%s -> %s); retry after VM stabilizes", firstFP, secondFP)
+	var second scannedHostKey
+	for _, k := range keys {
+		if k.Type == first.Type {
+			second = k
+			break
+		}
 	}
-	if strings.TrimSpace(secondEntry) == "" {
-		return "", "", fmt.Errorf("ssh host key entry is empty after verification")
+	if second.SHA256 == "" {
+		return scannedHostKey{}, fmt.Errorf("ssh host %s key disappeared during verification; retry after VM stabilizes", first.Type)
 	}
-	return secondFP, secondEntry, nil
-}
-
-func scanHostKeyFingerprint(ctx context.Context, cfg ExecConfig) (string, string, error) {
-	fp, entry, _, err := scanHostKeyFingerprintSet(ctx, cfg)
-	return fp, entry, err
-}
-
-func scanHostKeyFingerprintSet(ctx context.Context, cfg ExecConfig) (string, string, map[string]string, error) {
-	hostTarget, scanArgs := knownHostsTarget(cfg)
-	args := append([]string{"-H", "-t", "ed25519"}, scanArgs...)
-	out, err := exec.CommandContext(ctx, "ssh-keyscan", args...).Output()
-	if err != nil {
-		return "", "", nil, fmt.Errorf("ssh-keyscan %s: %w", hostTarget, err)
-	}
-	lines := strings.Split(string(out), "\n")
-	allFPs := make(map[string]string)
-	preferredFP := ""
-	preferredEntry := ""
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-		fields := strings.Fields(line)
-		if len(fields) < 3 {
-			continue
-		}
-		keyLine := fields[1] + " " + fields[2]
-		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(keyLine))
-		if err != nil {
-			continue
-		}
-		fp := ssh.FingerprintSHA256(key)
-		entry := line + "\n"
-		allFPs[fp] = entry
-		if preferredFP == "" {
-			preferredFP = fp
-			preferredEntry = entry
-		}
+	if first.SHA256 != second.SHA256 {
+		return scannedHostKey{}, fmt.Errorf("ssh host fingerprint changed during verification (%s -> %s); retry after VM stabilizes", first.SHA256, second.SHA256)
 	}
-	if preferredFP != "" {
-		return preferredFP, preferredEntry, allFPs, nil
+	if strings.TrimSpace(second.entry) == "" {
+		return scannedHostKey{}, fmt.Errorf("ssh host key entry is empty after verification")
 	}
-	return "", "", nil, fmt.Errorf("no valid host key found for %s", hostTarget)
+	return second, nil
 }
 
 // ScanHostKeyFingerprint returns the SHA256 fingerprint for host:port.
+// It uses ssh-keyscan when available and falls back to an in-process scan.
 func ScanHostKeyFingerprint(ctx context.Context, host string, port int) (string, error) {
-	if strings.TrimSpace(host) == "" {
-		return "", fmt.Errorf("host is empty")
+	return ScanHostKeyFingerprintWithConfig(ctx, ExecConfig{Host: host, Port: port})
+}
+
+// ScanHostKeyFingerprintWithConfig returns the SHA256 fingerprint of the most
+// preferred host key of cfg.Host, reached through cfg.JumpHosts when set. Jump
+// hosts are authenticated and verified with cfg's known_hosts settings; the
+// target key is only reported.
+func ScanHostKeyFingerprintWithConfig(ctx context.Context, cfg ExecConfig) (string, error) {
+	fps, err := ScanHostKeyFingerprintsWithConfig(ctx, cfg)
+	if err != nil {
+		return "", err
 	}
-	cfg := ExecConfig{Host: host, Port: port}
-	fp, _, err := scanHostKeyFingerprint(ctx, cfg)
-	return fp, err
+	return fps[0].SHA256, nil
 }
 
 func writeKnownHostsEntry(cfg ExecConfig, entry string) error {
@@ -274,17 +354,10 @@ func writeKnownHostsEntry(cfg ExecConfig, entry string) error {
 	if err := os.MkdirAll(filepathDirSafe(knownHosts), 0o700); err != nil {
 		return fmt.Errorf("create known_hosts dir: %w", err)
 	}
-	remove := exec.CommandContext(context.Background(), "ssh-keygen", "-f", knownHosts, "-R", hostTarget)
-	_ = remove.Run()
-	f, err := os.OpenFile(knownHosts, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
-	if err != nil {
-		return fmt.Errorf("open known_hosts %s: %w", knownHosts, err)
-	}
-	defer func() { _ = f.Close() }()
-	if _, err := f.WriteString(entry); err != nil {
-		return fmt.Errorf("append known_hosts %s: %w", knownHosts, err)
+	if err := removeKnownHostsEntries(knownHosts, hostTarget); err != nil {
+		return err
 	}
-	return nil
+	return appendKnownHostsEntry(knownHosts, entry)
 }
 
 func knownHostsTarget(cfg ExecConfig) (string, []string) {
@@ -360,6 +433,15 @@ func summarizeSSHStderr(stderr string) string {
 }
 
 func buildSSHArgs(cfg ExecConfig, remoteCommand string) []string {
+	args := buildSSHOptions(cfg)
+	destination := cfg.User + "@" + cfg.Host
+	args = append(args, destination, remoteCommand)
+	return args
+}
+
+// buildSSHOptions returns the ssh options (everything before the destination)
+// for cfg, including the ProxyCommand chain for jump hosts.
+func buildSSHOptions(cfg ExecConfig) []string {
 	connectSeconds := int(cfg.ConnectTimeout / time.Second)
 	if connectSeconds <= 0 {
 		connectSeconds = 5
@@ -367,11 +449,25 @@ func buildSSHArgs(cfg ExecConfig, remoteCommand string) []string {
 
 	args := []string{
 		"-o", "BatchMode=yes",
-		"-o", "IdentitiesOnly=yes",
-		"-o", "HostKeyAlgorithms=" + hostKeyAlgorithm,
-		"-o", "ConnectTimeout=" + strconv.Itoa(connectSeconds),
+	}
+	// With the agent and no identity filter, ssh offers every agent key.
+	identity := cfg.PrivateKeyPath
+	if cfg.UseAgent {
+		identity = strings.TrimSpace(cfg.AgentIdentity)
+	}
+	if identity != "" {
+		args = append(args, "-o", "IdentitiesOnly=yes")
+	}
+	args = append(args,
+		"-o", "HostKeyAlgorithms="+strings.Join(hostKeyAlgorithms(cfg), ","),
+		"-o", "ConnectTimeout="+strconv.Itoa(connectSeconds),
 		"-p", strconv.Itoa(cfg.Port),
-		"-i", cfg.PrivateKeyPath,
+	)
+	if identity != "" {
+		args = append(args, "-i", identity)
+	}
+	if cert := strings.TrimSpace(cfg.CertificateFile); cert != "" {
+		args = append(args, "-o", "CertificateFile="+cert)
 	}
 
 	mode := normalizeKnownHostsMode(cfg.KnownHostsMode)
@@ -380,7 +476,16 @@ func buildSSHArgs(cfg ExecConfig, remoteCommand string) []string {
 		strict = "accept-new"
 	}
 
-	if cfg.KnownHostsFile != "" {
+	if cfg.hostCAKnownHosts != "" {
+		knownHosts := cfg.KnownHostsFile
+		if knownHosts == "" {
+			knownHosts = defaultKnownHostsFile()
+		}
+		args = append(args,
+			"-o", "StrictHostKeyChecking="+strict,
+			"-o", "UserKnownHostsFile="+knownHostsFileList(knownHosts, cfg.hostCAKnownHosts),
+		)
+	} else if cfg.KnownHostsFile != "" {
 		args = append(args,
 			"-o", "StrictHostKeyChecking="+strict,
 			"-o", "UserKnownHostsFile="+cfg.KnownHostsFile,
@@ -389,7 +494,21 @@ func buildSSHArgs(cfg ExecConfig, remoteCommand string) []string {
 		args = append(args, "-o", "StrictHostKeyChecking="+strict)
 	}
 
-	destination := cfg.User + "@" + cfg.Host
-	args = append(args, destination, remoteCommand)
+	if len(cfg.JumpHosts) > 0 {
+		args = append(args, "-o", "ProxyCommand="+jumpProxyCommand(cfg))
+	}
 	return args
 }
+
+// knownHostsFileList renders several files for UserKnownHostsFile, quoting
+// paths that contain spaces.
+func knownHostsFileList(paths ...string) string {
+	out := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if strings.ContainsAny(p, " \t") {
+			p = `"` + p + `"`
+		}
+		out = append(out, p)
+	}
+	return strings.Join(out, " ")
+}
@@ -3,6 +3,7 @@ package ssh
 import (
 	"context"
 	"errors"
+	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -194,14 +195,14 @@ func TestEnsureExpectedHostKey(t *testing.T) {
 
 	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
 	cfg := ExecConfig{
-		Host:                  "example.com",
-		Port:                  22,
-		User:                  "dev",
-		PrivateKeyPath:        "/tmp/key",
-		KnownHostsFile:        knownHosts,
-		ExpectedHostKeySHA256: expected,
-	}
-	if err := ensureExpectedHostKey(context.Background(), cfg); err != nil {
+		Host:             "example.com",
+		Port:             22,
+		User:             "dev",
+		PrivateKeyPath:   "/tmp/key",
+		KnownHostsFile:   knownHosts,
+		ExpectedHostKeys: []string{expected},
+	}
+	if _, err := ensureExpectedHostKey(context.Background(), cfg); err != nil {
 		t.Fatalf("ensureExpectedHostKey failed: %v", err)
 	}
 	if data, err := os.ReadFile(knownHosts); err != nil || len(data) == 0 {
@@ -220,15 +221,15 @@ func TestEnsureExpectedHostKeyMismatchStrictFails(t *testing.T) {
 	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
 
 	cfg := ExecConfig{
-		Host:                  "example.com",
-		Port:                  22,
-		User:                  "dev",
-		PrivateKeyPath:        "/tmp/key",
-		KnownHostsFile:        filepath.Join(t.TempDir(), "known_hosts"),
-		KnownHostsMode:        "strict",
-		ExpectedHostKeySHA256: "SHA256:does-not-match",
-	}
-	err := ensureExpectedHostKey(context.Background(), cfg)
+		Host:             "example.com",
+		Port:             22,
+		User:             "dev",
+		PrivateKeyPath:   "/tmp/key",
+		KnownHostsFile:   filepath.Join(t.TempDir(), "known_hosts"),
+		KnownHostsMode:   "strict",
+		ExpectedHostKeys: []string{"SHA256:does-not-match"},
+	}
+	_, err := ensureExpectedHostKey(context.Background(), cfg)
 	if err == nil || !strings.Contains(err.Error(), "fingerprint mismatch") {
 		t.Fatalf("expected strict mismatch error, got: %v", err)
 	}
@@ -246,15 +247,15 @@ func TestEnsureExpectedHostKeyMismatchAutoRefreshAccepts(t *testing.T) {
 
 	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
 	cfg := ExecConfig{
-		Host:                  "example.com",
-		Port:                  22,
-		User:                  "dev",
-		PrivateKeyPath:        "/tmp/key",
-		KnownHostsFile:        knownHosts,
-		KnownHostsMode:        "auto-refresh",
-		ExpectedHostKeySHA256: "SHA256:does-not-match",
-	}
-	if err := ensureExpectedHostKey(context.Background(), cfg); err != nil {
+		Host:             "example.com",
+		Port:             22,
+		User:             "dev",
+		PrivateKeyPath:   "/tmp/key",
+		KnownHostsFile:   knownHosts,
+		KnownHostsMode:   "auto-refresh",
+		ExpectedHostKeys: []string{"SHA256:does-not-match"},
+	}
+	if _, err := ensureExpectedHostKey(context.Background(), cfg); err != nil {
 		t.Fatalf("expected auto-refresh mismatch to pass, got: %v", err)
 	}
 	if data, err := os.ReadFile(knownHosts); err != nil || len(data) == 0 {
@@ -275,15 +276,15 @@ func TestEnsureExpectedHostKeyMismatchAutoRefreshFailsWhenKeyUnstable(t *testing
 	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
 
 	cfg := ExecConfig{
-		Host:                  "example.com",
-		Port:                  22,
-		User:                  "dev",
-		PrivateKeyPath:        "/tmp/key",
-		KnownHostsFile:        filepath.Join(t.TempDir(), "known_hosts"),
-		KnownHostsMode:        "auto-refresh",
-		ExpectedHostKeySHA256: "SHA256:does-not-match",
-	}
-	err := ensureExpectedHostKey(context.Background(), cfg)
+		Host:             "example.com",
+		Port:             22,
+		User:             "dev",
+		PrivateKeyPath:   "/tmp/key",
+		KnownHostsFile:   filepath.Join(t.TempDir(), "known_hosts"),
+		KnownHostsMode:   "auto-refresh",
+		ExpectedHostKeys: []string{"SHA256:does-not-match"},
+	}
+	_, err := ensureExpectedHostKey(context.Background(), cfg)
 	if err == nil || !strings.Contains(err.Error(), "changed during verification") {
 		t.Fatalf("expected unstable key verification failure, got: %v", err)
 	}
@@ -309,15 +310,15 @@ func TestEnsureExpectedHostKeyStrictAcceptsExpectedFingerprintFromAnyKeyType(t *
 	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
 
 	cfg := ExecConfig{
-		Host:                  "example.com",
-		Port:                  22,
-		User:                  "dev",
-		PrivateKeyPath:        "/tmp/key",
-		KnownHostsFile:        filepath.Join(t.TempDir(), "known_hosts"),
-		KnownHostsMode:        "strict",
-		ExpectedHostKeySHA256: expected,
-	}
-	if err := ensureExpectedHostKey(context.Background(), cfg); err != nil {
+		Host:             "example.com",
+		Port:             22,
+		User:             "dev",
+		PrivateKeyPath:   "/tmp/key",
+		KnownHostsFile:   filepath.Join(t.TempDir(), "known_hosts"),
+		KnownHostsMode:   "strict",
+		ExpectedHostKeys: []string{expected},
+	}
+	if _, err := ensureExpectedHostKey(context.Background(), cfg); err != nil {
 		t.Fatalf("expected strict mode to accept matching fingerprint from key set, got: %v", err)
 	}
 }
@@ -347,3 +348,17 @@ func generatePublicKeyFields(t *testing.T) (string, string) {
 	}
 	return fields[0], fields[1]
 }
+
+func TestExitStatusSeparatesRemoteExitFromSSHFailure(t *testing.T) {
+	remote := exec.Command("sh", "-c", "exit 1").Run()
+	if status, ok := ExitStatus(fmt.Errorf("ssh run command failed: %w", remote)); !ok || status != 1 {
+		t.Fatalf("ExitStatus(exit 1) = %d, %v; want 1", status, ok)
+	}
+	sshFailure := exec.Command("sh", "-c", "exit 255").Run()
+	if _, ok := ExitStatus(sshFailure); ok {
+		t.Fatal("expected OpenSSH's 255 to report no remote exit status")
+	}
+	if _, ok := ExitStatus(&ConnectError{Addr: "vm:22", Err: errors.New("refused")}); ok {
+		t.Fatal("expected a connect error to report no remote exit status")
+	}
+}
@@ -0,0 +1,252 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// hostKeyAlgorithmInfo describes a supported host key algorithm: the key type
+// it verifies, the ssh-keyscan -t name and the matching certificate algorithm.
+type hostKeyAlgorithmInfo struct {
+	keyType  string
+	scanType string
+	certAlgo string
+}
+
+var hostKeyAlgorithmTable = map[string]hostKeyAlgorithmInfo{
+	ssh.KeyAlgoED25519:   {keyType: ssh.KeyAlgoED25519, scanType: "ed25519", certAlgo: ssh.CertAlgoED25519v01},
+	ssh.KeyAlgoECDSA256:  {keyType: ssh.KeyAlgoECDSA256, scanType: "ecdsa", certAlgo: ssh.CertAlgoECDSA256v01},
+	ssh.KeyAlgoECDSA384:  {keyType: ssh.KeyAlgoECDSA384, scanType: "ecdsa", certAlgo: ssh.CertAlgoECDSA384v01},
+	ssh.KeyAlgoECDSA521:  {keyType: ssh.KeyAlgoECDSA521, scanType: "ecdsa", certAlgo: ssh.CertAlgoECDSA521v01},
+	ssh.KeyAlgoRSASHA512: {keyType: ssh.KeyAlgoRSA, scanType: "rsa", certAlgo: ssh.CertAlgoRSASHA512v01},
+	ssh.KeyAlgoRSASHA256: {keyType: ssh.KeyAlgoRSA, scanType: "rsa", certAlgo: ssh.CertAlgoRSASHA256v01},
+}
+
+// defaultHostKeyAlgorithms is used when ExecConfig.HostKeyAlgorithms is empty.
+var defaultHostKeyAlgorithms = []string{ssh.KeyAlgoED25519}
+
+// HostKeyFingerprint is one host key offered by a server.
+type HostKeyFingerprint struct {
+	// Type is the key type, e.g. ssh-ed25519, ecdsa-sha2-nistp256 or ssh-rsa.
+	Type   string
+	SHA256 string
+}
+
+type scannedHostKey struct {
+	HostKeyFingerprint
+	entry string
+}
+
+// configuredHostKeyAlgorithms returns cfg.HostKeyAlgorithms in preference
+// order, without unknown or duplicate names, falling back to the defaults.
+func configuredHostKeyAlgorithms(cfg ExecConfig) []string {
+	out := make([]string, 0, len(cfg.HostKeyAlgorithms))
+	seen := make(map[string]bool, len(cfg.HostKeyAlgorithms))
+	for _, a := range cfg.HostKeyAlgorithms {
+		a = strings.TrimSpace(a)
+		if _, ok := hostKeyAlgorithmTable[a]; !ok || seen[a] {
+			continue
+		}
+		seen[a] = true
+		out = append(out, a)
+	}
+	if len(out) == 0 {
+		return defaultHostKeyAlgorithms
+	}
+	return out
+}
+
+// hostKeyAlgorithms returns the algorithms offered during key exchange. With a
+// host CA the certificate variants come first, so servers with a certificate
+// present it.
+func hostKeyAlgorithms(cfg ExecConfig) []string {
+	algos := configuredHostKeyAlgorithms(cfg)
+	if strings.TrimSpace(cfg.HostCAFile) == "" {
+		return algos
+	}
+	out := make([]string, 0, 2*len(algos))
+	for _, a := range algos {
+		out = append(out, hostKeyAlgorithmTable[a].certAlgo)
+	}
+	return append(out, algos...)
+}
+
+// hostKeyTypeRank orders key types by the first configured algorithm that
+// verifies them; unconfigured types rank last.
+func hostKeyTypeRank(cfg ExecConfig, keyType string) int {
+	algos := configuredHostKeyAlgorithms(cfg)
+	for i, a := range algos {
+		if hostKeyAlgorithmTable[a].keyType == keyType {
+			return i
+		}
+	}
+	return len(algos)
+}
+
+func hostKeyScanTypes(cfg ExecConfig) []string {
+	var out []string
+	for _, a := range configuredHostKeyAlgorithms(cfg) {
+		if t := hostKeyAlgorithmTable[a].scanType; !containsString(out, t) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// algorithmsForKeyTypes narrows the configured algorithms to those verifying
+// one of keyTypes, keeping preference order.
+func algorithmsForKeyTypes(cfg ExecConfig, keyTypes []string) []string {
+	var out []string
+	for _, a := range configuredHostKeyAlgorithms(cfg) {
+		if containsString(keyTypes, hostKeyAlgorithmTable[a].keyType) {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+func expectedHostKeys(cfg ExecConfig) []string {
+	out := make([]string, 0, len(cfg.ExpectedHostKeys))
+	for _, fp := range cfg.ExpectedHostKeys {
+		if fp = strings.TrimSpace(fp); fp != "" {
+			out = append(out, fp)
+		}
+	}
+	return out
+}
+
+// scanHostKeys returns every host key the server offers for the configured
+// algorithms, most preferred first.
+func scanHostKeys(ctx context.Context, cfg ExecConfig) ([]scannedHostKey, error) {
+	// ssh-keyscan cannot traverse jump hosts, so those scans always run in-process.
+	if useNativeTransport(cfg) || len(cfg.JumpHosts) > 0 {
+		return scanHostKeysNative(ctx, cfg)
+	}
+	hostTarget, scanArgs := knownHostsTarget(cfg)
+	args := append([]string{"-H", "-t", strings.Join(hostKeyScanTypes(cfg), ",")}, scanArgs...)
+	out, err := exec.CommandContext(ctx, "ssh-keyscan", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ssh-keyscan %s: %w", hostTarget, err)
+	}
+	var keys []scannedHostKey
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(fields[1] + " " + fields[2]))
+		if err != nil {
+			continue
+		}
+		keys = append(keys, scannedHostKey{
+			HostKeyFingerprint: HostKeyFingerprint{Type: key.Type(), SHA256: ssh.FingerprintSHA256(key)},
+			entry:              line + "\n",
+		})
+	}
+	return sortScannedHostKeys(cfg, hostTarget, keys)
+}
+
+func sortScannedHostKeys(cfg ExecConfig, hostTarget string, keys []scannedHostKey) ([]scannedHostKey, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no valid host key found for %s", hostTarget)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return hostKeyTypeRank(cfg, keys[i].Type) < hostKeyTypeRank(cfg, keys[j].Type)
+	})
+	return keys, nil
+}
+
+// scanHostKeysNative performs one key exchange per configured algorithm (no
+// authentication) and returns the host keys offered, replacing ssh-keyscan.
+// Algorithms the server does not support are skipped.
+func scanHostKeysNative(ctx context.Context, cfg ExecConfig) ([]scannedHostKey, error) {
+	hostTarget, _ := knownHostsTarget(cfg)
+	var keys []scannedHostKey
+	var lastErr error
+	for _, algo := range configuredHostKeyAlgorithms(cfg) {
+		key, err := scanHostKeyNative(ctx, cfg, algo)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("scan host key %s: %w", hostTarget, ctx.Err())
+			}
+			lastErr = err
+			continue
+		}
+		fp := ssh.FingerprintSHA256(key)
+		if containsScannedKey(keys, fp) {
+			continue
+		}
+		keys = append(keys, scannedHostKey{
+			HostKeyFingerprint: HostKeyFingerprint{Type: key.Type(), SHA256: fp},
+			entry:              knownhosts.Line([]string{knownhosts.HashHostname(hostTarget)}, key) + "\n",
+		})
+	}
+	if len(keys) == 0 && lastErr != nil {
+		return nil, fmt.Errorf("scan host key %s: %w", hostTarget, lastErr)
+	}
+	return sortScannedHostKeys(cfg, hostTarget, keys)
+}
+
+func containsScannedKey(keys []scannedHostKey, fp string) bool {
+	for _, k := range keys {
+		if k.SHA256 == fp {
+			return true
+		}
+	}
+	return false
+}
+
+// pinnedHostKeyAlgorithms narrows cfg.HostKeyAlgorithms to the algorithms
+// whose host key matches a pin, so the key exchange negotiates a pinned key
+// when the server also offers unpinned key types. Without pins, or when
+// nothing matches (verification then reports the mismatch), cfg is unchanged.
+func pinnedHostKeyAlgorithms(ctx context.Context, cfg ExecConfig) ExecConfig {
+	pins := expectedHostKeys(cfg)
+	if len(pins) == 0 || len(configuredHostKeyAlgorithms(cfg)) < 2 {
+		return cfg
+	}
+	keys, err := scanHostKeys(ctx, cfg)
+	if err != nil {
+		return cfg
+	}
+	var types []string
+	for _, k := range keys {
+		if containsString(pins, k.SHA256) {
+			types = append(types, k.Type)
+		}
+	}
+	if algos := algorithmsForKeyTypes(cfg, types); len(algos) > 0 {
+		cfg.HostKeyAlgorithms = algos
+	}
+	return cfg
+}
+
+// ScanHostKeyFingerprintsWithConfig returns the fingerprint of every host key
+// cfg.Host offers for the configured algorithms, most preferred first.
+func ScanHostKeyFingerprintsWithConfig(ctx context.Context, cfg ExecConfig) ([]HostKeyFingerprint, error) {
+	if strings.TrimSpace(cfg.Host) == "" {
+		return nil, fmt.Errorf("host is empty")
+	}
+	if _, err := exec.LookPath("ssh-keyscan"); err != nil {
+		cfg.Transport = TransportNative
+	}
+	keys, err := scanHostKeys(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]HostKeyFingerprint, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, k.HostKeyFingerprint)
+	}
+	return out, nil
+}
@@ -0,0 +1,167 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestECDSASigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate ecdsa key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("signer: %v", err)
+	}
+	return signer
+}
+
+func newTestRSASigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate rsa key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("signer: %v", err)
+	}
+	return signer
+}
+
+// startMultiKeyTestServer serves every signer in hostKeys as a host key.
+func startMultiKeyTestServer(t *testing.T, hostKeys ...ssh.Signer) *testSSHServer {
+	t.Helper()
+	clientSigner, clientKeyPath := newTestClientKey(t)
+	serverCfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(clientSigner.PublicKey().Marshal()) {
+				return &ssh.Permissions{}, nil
+			}
+			return nil, errors.New("unknown client key")
+		},
+	}
+	for _, k := range hostKeys {
+		serverCfg.AddHostKey(k)
+	}
+	return serveTestSSH(t, serverCfg, hostKeys[0], clientKeyPath, echoStdinHandler)
+}
+
+func TestNativeRSAOnlyHostNeedsConfiguredAlgorithm(t *testing.T) {
+	srv := startMultiKeyTestServer(t, newTestRSASigner(t))
+	cfg := srv.execConfig(filepath.Join(t.TempDir(), "known_hosts"), "accept-new")
+
+	if _, _, err := RunCommand(context.Background(), cfg, "true"); err == nil {
+		t.Fatalf("expected default ed25519-only algorithms to fail against an RSA-only host")
+	}
+
+	cfg.HostKeyAlgorithms = []string{ssh.KeyAlgoED25519, ssh.KeyAlgoRSASHA512}
+	if _, _, err := RunCommand(context.Background(), cfg, "true"); err != nil {
+		t.Fatalf("expected rsa-sha2-512 to connect, got %v", err)
+	}
+}
+
+func TestNativeScanReturnsEveryConfiguredKeyTypeInPreferenceOrder(t *testing.T) {
+	edKey, ecKey := newTestSigner(t), newTestECDSASigner(t)
+	srv := startMultiKeyTestServer(t, edKey, ecKey)
+	cfg := ExecConfig{
+		Host:              srv.host,
+		Port:              srv.port,
+		Transport:         TransportNative,
+		HostKeyAlgorithms: []string{ssh.KeyAlgoECDSA256, ssh.KeyAlgoED25519},
+	}
+
+	fps, err := ScanHostKeyFingerprintsWithConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if len(fps) != 2 || fps[0].Type != ssh.KeyAlgoECDSA256 || fps[1].Type != ssh.KeyAlgoED25519 {
+		t.Fatalf("expected ecdsa then ed25519, got %+v", fps)
+	}
+	if fps[0].SHA256 != ssh.FingerprintSHA256(ecKey.PublicKey()) || fps[1].SHA256 != ssh.FingerprintSHA256(edKey.PublicKey()) {
+		t.Fatalf("unexpected fingerprints: %+v", fps)
+	}
+}
+
+func TestNativePinOnLessPreferredKeyTypeNegotiatesPinnedKey(t *testing.T) {
+	edKey, ecKey := newTestSigner(t), newTestECDSASigner(t)
+	srv := startMultiKeyTestServer(t, edKey, ecKey)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	cfg := srv.execConfig(knownHosts, "strict")
+	cfg.HostKeyAlgorithms = []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256}
+	cfg.ExpectedHostKeys = []string{"SHA256:some-other-host", ssh.FingerprintSHA256(ecKey.PublicKey())}
+
+	if _, _, err := RunCommand(context.Background(), cfg, "true"); err != nil {
+		t.Fatalf("expected pinned ecdsa key to be accepted, got %v", err)
+	}
+	data, err := os.ReadFile(knownHosts)
+	if err != nil || !strings.Contains(string(data), ssh.KeyAlgoECDSA256) {
+		t.Fatalf("expected ecdsa known_hosts entry, got %q (%v)", data, err)
+	}
+}
+
+func TestEnsureExpectedHostKeyNarrowsAlgorithmsToPinnedType(t *testing.T) {
+	edType, edData := generatePublicKeyFields(t)
+	ecLine := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(newTestECDSASigner(t).PublicKey())))
+	ecKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(ecLine))
+	if err != nil {
+		t.Fatalf("parse ecdsa key: %v", err)
+	}
+
+	binDir := t.TempDir()
+	argsLog := filepath.Join(binDir, "args")
+	sshKeyscan := "#!/usr/bin/env bash\necho \"$*\" > \"" + argsLog + "\"\n" +
+		"echo \"example.com " + edType + " " + edData + "\"\n" +
+		"echo \"example.com " + ecLine + "\"\n"
+	writeExecutable(t, filepath.Join(binDir, "ssh-keyscan"), sshKeyscan)
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	cfg := ExecConfig{
+		Host:              "example.com",
+		Port:              22,
+		User:              "dev",
+		PrivateKeyPath:    "/tmp/key",
+		KnownHostsFile:    filepath.Join(t.TempDir(), "known_hosts"),
+		HostKeyAlgorithms: []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoRSASHA512},
+		ExpectedHostKeys:  []string{ssh.FingerprintSHA256(ecKey)},
+	}
+	verified, err := ensureExpectedHostKey(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("ensureExpectedHostKey failed: %v", err)
+	}
+	if got := strings.Join(verified.HostKeyAlgorithms, ","); got != ssh.KeyAlgoECDSA256 {
+		t.Fatalf("expected algorithms narrowed to the pinned ecdsa key, got %q", got)
+	}
+	if args, _ := os.ReadFile(argsLog); !strings.Contains(string(args), "-t ed25519,ecdsa,rsa") {
+		t.Fatalf("expected ssh-keyscan to scan every configured key type, got %q", args)
+	}
+	if joined := strings.Join(buildSSHArgs(verified, "true"), " "); !strings.Contains(joined, "HostKeyAlgorithms="+ssh.KeyAlgoECDSA256+" ") {
+		t.Fatalf("expected ssh to negotiate the pinned key type, got %q", joined)
+	}
+}
+
+func TestConfiguredHostKeyAlgorithms(t *testing.T) {
+	if got := configuredHostKeyAlgorithms(ExecConfig{}); len(got) != 1 || got[0] != ssh.KeyAlgoED25519 {
+		t.Fatalf("expected ed25519 default, got %v", got)
+	}
+	got := configuredHostKeyAlgorithms(ExecConfig{HostKeyAlgorithms: []string{"rsa-sha2-256", "bogus", "rsa-sha2-256", "ssh-ed25519"}})
+	if strings.Join(got, ",") != "rsa-sha2-256,ssh-ed25519" {
+		t.Fatalf("unexpected algorithms: %v", got)
+	}
+	withCA := hostKeyAlgorithms(ExecConfig{HostCAFile: "/ca.pub", HostKeyAlgorithms: []string{"ecdsa-sha2-nistp256"}})
+	if strings.Join(withCA, ",") != ssh.CertAlgoECDSA256v01+","+ssh.KeyAlgoECDSA256 {
+		t.Fatalf("unexpected algorithms with host CA: %v", withCA)
+	}
+}
@@ -0,0 +1,113 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// JumpHost is one bastion hop between the client and the target host.
+// Empty User and PrivateKeyPath inherit the target's values, including
+// agent authentication and the user certificate.
+type JumpHost struct {
+	Host             string
+	Port             int
+	User             string
+	PrivateKeyPath   string
+	ExpectedHostKeys []string
+	// HostKeyAlgorithms overrides the target's algorithms for this hop; empty
+	// inherits them.
+	HostKeyAlgorithms []string
+}
+
+// hopExecConfig returns the connection settings for cfg.JumpHosts[i]. The hop
+// shares the trust settings of cfg, keeps its own pin, and is itself reached
+// through the hops before it.
+func hopExecConfig(cfg ExecConfig, i int) ExecConfig {
+	hop := cfg.JumpHosts[i]
+	hc := cfg
+	hc.Host = strings.TrimSpace(hop.Host)
+	hc.Port = hop.Port
+	if hc.Port <= 0 {
+		hc.Port = 22
+	}
+	if u := strings.TrimSpace(hop.User); u != "" {
+		hc.User = u
+	}
+	if k := strings.TrimSpace(hop.PrivateKeyPath); k != "" {
+		hc.PrivateKeyPath = k
+		hc.UseAgent = false
+		hc.AgentIdentity = ""
+		hc.CertificateFile = ""
+	}
+	hc.ExpectedHostKeys = hop.ExpectedHostKeys
+	if len(hop.HostKeyAlgorithms) > 0 {
+		hc.HostKeyAlgorithms = hop.HostKeyAlgorithms
+	}
+	hc.JumpHosts = cfg.JumpHosts[:i]
+	return hc
+}
+
+func lastHopExecConfig(cfg ExecConfig) ExecConfig {
+	return hopExecConfig(cfg, len(cfg.JumpHosts)-1)
+}
+
+// nativeDialConn opens a TCP stream to addr, tunnelled through the jump chain
+// when one is configured. release frees the jump connections and must be
+// called once the stream is no longer needed.
+func nativeDialConn(ctx context.Context, cfg ExecConfig, addr string) (net.Conn, func(), error) {
+	if len(cfg.JumpHosts) == 0 {
+		d := net.Dialer{Timeout: nativeConnectTimeout(cfg)}
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, func() {}, nil
+	}
+	hop := lastHopExecConfig(cfg)
+	jump, err := dialNative(ctx, hop)
+	if err != nil {
+		return nil, nil, fmt.Errorf("jump host %s: %w", nativeAddr(hop), err)
+	}
+	conn, err := jump.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		_ = jump.Close()
+		return nil, nil, fmt.Errorf("via jump host %s: %w", nativeAddr(hop), err)
+	}
+	return conn, func() { _ = jump.Close() }, nil
+}
+
+// jumpProxyCommand renders the OpenSSH ProxyCommand that reaches cfg.Host
+// through cfg.JumpHosts. Each hop is a separate ssh invocation with its own
+// key and known_hosts checks; earlier hops nest as that invocation's own
+// ProxyCommand.
+func jumpProxyCommand(cfg ExecConfig) string {
+	hop := lastHopExecConfig(cfg)
+	port := cfg.Port
+	if port <= 0 {
+		port = 22
+	}
+	args := buildSSHOptions(hop)
+	args = append(args, "-W", net.JoinHostPort(strings.TrimSpace(cfg.Host), strconv.Itoa(port)), hop.User+"@"+hop.Host)
+	quoted := make([]string, 0, len(args)+1)
+	quoted = append(quoted, "exec", "ssh")
+	for _, a := range args {
+		quoted = append(quoted, ShellQuote(a))
+	}
+	// ssh expands %-tokens in ProxyCommand; keep literal percent signs intact.
+	return strings.ReplaceAll(strings.Join(quoted, " "), "%", "%%")
+}
+
+// ShellQuote quotes s as a single POSIX shell word. Words of safe
+// characters are returned as they are.
+func ShellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r == '-' || r == '_' || r == '.' || r == '/' || r == ':' || r == '=' || r == '@' ||
+			(r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9'))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
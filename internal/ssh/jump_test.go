@@ -0,0 +1,240 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestNativeRunCommandThroughJumpHost(t *testing.T) {
+	jump := startTestSSHServer(t, echoStdinHandler)
+	target := startTestSSHServer(t, echoStdinHandler)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+
+	cfg := target.execConfig(knownHosts, "accept-new")
+	cfg.JumpHosts = []JumpHost{{
+		Host:             jump.host,
+		Port:             jump.port,
+		PrivateKeyPath:   jump.clientKeyPath,
+		ExpectedHostKeys: []string{ssh.FingerprintSHA256(jump.hostKey.PublicKey())},
+	}}
+
+	out, _, err := RunCommand(context.Background(), cfg, "hostname")
+	if err != nil {
+		t.Fatalf("RunCommand through jump host failed: %v", err)
+	}
+	if out != "hostname" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	if got := jump.forwards.Load(); got != 1 {
+		t.Fatalf("expected one forwarded connection through the jump host, got %d", got)
+	}
+}
+
+func TestNativeJumpHostPinMismatchFails(t *testing.T) {
+	jump := startTestSSHServer(t, echoStdinHandler)
+	target := startTestSSHServer(t, echoStdinHandler)
+
+	cfg := target.execConfig(filepath.Join(t.TempDir(), "known_hosts"), "strict")
+	cfg.JumpHosts = []JumpHost{{
+		Host:             jump.host,
+		Port:             jump.port,
+		PrivateKeyPath:   jump.clientKeyPath,
+		ExpectedHostKeys: []string{"SHA256:not-the-jump-key"},
+	}}
+
+	_, _, err := RunCommand(context.Background(), cfg, "true")
+	var mismatch *HostKeyMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected HostKeyMismatchError for the jump host, got %v", err)
+	}
+	if mismatch.Host != jump.target() {
+		t.Fatalf("expected mismatch to name the jump host %s, got %s", jump.target(), mismatch.Host)
+	}
+	if got := jump.forwards.Load(); got != 0 {
+		t.Fatalf("expected no forwarding after a failed jump host check, got %d", got)
+	}
+}
+
+func TestScanHostKeyFingerprintThroughJumpHost(t *testing.T) {
+	jump := startTestSSHServer(t, echoStdinHandler)
+	target := startTestSSHServer(t, echoStdinHandler)
+
+	cfg := ExecConfig{
+		Host:           target.host,
+		Port:           target.port,
+		KnownHostsFile: filepath.Join(t.TempDir(), "known_hosts"),
+		KnownHostsMode: "accept-new",
+		JumpHosts: []JumpHost{{
+			Host:           jump.host,
+			Port:           jump.port,
+			User:           "dev",
+			PrivateKeyPath: jump.clientKeyPath,
+		}},
+	}
+	fp, err := ScanHostKeyFingerprintWithConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("scan through jump host failed: %v", err)
+	}
+	if want := ssh.FingerprintSHA256(target.hostKey.PublicKey()); fp != want {
+		t.Fatalf("expected target fingerprint %s, got %s", want, fp)
+	}
+}
+
+func TestWaitForTCPPortViaJumps(t *testing.T) {
+	jump := startTestSSHServer(t, echoStdinHandler)
+	target := startTestSSHServer(t, echoStdinHandler)
+
+	cfg := ExecConfig{
+		Host:           target.host,
+		Port:           target.port,
+		User:           "dev",
+		KnownHostsFile: filepath.Join(t.TempDir(), "known_hosts"),
+		KnownHostsMode: "accept-new",
+		Transport:      TransportNative,
+		JumpHosts:      []JumpHost{{Host: jump.host, Port: jump.port, PrivateKeyPath: jump.clientKeyPath}},
+	}
+	stats, err := WaitForTCPPortViaJumpsWithStats(context.Background(), cfg, 2, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("probe through jump host failed: %v", err)
+	}
+	if stats.Attempts != 1 || jump.forwards.Load() != 1 {
+		t.Fatalf("expected one forwarded probe, got attempts=%d forwards=%d", stats.Attempts, jump.forwards.Load())
+	}
+}
+
+func TestWaitForTCPPortViaJumpsUsesOpenSSH(t *testing.T) {
+	binDir := t.TempDir()
+	argsFile := filepath.Join(binDir, "args")
+	marker := filepath.Join(binDir, "refused")
+	// The first probe is refused by the target, the second gets its banner.
+	sshScript := "#!/usr/bin/env bash\necho \"$*\" >> \"" + argsFile + "\"\n" +
+		"if [ ! -f \"" + marker + "\" ]; then\n  touch \"" + marker + "\"\n" +
+		"  echo \"channel 0: open failed: connect failed: Connection refused\" >&2\n  exit 255\nfi\n" +
+		"printf 'SSH-2.0-OpenSSH_9.6\\r\\n'\ncat >/dev/null\n"
+	writeExecutable(t, filepath.Join(binDir, "ssh"), sshScript)
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	cfg := ExecConfig{
+		Host:           "10.0.0.5",
+		Port:           2222,
+		User:           "dev",
+		PrivateKeyPath: "/keys/vm",
+		KnownHostsMode: "accept-new",
+		ConnectTimeout: 2 * time.Second,
+		JumpHosts:      []JumpHost{{Host: "bastion", User: "ops"}},
+	}
+	stats, err := WaitForTCPPortViaJumpsWithStats(context.Background(), cfg, 3, time.Millisecond)
+	if err != nil {
+		t.Fatalf("probe through ssh -W failed: %v", err)
+	}
+	if stats.Attempts != 2 {
+		t.Fatalf("expected a refused probe to be retried, got %d attempts", stats.Attempts)
+	}
+	data, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "-W 10.0.0.5:2222 ops@bastion") {
+		t.Fatalf("expected an ssh -W probe through the jump host, got %q", data)
+	}
+
+	_ = os.Remove(marker)
+	_, err = WaitForTCPPortViaJumpsWithStats(context.Background(), cfg, 1, time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "Connection refused") {
+		t.Fatalf("expected the ssh error in the probe failure, got %v", err)
+	}
+}
+
+func TestHopExecConfigInheritsTargetDefaults(t *testing.T) {
+	cfg := ExecConfig{
+		Host:           "10.0.0.5",
+		Port:           2222,
+		User:           "dev",
+		PrivateKeyPath: "/keys/vm",
+		KnownHostsFile: "/tmp/known_hosts",
+		JumpHosts: []JumpHost{
+			{Host: "bastion1"},
+			{Host: "bastion2", Port: 2200, User: "ops", PrivateKeyPath: "/keys/ops", ExpectedHostKeys: []string{"SHA256:abc"}},
+		},
+	}
+	first := hopExecConfig(cfg, 0)
+	if first.Port != 22 || first.User != "dev" || first.PrivateKeyPath != "/keys/vm" || len(first.JumpHosts) != 0 {
+		t.Fatalf("unexpected first hop config: %+v", first)
+	}
+	second := hopExecConfig(cfg, 1)
+	if second.Host != "bastion2" || second.Port != 2200 || second.User != "ops" || len(second.ExpectedHostKeys) != 1 || second.ExpectedHostKeys[0] != "SHA256:abc" {
+		t.Fatalf("unexpected second hop config: %+v", second)
+	}
+	if len(second.JumpHosts) != 1 || second.JumpHosts[0].Host != "bastion1" {
+		t.Fatalf("expected second hop to be reached through the first, got %+v", second.JumpHosts)
+	}
+	if second.KnownHostsFile != "/tmp/known_hosts" {
+		t.Fatalf("expected hop to share known_hosts file")
+	}
+}
+
+func TestBuildSSHArgsWithJumpHostsNestsProxyCommands(t *testing.T) {
+	cfg := ExecConfig{
+		Host:           "10.0.0.5",
+		Port:           22,
+		User:           "dev",
+		PrivateKeyPath: "/keys/my key",
+		KnownHostsFile: "/tmp/known_hosts",
+		JumpHosts: []JumpHost{
+			{Host: "bastion1", User: "ops"},
+			{Host: "bastion2", Port: 2200},
+		},
+	}
+	args := buildSSHArgs(cfg, "echo ok")
+	var proxy string
+	for i, a := range args {
+		if a == "-o" && strings.HasPrefix(args[i+1], "ProxyCommand=") {
+			proxy = strings.TrimPrefix(args[i+1], "ProxyCommand=")
+		}
+	}
+	if proxy == "" {
+		t.Fatalf("expected ProxyCommand in args: %v", args)
+	}
+	if !strings.Contains(proxy, "-W 10.0.0.5:22 dev@bastion2") {
+		t.Fatalf("expected last hop to forward to the VM, got %q", proxy)
+	}
+	if !strings.Contains(proxy, "-W bastion2:2200 ops@bastion1") {
+		t.Fatalf("expected first hop nested inside the second, got %q", proxy)
+	}
+	if !strings.Contains(proxy, `'/keys/my key'`) {
+		t.Fatalf("expected key path with spaces to be shell-quoted, got %q", proxy)
+	}
+	if args[len(args)-2] != "dev@10.0.0.5" || args[len(args)-1] != "echo ok" {
+		t.Fatalf("expected destination and command last, got %v", args[len(args)-2:])
+	}
+}
+
+func TestNativeHandshakeThroughJumpHostHonoursConnectTimeout(t *testing.T) {
+	jump := startTestSSHServer(t, echoStdinHandler)
+	silent := startSilentServer(t)
+	cfg := silent.execConfig(filepath.Join(t.TempDir(), "known_hosts"), "accept-new")
+	cfg.PrivateKeyPath = jump.clientKeyPath
+	cfg.ConnectTimeout = 200 * time.Millisecond
+	cfg.JumpHosts = []JumpHost{{
+		Host:             jump.host,
+		Port:             jump.port,
+		PrivateKeyPath:   jump.clientKeyPath,
+		ExpectedHostKeys: []string{ssh.FingerprintSHA256(jump.hostKey.PublicKey())},
+	}}
+
+	start := time.Now()
+	_, _, err := RunCommand(context.Background(), cfg, "true")
+	if err == nil || !strings.Contains(err.Error(), "handshake timed out after 200ms") {
+		t.Fatalf("expected a handshake timeout through the jump host, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("handshake took %s despite a 200ms timeout", elapsed)
+	}
+}
@@ -0,0 +1,137 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// removeKnownHostsEntries drops every known_hosts line whose host pattern
+// matches target exactly (plain or hashed), like `ssh-keygen -R`.
+// Marker lines (@cert-authority, @revoked) are kept untouched.
+func removeKnownHostsEntries(path, target string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("read known_hosts %s: %w", path, err)
+	}
+
+	var out bytes.Buffer
+	removed := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if knownHostsLineMatches(line, target) {
+			removed = true
+			continue
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read known_hosts %s: %w", path, err)
+	}
+	if !removed {
+		return nil
+	}
+	return writeFileAtomic(path, out.Bytes(), 0o600)
+}
+
+func knownHostsLineMatches(line, target string) bool {
+	t := strings.TrimSpace(line)
+	if t == "" || strings.HasPrefix(t, "#") || strings.HasPrefix(t, "@") {
+		return false
+	}
+	fields := strings.Fields(t)
+	if len(fields) < 2 {
+		return false
+	}
+	for _, pattern := range strings.Split(fields[0], ",") {
+		if strings.HasPrefix(pattern, "|1|") {
+			if hashedHostMatches(pattern, target) {
+				return true
+			}
+			continue
+		}
+		if pattern == target {
+			return true
+		}
+	}
+	return false
+}
+
+// hashedHostMatches checks a HashKnownHosts entry (|1|salt|hash) against host.
+func hashedHostMatches(pattern, host string) bool {
+	parts := strings.Split(pattern, "|")
+	if len(parts) != 4 || parts[1] != "1" {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+func appendKnownHostsEntry(path, entry string) error {
+	if err := os.MkdirAll(filepathDirSafe(path), 0o700); err != nil {
+		return fmt.Errorf("create known_hosts dir: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("open known_hosts %s: %w", path, err)
+	}
+	defer func() { _ = f.Close() }()
+	if _, err := f.WriteString(entry); err != nil {
+		return fmt.Errorf("append known_hosts %s: %w", path, err)
+	}
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepathDirSafe(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create temp file for %s: %w", path, err)
+	}
+	tmpName := tmp.Name()
+	defer func() { _ = os.Remove(tmpName) }()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("chmod %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", path, err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return fmt.Errorf("replace %s: %w", path, err)
+	}
+	return nil
+}
+
+// defaultKnownHostsFile mirrors OpenSSH's UserKnownHostsFile default.
+func defaultKnownHostsFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil || home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
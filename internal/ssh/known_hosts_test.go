@@ -0,0 +1,53 @@
+package ssh
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestRemoveKnownHostsEntriesPlainAndHashed(t *testing.T) {
+	key := newTestSigner(t).PublicKey()
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	content := strings.Join([]string{
+		"# comment",
+		knownhosts.Line([]string{"10.0.0.1"}, key),
+		knownhosts.Line([]string{knownhosts.HashHostname("10.0.0.1")}, key),
+		knownhosts.Line([]string{"[10.0.0.1]:2222"}, key),
+		knownhosts.Line([]string{"10.0.0.2"}, key),
+		"@cert-authority 10.0.0.1 " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+	}, "\n") + "\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write known_hosts: %v", err)
+	}
+
+	if err := removeKnownHostsEntries(path, "10.0.0.1"); err != nil {
+		t.Fatalf("removeKnownHostsEntries: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read known_hosts: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 remaining lines, got %d:\n%s", len(lines), data)
+	}
+	for _, l := range lines {
+		if strings.HasPrefix(l, "10.0.0.1 ") || strings.HasPrefix(l, "|1|") {
+			t.Fatalf("expected entry for 10.0.0.1 to be removed, got %q", l)
+		}
+	}
+	if st, err := os.Stat(path); err != nil || st.Mode().Perm() != 0o600 {
+		t.Fatalf("expected known_hosts mode 0600, got %v (%v)", st.Mode().Perm(), err)
+	}
+}
+
+func TestRemoveKnownHostsEntriesMissingFile(t *testing.T) {
+	if err := removeKnownHostsEntries(filepath.Join(t.TempDir(), "missing"), "10.0.0.1"); err != nil {
+		t.Fatalf("expected missing known_hosts to be a no-op, got %v", err)
+	}
+}
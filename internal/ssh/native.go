@@ -0,0 +1,349 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	// TransportOpenSSH execs the system ssh/ssh-keyscan binaries.
+	TransportOpenSSH = "openssh"
+	// TransportNative speaks SSH in-process via golang.org/x/crypto/ssh.
+	TransportNative = "native"
+)
+
+var errHostKeyCaptured = errors.New("host key captured")
+
+func normalizeTransport(transport string) string {
+	switch strings.ToLower(strings.TrimSpace(transport)) {
+	case "native":
+		return TransportNative
+	default:
+		return TransportOpenSSH
+	}
+}
+
+func useNativeTransport(cfg ExecConfig) bool {
+	return normalizeTransport(cfg.Transport) == TransportNative
+}
+
+func runNativeCommand(ctx context.Context, cfg ExecConfig, remoteCommand string, stdinScript string, prefix string) (string, string, error) {
+	client, err := dialNative(ctx, cfg)
+	if err != nil {
+		return "", "", err
+	}
+	defer func() { _ = client.Close() }()
+	return runNativeSession(ctx, client, remoteCommand, scriptReader(stdinScript), prefix)
+}
+
+func runNativeSession(ctx context.Context, client *ssh.Client, remoteCommand string, stdin io.Reader, prefix string) (string, string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", "", fmt.Errorf("%s: open session: %w", prefix, err)
+	}
+	defer func() { _ = session.Close() }()
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	var flush func()
+	session.Stdout, session.Stderr, flush = outputWriters(ctx, &stdout, &stderr)
+	if stdin != nil {
+		session.Stdin = stdin
+	}
+
+	stop := context.AfterFunc(ctx, func() { _ = session.Close() })
+	defer stop()
+
+	err = session.Run(remoteCommand)
+	flush()
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		return stdout.String(), stderr.String(), formatSSHRunError(prefix, err, stderr.String())
+	}
+	return stdout.String(), stderr.String(), nil
+}
+
+func dialNative(ctx context.Context, cfg ExecConfig) (*ssh.Client, error) {
+	addr := nativeAddr(cfg)
+	cfg = pinnedHostKeyAlgorithms(ctx, cfg)
+	auth, closeAuth, err := nativeAuthMethods(cfg)
+	if err != nil {
+		return nil, &ConnectError{Addr: addr, Err: err}
+	}
+	defer closeAuth()
+	clientCfg := &ssh.ClientConfig{
+		User:              cfg.User,
+		Auth:              auth,
+		HostKeyCallback:   nativeHostKeyCallback(ctx, cfg),
+		HostKeyAlgorithms: hostKeyAlgorithms(cfg),
+		Timeout:           nativeConnectTimeout(cfg),
+	}
+	conn, chans, reqs, release, err := nativeHandshake(ctx, cfg, addr, clientCfg)
+	if err != nil {
+		return nil, &ConnectError{Addr: addr, Err: err}
+	}
+	client := ssh.NewClient(conn, chans, reqs)
+	go func() {
+		_ = client.Wait()
+		release()
+	}()
+	return client, nil
+}
+
+func nativeHandshake(ctx context.Context, cfg ExecConfig, addr string, clientCfg *ssh.ClientConfig) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, func(), error) {
+	netConn, release, err := nativeDialConn(ctx, cfg, addr)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	// ssh.NewClientConn ignores clientCfg.Timeout, so the handshake gets its
+	// own: the connection is closed when it takes longer than the connect
+	// timeout, or when ctx is done. A timer works for TCP and for channels
+	// through a jump host alike, which do not support deadlines. It is paused
+	// while the host key callback runs, as host key prompts may wait on the
+	// user.
+	timeout := nativeConnectTimeout(cfg)
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(timeout, func() {
+		timedOut.Store(true)
+		_ = netConn.Close()
+	})
+	handshakeCfg := *clientCfg
+	handshakeCfg.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		timer.Stop()
+		defer timer.Reset(timeout)
+		return clientCfg.HostKeyCallback(hostname, remote, key)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = netConn.Close() })
+	conn, chans, reqs, err := ssh.NewClientConn(netConn, addr, &handshakeCfg)
+	stop()
+	timer.Stop()
+	if err == nil && timedOut.Load() {
+		_ = conn.Close()
+		err = errors.New("connection closed")
+	}
+	if err != nil {
+		_ = netConn.Close()
+		release()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, nil, nil, nil, ctxErr
+		}
+		if timedOut.Load() {
+			return nil, nil, nil, nil, fmt.Errorf("ssh handshake timed out after %s", timeout)
+		}
+		return nil, nil, nil, nil, err
+	}
+	return conn, chans, reqs, release, nil
+}
+
+// nativeAuthMethods returns the client auth methods for cfg. The close func
+// releases the agent connection once the handshake is over.
+func nativeAuthMethods(cfg ExecConfig) ([]ssh.AuthMethod, func(), error) {
+	if cfg.UseAgent {
+		signers, closeAgent, err := agentSigners(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		signers, err = withUserCertificate(cfg, signers)
+		if err != nil {
+			closeAgent()
+			return nil, nil, err
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(signers...)}, closeAgent, nil
+	}
+	keyPath := strings.TrimSpace(cfg.PrivateKeyPath)
+	if keyPath == "" {
+		return nil, nil, fmt.Errorf("private key path is empty")
+	}
+	pem, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read private key %s: %w", keyPath, err)
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		var passErr *ssh.PassphraseMissingError
+		if errors.As(err, &passErr) {
+			return nil, nil, fmt.Errorf("private key %s is passphrase protected; load it into ssh-agent and use agent authentication", keyPath)
+		}
+		return nil, nil, fmt.Errorf("parse private key %s: %w", keyPath, err)
+	}
+	signers, err := withUserCertificate(cfg, []ssh.Signer{signer})
+	if err != nil {
+		return nil, nil, err
+	}
+	return []ssh.AuthMethod{ssh.PublicKeys(signers...)}, func() {}, nil
+}
+
+func nativeAddr(cfg ExecConfig) string {
+	port := cfg.Port
+	if port <= 0 {
+		port = 22
+	}
+	return net.JoinHostPort(strings.TrimSpace(cfg.Host), strconv.Itoa(port))
+}
+
+func nativeConnectTimeout(cfg ExecConfig) time.Duration {
+	if cfg.ConnectTimeout <= 0 {
+		return 5 * time.Second
+	}
+	return cfg.ConnectTimeout
+}
+
+func nativeKnownHostsFile(cfg ExecConfig) string {
+	if p := strings.TrimSpace(cfg.KnownHostsFile); p != "" {
+		return p
+	}
+	return defaultKnownHostsFile()
+}
+
+func nativeHostKeyCallback(ctx context.Context, cfg ExecConfig) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return verifyNativeHostKey(ctx, cfg, hostname, remote, key)
+	}
+}
+
+// verifyNativeHostKey applies the same trust rules as the OpenSSH path:
+// a host certificate is checked against the configured CA, a pinned
+// fingerprint is checked first, otherwise known_hosts decides and
+// known_hosts_mode controls whether unknown or changed keys are accepted.
+func verifyNativeHostKey(ctx context.Context, cfg ExecConfig, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		return verifyHostCertificate(cfg, cert)
+	}
+	target, _ := knownHostsTarget(cfg)
+	got := ssh.FingerprintSHA256(key)
+	entry := knownhosts.Line([]string{knownhosts.HashHostname(target)}, key) + "\n"
+	mode := normalizeKnownHostsMode(cfg.KnownHostsMode)
+	knownHostsFile := nativeKnownHostsFile(cfg)
+
+	if pins := expectedHostKeys(cfg); len(pins) > 0 {
+		if strings.TrimSpace(cfg.KnownHostsFile) == "" {
+			return fmt.Errorf("known_hosts_file is required when expected host fingerprint is set")
+		}
+		if containsString(pins, got) {
+			return writeKnownHostsEntry(cfg, entry)
+		}
+		expected := strings.Join(pins, ",")
+		mismatch := &HostKeyMismatchError{Host: target, Expected: expected, Got: got}
+		allow, err := acceptHostKeyChange(cfg, mode, fmt.Sprintf("SSH host key changed (expected %s, got %s). Accept new host key?", expected, got))
+		if err != nil {
+			return err
+		}
+		if !allow {
+			return mismatch
+		}
+		if _, err := ensureStableScannedHostKey(ctx, cfg, scannedHostKey{HostKeyFingerprint: HostKeyFingerprint{Type: key.Type(), SHA256: got}, entry: entry}); err != nil {
+			return err
+		}
+		return writeKnownHostsEntry(cfg, entry)
+	}
+
+	if knownHostsFile == "" {
+		return fmt.Errorf("known_hosts path is empty")
+	}
+	err := checkKnownHosts(knownHostsFile, hostname, remote, key)
+	if err == nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return err
+	}
+	if len(keyErr.Want) == 0 {
+		if mode == "accept-new" {
+			return appendKnownHostsEntry(knownHostsFile, entry)
+		}
+		return &HostKeyUnknownError{Host: target, Got: got, KnownHostsFile: knownHostsFile}
+	}
+
+	known := make([]string, 0, len(keyErr.Want))
+	for _, w := range keyErr.Want {
+		known = append(known, ssh.FingerprintSHA256(w.Key))
+	}
+	mismatch := &HostKeyMismatchError{Host: target, Expected: strings.Join(known, ","), Got: got, KnownHostsFile: knownHostsFile}
+	if strings.TrimSpace(cfg.KnownHostsFile) == "" {
+		return mismatch
+	}
+	allow, err := acceptHostKeyChange(cfg, mode, "SSH host key changed. Accept new host key?")
+	if err != nil {
+		return err
+	}
+	if !allow {
+		return mismatch
+	}
+	return writeKnownHostsEntry(cfg, entry)
+}
+
+func checkKnownHosts(path, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return &knownhosts.KeyError{}
+		}
+		return fmt.Errorf("stat known_hosts %s: %w", path, err)
+	}
+	cb, err := knownhosts.New(path)
+	if err != nil {
+		return fmt.Errorf("load known_hosts %s: %w", path, err)
+	}
+	return cb(hostname, remote, key)
+}
+
+// acceptHostKeyChange decides whether a changed host key may replace the
+// trusted one: always in auto-refresh mode, on confirmation in prompt mode.
+func acceptHostKeyChange(cfg ExecConfig, mode string, message string) (bool, error) {
+	switch mode {
+	case "auto-refresh":
+		return true, nil
+	case "prompt":
+		if cfg.Prompt == nil {
+			return false, nil
+		}
+		ok, err := cfg.Prompt(message)
+		if err != nil {
+			return false, fmt.Errorf("known_hosts prompt failed: %w", err)
+		}
+		return ok, nil
+	default:
+		return false, nil
+	}
+}
+
+// scanHostKeyNative performs a key exchange only (no authentication) offering
+// just algo and returns the host key the server presented.
+func scanHostKeyNative(ctx context.Context, cfg ExecConfig, algo string) (ssh.PublicKey, error) {
+	var captured ssh.PublicKey
+	clientCfg := &ssh.ClientConfig{
+		User: "keyscan",
+		HostKeyCallback: func(_ string, _ net.Addr, key ssh.PublicKey) error {
+			captured = key
+			return errHostKeyCaptured
+		},
+		HostKeyAlgorithms: []string{algo},
+		Timeout:           nativeConnectTimeout(cfg),
+	}
+	conn, _, _, release, err := nativeHandshake(ctx, cfg, nativeAddr(cfg), clientCfg)
+	if err == nil {
+		_ = conn.Close()
+		release()
+	}
+	if captured != nil {
+		return captured, nil
+	}
+	if err == nil {
+		err = errors.New("server did not present a host key")
+	}
+	return nil, err
+}
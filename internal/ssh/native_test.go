@@ -0,0 +1,424 @@
+package ssh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type testExecResult struct {
+	stdout string
+	stderr string
+	exit   uint32
+}
+
+type testSSHServer struct {
+	host          string
+	port          int
+	hostKey       ssh.Signer
+	clientKeyPath string
+	dials         atomic.Int32
+	forwards      atomic.Int32
+}
+
+func startTestSSHServer(t *testing.T, handler func(cmd string, stdin []byte) testExecResult) *testSSHServer {
+	t.Helper()
+	hostKey := newTestSigner(t)
+	clientSigner, clientKeyPath := newTestClientKey(t)
+
+	serverCfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(clientSigner.PublicKey().Marshal()) {
+				return &ssh.Permissions{}, nil
+			}
+			return nil, errors.New("unknown client key")
+		},
+	}
+	serverCfg.AddHostKey(hostKey)
+	return serveTestSSH(t, serverCfg, hostKey, clientKeyPath, handler)
+}
+
+// serveTestSSH accepts connections for serverCfg on a loopback port.
+func serveTestSSH(t *testing.T, serverCfg *ssh.ServerConfig, hostKey ssh.Signer, clientKeyPath string, handler func(cmd string, stdin []byte) testExecResult) *testSSHServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	srv := &testSSHServer{host: "127.0.0.1", port: ln.Addr().(*net.TCPAddr).Port, hostKey: hostKey, clientKeyPath: clientKeyPath}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			srv.dials.Add(1)
+			go srv.serveConn(conn, serverCfg, handler)
+		}
+	}()
+	return srv
+}
+
+func (s *testSSHServer) serveConn(conn net.Conn, cfg *ssh.ServerConfig, handler func(cmd string, stdin []byte) testExecResult) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	defer func() { _ = sconn.Close() }()
+	go ssh.DiscardRequests(reqs)
+	for newCh := range chans {
+		if newCh.ChannelType() == "direct-tcpip" {
+			s.forwards.Add(1)
+			go forwardTestChannel(newCh)
+			continue
+		}
+		if newCh.ChannelType() != "session" {
+			_ = newCh.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer func() { _ = ch.Close() }()
+			for req := range chReqs {
+				if req.Type != "exec" {
+					_ = req.Reply(false, nil)
+					continue
+				}
+				n := binary.BigEndian.Uint32(req.Payload[:4])
+				cmd := string(req.Payload[4 : 4+n])
+				_ = req.Reply(true, nil)
+				stdin, _ := io.ReadAll(ch)
+				res := handler(cmd, stdin)
+				_, _ = io.WriteString(ch, res.stdout)
+				_, _ = io.WriteString(ch.Stderr(), res.stderr)
+				status := make([]byte, 4)
+				binary.BigEndian.PutUint32(status, res.exit)
+				_, _ = ch.SendRequest("exit-status", false, status)
+				return
+			}
+		}()
+	}
+}
+
+// forwardTestChannel serves a direct-tcpip request, making the test server
+// usable as a jump host.
+func forwardTestChannel(newCh ssh.NewChannel) {
+	var req struct {
+		Host     string
+		Port     uint32
+		OrigHost string
+		OrigPort uint32
+	}
+	if err := ssh.Unmarshal(newCh.ExtraData(), &req); err != nil {
+		_ = newCh.Reject(ssh.ConnectionFailed, "bad request")
+		return
+	}
+	target, err := net.Dial("tcp", net.JoinHostPort(req.Host, strconv.Itoa(int(req.Port))))
+	if err != nil {
+		_ = newCh.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, chReqs, err := newCh.Accept()
+	if err != nil {
+		_ = target.Close()
+		return
+	}
+	go ssh.DiscardRequests(chReqs)
+	go func() {
+		_, _ = io.Copy(target, ch)
+		_ = target.Close()
+	}()
+	_, _ = io.Copy(ch, target)
+	_ = ch.Close()
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("signer: %v", err)
+	}
+	return signer
+}
+
+func newTestClientKey(t *testing.T) (ssh.Signer, string) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "test")
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("signer: %v", err)
+	}
+	return signer, path
+}
+
+func echoStdinHandler(cmd string, stdin []byte) testExecResult {
+	if len(stdin) == 0 {
+		return testExecResult{stdout: cmd}
+	}
+	return testExecResult{stdout: string(stdin)}
+}
+
+func (s *testSSHServer) execConfig(knownHosts, mode string) ExecConfig {
+	return ExecConfig{
+		Host:           s.host,
+		Port:           s.port,
+		User:           "dev",
+		PrivateKeyPath: s.clientKeyPath,
+		KnownHostsFile: knownHosts,
+		KnownHostsMode: mode,
+		ConnectTimeout: 2 * time.Second,
+		Transport:      TransportNative,
+	}
+}
+
+func (s *testSSHServer) addr() string {
+	return net.JoinHostPort(s.host, strconv.Itoa(s.port))
+}
+
+func (s *testSSHServer) target() string {
+	return knownhosts.Normalize(s.addr())
+}
+
+func TestNativeRunScriptAcceptNewWritesKnownHosts(t *testing.T) {
+	srv := startTestSSHServer(t, echoStdinHandler)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+
+	out, _, err := RunScript(context.Background(), srv.execConfig(knownHosts, "accept-new"), "echo hello\n")
+	if err != nil {
+		t.Fatalf("RunScript failed: %v", err)
+	}
+	if out != "echo hello\n" {
+		t.Fatalf("expected script on stdin to be echoed, got %q", out)
+	}
+	cb, err := knownhosts.New(knownHosts)
+	if err != nil {
+		t.Fatalf("load known_hosts: %v", err)
+	}
+	if err := cb(srv.addr(), &net.TCPAddr{IP: net.ParseIP(srv.host), Port: srv.port}, srv.hostKey.PublicKey()); err != nil {
+		t.Fatalf("expected host key to be trusted after accept-new: %v", err)
+	}
+}
+
+func TestNativeStrictUnknownHostFails(t *testing.T) {
+	srv := startTestSSHServer(t, echoStdinHandler)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+
+	_, _, err := RunCommand(context.Background(), srv.execConfig(knownHosts, "strict"), "true")
+	var unknown *HostKeyUnknownError
+	if !errors.As(err, &unknown) {
+		t.Fatalf("expected HostKeyUnknownError, got %v", err)
+	}
+	var connErr *ConnectError
+	if !errors.As(err, &connErr) {
+		t.Fatalf("expected ConnectError wrapper, got %T", err)
+	}
+}
+
+func TestNativeKnownHostsMismatchStrictReturnsTypedError(t *testing.T) {
+	srv := startTestSSHServer(t, echoStdinHandler)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	other := newTestSigner(t)
+	line := knownhosts.Line([]string{srv.target()}, other.PublicKey()) + "\n"
+	if err := os.WriteFile(knownHosts, []byte(line), 0o600); err != nil {
+		t.Fatalf("write known_hosts: %v", err)
+	}
+
+	_, _, err := RunCommand(context.Background(), srv.execConfig(knownHosts, "strict"), "true")
+	var mismatch *HostKeyMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected HostKeyMismatchError, got %v", err)
+	}
+	if mismatch.Expected != ssh.FingerprintSHA256(other.PublicKey()) || mismatch.Got != ssh.FingerprintSHA256(srv.hostKey.PublicKey()) {
+		t.Fatalf("unexpected mismatch details: %#v", mismatch)
+	}
+}
+
+func TestNativeKnownHostsMismatchAutoRefreshReplacesEntry(t *testing.T) {
+	srv := startTestSSHServer(t, echoStdinHandler)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	other := newTestSigner(t)
+	line := knownhosts.Line([]string{knownhosts.HashHostname(srv.target())}, other.PublicKey()) + "\n"
+	if err := os.WriteFile(knownHosts, []byte(line), 0o600); err != nil {
+		t.Fatalf("write known_hosts: %v", err)
+	}
+
+	if _, _, err := RunCommand(context.Background(), srv.execConfig(knownHosts, "auto-refresh"), "true"); err != nil {
+		t.Fatalf("expected auto-refresh to accept changed key: %v", err)
+	}
+	data, err := os.ReadFile(knownHosts)
+	if err != nil {
+		t.Fatalf("read known_hosts: %v", err)
+	}
+	if strings.Count(strings.TrimSpace(string(data)), "\n") != 0 {
+		t.Fatalf("expected stale entry to be replaced, got:\n%s", data)
+	}
+}
+
+func TestNativeKnownHostsMismatchPromptDeclined(t *testing.T) {
+	srv := startTestSSHServer(t, echoStdinHandler)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	other := newTestSigner(t)
+	line := knownhosts.Line([]string{srv.target()}, other.PublicKey()) + "\n"
+	if err := os.WriteFile(knownHosts, []byte(line), 0o600); err != nil {
+		t.Fatalf("write known_hosts: %v", err)
+	}
+
+	cfg := srv.execConfig(knownHosts, "prompt")
+	prompted := false
+	cfg.Prompt = func(string) (bool, error) {
+		prompted = true
+		return false, nil
+	}
+	_, _, err := RunCommand(context.Background(), cfg, "true")
+	var mismatch *HostKeyMismatchError
+	if !prompted || !errors.As(err, &mismatch) {
+		t.Fatalf("expected declined prompt to return mismatch, prompted=%v err=%v", prompted, err)
+	}
+}
+
+func TestNativePinnedFingerprint(t *testing.T) {
+	srv := startTestSSHServer(t, echoStdinHandler)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+
+	cfg := srv.execConfig(knownHosts, "strict")
+	cfg.ExpectedHostKeys = []string{ssh.FingerprintSHA256(srv.hostKey.PublicKey())}
+	if _, _, err := RunCommand(context.Background(), cfg, "true"); err != nil {
+		t.Fatalf("expected pinned fingerprint to pass: %v", err)
+	}
+	if data, err := os.ReadFile(knownHosts); err != nil || len(data) == 0 {
+		t.Fatalf("expected known_hosts entry for pinned host")
+	}
+
+	cfg.ExpectedHostKeys = []string{"SHA256:does-not-match"}
+	_, _, err := RunCommand(context.Background(), cfg, "true")
+	var mismatch *HostKeyMismatchError
+	if !errors.As(err, &mismatch) || mismatch.Expected != "SHA256:does-not-match" {
+		t.Fatalf("expected pinned mismatch error, got %v", err)
+	}
+}
+
+func TestNativeRemoteFailureIncludesStderr(t *testing.T) {
+	srv := startTestSSHServer(t, func(string, []byte) testExecResult {
+		return testExecResult{stderr: "apt-get: not found\n", exit: 2}
+	})
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+
+	_, stderr, err := RunCommand(context.Background(), srv.execConfig(knownHosts, "accept-new"), "apt-get update")
+	if err == nil || !strings.Contains(err.Error(), "apt-get: not found") {
+		t.Fatalf("expected remote stderr in error, got %v", err)
+	}
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 2 {
+		t.Fatalf("expected exit status 2, got %v", err)
+	}
+	if status, ok := ExitStatus(err); !ok || status != 2 {
+		t.Fatalf("ExitStatus() = %d, %v; want 2", status, ok)
+	}
+	if strings.TrimSpace(stderr) != "apt-get: not found" {
+		t.Fatalf("unexpected stderr: %q", stderr)
+	}
+}
+
+func TestScanHostKeysNative(t *testing.T) {
+	srv := startTestSSHServer(t, echoStdinHandler)
+	cfg := ExecConfig{Host: srv.host, Port: srv.port, Transport: TransportNative, ConnectTimeout: 2 * time.Second}
+
+	keys, err := scanHostKeys(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("native scan failed: %v", err)
+	}
+	if len(keys) != 1 || keys[0].SHA256 != ssh.FingerprintSHA256(srv.hostKey.PublicKey()) {
+		t.Fatalf("unexpected scanned keys: %+v", keys)
+	}
+	if !strings.HasPrefix(keys[0].entry, "|1|") {
+		t.Fatalf("expected hashed known_hosts entry, got %q", keys[0].entry)
+	}
+}
+
+func TestNormalizeTransport(t *testing.T) {
+	if got := normalizeTransport(""); got != TransportOpenSSH {
+		t.Fatalf("expected openssh default, got %q", got)
+	}
+	if got := normalizeTransport("Native"); got != TransportNative {
+		t.Fatalf("expected native, got %q", got)
+	}
+}
+
+// startSilentServer accepts TCP connections and never speaks SSH.
+func startSilentServer(t *testing.T) *testSSHServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		_ = ln.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				<-done
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return &testSSHServer{host: "127.0.0.1", port: ln.Addr().(*net.TCPAddr).Port}
+}
+
+func TestNativeHandshakeHonoursConnectTimeout(t *testing.T) {
+	silent := startSilentServer(t)
+	cfg := silent.execConfig(filepath.Join(t.TempDir(), "known_hosts"), "accept-new")
+	cfg.PrivateKeyPath = startTestSSHServer(t, echoStdinHandler).clientKeyPath
+	cfg.ConnectTimeout = 200 * time.Millisecond
+
+	start := time.Now()
+	_, _, err := RunCommand(context.Background(), cfg, "true")
+	if err == nil || !strings.Contains(err.Error(), "handshake timed out after 200ms") {
+		t.Fatalf("expected a handshake timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("handshake took %s despite a 200ms timeout", elapsed)
+	}
+}
@@ -0,0 +1,201 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// controlPersist bounds how long an orphaned OpenSSH master lingers if the
+// process dies before Close.
+const controlPersist = "10m"
+
+// Session is one authenticated connection to a host, shared by every command
+// of a run. Host key verification happens once, in Dial.
+//
+// With the native transport it wraps a single *ssh.Client and opens a channel
+// per command. With the OpenSSH transport it owns a ControlMaster socket and
+// every ssh invocation is multiplexed over it.
+type Session struct {
+	cfg    ExecConfig
+	native bool
+
+	mu          sync.Mutex
+	client      *ssh.Client
+	controlDir  string
+	controlPath string
+	closed      bool
+}
+
+type sessionContextKey struct{}
+
+// Dial opens a session to cfg.Host and verifies its host key.
+func Dial(ctx context.Context, cfg ExecConfig) (*Session, error) {
+	s := &Session{cfg: cfg}
+	if useNativeTransport(cfg) {
+		client, err := dialNative(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		s.client = client
+		s.native = true
+		return s, nil
+	}
+
+	cfg, err := prepareOpenSSH(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.cfg = cfg
+	dir, err := os.MkdirTemp("", "tdb-ssh-")
+	if err != nil {
+		return nil, fmt.Errorf("create ssh control dir: %w", err)
+	}
+	s.controlDir = dir
+	s.controlPath = filepath.Join(dir, "cm")
+
+	// The master runs a no-op command and, thanks to ControlPersist, stays
+	// in the background serving later invocations.
+	masterArgs := func(verified ExecConfig) []string {
+		s.cfg = verified
+		return append([]string{
+			"-o", "ControlMaster=yes",
+			"-o", "ControlPath=" + s.controlPath,
+			"-o", "ControlPersist=" + controlPersist,
+		}, buildSSHArgs(verified, "true")...)
+	}
+	if _, _, err := runSSHCommand(ctx, cfg, masterArgs, "", "ssh connect failed"); err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Config returns the connection settings the session was dialed with.
+func (s *Session) Config() ExecConfig {
+	return s.cfg
+}
+
+// RunScript runs script via `sudo -n bash -s` over the session.
+func (s *Session) RunScript(ctx context.Context, script string) (string, string, error) {
+	return s.RunScriptWithCommand(ctx, "sudo -n bash -s", script)
+}
+
+// RunScriptWithCommand runs remoteCommand with script on stdin.
+func (s *Session) RunScriptWithCommand(ctx context.Context, remoteCommand string, script string) (string, string, error) {
+	return s.run(ctx, remoteCommand, scriptReader(script), "ssh run script failed")
+}
+
+// RunCommand runs remoteCommand over the session.
+func (s *Session) RunCommand(ctx context.Context, remoteCommand string) (string, string, error) {
+	return s.run(ctx, remoteCommand, nil, "ssh run command failed")
+}
+
+func (s *Session) run(ctx context.Context, remoteCommand string, stdin io.Reader, prefix string) (string, string, error) {
+	if !s.native && s.controlPath == "" {
+		return "", "", fmt.Errorf("%s: session is not connected", prefix)
+	}
+	if s.native {
+		client, err := s.nativeClient(ctx)
+		if err != nil {
+			return "", "", err
+		}
+		return runNativeSession(ctx, client, remoteCommand, stdin, prefix)
+	}
+	if s.isClosed() {
+		return "", "", fmt.Errorf("%s: session is closed", prefix)
+	}
+	// If the master went away, ssh falls back to a direct connection that
+	// still checks the known_hosts entry written at dial time.
+	args := append([]string{
+		"-o", "ControlMaster=no",
+		"-o", "ControlPath=" + s.controlPath,
+	}, buildSSHArgs(s.cfg, remoteCommand)...)
+	return runSSHProcess(ctx, args, stdin, prefix)
+}
+
+// nativeClient returns the shared client, redialing once if the connection
+// was dropped (for example by an sshd restart during hardening).
+func (s *Session) nativeClient(ctx context.Context) (*ssh.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, errors.New("ssh session is closed")
+	}
+	if _, _, err := s.client.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+		return s.client, nil
+	}
+	_ = s.client.Close()
+	client, err := dialNative(ctx, s.cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.client = client
+	return client, nil
+}
+
+func (s *Session) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// serves reports whether cfg targets the same endpoint as the session.
+func (s *Session) serves(cfg ExecConfig) bool {
+	return strings.TrimSpace(s.cfg.Host) == strings.TrimSpace(cfg.Host) &&
+		s.cfg.Port == cfg.Port &&
+		s.cfg.User == cfg.User
+}
+
+// Close tears down the connection. It is safe to call more than once.
+func (s *Session) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.client != nil {
+		return s.client.Close()
+	}
+	if s.controlPath == "" {
+		return nil
+	}
+	args := []string{"-o", "ControlPath=" + s.controlPath, "-O", "exit", s.cfg.User + "@" + s.cfg.Host}
+	_ = exec.Command("ssh", args...).Run() // best-effort: master may already be gone
+	return os.RemoveAll(s.controlDir)
+}
+
+// ContextWithSession returns a context whose RunScript/RunCommand calls reuse s
+// for matching targets. A nil session returns ctx unchanged.
+func ContextWithSession(ctx context.Context, s *Session) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, sessionContextKey{}, s)
+}
+
+// SessionFromContext returns the session attached by ContextWithSession, if any.
+func SessionFromContext(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionContextKey{}).(*Session)
+	return s
+}
+
+func sessionFor(ctx context.Context, cfg ExecConfig) *Session {
+	s := SessionFromContext(ctx)
+	if s == nil || !s.serves(cfg) {
+		return nil
+	}
+	return s
+}
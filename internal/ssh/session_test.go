@@ -0,0 +1,128 @@
+package ssh
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNativeSessionReusesOneConnection(t *testing.T) {
+	srv := startTestSSHServer(t, echoStdinHandler)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	cfg := srv.execConfig(knownHosts, "accept-new")
+
+	sess, err := Dial(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer func() { _ = sess.Close() }()
+
+	ctx := ContextWithSession(context.Background(), sess)
+	for i := 0; i < 3; i++ {
+		out, _, err := RunScript(ctx, cfg, "step\n")
+		if err != nil {
+			t.Fatalf("RunScript %d failed: %v", i, err)
+		}
+		if out != "step\n" {
+			t.Fatalf("unexpected output: %q", out)
+		}
+	}
+	if _, _, err := RunCommand(ctx, cfg, "status"); err != nil {
+		t.Fatalf("RunCommand failed: %v", err)
+	}
+	if got := srv.dials.Load(); got != 1 {
+		t.Fatalf("expected a single SSH handshake, got %d", got)
+	}
+}
+
+func TestNativeSessionRedialsAfterDrop(t *testing.T) {
+	srv := startTestSSHServer(t, echoStdinHandler)
+	cfg := srv.execConfig(filepath.Join(t.TempDir(), "known_hosts"), "accept-new")
+
+	sess, err := Dial(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer func() { _ = sess.Close() }()
+
+	_ = sess.client.Close()
+	if _, _, err := sess.RunCommand(context.Background(), "status"); err != nil {
+		t.Fatalf("expected redial after dropped connection, got %v", err)
+	}
+	if got := srv.dials.Load(); got != 2 {
+		t.Fatalf("expected one redial, got %d handshakes", got)
+	}
+}
+
+func TestSessionIgnoredForOtherTarget(t *testing.T) {
+	srv := startTestSSHServer(t, echoStdinHandler)
+	cfg := srv.execConfig(filepath.Join(t.TempDir(), "known_hosts"), "accept-new")
+
+	sess, err := Dial(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer func() { _ = sess.Close() }()
+
+	other := cfg
+	other.User = "someone-else"
+	if got := sessionFor(ContextWithSession(context.Background(), sess), other); got != nil {
+		t.Fatalf("expected session not to serve a different target")
+	}
+	if got := sessionFor(context.Background(), cfg); got != nil {
+		t.Fatalf("expected no session without ContextWithSession")
+	}
+}
+
+func TestOpenSSHSessionMultiplexesOverControlMaster(t *testing.T) {
+	binDir := t.TempDir()
+	logPath := filepath.Join(binDir, "calls")
+	sshScript := "#!/usr/bin/env bash\necho \"$*\" >> \"" + logPath + "\"\necho ok\n"
+	writeExecutable(t, filepath.Join(binDir, "ssh"), sshScript)
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	cfg := ExecConfig{
+		Host:           "10.0.0.1",
+		Port:           22,
+		User:           "dev",
+		PrivateKeyPath: "/tmp/key",
+		KnownHostsMode: "accept-new",
+		ConnectTimeout: 2 * time.Second,
+	}
+	sess, err := Dial(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	ctx := ContextWithSession(context.Background(), sess)
+	if _, _, err := RunCommand(ctx, cfg, "echo ok"); err != nil {
+		t.Fatalf("RunCommand failed: %v", err)
+	}
+	controlDir := sess.controlDir
+	if err := sess.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, err := os.Stat(controlDir); !os.IsNotExist(err) {
+		t.Fatalf("expected control dir to be removed, got %v", err)
+	}
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("read ssh call log: %v", err)
+	}
+	calls := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(calls) != 3 {
+		t.Fatalf("expected master, command and exit calls, got %d:\n%s", len(calls), data)
+	}
+	if !strings.Contains(calls[0], "ControlMaster=yes") || !strings.Contains(calls[0], "ControlPersist=") {
+		t.Fatalf("expected master invocation first, got %q", calls[0])
+	}
+	if !strings.Contains(calls[1], "ControlMaster=no") || !strings.HasSuffix(calls[1], "echo ok") {
+		t.Fatalf("expected multiplexed command, got %q", calls[1])
+	}
+	if !strings.Contains(calls[2], "-O exit") {
+		t.Fatalf("expected master shutdown, got %q", calls[2])
+	}
+}
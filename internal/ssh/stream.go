@@ -0,0 +1,93 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+)
+
+const (
+	// StreamStdout tags lines the remote command wrote to stdout.
+	StreamStdout = "stdout"
+	// StreamStderr tags lines the remote command wrote to stderr.
+	StreamStderr = "stderr"
+)
+
+// OutputFunc receives remote output line by line as it arrives, without the
+// trailing newline. stream is StreamStdout or StreamStderr. Both streams are
+// delivered through the same func, serialized.
+type OutputFunc func(stream, line string)
+
+type outputContextKey struct{}
+
+// ContextWithOutput returns a context whose RunScript/RunCommand calls stream
+// their output to fn while still capturing it. A nil fn returns ctx unchanged.
+func ContextWithOutput(ctx context.Context, fn OutputFunc) context.Context {
+	if fn == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, outputContextKey{}, fn)
+}
+
+// OutputFromContext returns the func attached by ContextWithOutput, if any.
+func OutputFromContext(ctx context.Context) OutputFunc {
+	fn, _ := ctx.Value(outputContextKey{}).(OutputFunc)
+	return fn
+}
+
+// lineWriter splits what is written to it into lines for an OutputFunc.
+type lineWriter struct {
+	mu     *sync.Mutex
+	stream string
+	fn     OutputFunc
+	buf    []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush delivers a final line that was not newline-terminated.
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.emit(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *lineWriter) emit(line []byte) {
+	w.fn(w.stream, strings.TrimRight(string(line), "\r"))
+}
+
+// outputWriters returns the writers for a remote command's stdout and stderr:
+// the capture buffers, teed to the context's OutputFunc when one is set. The
+// returned flush func must be called once the command has finished.
+func outputWriters(ctx context.Context, stdout, stderr *bytes.Buffer) (io.Writer, io.Writer, func()) {
+	fn := OutputFromContext(ctx)
+	if fn == nil {
+		return stdout, stderr, func() {}
+	}
+	mu := &sync.Mutex{}
+	outLines := &lineWriter{mu: mu, stream: StreamStdout, fn: fn}
+	errLines := &lineWriter{mu: mu, stream: StreamStderr, fn: fn}
+	flush := func() {
+		outLines.flush()
+		errLines.flush()
+	}
+	return io.MultiWriter(stdout, outLines), io.MultiWriter(stderr, errLines), flush
+}
@@ -0,0 +1,75 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type recordedLine struct {
+	stream, line string
+}
+
+func TestLineWriterSplitsChunksIntoLines(t *testing.T) {
+	var got []recordedLine
+	ctx := ContextWithOutput(context.Background(), func(stream, line string) {
+		got = append(got, recordedLine{stream, line})
+	})
+	var stdout, stderr bytes.Buffer
+	outW, errW, flush := outputWriters(ctx, &stdout, &stderr)
+
+	_, _ = outW.Write([]byte("pulling ima"))
+	_, _ = outW.Write([]byte("ge\r\nstarting\n"))
+	_, _ = errW.Write([]byte("warning: slow\n"))
+	_, _ = outW.Write([]byte("done"))
+	flush()
+
+	want := []recordedLine{
+		{StreamStdout, "pulling image"},
+		{StreamStdout, "starting"},
+		{StreamStderr, "warning: slow"},
+		{StreamStdout, "done"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected lines:\n got %v\nwant %v", got, want)
+	}
+	if stdout.String() != "pulling image\r\nstarting\ndone" || stderr.String() != "warning: slow\n" {
+		t.Fatalf("expected output to still be captured, got %q / %q", stdout.String(), stderr.String())
+	}
+}
+
+func TestOutputWritersWithoutFuncOnlyCapture(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	outW, errW, flush := outputWriters(context.Background(), &stdout, &stderr)
+	defer flush()
+	if outW != &stdout || errW != &stderr {
+		t.Fatalf("expected the capture buffers to be used directly")
+	}
+}
+
+func TestNativeRunCommandStreamsOutput(t *testing.T) {
+	srv := startTestSSHServer(t, func(cmd string, _ []byte) testExecResult {
+		return testExecResult{stdout: "one\ntwo\n", stderr: "oops\n"}
+	})
+	cfg := srv.execConfig(filepath.Join(t.TempDir(), "known_hosts"), "accept-new")
+
+	// stdout and stderr travel on separate channels, so only the order within
+	// a stream is guaranteed.
+	got := map[string][]string{}
+	ctx := ContextWithOutput(context.Background(), func(stream, line string) {
+		got[stream] = append(got[stream], line)
+	})
+	stdout, stderr, err := RunCommand(ctx, cfg, "run")
+	if err != nil {
+		t.Fatalf("RunCommand: %v", err)
+	}
+	if stdout != "one\ntwo\n" || stderr != "oops\n" {
+		t.Fatalf("expected full output to be returned, got %q / %q", stdout, stderr)
+	}
+	want := map[string][]string{StreamStdout: {"one", "two"}, StreamStderr: {"oops"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected streamed lines: %v", got)
+	}
+}
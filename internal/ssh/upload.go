@@ -0,0 +1,38 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+)
+
+// Upload copies the local file src to dst on the host as root (via sudo -n),
+// creating dst's directory. The file is streamed over the session in ctx
+// (see ContextWithSession) or, without one, over a connection dialed for the
+// copy. It is written under a temporary name and renamed, so an interrupted
+// upload never leaves a truncated dst.
+func Upload(ctx context.Context, cfg ExecConfig, src, dst string, mode os.FileMode) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", src, err)
+	}
+	defer func() { _ = f.Close() }()
+
+	s := sessionFor(ctx, cfg)
+	if s == nil {
+		s, err = Dial(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = s.Close() }()
+	}
+
+	tmp := dst + ".part"
+	script := fmt.Sprintf("set -e; install -d -m 0755 %s; cat > %s; chmod %04o %s; mv -f %s %s",
+		ShellQuote(path.Dir(dst)), ShellQuote(tmp), mode.Perm(), ShellQuote(tmp), ShellQuote(tmp), ShellQuote(dst))
+	if _, _, err := s.run(ctx, "sudo -n sh -c "+ShellQuote(script), f, "ssh upload failed"); err != nil {
+		return fmt.Errorf("upload %s to %s: %w", src, dst, err)
+	}
+	return nil
+}
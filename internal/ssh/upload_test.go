@@ -0,0 +1,53 @@
+package ssh
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUploadStreamsFileOverSession(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		gotCmd   string
+		gotStdin []byte
+	)
+	srv := startTestSSHServer(t, func(cmd string, stdin []byte) testExecResult {
+		mu.Lock()
+		defer mu.Unlock()
+		gotCmd, gotStdin = cmd, stdin
+		return testExecResult{}
+	})
+	cfg := srv.execConfig(filepath.Join(t.TempDir(), "known_hosts"), "accept-new")
+	src := filepath.Join(t.TempDir(), "talosctl")
+	if err := os.WriteFile(src, []byte("binary\x00content"), 0o600); err != nil {
+		t.Fatalf("write src: %v", err)
+	}
+
+	sess, err := Dial(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer func() { _ = sess.Close() }()
+	ctx := ContextWithSession(context.Background(), sess)
+	if err := Upload(ctx, cfg, src, "/var/cache/tdb/talosctl", 0o755); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if string(gotStdin) != "binary\x00content" {
+		t.Fatalf("unexpected uploaded content: %q", gotStdin)
+	}
+	for _, want := range []string{"sudo -n sh -c", "install -d -m 0755 /var/cache/tdb", "cat > /var/cache/tdb/talosctl.part", "chmod 0755", "mv -f /var/cache/tdb/talosctl.part /var/cache/tdb/talosctl"} {
+		if !strings.Contains(gotCmd, want) {
+			t.Fatalf("expected upload command to contain %q, got %q", want, gotCmd)
+		}
+	}
+	if got := srv.dials.Load(); got != 1 {
+		t.Fatalf("expected upload to reuse the session, got %d handshakes", got)
+	}
+}
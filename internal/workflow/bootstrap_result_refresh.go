@@ -6,15 +6,18 @@ import (
 	"strings"
 	"time"
 
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/bootstrap"
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
 	"github.com/infrakit-io/talos-docker-bootstrap/internal/ssh"
 	vmconfig "github.com/infrakit-io/vmware-vm-bootstrap/pkg/config"
 )
 
-var scanHostKeyFingerprintFn = ssh.ScanHostKeyFingerprint
+var scanHostKeyFingerprintsFn = ssh.ScanHostKeyFingerprintsWithConfig
 
-// RefreshBootstrapFingerprint re-checks the host fingerprint until it stabilizes
-// and updates the result file if needed.
-func RefreshBootstrapFingerprint(path string, result *BootstrapResult) (bool, error) {
+// RefreshBootstrapFingerprint re-checks the host fingerprints until they
+// stabilize and records the most preferred one in the result file if needed.
+// Jump hosts, host key algorithms and trust settings are taken from stage2.
+func RefreshBootstrapFingerprint(path string, result *BootstrapResult, stage2 config.Config) (bool, error) {
 	if result == nil {
 		return false, fmt.Errorf("bootstrap result is nil")
 	}
@@ -25,6 +28,10 @@ func RefreshBootstrapFingerprint(path string, result *BootstrapResult) (bool, er
 	if host == "" {
 		return false, nil
 	}
+	// Hosts with CA-signed certificates are trusted without scanning the key.
+	if strings.TrimSpace(stage2.VM.SSHHostCA) != "" {
+		return false, nil
+	}
 	port := result.SSHPort
 	if port <= 0 {
 		port = 22
@@ -33,11 +40,15 @@ func RefreshBootstrapFingerprint(path string, result *BootstrapResult) (bool, er
 	ctx, cancel := context.WithTimeout(context.Background(), 25*time.Second)
 	defer cancel()
 
-	fp, err := stabilizeHostFingerprint(ctx, host, port)
+	target := bootstrap.SSHExecConfig(stage2)
+	target.Host = host
+	target.Port = port
+	fps, err := stabilizeHostFingerprint(ctx, target)
 	if err != nil {
 		return false, err
 	}
-	if fp == "" || fp == result.SSHHostFingerprint {
+	fp := fps[0].SHA256
+	if fp == result.SSHHostFingerprint {
 		return false, nil
 	}
 	result.SSHHostFingerprint = fp
@@ -54,46 +65,64 @@ func RefreshBootstrapFingerprint(path string, result *BootstrapResult) (bool, er
 	return true, nil
 }
 
-func stabilizeHostFingerprint(ctx context.Context, host string, port int) (string, error) {
+// stabilizeHostFingerprint scans until every host key type the server offers
+// has returned the same fingerprint on consecutive probes. Key types are
+// tracked separately, so one key being regenerated does not reset the others.
+func stabilizeHostFingerprint(ctx context.Context, target ssh.ExecConfig) ([]ssh.HostKeyFingerprint, error) {
 	const (
 		requiredConsecutive = 2
 		probeInterval       = 900 * time.Millisecond
 	)
 
-	prev := ""
-	consecutive := 0
+	prev := map[string]string{}
+	consecutive := map[string]int{}
 	var lastErr error
 
 	for {
 		select {
 		case <-ctx.Done():
 			if lastErr != nil {
-				return "", fmt.Errorf("stabilize ssh host fingerprint: %w (last probe error: %v)", ctx.Err(), lastErr)
+				return nil, fmt.Errorf("stabilize ssh host fingerprint: %w (last probe error: %v)", ctx.Err(), lastErr)
 			}
-			return "", fmt.Errorf("stabilize ssh host fingerprint: %w", ctx.Err())
+			return nil, fmt.Errorf("stabilize ssh host fingerprint: %w", ctx.Err())
 		default:
 		}
 
-		fp, err := scanHostKeyFingerprintFn(ctx, host, port)
+		fps, err := scanHostKeyFingerprintsFn(ctx, target)
 		if err != nil {
 			lastErr = err
 			time.Sleep(probeInterval)
 			continue
 		}
-		if strings.TrimSpace(fp) == "" {
+		if len(fps) == 0 {
 			time.Sleep(probeInterval)
 			continue
 		}
 
-		if fp == prev {
-			consecutive++
-		} else {
-			prev = fp
-			consecutive = 1
+		stable := true
+		offered := make(map[string]bool, len(fps))
+		for _, fp := range fps {
+			offered[fp.Type] = true
+			if fp.SHA256 == prev[fp.Type] {
+				consecutive[fp.Type]++
+			} else {
+				prev[fp.Type] = fp.SHA256
+				consecutive[fp.Type] = 1
+			}
+			if consecutive[fp.Type] < requiredConsecutive {
+				stable = false
+			}
+		}
+		// A key type that disappears has to be seen twice again once it returns.
+		for keyType := range prev {
+			if !offered[keyType] {
+				delete(prev, keyType)
+				delete(consecutive, keyType)
+			}
 		}
 
-		if consecutive >= requiredConsecutive {
-			return fp, nil
+		if stable {
+			return fps, nil
 		}
 		time.Sleep(probeInterval)
 	}
@@ -7,75 +7,121 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
+	"github.com/infrakit-io/talos-docker-bootstrap/internal/ssh"
 )
 
 func TestStabilizeHostFingerprintReturnsAfterTwoConsecutiveMatches(t *testing.T) {
-	orig := scanHostKeyFingerprintFn
-	t.Cleanup(func() { scanHostKeyFingerprintFn = orig })
+	orig := scanHostKeyFingerprintsFn
+	t.Cleanup(func() { scanHostKeyFingerprintsFn = orig })
 
 	seq := []string{"A", "B", "B"}
-	scanHostKeyFingerprintFn = func(ctx context.Context, host string, port int) (string, error) {
+	scanHostKeyFingerprintsFn = func(ctx context.Context, target ssh.ExecConfig) ([]ssh.HostKeyFingerprint, error) {
 		if len(seq) == 0 {
-			return "B", nil
+			return ed25519Scan("B"), nil
 		}
 		fp := seq[0]
 		seq = seq[1:]
-		return fp, nil
+		return ed25519Scan(fp), nil
+	}
+
+	fp, err := stabilizeHostFingerprint(context.Background(), ssh.ExecConfig{Host: "example.com", Port: 22})
+	if err != nil {
+		t.Fatalf("stabilizeHostFingerprint error: %v", err)
+	}
+	if len(fp) != 1 || fp[0].SHA256 != "B" {
+		t.Fatalf("expected stabilized fingerprint B, got %v", fp)
+	}
+}
+
+func ed25519Scan(fp string) []ssh.HostKeyFingerprint {
+	if fp == "" {
+		return nil
+	}
+	return []ssh.HostKeyFingerprint{{Type: "ssh-ed25519", SHA256: fp}}
+}
+
+func TestStabilizeHostFingerprintTracksKeyTypesSeparately(t *testing.T) {
+	orig := scanHostKeyFingerprintsFn
+	t.Cleanup(func() { scanHostKeyFingerprintsFn = orig })
+
+	// ed25519 is stable from the start; ecdsa is regenerated after one probe.
+	ecdsa := []string{"E1", "E2", "E2"}
+	probes := 0
+	scanHostKeyFingerprintsFn = func(ctx context.Context, target ssh.ExecConfig) ([]ssh.HostKeyFingerprint, error) {
+		probes++
+		fp := ecdsa[0]
+		if len(ecdsa) > 1 {
+			ecdsa = ecdsa[1:]
+		}
+		return []ssh.HostKeyFingerprint{
+			{Type: "ssh-ed25519", SHA256: "ED"},
+			{Type: "ecdsa-sha2-nistp256", SHA256: fp},
+		}, nil
 	}
 
-	fp, err := stabilizeHostFingerprint(context.Background(), "example.com", 22)
+	fps, err := stabilizeHostFingerprint(context.Background(), ssh.ExecConfig{Host: "example.com", Port: 22, HostKeyAlgorithms: []string{"ssh-ed25519", "ecdsa-sha2-nistp256"}})
 	if err != nil {
 		t.Fatalf("stabilizeHostFingerprint error: %v", err)
 	}
-	if fp != "B" {
-		t.Fatalf("expected stabilized fingerprint B, got %q", fp)
+	if probes != 3 {
+		t.Fatalf("expected 3 probes until both key types are stable, got %d", probes)
+	}
+	if len(fps) != 2 || fps[0].SHA256 != "ED" || fps[1].SHA256 != "E2" {
+		t.Fatalf("unexpected stabilized fingerprints: %v", fps)
 	}
 }
 
 func TestStabilizeHostFingerprintReturnsContextErrorWhenProbeFails(t *testing.T) {
-	orig := scanHostKeyFingerprintFn
-	t.Cleanup(func() { scanHostKeyFingerprintFn = orig })
+	orig := scanHostKeyFingerprintsFn
+	t.Cleanup(func() { scanHostKeyFingerprintsFn = orig })
 
-	scanHostKeyFingerprintFn = func(ctx context.Context, host string, port int) (string, error) {
-		return "", errors.New("scan failed")
+	scanHostKeyFingerprintsFn = func(ctx context.Context, target ssh.ExecConfig) ([]ssh.HostKeyFingerprint, error) {
+		return nil, errors.New("scan failed")
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	cancel()
-	_, err := stabilizeHostFingerprint(ctx, "example.com", 22)
+	_, err := stabilizeHostFingerprint(ctx, ssh.ExecConfig{Host: "example.com", Port: 22})
 	if err == nil {
 		t.Fatalf("expected error")
 	}
 }
 
 func TestRefreshBootstrapFingerprintGuards(t *testing.T) {
-	if _, err := RefreshBootstrapFingerprint("x.yaml", nil); err == nil {
+	if _, err := RefreshBootstrapFingerprint("x.yaml", nil, config.Config{}); err == nil {
 		t.Fatalf("expected nil guard error")
 	}
 	res := BootstrapResult{}
-	changed, err := RefreshBootstrapFingerprint("", &res)
+	changed, err := RefreshBootstrapFingerprint("", &res, config.Config{})
 	if err != nil || changed {
 		t.Fatalf("expected no-op for empty path, changed=%v err=%v", changed, err)
 	}
-	changed, err = RefreshBootstrapFingerprint("x.yaml", &res)
+	changed, err = RefreshBootstrapFingerprint("x.yaml", &res, config.Config{})
 	if err != nil || changed {
 		t.Fatalf("expected no-op for empty host, changed=%v err=%v", changed, err)
 	}
+	res.IPAddress = "192.168.1.10"
+	changed, err = RefreshBootstrapFingerprint("x.yaml", &res, config.Config{VM: config.VMConfig{SSHHostCA: "/etc/ssh/ca.pub"}})
+	if err != nil || changed {
+		t.Fatalf("expected no scan when a host CA is configured, changed=%v err=%v", changed, err)
+	}
 }
 
 func TestRefreshBootstrapFingerprintUpdatesFile(t *testing.T) {
-	orig := scanHostKeyFingerprintFn
-	t.Cleanup(func() { scanHostKeyFingerprintFn = orig })
+	orig := scanHostKeyFingerprintsFn
+	t.Cleanup(func() { scanHostKeyFingerprintsFn = orig })
 
 	const newFP = "SHA256:abcdefghijklmnopqrstuvwxyzABCDEFGH0123456789+/"
 	seq := []string{newFP, newFP}
-	scanHostKeyFingerprintFn = func(ctx context.Context, host string, port int) (string, error) {
+	scanHostKeyFingerprintsFn = func(ctx context.Context, target ssh.ExecConfig) ([]ssh.HostKeyFingerprint, error) {
 		if len(seq) == 0 {
-			return "SHA256:newfp", nil
+			return ed25519Scan("SHA256:newfp"), nil
 		}
 		fp := seq[0]
 		seq = seq[1:]
-		return fp, nil
+		return ed25519Scan(fp), nil
 	}
 
 	dir := t.TempDir()
@@ -92,7 +138,7 @@ func TestRefreshBootstrapFingerprintUpdatesFile(t *testing.T) {
 		SSHPort:            22,
 		SSHHostFingerprint: "SHA256:oldoldoldoldoldoldoldoldoldoldoldoldoldoldoldold",
 	}
-	changed, err := RefreshBootstrapFingerprint(path, &res)
+	changed, err := RefreshBootstrapFingerprint(path, &res, config.Config{})
 	if err != nil {
 		t.Fatalf("RefreshBootstrapFingerprint: %v", err)
 	}
@@ -112,21 +158,48 @@ func TestRefreshBootstrapFingerprintUpdatesFile(t *testing.T) {
 }
 
 func TestStabilizeHostFingerprintSkipsEmptyProbeThenConverges(t *testing.T) {
-	orig := scanHostKeyFingerprintFn
-	t.Cleanup(func() { scanHostKeyFingerprintFn = orig })
+	orig := scanHostKeyFingerprintsFn
+	t.Cleanup(func() { scanHostKeyFingerprintsFn = orig })
 
 	seq := []string{"", "SHA256:x", "SHA256:x"}
-	scanHostKeyFingerprintFn = func(ctx context.Context, host string, port int) (string, error) {
+	scanHostKeyFingerprintsFn = func(ctx context.Context, target ssh.ExecConfig) ([]ssh.HostKeyFingerprint, error) {
 		fp := seq[0]
 		seq = seq[1:]
-		return fp, nil
+		return ed25519Scan(fp), nil
 	}
 
-	fp, err := stabilizeHostFingerprint(context.Background(), "example.com", 22)
+	fp, err := stabilizeHostFingerprint(context.Background(), ssh.ExecConfig{Host: "example.com", Port: 22})
 	if err != nil {
 		t.Fatalf("stabilizeHostFingerprint error: %v", err)
 	}
-	if fp != "SHA256:x" {
-		t.Fatalf("expected stabilized fingerprint SHA256:x, got %q", fp)
+	if len(fp) != 1 || fp[0].SHA256 != "SHA256:x" {
+		t.Fatalf("expected stabilized fingerprint SHA256:x, got %v", fp)
+	}
+}
+
+func TestRefreshBootstrapFingerprintScansThroughJumpHosts(t *testing.T) {
+	orig := scanHostKeyFingerprintsFn
+	t.Cleanup(func() { scanHostKeyFingerprintsFn = orig })
+
+	var scanned ssh.ExecConfig
+	scanHostKeyFingerprintsFn = func(ctx context.Context, target ssh.ExecConfig) ([]ssh.HostKeyFingerprint, error) {
+		scanned = target
+		return ed25519Scan("SHA256:same"), nil
+	}
+
+	stage2 := config.Config{VM: config.VMConfig{
+		Host:      "stale-host",
+		Port:      22,
+		JumpHosts: []config.JumpHostConfig{{Host: "bastion", Port: 2222}},
+	}}
+	res := BootstrapResult{IPAddress: "192.168.1.10", SSHPort: 2200, SSHHostFingerprint: "SHA256:same"}
+	if _, err := RefreshBootstrapFingerprint("x.yaml", &res, stage2); err != nil {
+		t.Fatalf("RefreshBootstrapFingerprint: %v", err)
+	}
+	if scanned.Host != "192.168.1.10" || scanned.Port != 2200 {
+		t.Fatalf("expected scan of the bootstrap result address, got %s:%d", scanned.Host, scanned.Port)
+	}
+	if len(scanned.JumpHosts) != 1 || scanned.JumpHosts[0].Host != "bastion" || scanned.JumpHosts[0].Port != 2222 {
+		t.Fatalf("expected scan through configured jump host, got %+v", scanned.JumpHosts)
 	}
 }
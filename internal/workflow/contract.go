@@ -2,8 +2,12 @@ package workflow
 
 import (
 	"fmt"
+	"os"
+	"slices"
 	"strings"
 
+	"golang.org/x/crypto/ssh"
+
 	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
 	vmconfig "github.com/infrakit-io/vmware-vm-bootstrap/pkg/config"
 )
@@ -12,7 +16,9 @@ import (
 type BootstrapResult = vmconfig.BootstrapResult
 
 // MergeBootstrapIntoStage2 applies the bootstrap contract values into a Talos config.
-// Bootstrap values are authoritative for VM connection fields.
+// Bootstrap values are authoritative for VM connection fields. When the base
+// config authenticates through ssh-agent, the agent mode is kept and the
+// bootstrap key's public half (if present) becomes the agent identity filter.
 func MergeBootstrapIntoStage2(base config.Config, bootstrap BootstrapResult) (config.Config, error) {
 	if err := bootstrap.Validate(); err != nil {
 		return config.Config{}, err
@@ -22,11 +28,19 @@ func MergeBootstrapIntoStage2(base config.Config, bootstrap BootstrapResult) (co
 	merged.VM.Host = bootstrap.IPAddress
 	merged.VM.User = bootstrap.SSHUser
 	merged.VM.SSHPrivateKey = bootstrap.SSHPrivateKey
+	if merged.VM.UsesAgent() && strings.TrimSpace(merged.VM.SSHAgentIdentity) == "" {
+		merged.VM.SSHAgentIdentity = bootstrapAgentIdentity(bootstrap.SSHPrivateKey)
+	}
 	if bootstrap.SSHPort > 0 {
 		merged.VM.Port = bootstrap.SSHPort
+		// The bootstrap decides the SSH port, so UFW must keep it open.
+		h := merged.Hardening
+		if h.Enabled && h.EnableUFW && !h.AllowsTCP(merged.VM.Port) {
+			merged.Hardening.AllowTCPPorts = append(slices.Clone(h.AllowTCPPorts), merged.VM.Port)
+		}
 	}
-	if strings.TrimSpace(bootstrap.SSHHostFingerprint) != "" {
-		merged.VM.SSHHostFingerprint = bootstrap.SSHHostFingerprint
+	if fp := strings.TrimSpace(bootstrap.SSHHostFingerprint); fp != "" && !slices.Contains(merged.VM.SSHHostFingerprint, fp) {
+		merged.VM.SSHHostFingerprint = mergeHostKeyPin(merged.VM.SSHHostFingerprint, fp, merged.VM.KnownHostsFile)
 	}
 
 	if err := merged.Validate(); err != nil {
@@ -34,3 +48,59 @@ func MergeBootstrapIntoStage2(base config.Config, bootstrap BootstrapResult) (co
 	}
 	return merged, nil
 }
+
+// mergeHostKeyPin replaces the ed25519 pin with fp, the ed25519 fingerprint
+// the bootstrap result carries. Pins are bare fingerprints, so their key
+// types are looked up in knownHostsFile: pins of other key types are kept,
+// and pins whose type is unknown are dropped with the old ed25519 one.
+func mergeHostKeyPin(pins config.Fingerprints, fp, knownHostsFile string) config.Fingerprints {
+	types := knownHostKeyTypes(knownHostsFile)
+	merged := config.Fingerprints{fp}
+	for _, pin := range pins {
+		if t, ok := types[pin]; ok && t != ssh.KeyAlgoED25519 {
+			merged = append(merged, pin)
+		}
+	}
+	return merged
+}
+
+// knownHostKeyTypes maps the fingerprint of every plain key in a known_hosts
+// file to its key type. A missing or unreadable file yields no types.
+func knownHostKeyTypes(path string) map[string]string {
+	types := map[string]string{}
+	rest, err := os.ReadFile(strings.TrimSpace(path))
+	if err != nil {
+		return types
+	}
+	for len(rest) > 0 {
+		var (
+			marker string
+			key    ssh.PublicKey
+		)
+		marker, _, key, _, rest, err = ssh.ParseKnownHosts(rest)
+		if err != nil {
+			break
+		}
+		if marker == "" {
+			types[ssh.FingerprintSHA256(key)] = key.Type()
+		}
+	}
+	return types
+}
+
+// bootstrapAgentIdentity returns the public key file next to the bootstrap
+// private key, or "" when there is none to filter agent keys by.
+func bootstrapAgentIdentity(privateKey string) string {
+	key := strings.TrimSpace(privateKey)
+	if key == "" {
+		return ""
+	}
+	pub := key
+	if !strings.HasSuffix(pub, ".pub") {
+		pub += ".pub"
+	}
+	if st, err := os.Stat(pub); err != nil || st.IsDir() {
+		return ""
+	}
+	return pub
+}
@@ -1,8 +1,20 @@
 package workflow
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
 	"github.com/infrakit-io/talos-docker-bootstrap/internal/config"
 )
 
@@ -58,11 +70,190 @@ func TestMergeBootstrapIntoStage2(t *testing.T) {
 	if got.VM.Port != 2222 {
 		t.Fatalf("unexpected vm.port: %d", got.VM.Port)
 	}
-	if got.VM.SSHHostFingerprint != "SHA256:abc123def456" {
+	if len(got.VM.SSHHostFingerprint) != 1 || got.VM.SSHHostFingerprint[0] != "SHA256:abc123def456" {
 		t.Fatalf("unexpected vm.ssh_host_fingerprint: %s", got.VM.SSHHostFingerprint)
 	}
 }
 
+func TestMergeBootstrapIntoStage2KeepsPinsForOtherKeyTypes(t *testing.T) {
+	ed25519Key, ed25519Pin := testHostKey(t, "ed25519")
+	rsaKey, rsaPin := testHostKey(t, "rsa")
+	ecdsaKey, ecdsaPin := testHostKey(t, "ecdsa")
+	_, rotatedPin := testHostKey(t, "ed25519")
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	var lines []string
+	for _, key := range []ssh.PublicKey{ed25519Key, rsaKey, ecdsaKey} {
+		lines = append(lines, knownhosts.Line([]string{"192.168.1.50"}, key))
+	}
+	if err := os.WriteFile(knownHosts, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	base := mustValidStage2Config(t)
+	base.VM.KnownHostsFile = knownHosts
+	base.VM.SSHHostFingerprint = config.Fingerprints{ed25519Pin, rsaPin, ecdsaPin}
+	res := BootstrapResult{VMName: "devvm-01", IPAddress: "192.168.1.50", SSHUser: "developer", SSHPrivateKey: "/tmp/key", SSHHostFingerprint: ed25519Pin}
+
+	got, err := MergeBootstrapIntoStage2(base, res)
+	if err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+	if got.VM.SSHHostFingerprint.String() != base.VM.SSHHostFingerprint.String() {
+		t.Fatalf("expected existing pins to be kept, got %s", got.VM.SSHHostFingerprint)
+	}
+
+	res.SSHHostFingerprint = rotatedPin
+	got, err = MergeBootstrapIntoStage2(base, res)
+	if err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+	want := config.Fingerprints{rotatedPin, rsaPin, ecdsaPin}
+	if got.VM.SSHHostFingerprint.String() != want.String() {
+		t.Fatalf("expected the ed25519 pin to be replaced and the rsa/ecdsa pins kept, got %s", got.VM.SSHHostFingerprint)
+	}
+
+	// Without known_hosts the pin types are unknown, so only the new one is kept.
+	base.VM.KnownHostsFile = filepath.Join(t.TempDir(), "missing")
+	got, err = MergeBootstrapIntoStage2(base, res)
+	if err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+	if got.VM.SSHHostFingerprint.String() != rotatedPin {
+		t.Fatalf("expected pins of unknown type to be replaced, got %s", got.VM.SSHHostFingerprint)
+	}
+}
+
+// testHostKey generates a host key of kind and returns its public key and
+// SHA256 fingerprint.
+func testHostKey(t *testing.T, kind string) (ssh.PublicKey, string) {
+	t.Helper()
+	var (
+		pub any
+		err error
+	)
+	switch kind {
+	case "ed25519":
+		pub, _, err = ed25519.GenerateKey(rand.Reader)
+	case "rsa":
+		var key *rsa.PrivateKey
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err == nil {
+			pub = &key.PublicKey
+		}
+	case "ecdsa":
+		var key *ecdsa.PrivateKey
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err == nil {
+			pub = &key.PublicKey
+		}
+	}
+	if err != nil {
+		t.Fatalf("generate %s key: %v", kind, err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("convert %s key: %v", kind, err)
+	}
+	return key, ssh.FingerprintSHA256(key)
+}
+
+func TestMergeBootstrapIntoStage2AllowsBootstrapSSHPort(t *testing.T) {
+	base := mustValidStage2Config(t)
+	res := BootstrapResult{VMName: "devvm-01", IPAddress: "192.168.1.50", SSHUser: "developer", SSHPrivateKey: "/tmp/key", SSHPort: 2200}
+
+	got, err := MergeBootstrapIntoStage2(base, res)
+	if err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+	if !slices.Equal(got.Hardening.AllowTCPPorts, []int{22, 2200}) {
+		t.Fatalf("expected the bootstrap SSH port to be allowed, got %v", got.Hardening.AllowTCPPorts)
+	}
+	if !slices.Equal(base.Hardening.AllowTCPPorts, []int{22}) {
+		t.Fatalf("merge must not modify the base config, got %v", base.Hardening.AllowTCPPorts)
+	}
+}
+
+func TestStage2ConfigRejectsUFWWithoutSSHPort(t *testing.T) {
+	cfg := config.Config{
+		VM: config.VMConfig{
+			Host:           "192.168.1.50",
+			Port:           2200,
+			User:           "dev",
+			SSHPrivateKey:  "/tmp/id_ed25519",
+			KnownHostsFile: "/tmp/known_hosts",
+		},
+		Hardening: config.HardeningConfig{
+			Enabled:       true,
+			EnableUFW:     true,
+			AllowTCPPorts: []int{22, 6443},
+			FirewallRules: []config.FirewallRule{{Port: "2201:2210"}},
+		},
+		Docker: config.DockerConfig{Version: "28.0.2"},
+		Talos: config.TalosConfig{
+			Version:        "1.12.3",
+			SHA256Checksum: "2baf4747e5f6b7f3655f47c665b45dec0c4b6935f0be9614dfe2262c3079eb93",
+		},
+		Cluster: config.ClusterConfig{Name: "devvm", StateDir: "/tmp/devvm", MountSrc: "/tmp", MountDst: "/var/mnt/work"},
+		Timeouts: config.TimeoutsConfig{
+			SSHConnectSeconds: 5,
+			SSHRetries:        3,
+			SSHRetryDelaySec:  1,
+			TotalMinutes:      5,
+		},
+	}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "vm.port 2200") {
+		t.Fatalf("expected the unreachable SSH port to be rejected, got %v", err)
+	}
+
+	cfg.Hardening.FirewallRules[0].Port = "2200:2210"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected a range covering the SSH port to be accepted, got %v", err)
+	}
+	cfg.Hardening.EnableUFW = false
+	cfg.Hardening.FirewallRules = nil
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("expected no SSH rule to be needed without UFW, got %v", err)
+	}
+}
+
+func TestMergeBootstrapIntoStage2KeepsAgentAuth(t *testing.T) {
+	base := mustValidStage2Config(t)
+	base.VM.SSHAuth = "agent"
+	base.VM.SSHPrivateKey = ""
+
+	key := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(key+".pub", []byte("ssh-ed25519 AAAA dev@laptop\n"), 0o600); err != nil {
+		t.Fatalf("write pub key: %v", err)
+	}
+	bootstrapResult := BootstrapResult{
+		VMName:        "devvm-01",
+		IPAddress:     "192.168.1.50",
+		SSHUser:       "developer",
+		SSHPrivateKey: key,
+	}
+
+	got, err := MergeBootstrapIntoStage2(base, bootstrapResult)
+	if err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+	if !got.VM.UsesAgent() {
+		t.Fatalf("expected agent auth to be kept, got ssh_auth=%q", got.VM.SSHAuth)
+	}
+	if got.VM.SSHAgentIdentity != key+".pub" {
+		t.Fatalf("expected bootstrap public key as agent identity, got %q", got.VM.SSHAgentIdentity)
+	}
+
+	base.VM.SSHAgentIdentity = "yubikey-5c"
+	got, err = MergeBootstrapIntoStage2(base, bootstrapResult)
+	if err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+	if got.VM.SSHAgentIdentity != "yubikey-5c" {
+		t.Fatalf("expected explicit agent identity to win, got %q", got.VM.SSHAgentIdentity)
+	}
+}
+
 func mustValidStage2Config(t *testing.T) config.Config {
 	t.Helper()
 	cfg := config.Config{
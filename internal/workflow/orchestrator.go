@@ -12,7 +12,12 @@ import (
 // ProvisionAndBootstrapOptions controls orchestrated execution behavior.
 type ProvisionAndBootstrapOptions struct {
 	DryRun        bool
+	Check         bool
 	HumanProgress bool
+	JournalDir    string
+	Resume        bool
+	Only          []string
+	Skip          []string
 }
 
 var bootstrapRunFn = bootstrap.Run
@@ -44,6 +49,11 @@ func ProvisionAndBootstrap(
 
 	return bootstrapRunFn(ctx, logger, merged, bootstrap.Options{
 		DryRun:        opts.DryRun,
+		Check:         opts.Check,
 		HumanProgress: opts.HumanProgress,
+		JournalDir:    opts.JournalDir,
+		Resume:        opts.Resume,
+		Only:          opts.Only,
+		Skip:          opts.Skip,
 	})
 }
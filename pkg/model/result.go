@@ -10,6 +10,10 @@ const (
 	StepStatusFailed     StepStatus = "failed"
 	StepStatusSkipped    StepStatus = "skipped"
 	StepStatusInProgress StepStatus = "in_progress"
+	// StepStatusNoChange and StepStatusWouldChange report a step inspected
+	// in check mode.
+	StepStatusNoChange    StepStatus = "no_change"
+	StepStatusWouldChange StepStatus = "would_change"
 )
 
 type StepResult struct {
@@ -17,6 +21,29 @@ type StepResult struct {
 	Status   StepStatus    `json:"status"`
 	Duration time.Duration `json:"duration"`
 	Message  string        `json:"message,omitempty"`
+	// Output is the remote output captured while the step ran.
+	Output string `json:"output,omitempty"`
+	// WouldChange lists what the step would change, from check mode.
+	WouldChange []string `json:"would_change,omitempty"`
+}
+
+// PreflightFact is one remote fact gathered before any step changes the VM,
+// with the outcome of validating it against the configured minimums.
+type PreflightFact struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	OK    bool   `json:"ok"`
+	// Requirement describes what was expected; empty when not checked.
+	Requirement string `json:"requirement,omitempty"`
+}
+
+// AuditControl is one hardening baseline control checked on the VM by the
+// hardening audit.
+type AuditControl struct {
+	Name     string `json:"name"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+	Passed   bool   `json:"passed"`
 }
 
 type BootstrapResult struct {
@@ -28,6 +55,9 @@ type BootstrapResult struct {
 	Cluster        string       `json:"cluster"`
 	KubeconfigPath string       `json:"kubeconfig_path"`
 	DryRun         bool         `json:"dry_run"`
+	Check          bool         `json:"check,omitempty"`
 	Steps          []StepResult `json:"steps"`
-	Error          string       `json:"error,omitempty"`
+	// Preflight holds the facts gathered by the preflight step.
+	Preflight []PreflightFact `json:"preflight,omitempty"`
+	Error     string          `json:"error,omitempty"`
 }